@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/soulteary/herald-totp/internal/admin"
+	"github.com/soulteary/herald-totp/internal/audit"
+	"github.com/soulteary/herald-totp/internal/clock"
+	"github.com/soulteary/herald-totp/internal/config"
+	"github.com/soulteary/herald-totp/internal/router"
+	"github.com/soulteary/herald-totp/internal/secret"
+	"github.com/soulteary/herald-totp/internal/store"
+	"github.com/soulteary/logger-kit"
+	version "github.com/soulteary/version-kit"
+)
+
+// newKeyEnv holds the replacement key for rotate-key. It is read from the environment rather than a flag
+// so the key does not show up in the process list.
+const newKeyEnv = "HERALD_TOTP_NEW_ENCRYPTION_KEY"
+
+type subcommand struct {
+	usage string
+	run   func(args []string) int
+}
+
+// subcommands are selected by the first argument; without one the server starts. Every command except
+// serve prints a single JSON document to stdout (errors as {"error": "..."}) and exits non-zero on failure.
+var subcommands = map[string]subcommand{
+	"serve":        {"serve                          start the HTTP server (default)", runServe},
+	"status":       {"status <subject>               show a subject's credentials and backup codes", runStatus},
+	"list":         {"list                           list every enrolled subject", runList},
+	"revoke":       {"revoke <subject>               remove a subject's credentials and backup codes", runRevoke},
+	"rotate-key":   {"rotate-key [-dry-run]          re-encrypt secrets with " + newKeyEnv, runRotateKey},
+	"export":       {"export [-o file]               write an encrypted migration bundle", runExport},
+	"import":       {"import [-i file] [-overwrite]  load a migration bundle", runImport},
+	"check-config": {"check-config                   validate configuration and Redis connectivity", runCheckConfig},
+}
+
+func run(args []string) int {
+	if len(args) == 0 {
+		return runServe(nil)
+	}
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		usage(os.Stdout)
+		return 0
+	}
+	cmd, ok := subcommands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+		usage(os.Stderr)
+		return 2
+	}
+	return cmd.run(args[1:])
+}
+
+func usage(w io.Writer) {
+	names := make([]string, 0, len(subcommands))
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "Usage: herald-totp <command> [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, name := range names {
+		fmt.Fprintln(w, "  "+subcommands[name].usage)
+	}
+}
+
+// loadConfig creates the logger and initializes config from the config file and environment.
+func loadConfig(defaultLevel logger.Level) (*logger.Logger, error) {
+	log := logger.New(logger.Config{
+		Level:          logger.ParseLevelFromEnv("LOG_LEVEL", defaultLevel),
+		ServiceName:    "herald-totp",
+		ServiceVersion: version.Version,
+	})
+	return log, config.Initialize(log)
+}
+
+// logLevel maps a LOG_LEVEL value to a logger level; unknown names give fallback.
+func logLevel(name string, fallback logger.Level) logger.Level {
+	switch strings.ToLower(name) {
+	case "trace":
+		return logger.TraceLevel
+	case "debug":
+		return logger.DebugLevel
+	case "info":
+		return logger.InfoLevel
+	case "warn":
+		return logger.WarnLevel
+	case "error":
+		return logger.ErrorLevel
+	case "fatal":
+		return logger.FatalLevel
+	case "panic":
+		return logger.PanicLevel
+	case "disabled":
+		return logger.Disabled
+	}
+	return fallback
+}
+
+// openStore loads config for an admin command and connects to Redis.
+func openStore() (*store.Store, *logger.Logger, error) {
+	log, err := loadConfig(logger.WarnLevel)
+	if err != nil {
+		return nil, log, err
+	}
+	st, err := router.NewStore(config.Get())
+	return st, log, err
+}
+
+// encryptionKey returns HERALD_TOTP_ENCRYPTION_KEY as AES key bytes.
+func encryptionKey() ([]byte, error) {
+	return keyFrom("HERALD_TOTP_ENCRYPTION_KEY", config.Get().EncryptionKey)
+}
+
+func keyFrom(name, value string) ([]byte, error) {
+	if len(value) < 32 {
+		return nil, fmt.Errorf("%s must be at least 32 bytes", name)
+	}
+	return secret.KeyBytes(value)
+}
+
+// parseFlags parses args and returns the positional arguments; it wants exactly nArgs of them.
+func parseFlags(fs *flag.FlagSet, args []string, nArgs int) ([]string, bool) {
+	if err := fs.Parse(args); err != nil {
+		return nil, false
+	}
+	if fs.NArg() != nArgs {
+		fmt.Fprintf(os.Stderr, "%s: want %d argument(s), got %d\n", fs.Name(), nArgs, fs.NArg())
+		return nil, false
+	}
+	return fs.Args(), true
+}
+
+func printJSON(w io.Writer, v any) {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+// fail prints err as JSON on stdout and returns the exit code for a failed command.
+func fail(err error) int {
+	printJSON(os.Stdout, map[string]string{"error": err.Error()})
+	return 1
+}
+
+func runStatus(args []string) int {
+	pos, ok := parseFlags(flag.NewFlagSet("status", flag.ContinueOnError), args, 1)
+	if !ok {
+		return 2
+	}
+	st, _, err := openStore()
+	if err != nil {
+		return fail(err)
+	}
+	s, err := admin.Status(context.Background(), st, pos[0])
+	if err != nil {
+		return fail(err)
+	}
+	printJSON(os.Stdout, s)
+	return 0
+}
+
+func runList(args []string) int {
+	if _, ok := parseFlags(flag.NewFlagSet("list", flag.ContinueOnError), args, 0); !ok {
+		return 2
+	}
+	st, _, err := openStore()
+	if err != nil {
+		return fail(err)
+	}
+	subjects, err := admin.List(context.Background(), st)
+	if err != nil {
+		return fail(err)
+	}
+	printJSON(os.Stdout, map[string]any{"subjects": subjects, "count": len(subjects)})
+	return 0
+}
+
+func runRevoke(args []string) int {
+	pos, ok := parseFlags(flag.NewFlagSet("revoke", flag.ContinueOnError), args, 1)
+	if !ok {
+		return 2
+	}
+	st, log, err := openStore()
+	if err != nil {
+		return fail(err)
+	}
+	ctx := context.Background()
+	res, err := admin.Revoke(ctx, st, pos[0])
+	if err != nil {
+		return fail(err)
+	}
+	// Record the revoke like POST /v1/revoke does so audit streams and webhooks see it; the stdout audit
+	// sink goes to stderr to keep stdout a single JSON document.
+	rec, _, err := router.NewAuditRecorder(config.Get(), st, clock.System(), os.Stderr, log)
+	if err != nil {
+		log.Warn().Err(err).Msg("audit sinks")
+	}
+	rec.Record(ctx, audit.Event{
+		Timestamp: time.Now().Unix(),
+		Type:      audit.EventRevoke,
+		Subject:   pos[0],
+		Service:   "herald-totp-cli",
+		Outcome:   audit.OutcomeSuccess,
+		Reason:    "cli",
+	})
+	_ = rec.Close()
+	printJSON(os.Stdout, res)
+	return 0
+}
+
+func runRotateKey(args []string) int {
+	fs := flag.NewFlagSet("rotate-key", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "check every secret without writing")
+	if _, ok := parseFlags(fs, args, 0); !ok {
+		return 2
+	}
+	st, _, err := openStore()
+	if err != nil {
+		return fail(err)
+	}
+	oldKey, err := encryptionKey()
+	if err != nil {
+		return fail(err)
+	}
+	newKey, err := keyFrom(newKeyEnv, os.Getenv(newKeyEnv))
+	if err != nil {
+		return fail(err)
+	}
+	res, err := admin.RotateKey(context.Background(), st, oldKey, newKey, *dryRun)
+	if err != nil {
+		return fail(err)
+	}
+	printJSON(os.Stdout, res)
+	return 0
+}
+
+func runCheckConfig(args []string) int {
+	if _, ok := parseFlags(flag.NewFlagSet("check-config", flag.ContinueOnError), args, 0); !ok {
+		return 2
+	}
+	st, _, err := openStore()
+	var report *admin.ConfigReport
+	if err != nil {
+		report = admin.CheckConfig(context.Background(), nil)
+		report.Redis = err.Error()
+		report.Errors = append(report.Errors, "redis: "+err.Error())
+		report.OK = false
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		report = admin.CheckConfig(ctx, st)
+	}
+	printJSON(os.Stdout, report)
+	if !report.OK {
+		return 1
+	}
+	return 0
+}
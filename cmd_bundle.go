@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"time"
+
+	"github.com/soulteary/herald-totp/internal/bundle"
+	"github.com/soulteary/herald-totp/internal/config"
+)
+
+// runExport writes every credential and backup code set to an encrypted bundle. The summary goes to
+// stdout, or to stderr when the bundle itself is written to stdout.
+func runExport(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	out := fs.String("o", "-", "bundle file to write (- for stdout)")
+	if _, ok := parseFlags(fs, args, 0); !ok {
+		return 2
+	}
+	st, _, err := openStore()
+	if err != nil {
+		return fail(err)
+	}
+	sourceKey, transferKey, err := bundleKeys()
+	if err != nil {
+		return fail(err)
+	}
+	f, err := bundle.Export(context.Background(), st, sourceKey, transferKey, time.Now())
+	if err != nil {
+		return fail(err)
+	}
+
+	var w io.Writer = os.Stdout
+	summary := os.Stdout
+	if *out == "-" {
+		summary = os.Stderr
+	} else {
+		file, err := os.OpenFile(*out, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+		if err != nil {
+			return fail(err)
+		}
+		defer file.Close()
+		w = file
+	}
+	if err := f.Write(w); err != nil {
+		return fail(err)
+	}
+	printJSON(summary, map[string]any{"subjects": f.Subjects, "version": f.Version, "created_at": f.CreatedAt})
+	return 0
+}
+
+// runImport writes a bundle into this instance, re-encrypting secrets with HERALD_TOTP_ENCRYPTION_KEY.
+func runImport(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	in := fs.String("i", "-", "bundle file to read (- for stdin)")
+	overwrite := fs.Bool("overwrite", false, "replace subjects that already exist instead of failing")
+	if _, ok := parseFlags(fs, args, 0); !ok {
+		return 2
+	}
+	st, _, err := openStore()
+	if err != nil {
+		return fail(err)
+	}
+	destKey, transferKey, err := bundleKeys()
+	if err != nil {
+		return fail(err)
+	}
+
+	var r io.Reader = os.Stdin
+	if *in != "-" {
+		file, err := os.Open(*in)
+		if err != nil {
+			return fail(err)
+		}
+		defer file.Close()
+		r = file
+	}
+	f, err := bundle.Read(r)
+	if err != nil {
+		return fail(err)
+	}
+	res, err := bundle.Import(context.Background(), st, f, transferKey, destKey, *overwrite)
+	var dup *bundle.DuplicateError
+	if errors.As(err, &dup) {
+		printJSON(os.Stdout, map[string]any{"error": "subjects already exist; rerun with -overwrite to replace them", "subjects": dup.Subjects})
+		return 1
+	}
+	if err != nil {
+		return fail(err)
+	}
+	printJSON(os.Stdout, res)
+	return 0
+}
+
+// bundleKeys returns the instance encryption key and the transfer key.
+func bundleKeys() (instanceKey, transferKey []byte, err error) {
+	if instanceKey, err = encryptionKey(); err != nil {
+		return nil, nil, err
+	}
+	if transferKey, err = keyFrom("HERALD_TOTP_TRANSFER_KEY", config.Get().TransferKey); err != nil {
+		return nil, nil, err
+	}
+	return instanceKey, transferKey, nil
+}
@@ -0,0 +1,229 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/soulteary/herald-totp/internal/secret"
+	"github.com/soulteary/herald-totp/internal/store"
+)
+
+// CredentialInfo describes one stored credential without its secret.
+type CredentialInfo struct {
+	ID        string `json:"id,omitempty"`
+	Type      string `json:"type"`
+	Issuer    string `json:"issuer"`
+	Label     string `json:"label"`
+	Algo      string `json:"algo"`
+	Digits    int    `json:"digits"`
+	Period    uint   `json:"period,omitempty"`
+	Counter   uint64 `json:"counter,omitempty"`
+	Serial    string `json:"serial,omitempty"`
+	Enabled   bool   `json:"enabled"`
+	CreatedAt int64  `json:"created_at"`
+	UpdatedAt int64  `json:"updated_at"`
+}
+
+// SubjectStatus is the output of Status.
+type SubjectStatus struct {
+	Subject              string           `json:"subject"`
+	TotpEnabled          bool             `json:"totp_enabled"`
+	Credentials          []CredentialInfo `json:"credentials"`
+	BackupCodesRemaining int              `json:"backup_codes_remaining"`
+	BackupCodesTotal     int              `json:"backup_codes_total"`
+}
+
+// SubjectSummary is one entry of List.
+type SubjectSummary struct {
+	Subject              string `json:"subject"`
+	TotpEnabled          bool   `json:"totp_enabled"`
+	Credentials          int    `json:"credentials"`
+	BackupCodesRemaining int    `json:"backup_codes_remaining"`
+}
+
+// RevokeResult is the output of Revoke.
+type RevokeResult struct {
+	Subject     string `json:"subject"`
+	Credentials int    `json:"credentials_removed"`
+	BackupCodes int    `json:"backup_codes_removed"`
+}
+
+// RotateResult is the output of RotateKey. Already counts secrets that were encrypted under the new key
+// before the run (e.g. when resuming an interrupted rotation).
+type RotateResult struct {
+	DryRun         bool `json:"dry_run"`
+	Credentials    int  `json:"credentials"`
+	Enrollments    int  `json:"enrollments"`
+	HardwareTokens int  `json:"hardware_tokens"`
+	Already        int  `json:"already_rotated"`
+}
+
+// Status returns a subject's credentials (without secrets) and backup code counts.
+func Status(ctx context.Context, st *store.Store, subject string) (*SubjectStatus, error) {
+	creds, err := st.GetCredentials(ctx, subject)
+	if err != nil {
+		return nil, err
+	}
+	codes, err := st.GetBackupCodes(ctx, subject)
+	if err != nil {
+		return nil, err
+	}
+	out := &SubjectStatus{Subject: subject, Credentials: make([]CredentialInfo, 0, len(creds)), BackupCodesTotal: len(codes)}
+	for _, c := range creds {
+		typ := c.Type
+		if typ == "" {
+			typ = "totp"
+		}
+		out.Credentials = append(out.Credentials, CredentialInfo{
+			ID: c.ID, Type: typ, Issuer: c.Issuer, Label: c.Label, Algo: c.Algo, Digits: c.Digits,
+			Period: c.Period, Counter: c.Counter, Serial: c.Serial, Enabled: c.Enabled,
+			CreatedAt: c.CreatedAt, UpdatedAt: c.UpdatedAt,
+		})
+		if c.ID == "" && c.Enabled {
+			out.TotpEnabled = true
+		}
+	}
+	for _, e := range codes {
+		if e.UsedAt == 0 {
+			out.BackupCodesRemaining++
+		}
+	}
+	return out, nil
+}
+
+// List summarizes every subject that has a credential or backup codes.
+func List(ctx context.Context, st *store.Store) ([]SubjectSummary, error) {
+	subjects, err := st.ListSubjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]SubjectSummary, 0, len(subjects))
+	for _, subject := range subjects {
+		s, err := Status(ctx, st, subject)
+		if err != nil {
+			return nil, fmt.Errorf("subject %s: %w", subject, err)
+		}
+		out = append(out, SubjectSummary{
+			Subject:              subject,
+			TotpEnabled:          s.TotpEnabled,
+			Credentials:          len(s.Credentials),
+			BackupCodesRemaining: s.BackupCodesRemaining,
+		})
+	}
+	return out, nil
+}
+
+// Revoke removes all credentials and backup codes of a subject, like POST /v1/revoke.
+func Revoke(ctx context.Context, st *store.Store, subject string) (*RevokeResult, error) {
+	s, err := Status(ctx, st, subject)
+	if err != nil {
+		return nil, err
+	}
+	if err := st.DeleteCredential(ctx, subject); err != nil {
+		return nil, err
+	}
+	if err := st.DeleteBackupCodes(ctx, subject); err != nil {
+		return nil, err
+	}
+	return &RevokeResult{Subject: subject, Credentials: len(s.Credentials), BackupCodes: s.BackupCodesTotal}, nil
+}
+
+// ErrSameKey is returned by RotateKey when the old and new keys are equal.
+var ErrSameKey = errors.New("new encryption key equals the current one")
+
+// RotateKey re-encrypts every credential secret, pending enrollment secret and unassigned hardware token
+// seed from oldKey to newKey. Secrets that already decrypt under newKey are left alone, so an interrupted
+// rotation can be rerun. With dryRun nothing is written, but every secret is still checked.
+// Run it while the service is stopped: a running instance keeps using the old key.
+func RotateKey(ctx context.Context, st *store.Store, oldKey, newKey []byte, dryRun bool) (*RotateResult, error) {
+	if bytes.Equal(oldKey, newKey) {
+		return nil, ErrSameKey
+	}
+	res := &RotateResult{DryRun: dryRun}
+	// rewrap returns the secret re-encrypted under newKey, or "" when it already is.
+	rewrap := func(what, enc string) (string, error) {
+		plain, err := secret.Decrypt(oldKey, enc)
+		if err != nil {
+			if _, err := secret.Decrypt(newKey, enc); err == nil {
+				res.Already++
+				return "", nil
+			}
+			return "", fmt.Errorf("%s: secret decrypts under neither key", what)
+		}
+		return secret.Encrypt(newKey, plain)
+	}
+
+	subjects, err := st.ListSubjects(ctx)
+	if err != nil {
+		return res, err
+	}
+	for _, subject := range subjects {
+		creds, err := st.GetCredentials(ctx, subject)
+		if err != nil {
+			return res, err
+		}
+		for _, c := range creds {
+			enc, err := rewrap("subject "+subject, c.SecretEnc)
+			if err != nil {
+				return res, err
+			}
+			if enc == "" {
+				continue
+			}
+			c.SecretEnc = enc
+			if !dryRun {
+				if err := st.SaveCredential(ctx, c); err != nil {
+					return res, err
+				}
+			}
+			res.Credentials++
+		}
+	}
+
+	enrollments, err := st.ListEnrollments(ctx)
+	if err != nil {
+		return res, err
+	}
+	for _, e := range enrollments {
+		enc, err := rewrap("enrollment "+e.EnrollID, e.SecretEnc)
+		if err != nil {
+			return res, err
+		}
+		if enc == "" {
+			continue
+		}
+		e.SecretEnc = enc
+		if !dryRun {
+			if err := st.UpdateEnrollment(ctx, e); err != nil {
+				return res, err
+			}
+		}
+		res.Enrollments++
+	}
+
+	tokens, err := st.ListHardwareTokens(ctx)
+	if err != nil {
+		return res, err
+	}
+	var rewrapped []*store.HardwareToken
+	for _, t := range tokens {
+		enc, err := rewrap("hardware token "+t.Serial, t.SecretEnc)
+		if err != nil {
+			return res, err
+		}
+		if enc == "" {
+			continue
+		}
+		t.SecretEnc = enc
+		rewrapped = append(rewrapped, t)
+	}
+	if !dryRun && len(rewrapped) > 0 {
+		if _, err := st.AddHardwareTokens(ctx, rewrapped, true); err != nil {
+			return res, err
+		}
+	}
+	res.HardwareTokens = len(rewrapped)
+	return res, nil
+}
@@ -0,0 +1,164 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/soulteary/herald-totp/internal/config"
+	"github.com/soulteary/herald-totp/internal/secret"
+	"github.com/soulteary/herald-totp/internal/store"
+)
+
+var (
+	oldKey = []byte("old-key-0123456789abcdef01234567")
+	newKey = []byte("new-key-0123456789abcdef01234567")
+)
+
+func newTestStore(t *testing.T) (*store.Store, *miniredis.Miniredis) {
+	t.Helper()
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis: %v", err)
+	}
+	t.Cleanup(mr.Close)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	return store.NewStore(rdb, 10*time.Minute, 0, 5*time.Minute, time.Hour, time.Minute), mr
+}
+
+func encrypt(t *testing.T, key []byte, plain string) string {
+	t.Helper()
+	enc, err := secret.Encrypt(key, plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return enc
+}
+
+func TestStatusListRevoke(t *testing.T) {
+	st, _ := newTestStore(t)
+	ctx := context.Background()
+	_ = st.SaveCredential(ctx, &store.Credential{Subject: "alice", SecretEnc: "x", Algo: "SHA1", Digits: 6, Period: 30, Enabled: true})
+	_ = st.SaveCredential(ctx, &store.Credential{ID: "a_1", Type: "hotp", Subject: "alice", SecretEnc: "y", Serial: "HW1", Counter: 7, Enabled: true})
+	_ = st.SaveBackupCodes(ctx, "alice", []store.BackupCodeEntry{{CodeHash: "h1"}, {CodeHash: "h2", UsedAt: 1}})
+	_ = st.SaveBackupCodes(ctx, "bob", []store.BackupCodeEntry{{CodeHash: "h3"}})
+
+	s, err := Status(ctx, st, "alice")
+	if err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	if !s.TotpEnabled || len(s.Credentials) != 2 || s.BackupCodesRemaining != 1 || s.BackupCodesTotal != 2 {
+		t.Errorf("Status = %+v", s)
+	}
+	if c := s.Credentials[0]; c.Type != "totp" || c.ID != "" {
+		t.Errorf("primary = %+v", c)
+	}
+	if c := s.Credentials[1]; c.Type != "hotp" || c.Serial != "HW1" || c.Counter != 7 {
+		t.Errorf("extra = %+v", c)
+	}
+
+	list, err := List(ctx, st)
+	if err != nil || len(list) != 2 || list[0].Subject != "alice" || list[0].Credentials != 2 || list[1].TotpEnabled {
+		t.Fatalf("List = %+v, %v", list, err)
+	}
+
+	res, err := Revoke(ctx, st, "alice")
+	if err != nil || res.Credentials != 2 || res.BackupCodes != 2 {
+		t.Fatalf("Revoke = %+v, %v", res, err)
+	}
+	if s, _ = Status(ctx, st, "alice"); s.TotpEnabled || len(s.Credentials) != 0 || s.BackupCodesTotal != 0 {
+		t.Errorf("Status after revoke = %+v", s)
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	st, _ := newTestStore(t)
+	ctx := context.Background()
+	_ = st.SaveCredential(ctx, &store.Credential{Subject: "alice", SecretEnc: encrypt(t, oldKey, "JBSWY3DPEHPK3PXP"), Enabled: true})
+	_ = st.SaveCredential(ctx, &store.Credential{ID: "a_1", Subject: "alice", SecretEnc: encrypt(t, oldKey, "GEZDGNBVGY3TQOJQ")})
+	_ = st.SaveEnrollment(ctx, &store.Enrollment{EnrollID: "e1", Subject: "bob", SecretEnc: encrypt(t, oldKey, "KRSXG5CTMVRXEZLU")})
+	_, _ = st.AddHardwareTokens(ctx, []*store.HardwareToken{{Serial: "HW1", SecretEnc: encrypt(t, oldKey, "MFRGGZDFMZTWQ2LK")}}, false)
+
+	if _, err := RotateKey(ctx, st, oldKey, oldKey, false); !errors.Is(err, ErrSameKey) {
+		t.Errorf("same key err = %v", err)
+	}
+
+	res, err := RotateKey(ctx, st, oldKey, newKey, true)
+	if err != nil || res.Credentials != 2 || res.Enrollments != 1 || res.HardwareTokens != 1 {
+		t.Fatalf("dry run = %+v, %v", res, err)
+	}
+	if c, _ := st.GetCredential(ctx, "alice"); mustDecrypt(oldKey, c.SecretEnc) != "JBSWY3DPEHPK3PXP" {
+		t.Fatal("dry run rewrote a credential")
+	}
+
+	res, err = RotateKey(ctx, st, oldKey, newKey, false)
+	if err != nil || res.Credentials != 2 || res.Enrollments != 1 || res.HardwareTokens != 1 || res.Already != 0 {
+		t.Fatalf("RotateKey = %+v, %v", res, err)
+	}
+	creds, _ := st.GetCredentials(ctx, "alice")
+	if mustDecrypt(newKey, creds[0].SecretEnc) != "JBSWY3DPEHPK3PXP" || mustDecrypt(newKey, creds[1].SecretEnc) != "GEZDGNBVGY3TQOJQ" {
+		t.Error("credentials not readable under the new key")
+	}
+	if e, _ := st.GetEnrollment(ctx, "e1"); mustDecrypt(newKey, e.SecretEnc) != "KRSXG5CTMVRXEZLU" {
+		t.Error("enrollment not readable under the new key")
+	}
+	if tok, _ := st.TakeHardwareToken(ctx, "HW1"); mustDecrypt(newKey, tok.SecretEnc) != "MFRGGZDFMZTWQ2LK" {
+		t.Error("hardware token not readable under the new key")
+	}
+
+	// Rerunning (e.g. after an interruption) skips secrets that are already rotated.
+	res, err = RotateKey(ctx, st, oldKey, newKey, false)
+	if err != nil || res.Credentials != 0 || res.Already != 3 {
+		t.Fatalf("rerun = %+v, %v", res, err)
+	}
+
+	_ = st.SaveCredential(ctx, &store.Credential{Subject: "carol", SecretEnc: encrypt(t, []byte("other-key-0123456789abcdef012345"), "JBSWY3DPEHPK3PXP")})
+	if _, err := RotateKey(ctx, st, oldKey, newKey, false); err == nil {
+		t.Error("secret under an unknown key should fail the rotation")
+	}
+}
+
+func mustDecrypt(key []byte, enc string) string {
+	plain, err := secret.Decrypt(key, enc)
+	if err != nil {
+		return ""
+	}
+	return plain
+}
+
+func TestCheckConfig(t *testing.T) {
+	st, mr := newTestStore(t)
+	ctx := context.Background()
+	defer config.Set(config.Get())
+
+	config.Update(func(c *config.Config) {
+		c.Mode = config.ModeProduction
+		c.EncryptionKey = string(oldKey)
+		c.ReenrollPolicy = config.ReenrollRequireCode
+		c.APIKey = "api-key-0123456789"
+		c.CORSAllowOrigins = []string{"https://admin.example.com"}
+	})
+	if r := CheckConfig(ctx, st); !r.OK || r.Redis != "ok" || len(r.Errors) != 0 || len(r.Warnings) != 0 {
+		t.Fatalf("valid config report = %+v", r)
+	}
+
+	// In development insecure settings are warnings; invalid values and Redis failures are errors.
+	config.Update(func(c *config.Config) {
+		c.Mode = config.ModeDevelopment
+		c.EncryptionKey = "short"
+		c.ReenrollPolicy = "sometimes"
+	})
+	mr.Close()
+	r := CheckConfig(ctx, st)
+	if r.OK || len(r.Errors) != 2 || r.Redis == "ok" || len(r.Warnings) != 1 {
+		t.Errorf("development report = %+v", r)
+	}
+	config.Update(func(c *config.Config) { c.Mode = config.ModeProduction })
+	if r = CheckConfig(ctx, nil); r.OK || len(r.Errors) != 2 || len(r.Warnings) != 0 || r.Redis != "not checked" {
+		t.Errorf("production report = %+v", r)
+	}
+}
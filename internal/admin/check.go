@@ -0,0 +1,45 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/soulteary/herald-totp/internal/config"
+	"github.com/soulteary/herald-totp/internal/store"
+)
+
+// ConfigReport is the output of CheckConfig. OK is false when Errors is not empty; warnings do not fail it.
+type ConfigReport struct {
+	OK       bool     `json:"ok"`
+	Mode     string   `json:"mode"`
+	Errors   []string `json:"errors"`
+	Warnings []string `json:"warnings"`
+	Redis    string   `json:"redis"` // "ok" or the connection error
+}
+
+// CheckConfig runs config validation and, when st is not nil, checks the Redis connection. In development
+// mode the insecure settings that would stop a production start are reported as warnings.
+// Call config.Initialize before this.
+func CheckConfig(ctx context.Context, st *store.Store) *ConfigReport {
+	cfg := config.Get()
+	r := &ConfigReport{Mode: cfg.Mode, Errors: []string{}, Warnings: []string{}}
+	var verr *config.ValidationError
+	if err := cfg.Validate(); errors.As(err, &verr) {
+		r.Errors = append(r.Errors, verr.Problems...)
+	}
+	if cfg.Mode != config.ModeProduction {
+		r.Warnings = append(r.Warnings, cfg.Insecure()...)
+	}
+
+	if st == nil {
+		r.Redis = "not checked"
+	} else if err := st.Ping(ctx); err != nil {
+		r.Redis = err.Error()
+		r.Errors = append(r.Errors, fmt.Sprintf("redis %s: %v", cfg.RedisAddr, err))
+	} else {
+		r.Redis = "ok"
+	}
+	r.OK = len(r.Errors) == 0
+	return r
+}
@@ -0,0 +1,86 @@
+package audit
+
+import (
+	"context"
+	"io"
+
+	logger "github.com/soulteary/logger-kit"
+)
+
+// Event types for 2FA state changes.
+const (
+	EventEnrollStart    = "enroll_start"
+	EventEnrollConfirm  = "enroll_confirm"
+	EventEnrollCancel   = "enroll_cancel"
+	EventVerify         = "verify"
+	EventBackupCodeUsed = "backup_code_used"
+	EventRevoke         = "revoke"
+	EventHOTPResync     = "hotp_resync"
+	EventAnomaly        = "anomaly" // reason is the signal, e.g. "credential_stuffing"
+)
+
+// Outcomes recorded on events.
+const (
+	OutcomeSuccess  = "success"
+	OutcomeFailure  = "failure"
+	OutcomeDetected = "detected" // anomaly signalled, nothing blocked
+	OutcomeBlocked  = "blocked"  // anomaly signalled and the offending IP or subject blocked
+)
+
+// Event is a single append-only audit record.
+type Event struct {
+	Timestamp int64  `json:"timestamp"`
+	Type      string `json:"type"`
+	Subject   string `json:"subject"`
+	Service   string `json:"service,omitempty"`
+	KeyID     string `json:"key_id,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	Outcome   string `json:"outcome"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// Sink receives audit events (stdout, file, Redis stream, ...).
+type Sink interface {
+	Write(ctx context.Context, e Event) error
+}
+
+// Recorder writes events to a set of sinks. A nil *Recorder records nothing.
+type Recorder struct {
+	log   *logger.Logger
+	sinks []Sink
+}
+
+// NewRecorder returns a recorder writing to sinks and logging their errors to l (nil discards them).
+// A recorder with no sinks records nothing.
+func NewRecorder(l *logger.Logger, sinks ...Sink) *Recorder {
+	return &Recorder{log: l, sinks: sinks}
+}
+
+// Record writes the event to every sink. Sink errors are logged and never fail the caller, so a
+// broken sink cannot block enroll or verify.
+func (r *Recorder) Record(ctx context.Context, e Event) {
+	if r == nil {
+		return
+	}
+	for _, s := range r.sinks {
+		if err := s.Write(ctx, e); err != nil && r.log != nil {
+			r.log.Warn().Err(err).Str("type", e.Type).Msg("audit: sink write failed")
+		}
+	}
+}
+
+// Close closes every sink that holds resources (e.g. the file sink).
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	var firstErr error
+	for _, s := range r.sinks {
+		if c, ok := s.(io.Closer); ok {
+			if err := c.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,140 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/soulteary/herald-totp/internal/store"
+)
+
+func TestWriterSink(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewWriterSink(&buf)
+	e := Event{Timestamp: 1, Type: EventVerify, Subject: "user1", IP: "1.2.3.4", Outcome: OutcomeFailure, Reason: "invalid"}
+	if err := s.Write(context.Background(), e); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if !strings.HasSuffix(buf.String(), "\n") {
+		t.Errorf("output should end with newline: %q", buf.String())
+	}
+	var got Event
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if got != e {
+		t.Errorf("event = %+v, want %+v", got, e)
+	}
+}
+
+func TestFileSink_Rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	s, err := NewFileSink(path, 200, 2)
+	if err != nil {
+		t.Fatalf("NewFileSink: %v", err)
+	}
+	defer func() { _ = s.Close() }()
+	e := Event{Timestamp: 1, Type: EventRevoke, Subject: "user1", Outcome: OutcomeSuccess}
+	for i := 0; i < 10; i++ {
+		if err := s.Write(context.Background(), e); err != nil {
+			t.Fatalf("Write %d: %v", i, err)
+		}
+	}
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatalf("stat %s: %v", p, err)
+		}
+		if info.Size() > 200 {
+			t.Errorf("%s size = %d, want <= 200", p, info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3 should not exist (maxBackups=2)", path)
+	}
+}
+
+func TestFileSink_Closed(t *testing.T) {
+	s, err := NewFileSink(filepath.Join(t.TempDir(), "audit.log"), 0, 0)
+	if err != nil {
+		t.Fatalf("NewFileSink: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := s.Write(context.Background(), Event{}); err == nil {
+		t.Error("Write after Close should fail")
+	}
+}
+
+func TestRedisSink_Recent(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis: %v", err)
+	}
+	defer mr.Close()
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	st := store.NewStore(rdb, 10*time.Minute, 0, 5*time.Minute, time.Hour, time.Minute)
+	ctx := context.Background()
+
+	s := NewRedisSink(st, 100, 3, 0)
+	for i := int64(1); i <= 5; i++ {
+		if err := s.Write(ctx, Event{Timestamp: i, Type: EventVerify, Subject: "user1", Outcome: OutcomeSuccess}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	_ = s.Write(ctx, Event{Timestamp: 9, Type: EventVerify, Subject: "user2", Outcome: OutcomeSuccess})
+
+	got, err := Recent(ctx, st, "user1", 10)
+	if err != nil {
+		t.Fatalf("Recent: %v", err)
+	}
+	if len(got) == 0 || got[0].Timestamp != 5 {
+		t.Fatalf("Recent = %+v, want newest first", got)
+	}
+	for _, e := range got {
+		if e.Subject != "user1" {
+			t.Errorf("Recent returned event for %q", e.Subject)
+		}
+	}
+	got, _ = Recent(ctx, st, "user1", 2)
+	if len(got) != 2 {
+		t.Errorf("Recent(limit=2) len = %d, want 2", len(got))
+	}
+	got, _ = Recent(ctx, st, "nobody", 10)
+	if len(got) != 0 {
+		t.Errorf("Recent(nobody) = %+v, want empty", got)
+	}
+}
+
+type failingSink struct{ calls int }
+
+func (f *failingSink) Write(context.Context, Event) error {
+	f.calls++
+	return os.ErrClosed
+}
+
+func TestRecord_FansOutAndIgnoresErrors(t *testing.T) {
+	var buf bytes.Buffer
+	fail := &failingSink{}
+	rec := NewRecorder(nil, fail, NewWriterSink(&buf))
+
+	rec.Record(context.Background(), Event{Type: EventEnrollStart, Subject: "user1", Outcome: OutcomeSuccess})
+	if fail.calls != 1 {
+		t.Errorf("failing sink calls = %d, want 1", fail.calls)
+	}
+	if buf.Len() == 0 {
+		t.Error("writer sink should receive the event after a failing sink")
+	}
+
+	var none *Recorder
+	none.Record(context.Background(), Event{Type: EventEnrollStart}) // must not panic
+}
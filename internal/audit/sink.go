@@ -0,0 +1,166 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/soulteary/herald-totp/internal/store"
+)
+
+// WriterSink writes one JSON object per line to an io.Writer (e.g. os.Stdout).
+type WriterSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterSink returns a sink that writes JSON lines to w.
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+// Write encodes the event as a JSON line.
+func (s *WriterSink) Write(_ context.Context, e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(data, '\n'))
+	return err
+}
+
+// FileSink appends JSON lines to a file and rotates it by size (path -> path.1 -> path.2 ...).
+type FileSink struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+// NewFileSink opens (or creates) path for appending. maxSize is in bytes (0 = never rotate);
+// maxBackups is the number of rotated files kept.
+func NewFileSink(path string, maxSize int64, maxBackups int) (*FileSink, error) {
+	s := &FileSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	s.f = f
+	s.size = info.Size()
+	return nil
+}
+
+// rotate closes the current file, shifts backups and opens a fresh file. Caller holds s.mu.
+func (s *FileSink) rotate() error {
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	if s.maxBackups <= 0 {
+		if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return s.open()
+	}
+	_ = os.Remove(fmt.Sprintf("%s.%d", s.path, s.maxBackups))
+	for i := s.maxBackups - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+	}
+	if err := os.Rename(s.path, s.path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.open()
+}
+
+// Write appends the event, rotating first if the file would exceed maxSize.
+func (s *FileSink) Write(_ context.Context, e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return os.ErrClosed
+	}
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(data)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.f.Write(data)
+	s.size += int64(n)
+	return err
+}
+
+// Close closes the underlying file.
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+// RedisSink appends events to Redis streams via the store (global stream plus one stream per subject).
+type RedisSink struct {
+	st               *store.Store
+	maxLen           int64
+	subjectMaxLen    int64
+	subjectRetention time.Duration
+}
+
+// NewRedisSink returns a sink backed by the store's audit streams. A subject's stream is deleted
+// subjectRetention after its last event (0 = kept).
+func NewRedisSink(st *store.Store, maxLen, subjectMaxLen int64, subjectRetention time.Duration) *RedisSink {
+	return &RedisSink{st: st, maxLen: maxLen, subjectMaxLen: subjectMaxLen, subjectRetention: subjectRetention}
+}
+
+// Write appends the event to the audit streams.
+func (s *RedisSink) Write(ctx context.Context, e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.st.AppendAuditEvent(ctx, e.Subject, data, s.maxLen, s.subjectMaxLen, s.subjectRetention)
+}
+
+// Recent returns up to limit events for the subject, newest first, from the store's audit stream.
+func Recent(ctx context.Context, st *store.Store, subject string, limit int64) ([]Event, error) {
+	raw, err := st.ListAuditEvents(ctx, subject, limit)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Event, 0, len(raw))
+	for _, b := range raw {
+		var e Event
+		if err := json.Unmarshal(b, &e); err != nil {
+			continue
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
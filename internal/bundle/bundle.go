@@ -0,0 +1,198 @@
+package bundle
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/soulteary/herald-totp/internal/secret"
+	"github.com/soulteary/herald-totp/internal/store"
+)
+
+// Format identifies a herald-totp migration bundle.
+const Format = "herald-totp-bundle"
+
+// Version is the bundle layout written by Export. Import rejects other versions.
+const Version = 1
+
+// File is the on-disk bundle. Payload is the JSON-encoded []Subject sealed with AES-GCM under the
+// transfer key, so subjects, secrets and backup code hashes are never written in clear.
+type File struct {
+	Format    string `json:"format"`
+	Version   int    `json:"version"`
+	CreatedAt int64  `json:"created_at"`
+	Subjects  int    `json:"subjects"`
+	Payload   string `json:"payload"`
+}
+
+// Subject is everything exported for one subject.
+type Subject struct {
+	Subject     string                  `json:"subject"`
+	Credentials []Credential            `json:"credentials"`
+	BackupCodes []store.BackupCodeEntry `json:"backup_codes,omitempty"`
+}
+
+// Credential is a stored credential with its secret decrypted from the source instance key
+// (Credential.SecretEnc is empty). The secret is re-encrypted under the destination instance key on import.
+type Credential struct {
+	Credential   store.Credential `json:"credential"`
+	SecretBase32 string           `json:"secret_base32"`
+}
+
+// ImportResult reports what Import wrote.
+type ImportResult struct {
+	Subjects    int      `json:"subjects"`
+	Credentials int      `json:"credentials"`
+	Replaced    []string `json:"replaced,omitempty"` // subjects overwritten (overwrite mode only)
+}
+
+// DuplicateError is returned by Import when subjects in the bundle already exist and overwrite is off.
+type DuplicateError struct {
+	Subjects []string
+}
+
+func (e *DuplicateError) Error() string {
+	return fmt.Sprintf("%d subject(s) already exist in the destination: %s", len(e.Subjects), strings.Join(e.Subjects, ", "))
+}
+
+// Export reads every credential and backup code set, decrypts secrets with sourceKey and seals the
+// result under transferKey.
+func Export(ctx context.Context, st *store.Store, sourceKey, transferKey []byte, now time.Time) (*File, error) {
+	subjects, err := st.ListSubjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Subject, 0, len(subjects))
+	for _, subject := range subjects {
+		creds, err := st.GetCredentials(ctx, subject)
+		if err != nil {
+			return nil, fmt.Errorf("subject %s: %w", subject, err)
+		}
+		backup, err := st.GetBackupCodes(ctx, subject)
+		if err != nil {
+			return nil, fmt.Errorf("subject %s: %w", subject, err)
+		}
+		s := Subject{Subject: subject, BackupCodes: backup}
+		for _, c := range creds {
+			plain, err := secret.Decrypt(sourceKey, c.SecretEnc)
+			if err != nil {
+				return nil, fmt.Errorf("subject %s: decrypt secret (wrong HERALD_TOTP_ENCRYPTION_KEY?): %w", subject, err)
+			}
+			bc := Credential{Credential: *c, SecretBase32: plain}
+			bc.Credential.SecretEnc = ""
+			s.Credentials = append(s.Credentials, bc)
+		}
+		out = append(out, s)
+	}
+	payload, err := json.Marshal(out)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := secret.Encrypt(transferKey, string(payload))
+	if err != nil {
+		return nil, err
+	}
+	return &File{Format: Format, Version: Version, CreatedAt: now.Unix(), Subjects: len(out), Payload: sealed}, nil
+}
+
+// Open checks the bundle header and decrypts its payload with transferKey.
+func Open(f *File, transferKey []byte) ([]Subject, error) {
+	if f.Format != Format {
+		return nil, fmt.Errorf("not a %s file", Format)
+	}
+	if f.Version != Version {
+		return nil, fmt.Errorf("unsupported bundle version %d (want %d)", f.Version, Version)
+	}
+	payload, err := secret.Decrypt(transferKey, f.Payload)
+	if err != nil {
+		return nil, errors.New("decrypt bundle failed (wrong transfer key?)")
+	}
+	var subjects []Subject
+	if err := json.Unmarshal([]byte(payload), &subjects); err != nil {
+		return nil, fmt.Errorf("decode bundle payload: %w", err)
+	}
+	return subjects, nil
+}
+
+// Import writes the bundle's subjects to st, encrypting secrets with destKey. Subjects that already
+// have a credential or backup codes make the whole import fail with *DuplicateError unless overwrite is set,
+// in which case their existing records are replaced. Nothing is written when the bundle cannot be opened.
+func Import(ctx context.Context, st *store.Store, f *File, transferKey, destKey []byte, overwrite bool) (*ImportResult, error) {
+	subjects, err := Open(f, transferKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var existing []string
+	for _, s := range subjects {
+		creds, err := st.GetCredentials(ctx, s.Subject)
+		if err != nil {
+			return nil, err
+		}
+		backup, err := st.GetBackupCodes(ctx, s.Subject)
+		if err != nil {
+			return nil, err
+		}
+		if len(creds) > 0 || len(backup) > 0 {
+			existing = append(existing, s.Subject)
+		}
+	}
+	if len(existing) > 0 && !overwrite {
+		sort.Strings(existing)
+		return nil, &DuplicateError{Subjects: existing}
+	}
+
+	res := &ImportResult{Replaced: existing}
+	replace := make(map[string]bool, len(existing))
+	for _, s := range existing {
+		replace[s] = true
+	}
+	for _, s := range subjects {
+		if replace[s.Subject] {
+			if err := st.DeleteCredential(ctx, s.Subject); err != nil {
+				return res, err
+			}
+			if err := st.DeleteBackupCodes(ctx, s.Subject); err != nil {
+				return res, err
+			}
+		}
+		for _, bc := range s.Credentials {
+			c := bc.Credential
+			if c.SecretEnc, err = secret.Encrypt(destKey, bc.SecretBase32); err != nil {
+				return res, err
+			}
+			if err := st.SaveCredential(ctx, &c); err != nil {
+				return res, fmt.Errorf("subject %s: %w", s.Subject, err)
+			}
+			res.Credentials++
+		}
+		if len(s.BackupCodes) > 0 {
+			if err := st.SaveBackupCodes(ctx, s.Subject, s.BackupCodes); err != nil {
+				return res, fmt.Errorf("subject %s: %w", s.Subject, err)
+			}
+		}
+		res.Subjects++
+	}
+	return res, nil
+}
+
+// Write encodes the bundle as indented JSON.
+func (f *File) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(f)
+}
+
+// Read decodes a bundle written by Write.
+func Read(r io.Reader) (*File, error) {
+	var f File
+	if err := json.NewDecoder(r).Decode(&f); err != nil {
+		return nil, fmt.Errorf("read bundle: %w", err)
+	}
+	return &f, nil
+}
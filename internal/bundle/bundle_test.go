@@ -0,0 +1,133 @@
+package bundle
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/soulteary/herald-totp/internal/secret"
+	"github.com/soulteary/herald-totp/internal/store"
+)
+
+var (
+	sourceKey   = []byte("source-key-0123456789abcdef01234")
+	destKey     = []byte("dest-key-0123456789abcdef0123456")
+	transferKey = []byte("transfer-key-0123456789abcdef012")
+)
+
+func newTestStore(t *testing.T) *store.Store {
+	t.Helper()
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis: %v", err)
+	}
+	t.Cleanup(mr.Close)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	return store.NewStore(rdb, 10*time.Minute, 0, 5*time.Minute, time.Hour, time.Minute)
+}
+
+func seed(t *testing.T, st *store.Store, subject, secretB32, id string) {
+	t.Helper()
+	enc, err := secret.Encrypt(sourceKey, secretB32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &store.Credential{ID: id, Subject: subject, SecretEnc: enc, Period: 30, Digits: 6, Algo: "SHA1", Enabled: true, LastUsedStep: 42, CreatedAt: 1}
+	if err := st.SaveCredential(context.Background(), c); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportImport_RoundTrip(t *testing.T) {
+	ctx := context.Background()
+	src := newTestStore(t)
+	seed(t, src, "alice", "JBSWY3DPEHPK3PXP", "")
+	seed(t, src, "alice", "GEZDGNBVGY3TQOJQ", "a_extra")
+	seed(t, src, "bob", "KRSXG5CTMVRXEZLU", "")
+	_ = src.SaveBackupCodes(ctx, "alice", []store.BackupCodeEntry{{CodeHash: "h1"}, {CodeHash: "h2", UsedAt: 5}})
+
+	f, err := Export(ctx, src, sourceKey, transferKey, time.Unix(1000, 0))
+	if err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	if f.Subjects != 2 || f.Version != Version || bytes.Contains([]byte(f.Payload), []byte("alice")) {
+		t.Fatalf("bundle header = %+v", f)
+	}
+	var buf bytes.Buffer
+	if err := f.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("JBSWY3DPEHPK3PXP")) {
+		t.Fatal("bundle file contains a plaintext secret")
+	}
+	f, err = Read(&buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	dst := newTestStore(t)
+	res, err := Import(ctx, dst, f, transferKey, destKey, false)
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	if res.Subjects != 2 || res.Credentials != 3 {
+		t.Errorf("ImportResult = %+v", res)
+	}
+	creds, _ := dst.GetCredentials(ctx, "alice")
+	if len(creds) != 2 || creds[1].ID != "a_extra" || creds[0].LastUsedStep != 42 {
+		t.Fatalf("alice credentials = %+v", creds)
+	}
+	plain, err := secret.Decrypt(destKey, creds[0].SecretEnc)
+	if err != nil || plain != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("secret under destination key = %q, %v", plain, err)
+	}
+	if codes, _ := dst.GetBackupCodes(ctx, "alice"); len(codes) != 2 || codes[1].UsedAt != 5 {
+		t.Errorf("backup codes = %+v", codes)
+	}
+
+	// Importing again collides with every subject.
+	_, err = Import(ctx, dst, f, transferKey, destKey, false)
+	var dup *DuplicateError
+	if !errors.As(err, &dup) || len(dup.Subjects) != 2 {
+		t.Fatalf("second import err = %v, want DuplicateError for 2 subjects", err)
+	}
+	// Overwrite replaces existing records instead of merging them.
+	seed(t, dst, "bob", "MFRGGZDFMZTWQ2LK", "a_local")
+	res, err = Import(ctx, dst, f, transferKey, destKey, true)
+	if err != nil || len(res.Replaced) != 2 {
+		t.Fatalf("overwrite import = %+v, %v", res, err)
+	}
+	if creds, _ = dst.GetCredentials(ctx, "bob"); len(creds) != 1 {
+		t.Errorf("bob credentials after overwrite = %d, want 1", len(creds))
+	}
+}
+
+func TestImport_RejectsBadBundle(t *testing.T) {
+	ctx := context.Background()
+	src := newTestStore(t)
+	seed(t, src, "carol", "JBSWY3DPEHPK3PXP", "")
+	f, err := Export(ctx, src, sourceKey, transferKey, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := newTestStore(t)
+	if _, err := Import(ctx, dst, f, []byte("wrong-transfer-key-0123456789abc"), destKey, false); err == nil {
+		t.Error("wrong transfer key should fail")
+	}
+	bad := *f
+	bad.Version = 99
+	if _, err := Import(ctx, dst, &bad, transferKey, destKey, false); err == nil {
+		t.Error("unknown version should fail")
+	}
+	if subjects, _ := dst.ListSubjects(ctx); len(subjects) != 0 {
+		t.Errorf("failed imports wrote %v", subjects)
+	}
+	if _, err := Export(ctx, src, destKey, transferKey, time.Now()); err == nil {
+		t.Error("export with the wrong source key should fail")
+	}
+}
@@ -1,8 +1,13 @@
 package config
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/soulteary/cli-kit/env"
@@ -11,61 +16,473 @@ import (
 
 var log *logger.Logger
 
-var (
-	Port     = env.Get("PORT", ":8084")
-	LogLevel = env.Get("LOG_LEVEL", "info")
+// Re-enrollment policies (REENROLL_POLICY); the values are those of pkg/totpservice.
+const (
+	ReenrollReject      = "reject"
+	ReenrollRequireCode = "require_code"
+	ReenrollAdd         = "add"
+)
+
+// Run modes (HERALD_TOTP_MODE).
+const (
+	ModeProduction  = "production"  // insecure settings make Validate fail
+	ModeDevelopment = "development" // insecure settings are only reported by Insecure
+)
+
+// FileEnv names the env var holding the optional config file path.
+const FileEnv = "HERALD_TOTP_CONFIG_FILE"
+
+// Config holds every setting. A *Config returned by Get is shared and must not be modified; use Update.
+// File keys are the env var names in lower case (durations as strings such as "10m").
+type Config struct {
+	Mode     string `json:"herald_totp_mode"`
+	Port     string `json:"port"`
+	GRPCPort string `json:"grpc_port"` // empty disables the gRPC API
+	LogLevel string `json:"log_level"`
 
 	// Redis
-	RedisAddr     = env.Get("REDIS_ADDR", "localhost:6379")
-	RedisPassword = env.Get("REDIS_PASSWORD", "")
-	RedisDB       = env.GetInt("REDIS_DB", 0)
+	RedisAddr     string `json:"redis_addr"`
+	RedisPassword string `json:"redis_password"`
+	RedisDB       int    `json:"redis_db"`
 
 	// TOTP
-	TOTPIssuer = env.Get("TOTP_ISSUER", "Herald")
-	TOTPPeriod = env.GetInt("TOTP_PERIOD", 30)
-	TOTPDigits = env.GetInt("TOTP_DIGITS", 6)
-	TOTPSkew   = env.GetUint("TOTP_SKEW", 1)
+	TOTPIssuer string `json:"totp_issuer"`
+	TOTPPeriod int    `json:"totp_period"`
+	TOTPDigits int    `json:"totp_digits"`
+	TOTPSkew   uint   `json:"totp_skew"`
+
+	// HOTP: counters checked ahead of the stored one on verify, and the wider window searched on resync
+	HOTPLookAhead    int `json:"hotp_look_ahead"`
+	HOTPResyncWindow int `json:"hotp_resync_window"`
 
 	// Enrollment TTL (temp binding state)
-	EnrollTTL = env.GetDuration("ENROLL_TTL", 10*time.Minute)
+	EnrollTTL time.Duration `json:"-"`
+	// Max unexpired enrollments per subject (enroll/start fails with too_many_enrollments beyond this)
+	MaxPendingEnrollments int `json:"max_pending_enrollments"`
+	// Re-enrollment when the subject already has a credential: reject, require_code or add
+	ReenrollPolicy           string `json:"reenroll_policy"`
+	MaxCredentialsPerSubject int    `json:"max_credentials_per_subject"` // policy "add" only
+	// Enroll response: when false, do not return secret_base32 (only otpauth_uri for QR)
+	ExposeSecretInEnroll bool `json:"expose_secret_in_enroll"`
+	// Backup codes issued on enrollment (replacing any existing ones)
+	BackupCodeCount int `json:"backup_code_count"`
 
 	// Secret encryption (32 bytes for AES-256)
-	EncryptionKey = env.Get("HERALD_TOTP_ENCRYPTION_KEY", "")
+	EncryptionKey string `json:"herald_totp_encryption_key"`
+	// Key sealing export/import bundles; shared by the source and destination instances only for a migration
+	TransferKey string `json:"herald_totp_transfer_key"`
+	// Hardware token import: hex AES key that encrypts secrets in PSKC seed files (16, 24 or 32 bytes)
+	PSKCPreSharedKey string `json:"pskc_preshared_key"`
+
+	// Service auth: API Key or HMAC (single secret, or key ID -> secret)
+	APIKey      string            `json:"api_key"`
+	HMACSecret  string            `json:"hmac_secret"`
+	HMACKeys    map[string]string `json:"herald_totp_hmac_keys"`
+	ServiceName string            `json:"service_name"`
+	// Admin API (/v1/admin): its own API key, and mTLS caller identities (TLS_IDENTITIES values) allowed
+	// in; the service auth above does not open it. Neither set disables the admin API.
+	AdminAPIKey     string   `json:"admin_api_key"`
+	AdminIdentities []string `json:"admin_identities"`
 
-	// Service auth: API Key or HMAC
-	APIKey       = env.Get("API_KEY", "")
-	HMACSecret   = env.Get("HMAC_SECRET", "")
-	HMACKeysJSON = env.Get("HERALD_TOTP_HMAC_KEYS", "")
-	ServiceName  = env.Get("SERVICE_NAME", "herald-totp")
+	// TLS: server certificate and key (both set = HTTPS); client CA bundle enables mTLS caller auth
+	TLSCertFile     string `json:"tls_cert_file"`
+	TLSKeyFile      string `json:"tls_key_file"`
+	TLSClientCAFile string `json:"tls_client_ca_file"`
+	TLSClientAuth   string `json:"tls_client_auth"` // request or require
+	// Client certificate field -> caller identity, e.g. {"uri:spiffe://mesh/stargate":"stargate"}
+	TLSIdentities map[string]string `json:"tls_identities"`
 
-	hmacKeysMap      map[string]string
-	hmacDefaultKeyID string
+	// CORS: the policy for every route not matched by CORSRoutes. Allowed origins default to "*" in
+	// development and to none (CORS off) in production; an empty list disables CORS.
+	CORSEnabled          bool     `json:"cors_enabled"`
+	CORSAllowOrigins     []string `json:"cors_allow_origins"`
+	CORSAllowMethods     []string `json:"cors_allow_methods"`
+	CORSAllowHeaders     []string `json:"cors_allow_headers"`
+	CORSAllowCredentials bool     `json:"cors_allow_credentials"`
+	CORSMaxAge           int      `json:"cors_max_age"` // seconds browsers may cache a preflight; 0 = not sent
+	// Route path prefix -> policy, e.g. {"/healthz":{"allow_origins":["*"]}}; the longest prefix wins
+	CORSRoutes map[string]CORSPolicy `json:"cors_routes"`
 
 	// Rate limit
-	RateLimitPerSubject = env.GetInt("RATE_LIMIT_PER_SUBJECT", 20) // per hour
-	RateLimitPerIP      = env.GetInt("RATE_LIMIT_PER_IP", 30)      // per minute
+	RateLimitPerSubject int `json:"rate_limit_per_subject"` // per hour
+	RateLimitPerIP      int `json:"rate_limit_per_ip"`      // per minute
 
-	// Enroll response: when false, do not return secret_base32 (only otpauth_uri for QR)
-	ExposeSecretInEnroll = ParseBoolEnv("EXPOSE_SECRET_IN_ENROLL", true)
-)
+	// Anomaly detection on verify: thresholds within the sliding window (0 disables a signal) and how
+	// long the offending IP or subject is blocked (0 = signal only)
+	AnomalyWindow     time.Duration `json:"-"`
+	AnomalyIPSubjects int           `json:"anomaly_ip_subjects"`
+	AnomalySubjectIPs int           `json:"anomaly_subject_ips"`
+	AnomalyReplays    int           `json:"anomaly_replays"`
+	AnomalyBlockTTL   time.Duration `json:"-"`
 
-// Initialize sets the logger and parses HMAC keys if present.
-func Initialize(l *logger.Logger) {
-	log = l
-	if HMACKeysJSON != "" {
-		if err := parseHMACKeys(); err != nil {
-			log.Warn().Err(err).Msg("Failed to parse HERALD_TOTP_HMAC_KEYS")
+	// QR rendering defaults for enroll/start qr_format and GET /v1/enroll/:enroll_id/qr
+	QRSize            int    `json:"qr_size"`     // pixels
+	QRMaxSize         int    `json:"qr_max_size"` // upper bound for per-request qr_size
+	QRErrorCorrection string `json:"qr_error_correction"`
+
+	// Audit: sinks (stdout, file, redis); empty disables audit events
+	AuditSinks          []string `json:"audit_sinks"`
+	AuditFilePath       string   `json:"audit_file_path"`
+	AuditFileMaxSizeMB  int      `json:"audit_file_max_size_mb"`
+	AuditFileMaxBackups int      `json:"audit_file_max_backups"`
+	AuditStreamMaxLen   int      `json:"audit_stream_maxlen"`  // global stream
+	AuditSubjectMaxLen  int      `json:"audit_subject_maxlen"` // per-subject stream
+	// A subject's stream is deleted this long after its last event; 0 keeps it
+	AuditSubjectRetention time.Duration `json:"-"`
+
+	// Webhooks: event -> target URLs, e.g. {"enrolled":["https://accounts/hooks/totp"]}
+	WebhookURLs           map[string][]string `json:"webhook_urls"`
+	WebhookSecret         string              `json:"webhook_secret"`
+	WebhookMaxAttempts    int                 `json:"webhook_max_attempts"`
+	WebhookBackoff        time.Duration       `json:"-"`
+	WebhookMaxBackoff     time.Duration       `json:"-"`
+	WebhookTimeout        time.Duration       `json:"-"`
+	WebhookPollInterval   time.Duration       `json:"-"`
+	WebhookLowBackupCodes int                 `json:"webhook_low_backup_codes"`
+	WebhookDeadLetterMax  int                 `json:"webhook_dead_letter_max"`
+
+	// How often the config file is checked for changes; 0 leaves reloads to SIGHUP
+	ReloadInterval time.Duration `json:"-"`
+
+	// How often the enrolled subject, credential and pending enrollment gauges are updated; 0 = never
+	MetricsInventoryInterval time.Duration `json:"-"`
+
+	// Tracing: span exporter (none, stdout, otlp) and OTLP/HTTP endpoint; the standard OTEL_* env vars also apply
+	TracingExporter     string `json:"tracing_exporter"`
+	TracingOTLPEndpoint string `json:"tracing_otlp_endpoint"`
+
+	// problems found while loading (unparsable env values) that Validate reports
+	loadErrors []string
+}
+
+// durationFields maps the file keys of duration settings, which are given as strings ("10m").
+func (c *Config) durationFields() map[string]*time.Duration {
+	return map[string]*time.Duration{
+		"enroll_ttl":                         &c.EnrollTTL,
+		"webhook_backoff":                    &c.WebhookBackoff,
+		"webhook_max_backoff":                &c.WebhookMaxBackoff,
+		"webhook_timeout":                    &c.WebhookTimeout,
+		"webhook_poll_interval":              &c.WebhookPollInterval,
+		"herald_totp_config_reload_interval": &c.ReloadInterval,
+		"metrics_inventory_interval":         &c.MetricsInventoryInterval,
+		"audit_subject_retention":            &c.AuditSubjectRetention,
+		"anomaly_window":                     &c.AnomalyWindow,
+		"anomaly_block_ttl":                  &c.AnomalyBlockTTL,
+	}
+}
+
+// Defaults returns the built-in settings, before any file or env override.
+func Defaults() *Config {
+	return &Config{
+		Mode:                     ModeDevelopment,
+		Port:                     ":8084",
+		LogLevel:                 "info",
+		RedisAddr:                "localhost:6379",
+		TOTPIssuer:               "Herald",
+		TOTPPeriod:               30,
+		TOTPDigits:               6,
+		TOTPSkew:                 1,
+		HOTPLookAhead:            10,
+		HOTPResyncWindow:         100,
+		EnrollTTL:                10 * time.Minute,
+		MaxPendingEnrollments:    3,
+		ReenrollPolicy:           ReenrollRequireCode,
+		MaxCredentialsPerSubject: 5,
+		ExposeSecretInEnroll:     true,
+		BackupCodeCount:          10,
+		ServiceName:              "herald-totp",
+		TLSClientAuth:            "request",
+		CORSEnabled:              true,
+		CORSAllowMethods:         []string{"GET", "POST", "OPTIONS"},
+		CORSAllowHeaders:         []string{"Content-Type", "Authorization", "X-Service", "X-Signature", "X-Timestamp", "X-API-Key", "X-Key-Id"},
+		RateLimitPerSubject:      20,
+		RateLimitPerIP:           30,
+		AnomalyWindow:            10 * time.Minute,
+		AnomalyIPSubjects:        10,
+		AnomalySubjectIPs:        5,
+		AnomalyReplays:           5,
+		QRSize:                   256,
+		QRMaxSize:                1024,
+		QRErrorCorrection:        "M",
+		AuditSinks:               []string{"redis"},
+		AuditFilePath:            "herald-totp-audit.log",
+		AuditFileMaxSizeMB:       100,
+		AuditFileMaxBackups:      5,
+		AuditStreamMaxLen:        100000,
+		AuditSubjectMaxLen:       100,
+		AuditSubjectRetention:    90 * 24 * time.Hour,
+		WebhookMaxAttempts:       8,
+		WebhookBackoff:           5 * time.Second,
+		WebhookMaxBackoff:        time.Hour,
+		WebhookTimeout:           10 * time.Second,
+		WebhookPollInterval:      time.Second,
+		WebhookLowBackupCodes:    3,
+		WebhookDeadLetterMax:     1000,
+		ReloadInterval:           5 * time.Second,
+		MetricsInventoryInterval: time.Minute,
+		TracingExporter:          "none",
+	}
+}
+
+// Load builds the settings from the defaults, then the JSON file at path (if any), then env vars.
+// It fails only when the file cannot be read or parsed; bad env values are left for Validate to report.
+func Load(path string) (*Config, error) {
+	c := Defaults()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("config file: %w", err)
+		}
+		if err := c.decodeFile(data); err != nil {
+			return nil, fmt.Errorf("config file %s: %w", path, err)
+		}
+	}
+	c.applyEnv()
+	if c.CORSAllowOrigins == nil && c.Mode != ModeProduction {
+		c.CORSAllowOrigins = []string{"*"}
+	}
+	return c, nil
+}
+
+// decodeFile overlays the JSON object in data onto c. Unknown keys are rejected so typos surface.
+func (c *Config) decodeFile(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	for key, dst := range c.durationFields() {
+		v, ok := raw[key]
+		if !ok {
+			continue
+		}
+		var s string
+		if err := json.Unmarshal(v, &s); err != nil {
+			return fmt.Errorf("%s: want a duration string such as \"10m\"", key)
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		*dst = d
+		delete(raw, key)
+	}
+	rest, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(rest))
+	dec.DisallowUnknownFields()
+	return dec.Decode(c)
+}
+
+// applyEnv overrides c with every env var that is set.
+func (c *Config) applyEnv() {
+	c.Mode = env.Get("HERALD_TOTP_MODE", c.Mode)
+	c.Port = env.Get("PORT", c.Port)
+	c.GRPCPort = env.Get("GRPC_PORT", c.GRPCPort)
+	c.LogLevel = env.Get("LOG_LEVEL", c.LogLevel)
+
+	c.RedisAddr = env.Get("REDIS_ADDR", c.RedisAddr)
+	c.RedisPassword = env.Get("REDIS_PASSWORD", c.RedisPassword)
+	c.envInt(&c.RedisDB, "REDIS_DB")
+
+	c.TOTPIssuer = env.Get("TOTP_ISSUER", c.TOTPIssuer)
+	c.envInt(&c.TOTPPeriod, "TOTP_PERIOD")
+	c.envInt(&c.TOTPDigits, "TOTP_DIGITS")
+	if v, ok := lookup("TOTP_SKEW"); ok {
+		if n, err := strconv.ParseUint(v, 10, 64); err != nil {
+			c.badEnv("TOTP_SKEW", v, "uint")
+		} else {
+			c.TOTPSkew = uint(n)
+		}
+	}
+	c.envInt(&c.HOTPLookAhead, "HOTP_LOOK_AHEAD")
+	c.envInt(&c.HOTPResyncWindow, "HOTP_RESYNC_WINDOW")
+
+	c.envDuration(&c.EnrollTTL, "ENROLL_TTL")
+	c.envInt(&c.MaxPendingEnrollments, "MAX_PENDING_ENROLLMENTS")
+	c.ReenrollPolicy = env.Get("REENROLL_POLICY", c.ReenrollPolicy)
+	c.envInt(&c.MaxCredentialsPerSubject, "MAX_CREDENTIALS_PER_SUBJECT")
+	c.ExposeSecretInEnroll = ParseBoolEnv("EXPOSE_SECRET_IN_ENROLL", c.ExposeSecretInEnroll)
+	c.envInt(&c.BackupCodeCount, "BACKUP_CODE_COUNT")
+
+	c.EncryptionKey = env.Get("HERALD_TOTP_ENCRYPTION_KEY", c.EncryptionKey)
+	c.TransferKey = env.Get("HERALD_TOTP_TRANSFER_KEY", c.TransferKey)
+	c.PSKCPreSharedKey = env.Get("PSKC_PRESHARED_KEY", c.PSKCPreSharedKey)
+
+	c.APIKey = env.Get("API_KEY", c.APIKey)
+	c.HMACSecret = env.Get("HMAC_SECRET", c.HMACSecret)
+	if v, ok := lookup("HERALD_TOTP_HMAC_KEYS"); ok {
+		var keys map[string]string
+		if err := json.Unmarshal([]byte(v), &keys); err != nil {
+			c.loadErrors = append(c.loadErrors, fmt.Sprintf("HERALD_TOTP_HMAC_KEYS: %v", err))
 		} else {
-			for keyID := range hmacKeysMap {
-				hmacDefaultKeyID = keyID
-				break
-			}
+			c.HMACKeys = keys
 		}
 	}
+	c.ServiceName = env.Get("SERVICE_NAME", c.ServiceName)
+	c.AdminAPIKey = env.Get("ADMIN_API_KEY", c.AdminAPIKey)
+	if v, ok := lookup("ADMIN_IDENTITIES"); ok {
+		c.AdminIdentities = splitList(v)
+	}
+
+	c.TLSCertFile = env.Get("TLS_CERT_FILE", c.TLSCertFile)
+	c.TLSKeyFile = env.Get("TLS_KEY_FILE", c.TLSKeyFile)
+	c.TLSClientCAFile = env.Get("TLS_CLIENT_CA_FILE", c.TLSClientCAFile)
+	c.TLSClientAuth = strings.ToLower(env.Get("TLS_CLIENT_AUTH", c.TLSClientAuth))
+	if v, ok := lookup("TLS_IDENTITIES"); ok {
+		var ids map[string]string
+		if err := json.Unmarshal([]byte(v), &ids); err != nil {
+			c.loadErrors = append(c.loadErrors, fmt.Sprintf("TLS_IDENTITIES: %v", err))
+		} else {
+			c.TLSIdentities = ids
+		}
+	}
+
+	c.CORSEnabled = ParseBoolEnv("CORS_ENABLED", c.CORSEnabled)
+	if v, ok := os.LookupEnv("CORS_ALLOW_ORIGINS"); ok {
+		// Set but empty is an explicit "no origins", unlike unset.
+		c.CORSAllowOrigins = append([]string{}, splitList(v)...)
+	}
+	if v, ok := lookup("CORS_ALLOW_METHODS"); ok {
+		c.CORSAllowMethods = splitList(strings.ToUpper(v))
+	}
+	if v, ok := lookup("CORS_ALLOW_HEADERS"); ok {
+		c.CORSAllowHeaders = splitList(v)
+	}
+	c.CORSAllowCredentials = ParseBoolEnv("CORS_ALLOW_CREDENTIALS", c.CORSAllowCredentials)
+	c.envInt(&c.CORSMaxAge, "CORS_MAX_AGE")
+	if v, ok := lookup("CORS_ROUTES"); ok {
+		var routes map[string]CORSPolicy
+		if err := json.Unmarshal([]byte(v), &routes); err != nil {
+			c.loadErrors = append(c.loadErrors, fmt.Sprintf("CORS_ROUTES: %v", err))
+		} else {
+			c.CORSRoutes = routes
+		}
+	}
+
+	c.envInt(&c.RateLimitPerSubject, "RATE_LIMIT_PER_SUBJECT")
+	c.envInt(&c.RateLimitPerIP, "RATE_LIMIT_PER_IP")
+
+	c.envDuration(&c.AnomalyWindow, "ANOMALY_WINDOW")
+	c.envInt(&c.AnomalyIPSubjects, "ANOMALY_IP_SUBJECTS")
+	c.envInt(&c.AnomalySubjectIPs, "ANOMALY_SUBJECT_IPS")
+	c.envInt(&c.AnomalyReplays, "ANOMALY_REPLAYS")
+	c.envDuration(&c.AnomalyBlockTTL, "ANOMALY_BLOCK_TTL")
+
+	c.envInt(&c.QRSize, "QR_SIZE")
+	c.envInt(&c.QRMaxSize, "QR_MAX_SIZE")
+	c.QRErrorCorrection = env.Get("QR_ERROR_CORRECTION", c.QRErrorCorrection)
+
+	if v, ok := os.LookupEnv("AUDIT_SINKS"); ok {
+		c.AuditSinks = splitList(v)
+	}
+	sinks := make([]string, len(c.AuditSinks))
+	for i, name := range c.AuditSinks {
+		sinks[i] = strings.ToLower(name)
+	}
+	c.AuditSinks = sinks
+	c.AuditFilePath = env.Get("AUDIT_FILE_PATH", c.AuditFilePath)
+	c.envInt(&c.AuditFileMaxSizeMB, "AUDIT_FILE_MAX_SIZE_MB")
+	c.envInt(&c.AuditFileMaxBackups, "AUDIT_FILE_MAX_BACKUPS")
+	c.envInt(&c.AuditStreamMaxLen, "AUDIT_STREAM_MAXLEN")
+	c.envInt(&c.AuditSubjectMaxLen, "AUDIT_SUBJECT_MAXLEN")
+	c.envDuration(&c.AuditSubjectRetention, "AUDIT_SUBJECT_RETENTION")
+
+	if v, ok := lookup("WEBHOOK_URLS"); ok {
+		var urls map[string][]string
+		if err := json.Unmarshal([]byte(v), &urls); err != nil {
+			c.loadErrors = append(c.loadErrors, fmt.Sprintf("WEBHOOK_URLS: %v", err))
+		} else {
+			c.WebhookURLs = urls
+		}
+	}
+	c.WebhookSecret = env.Get("WEBHOOK_SECRET", c.WebhookSecret)
+	c.envInt(&c.WebhookMaxAttempts, "WEBHOOK_MAX_ATTEMPTS")
+	c.envDuration(&c.WebhookBackoff, "WEBHOOK_BACKOFF")
+	c.envDuration(&c.WebhookMaxBackoff, "WEBHOOK_MAX_BACKOFF")
+	c.envDuration(&c.WebhookTimeout, "WEBHOOK_TIMEOUT")
+	c.envDuration(&c.WebhookPollInterval, "WEBHOOK_POLL_INTERVAL")
+	c.envInt(&c.WebhookLowBackupCodes, "WEBHOOK_LOW_BACKUP_CODES")
+	c.envInt(&c.WebhookDeadLetterMax, "WEBHOOK_DEAD_LETTER_MAX")
+
+	c.envDuration(&c.ReloadInterval, "HERALD_TOTP_CONFIG_RELOAD_INTERVAL")
+	c.envDuration(&c.MetricsInventoryInterval, "METRICS_INVENTORY_INTERVAL")
+	c.TracingExporter = strings.ToLower(env.Get("TRACING_EXPORTER", c.TracingExporter))
+	c.TracingOTLPEndpoint = env.Get("TRACING_OTLP_ENDPOINT", c.TracingOTLPEndpoint)
+}
+
+// lookup returns the trimmed value of a non-empty env var.
+func lookup(key string) (string, bool) {
+	v := strings.TrimSpace(os.Getenv(key))
+	return v, v != ""
+}
+
+func (c *Config) badEnv(key, v, kind string) {
+	c.loadErrors = append(c.loadErrors, fmt.Sprintf("%s=%q is not a valid %s", key, v, kind))
 }
 
-func parseHMACKeys() error {
-	return json.Unmarshal([]byte(HMACKeysJSON), &hmacKeysMap)
+func (c *Config) envInt(dst *int, key string) {
+	if v, ok := lookup(key); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			c.badEnv(key, v, "int")
+			return
+		}
+		*dst = n
+	}
+}
+
+func (c *Config) envDuration(dst *time.Duration, key string) {
+	if v, ok := lookup(key); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			c.badEnv(key, v, "duration")
+			return
+		}
+		*dst = d
+	}
+}
+
+var (
+	current  atomic.Pointer[Config]
+	filePath string
+)
+
+func init() {
+	c, _ := Load("")
+	current.Store(c)
+}
+
+// Initialize sets the logger and loads the settings from the file named by HERALD_TOTP_CONFIG_FILE
+// (if set) and the environment. It fails when the file cannot be read or parsed.
+func Initialize(l *logger.Logger) error {
+	log = l
+	path := os.Getenv(FileEnv)
+	c, err := Load(path)
+	if err != nil {
+		return err
+	}
+	filePath = path
+	current.Store(c)
+	return nil
+}
+
+// Get returns the active settings. The result is a snapshot: reloads replace it rather than modify it.
+func Get() *Config {
+	return current.Load()
+}
+
+// Set replaces the active settings.
+func Set(c *Config) {
+	current.Store(c)
+}
+
+// Update replaces the active settings with a copy changed by fn.
+func Update(fn func(c *Config)) {
+	next := *Get()
+	fn(&next)
+	current.Store(&next)
 }
 
 // ParseBoolEnv reads an env var as bool: "true"/"1"/"yes" (case-insensitive) = true, "false"/"0"/etc = false, empty = defaultVal.
@@ -77,26 +494,68 @@ func ParseBoolEnv(key string, defaultVal bool) bool {
 	return v == "true" || v == "1" || v == "yes"
 }
 
-// GetHMACSecret returns the HMAC secret for the given key ID.
-func GetHMACSecret(keyID string) string {
-	if len(hmacKeysMap) > 0 {
+// HMACSecretFor returns the HMAC secret for the given key ID. Without a key ID the lowest configured
+// key ID is used.
+func (c *Config) HMACSecretFor(keyID string) string {
+	if len(c.HMACKeys) > 0 {
 		if keyID == "" {
-			keyID = hmacDefaultKeyID
+			keyID = sortedKeys(c.HMACKeys)[0]
+		}
+		return c.HMACKeys[keyID]
+	}
+	return c.HMACSecret
+}
+
+// AllowNoAuth returns true when no API key, HMAC or client certificate auth is set (dev only).
+func (c *Config) AllowNoAuth() bool {
+	return c.APIKey == "" && c.HMACSecret == "" && len(c.HMACKeys) == 0 && !c.MTLS()
+}
+
+// CORSPolicy is the CORS configuration of a group of routes. In CORSRoutes, nil lists inherit the
+// default policy's values; an empty AllowOrigins disables CORS on those routes.
+type CORSPolicy struct {
+	AllowOrigins     []string `json:"allow_origins"`
+	AllowMethods     []string `json:"allow_methods"`
+	AllowHeaders     []string `json:"allow_headers"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	MaxAge           int      `json:"max_age"`
+}
+
+// CORS returns the CORS policy for each route prefix, with "" for the default. It is nil when
+// CORS_ENABLED is false.
+func (c *Config) CORS() map[string]CORSPolicy {
+	if !c.CORSEnabled {
+		return nil
+	}
+	def := CORSPolicy{
+		AllowOrigins:     c.CORSAllowOrigins,
+		AllowMethods:     c.CORSAllowMethods,
+		AllowHeaders:     c.CORSAllowHeaders,
+		AllowCredentials: c.CORSAllowCredentials,
+		MaxAge:           c.CORSMaxAge,
+	}
+	out := map[string]CORSPolicy{"": def}
+	for prefix, p := range c.CORSRoutes {
+		if p.AllowOrigins == nil {
+			p.AllowOrigins = def.AllowOrigins
+		}
+		if p.AllowMethods == nil {
+			p.AllowMethods = def.AllowMethods
 		}
-		if s, ok := hmacKeysMap[keyID]; ok {
-			return s
+		if p.AllowHeaders == nil {
+			p.AllowHeaders = def.AllowHeaders
 		}
-		return ""
+		out[prefix] = p
 	}
-	return HMACSecret
+	return out
 }
 
-// HasHMACKeys returns true if multiple HMAC keys are configured.
-func HasHMACKeys() bool {
-	return len(hmacKeysMap) > 0
+// TLS reports whether the server terminates TLS itself.
+func (c *Config) TLS() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
 }
 
-// AllowNoAuth returns true when no API key or HMAC is set (dev only).
-func AllowNoAuth() bool {
-	return APIKey == "" && HMACSecret == "" && !HasHMACKeys()
+// MTLS reports whether callers can authenticate with a client certificate.
+func (c *Config) MTLS() bool {
+	return c.TLS() && c.TLSClientCAFile != ""
 }
@@ -2,7 +2,10 @@ package config
 
 import (
 	"os"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	logger "github.com/soulteary/logger-kit"
 )
@@ -15,24 +18,36 @@ func TestInitialize(t *testing.T) {
 	}
 }
 
-func TestGetHMACSecret_NoKeys(t *testing.T) {
-	// With no HERALD_TOTP_HMAC_KEYS, hmacKeysMap is empty; GetHMACSecret returns HMACSecret (env default "")
-	got := GetHMACSecret("")
-	if got != HMACSecret {
-		t.Errorf("GetHMACSecret(\"\") = %q, want %q (HMACSecret)", got, HMACSecret)
+func TestHMACSecretFor(t *testing.T) {
+	c := &Config{HMACSecret: "single"}
+	if got := c.HMACSecretFor(""); got != "single" {
+		t.Errorf("HMACSecretFor(\"\") = %q, want HMAC_SECRET", got)
 	}
-	got = GetHMACSecret("any-key")
-	if got != HMACSecret {
-		t.Errorf("GetHMACSecret(\"any-key\") = %q, want HMACSecret", got)
+	if got := c.HMACSecretFor("any-key"); got != "single" {
+		t.Errorf("HMACSecretFor(\"any-key\") = %q, want HMAC_SECRET", got)
 	}
-}
 
-func TestHasHMACKeys(t *testing.T) {
-	_ = HasHMACKeys()
+	c.HMACKeys = map[string]string{"k2": "two", "k1": "one"}
+	if got := c.HMACSecretFor("k2"); got != "two" {
+		t.Errorf("HMACSecretFor(\"k2\") = %q, want two", got)
+	}
+	if got := c.HMACSecretFor(""); got != "one" {
+		t.Errorf("HMACSecretFor(\"\") = %q, want the lowest key ID's secret", got)
+	}
+	if got := c.HMACSecretFor("k3"); got != "" {
+		t.Errorf("HMACSecretFor(\"k3\") = %q, want empty", got)
+	}
 }
 
 func TestAllowNoAuth(t *testing.T) {
-	_ = AllowNoAuth()
+	c := Defaults()
+	if !c.AllowNoAuth() {
+		t.Error("AllowNoAuth() = false with no credentials")
+	}
+	c.APIKey = "key"
+	if c.AllowNoAuth() {
+		t.Error("AllowNoAuth() = true with API_KEY set")
+	}
 }
 
 func TestParseBoolEnv(t *testing.T) {
@@ -69,3 +84,146 @@ func TestParseBoolEnv(t *testing.T) {
 		t.Errorf("ParseBoolEnv(space, true) = false, want true")
 	}
 }
+
+func validConfig() *Config {
+	return &Config{
+		Mode: ModeProduction, LogLevel: "info", RedisAddr: "localhost:6379",
+		TOTPPeriod: 30, TOTPDigits: 6, HOTPLookAhead: 10, HOTPResyncWindow: 100,
+		EnrollTTL: 10 * time.Minute, MaxPendingEnrollments: 3, ReenrollPolicy: ReenrollRequireCode, MaxCredentialsPerSubject: 5, BackupCodeCount: 10, TLSClientAuth: "request", CORSEnabled: true,
+		EncryptionKey: "0123456789abcdef0123456789abcdef", HMACSecret: "hmac-secret-0123456789abcdef0123",
+		RateLimitPerSubject: 20, RateLimitPerIP: 30, QRSize: 256, QRMaxSize: 1024, QRErrorCorrection: "M",
+		AuditSinks: []string{"redis"}, AuditStreamMaxLen: 1000, AuditSubjectMaxLen: 100,
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		want   []string // substrings of the expected problems, in order
+	}{
+		{"valid", func(c *Config) {}, nil},
+		{"digits", func(c *Config) { c.TOTPDigits = 7 }, []string{"TOTP_DIGITS must be 6 or 8"}},
+		{"zero period and ttl", func(c *Config) { c.TOTPPeriod = 0; c.EnrollTTL = 0 }, []string{"TOTP_PERIOD", "ENROLL_TTL"}},
+		{"unknown mode", func(c *Config) { c.Mode = "staging" }, []string{"HERALD_TOTP_MODE"}},
+		{"policy and sink", func(c *Config) { c.ReenrollPolicy = "x"; c.AuditSinks = []string{"kafka"} }, []string{"REENROLL_POLICY", "AUDIT_SINKS"}},
+		{"qr", func(c *Config) { c.QRSize = 2048; c.QRErrorCorrection = "Z" }, []string{"QR_SIZE", "QR_ERROR_CORRECTION"}},
+		{"grpc port", func(c *Config) { c.Port, c.GRPCPort = ":8084", "8084" }, []string{"GRPC_PORT must differ from PORT"}},
+		{"tracing", func(c *Config) { c.TracingExporter, c.TracingOTLPEndpoint = "jaeger", "otel-collector:4318" }, []string{"TRACING_EXPORTER", "TRACING_OTLP_ENDPOINT"}},
+		{"anomaly", func(c *Config) { c.AnomalyReplays = -1; c.AnomalySubjectIPs = 5; c.AnomalyBlockTTL = -time.Minute }, []string{"ANOMALY_REPLAYS", "ANOMALY_WINDOW", "ANOMALY_BLOCK_TTL"}},
+		{"webhook without secret", func(c *Config) {
+			c.Mode = ModeDevelopment
+			c.WebhookURLs = map[string][]string{"enrolled": {"https://a.example/hook"}}
+			c.WebhookMaxAttempts, c.WebhookBackoff, c.WebhookMaxBackoff = 8, time.Second, time.Hour
+			c.WebhookTimeout, c.WebhookPollInterval = time.Second, time.Second
+		}, []string{"WEBHOOK_SECRET"}},
+		{"pskc key", func(c *Config) { c.PSKCPreSharedKey = "abcd" }, []string{"PSKC_PRESHARED_KEY"}},
+		{"load errors first", func(c *Config) { c.loadErrors = []string{"HERALD_TOTP_HMAC_KEYS: bad"}; c.TOTPDigits = 9 }, []string{"HERALD_TOTP_HMAC_KEYS", "TOTP_DIGITS"}},
+		{"production no auth", func(c *Config) { c.HMACSecret = "" }, []string{"not authenticated"}},
+		{"production short keys", func(c *Config) { c.EncryptionKey = "short"; c.APIKey = "k" }, []string{"HERALD_TOTP_ENCRYPTION_KEY", "API_KEY"}},
+		{"production wildcard cors", func(c *Config) { c.CORSAllowOrigins = []string{"https://a.example", "*"} }, []string{"CORS_ALLOW_ORIGINS"}},
+		{"tls", func(c *Config) {
+			c.TLSCertFile = "server.pem"
+			c.TLSClientAuth = "always"
+			c.TLSIdentities = map[string]string{"serial:01": "x", "cn:stargate": "stargate"}
+		}, []string{"TLS_CERT_FILE and TLS_KEY_FILE", "TLS_CLIENT_AUTH", `key "serial:01"`}},
+		{"admin", func(c *Config) {
+			c.APIKey, c.AdminAPIKey = "api-key-0123456789", "api-key-0123456789"
+			c.AdminIdentities = []string{"ops"}
+		}, []string{"ADMIN_API_KEY must differ from API_KEY", "ADMIN_IDENTITIES needs TLS_CLIENT_CA_FILE"}},
+		{"production short admin key", func(c *Config) { c.AdminAPIKey = "k" }, []string{"ADMIN_API_KEY must be at least"}},
+		{"production mtls only", func(c *Config) {
+			c.HMACSecret = ""
+			c.TLSCertFile, c.TLSKeyFile, c.TLSClientCAFile = "server.pem", "server-key.pem", "ca.pem"
+		}, nil},
+		{"cors credentials with any origin", func(c *Config) {
+			c.Mode = ModeDevelopment
+			c.CORSAllowOrigins = []string{"*"}
+			c.CORSAllowCredentials = true
+			c.CORSRoutes = map[string]CORSPolicy{"healthz": {AllowOrigins: []string{"https://a.example"}}}
+		}, []string{"CORS_ALLOW_CREDENTIALS", `route "healthz"`}},
+		{"production public route may allow any origin", func(c *Config) {
+			c.CORSRoutes = map[string]CORSPolicy{"/healthz": {AllowOrigins: []string{"*"}}}
+		}, nil},
+		{"production wildcard cors on api route", func(c *Config) {
+			c.CORSRoutes = map[string]CORSPolicy{"/v1/status": {AllowOrigins: []string{"*"}}}
+		}, []string{`CORS_ROUTES "/v1/status"`}},
+		{"production short hmac key", func(c *Config) { c.HMACKeys = map[string]string{"k1": "short"} }, []string{`key "k1"`}},
+		{"development allows insecure", func(c *Config) {
+			c.Mode = ModeDevelopment
+			c.HMACSecret = ""
+			c.EncryptionKey = ""
+			c.CORSAllowOrigins = []string{"*"}
+		}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := validConfig()
+			tt.modify(c)
+			err := c.Validate()
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			verr, ok := err.(*ValidationError)
+			if !ok {
+				t.Fatalf("Validate() = %v, want *ValidationError", err)
+			}
+			if len(verr.Problems) != len(tt.want) {
+				t.Fatalf("problems = %q, want %d", verr.Problems, len(tt.want))
+			}
+			for i, sub := range tt.want {
+				if !strings.Contains(verr.Problems[i], sub) {
+					t.Errorf("problem %d = %q, want it to mention %q", i, verr.Problems[i], sub)
+				}
+			}
+		})
+	}
+}
+
+func TestLoad_ReportsUnparsableEnv(t *testing.T) {
+	t.Setenv("TOTP_DIGITS", "eight")
+	t.Setenv("WEBHOOK_BACKOFF", "5")
+	c, err := Load("")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(c.loadErrors) != 2 || !strings.Contains(c.loadErrors[0], "TOTP_DIGITS") || !strings.Contains(c.loadErrors[1], "WEBHOOK_BACKOFF") {
+		t.Errorf("loadErrors = %q", c.loadErrors)
+	}
+}
+
+func TestLoad_CORSDefaults(t *testing.T) {
+	t.Setenv("HERALD_TOTP_MODE", ModeDevelopment)
+	if c, _ := Load(""); !slices.Equal(c.CORSAllowOrigins, []string{"*"}) {
+		t.Errorf("development origins = %q, want [*]", c.CORSAllowOrigins)
+	}
+	t.Setenv("HERALD_TOTP_MODE", ModeProduction)
+	if c, _ := Load(""); len(c.CORSAllowOrigins) != 0 || len(c.CORS()[""].AllowOrigins) != 0 {
+		t.Errorf("production origins = %q, want none", c.CORSAllowOrigins)
+	}
+
+	t.Setenv("HERALD_TOTP_MODE", ModeDevelopment)
+	t.Setenv("CORS_ALLOW_ORIGINS", "")
+	if c, _ := Load(""); c.CORSAllowOrigins == nil || len(c.CORSAllowOrigins) != 0 {
+		t.Errorf("explicitly empty origins = %#v, want an empty list", c.CORSAllowOrigins)
+	}
+
+	t.Setenv("CORS_ALLOW_ORIGINS", "https://a.example")
+	t.Setenv("CORS_ROUTES", `{"/healthz":{"allow_origins":["*"],"allow_methods":["GET"]},"/v1/audit":{}}`)
+	c, _ := Load("")
+	cors := c.CORS()
+	if hz := cors["/healthz"]; !slices.Equal(hz.AllowOrigins, []string{"*"}) || !slices.Equal(hz.AllowMethods, []string{"GET"}) || !slices.Equal(hz.AllowHeaders, c.CORSAllowHeaders) {
+		t.Errorf("/healthz policy = %+v", hz)
+	}
+	if audit := cors["/v1/audit"]; !slices.Equal(audit.AllowOrigins, []string{"https://a.example"}) {
+		t.Errorf("/v1/audit policy = %+v, want the default origins", audit)
+	}
+
+	t.Setenv("CORS_ENABLED", "false")
+	if c, _ := Load(""); c.CORS() != nil {
+		t.Errorf("CORS() with CORS_ENABLED=false = %v", c.CORS())
+	}
+}
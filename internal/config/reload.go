@@ -0,0 +1,98 @@
+package config
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+)
+
+// reloadable lists the settings a reload applies. The others are read once at startup (listen address,
+// Redis, audit and webhook wiring, keys that protect stored data) and only change on restart.
+var reloadable = []string{
+	"LogLevel",
+	"RateLimitPerSubject", "RateLimitPerIP",
+	"AnomalyWindow", "AnomalyIPSubjects", "AnomalySubjectIPs", "AnomalyReplays", "AnomalyBlockTTL",
+	"APIKey", "HMACSecret", "HMACKeys", "TLSIdentities", "AdminAPIKey", "AdminIdentities",
+	"BackupCodeCount",
+}
+
+// ReloadResult reports what Reload changed.
+type ReloadResult struct {
+	Applied         []string // reloadable settings whose value changed
+	RestartRequired []string // other settings that differ from the running ones; ignored until restart
+}
+
+// Reload loads the config file and environment again and atomically applies the reloadable settings.
+// Nothing changes when loading fails or the resulting settings do not validate.
+func Reload() (*ReloadResult, error) {
+	loaded, err := Load(filePath)
+	if err != nil {
+		return nil, err
+	}
+	cur := Get()
+	next := *cur
+	nv, lv, cv := reflect.ValueOf(&next).Elem(), reflect.ValueOf(loaded).Elem(), reflect.ValueOf(cur).Elem()
+	res := &ReloadResult{}
+	isReloadable := make(map[string]bool, len(reloadable))
+	for _, name := range reloadable {
+		isReloadable[name] = true
+		if !reflect.DeepEqual(lv.FieldByName(name).Interface(), cv.FieldByName(name).Interface()) {
+			nv.FieldByName(name).Set(lv.FieldByName(name))
+			res.Applied = append(res.Applied, name)
+		}
+	}
+	t := cv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() || isReloadable[f.Name] {
+			continue
+		}
+		if !reflect.DeepEqual(lv.Field(i).Interface(), cv.Field(i).Interface()) {
+			res.RestartRequired = append(res.RestartRequired, f.Name)
+		}
+	}
+	next.loadErrors = loaded.loadErrors
+	if err := next.Validate(); err != nil {
+		return nil, err
+	}
+	next.loadErrors = nil
+	current.Store(&next)
+	return res, nil
+}
+
+// Watch calls Reload on SIGHUP and, when a config file is in use, whenever its modification time or size
+// changes (checked every ReloadInterval). onReload receives each outcome. It returns when ctx is done.
+func Watch(ctx context.Context, onReload func(*ReloadResult, error)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	var lastMod time.Time
+	var lastSize int64
+	if interval := Get().ReloadInterval; filePath != "" && interval > 0 {
+		if fi, err := os.Stat(filePath); err == nil {
+			lastMod, lastSize = fi.ModTime(), fi.Size()
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-tick:
+			fi, err := os.Stat(filePath)
+			if err != nil || (fi.ModTime().Equal(lastMod) && fi.Size() == lastSize) {
+				continue
+			}
+			lastMod, lastSize = fi.ModTime(), fi.Size()
+		}
+		onReload(Reload())
+	}
+}
@@ -0,0 +1,144 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	logger "github.com/soulteary/logger-kit"
+)
+
+// useConfigFile writes data to a temp config file and initializes config from it.
+func useConfigFile(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "herald-totp.json")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(FileEnv, path)
+	old := Get()
+	t.Cleanup(func() {
+		filePath = ""
+		Set(old)
+	})
+	if err := Initialize(logger.New(logger.Config{Level: logger.Disabled})); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+	return path
+}
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoad_FileThenEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "c.json")
+	writeFile(t, path, `{"port":":9000","rate_limit_per_ip":7,"enroll_ttl":"2m","herald_totp_hmac_keys":{"k1":"s1"}}`)
+	t.Setenv("RATE_LIMIT_PER_IP", "9")
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if c.Port != ":9000" || c.RateLimitPerIP != 9 || c.EnrollTTL != 2*time.Minute || c.HMACKeys["k1"] != "s1" {
+		t.Errorf("Load = port %q, rate/ip %d, ttl %s, keys %v", c.Port, c.RateLimitPerIP, c.EnrollTTL, c.HMACKeys)
+	}
+	if c.TOTPDigits != 6 {
+		t.Errorf("TOTPDigits = %d, want the default", c.TOTPDigits)
+	}
+
+	for _, bad := range []string{`{"rate_limit_per_ipp":7}`, `{"enroll_ttl":600}`, `{"port":`} {
+		writeFile(t, path, bad)
+		if _, err := Load(path); err == nil {
+			t.Errorf("Load(%s) = nil error", bad)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := useConfigFile(t, `{"rate_limit_per_ip":7,"api_key":"old-key"}`)
+	if Get().RateLimitPerIP != 7 || Get().APIKey != "old-key" {
+		t.Fatalf("initial config = %+v", Get())
+	}
+	before := Get()
+
+	writeFile(t, path, `{"rate_limit_per_ip":8,"api_key":"new-key","backup_code_count":5,"port":":9999"}`)
+	res, err := Reload()
+	if err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if want := []string{"RateLimitPerIP", "APIKey", "BackupCodeCount"}; !reflect.DeepEqual(res.Applied, want) {
+		t.Errorf("Applied = %v, want %v", res.Applied, want)
+	}
+	if !reflect.DeepEqual(res.RestartRequired, []string{"Port"}) {
+		t.Errorf("RestartRequired = %v, want [Port]", res.RestartRequired)
+	}
+	c := Get()
+	if c.RateLimitPerIP != 8 || c.APIKey != "new-key" || c.BackupCodeCount != 5 || c.Port != before.Port {
+		t.Errorf("after reload = rate/ip %d, api key %q, backup codes %d, port %q", c.RateLimitPerIP, c.APIKey, c.BackupCodeCount, c.Port)
+	}
+	if before.RateLimitPerIP != 7 {
+		t.Error("reload modified the previous snapshot")
+	}
+
+	// An invalid file keeps the running settings.
+	writeFile(t, path, `{"rate_limit_per_ip":9,"backup_code_count":0}`)
+	if _, err := Reload(); err == nil || !strings.Contains(err.Error(), "BACKUP_CODE_COUNT") {
+		t.Errorf("Reload with bad backup_code_count = %v", err)
+	}
+	writeFile(t, path, `{"rate_limit_per_ip":`)
+	if _, err := Reload(); err == nil {
+		t.Error("Reload with unparsable file = nil error")
+	}
+	if Get() != c {
+		t.Error("failed reload replaced the settings")
+	}
+}
+
+func TestWatch_FileChange(t *testing.T) {
+	path := useConfigFile(t, `{"herald_totp_config_reload_interval":"10ms","rate_limit_per_subject":3}`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := make(chan *ReloadResult, 1)
+	done := make(chan struct{})
+	go func() {
+		Watch(ctx, func(res *ReloadResult, err error) {
+			if err != nil {
+				return
+			}
+			select {
+			case results <- res:
+			default:
+			}
+		})
+		close(done)
+	}()
+
+	// Watch records the file's state when it starts, so keep rewriting until a change is picked up.
+	deadline := time.After(2 * time.Second)
+	for n := 40; ; n++ {
+		writeFile(t, path, fmt.Sprintf(`{"herald_totp_config_reload_interval":"10ms","rate_limit_per_subject":%d}`, n))
+		select {
+		case res := <-results:
+			if !reflect.DeepEqual(res.Applied, []string{"RateLimitPerSubject"}) || Get().RateLimitPerSubject < 40 {
+				t.Errorf("Applied = %v, RateLimitPerSubject = %d", res.Applied, Get().RateLimitPerSubject)
+			}
+		case <-time.After(50 * time.Millisecond):
+			continue
+		case <-deadline:
+			t.Fatal("no reload after the file changed")
+		}
+		break
+	}
+	cancel()
+	<-done
+}
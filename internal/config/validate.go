@@ -0,0 +1,266 @@
+package config
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Minimum lengths below which a secret counts as insecure.
+const (
+	minEncryptionKeyLen = 32
+	minHMACSecretLen    = 32
+	minAPIKeyLen        = 16
+)
+
+// ValidationError lists every problem found by Validate.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration: " + strings.Join(e.Problems, "; ")
+}
+
+// Validate checks every setting and returns a *ValidationError listing all problems, or nil.
+// In production mode the settings reported by Insecure are problems too.
+func (c *Config) Validate() error {
+	p := append([]string(nil), c.loadErrors...)
+	bad := func(format string, args ...any) { p = append(p, fmt.Sprintf(format, args...)) }
+
+	switch c.Mode {
+	case ModeProduction:
+		p = append(p, c.Insecure()...)
+	case ModeDevelopment:
+	default:
+		bad("HERALD_TOTP_MODE %q must be production or development", c.Mode)
+	}
+	switch strings.ToLower(c.LogLevel) {
+	case "trace", "debug", "info", "warn", "error", "fatal", "panic", "disabled":
+	default:
+		bad("LOG_LEVEL %q is not a log level", c.LogLevel)
+	}
+	if c.GRPCPort != "" && strings.TrimPrefix(c.GRPCPort, ":") == strings.TrimPrefix(c.Port, ":") {
+		bad("GRPC_PORT must differ from PORT")
+	}
+	if c.RedisAddr == "" || c.RedisDB < 0 {
+		bad("REDIS_ADDR must be set and REDIS_DB must be >= 0")
+	}
+
+	if c.TOTPPeriod <= 0 {
+		bad("TOTP_PERIOD must be positive, got %d", c.TOTPPeriod)
+	}
+	if c.TOTPDigits != 6 && c.TOTPDigits != 8 {
+		bad("TOTP_DIGITS must be 6 or 8, got %d", c.TOTPDigits)
+	}
+	if c.HOTPLookAhead < 0 {
+		bad("HOTP_LOOK_AHEAD must be >= 0, got %d", c.HOTPLookAhead)
+	}
+	if c.HOTPResyncWindow < 1 {
+		bad("HOTP_RESYNC_WINDOW must be >= 1, got %d", c.HOTPResyncWindow)
+	}
+	if c.EnrollTTL <= 0 {
+		bad("ENROLL_TTL must be positive, got %s", c.EnrollTTL)
+	}
+	if c.MaxPendingEnrollments < 1 {
+		bad("MAX_PENDING_ENROLLMENTS must be >= 1, got %d", c.MaxPendingEnrollments)
+	}
+	switch c.ReenrollPolicy {
+	case ReenrollReject, ReenrollRequireCode, ReenrollAdd:
+	default:
+		bad("REENROLL_POLICY %q must be reject, require_code or add", c.ReenrollPolicy)
+	}
+	if c.BackupCodeCount < 1 || c.BackupCodeCount > 100 {
+		bad("BACKUP_CODE_COUNT must be between 1 and 100, got %d", c.BackupCodeCount)
+	}
+	if c.MaxCredentialsPerSubject < 1 {
+		bad("MAX_CREDENTIALS_PER_SUBJECT must be >= 1, got %d", c.MaxCredentialsPerSubject)
+	}
+
+	if c.TransferKey != "" && len(c.TransferKey) < minEncryptionKeyLen {
+		bad("HERALD_TOTP_TRANSFER_KEY must be at least %d bytes", minEncryptionKeyLen)
+	}
+	if c.PSKCPreSharedKey != "" {
+		key, err := hex.DecodeString(c.PSKCPreSharedKey)
+		if err != nil || (len(key) != 16 && len(key) != 24 && len(key) != 32) {
+			bad("PSKC_PRESHARED_KEY must be 16, 24 or 32 bytes of hex")
+		}
+	}
+
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		bad("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if c.TLSClientCAFile != "" && !c.TLS() {
+		bad("TLS_CLIENT_CA_FILE needs TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+	if c.TLSClientAuth != "request" && c.TLSClientAuth != "require" {
+		bad("TLS_CLIENT_AUTH %q must be request or require", c.TLSClientAuth)
+	}
+	for _, key := range sortedKeys(c.TLSIdentities) {
+		field, value, _ := strings.Cut(key, ":")
+		if value == "" || (field != "uri" && field != "dns" && field != "email" && field != "cn") {
+			bad("TLS_IDENTITIES: key %q must be uri:, dns:, email: or cn: followed by a value", key)
+		}
+	}
+	if c.AdminAPIKey != "" && c.AdminAPIKey == c.APIKey {
+		bad("ADMIN_API_KEY must differ from API_KEY")
+	}
+	if len(c.AdminIdentities) > 0 && !c.MTLS() {
+		bad("ADMIN_IDENTITIES needs TLS_CLIENT_CA_FILE")
+	}
+
+	cors := c.CORS()
+	for _, prefix := range sortedKeys(cors) {
+		name := "CORS_ALLOW_CREDENTIALS"
+		if prefix != "" {
+			if !strings.HasPrefix(prefix, "/") {
+				bad("CORS_ROUTES: route %q must start with /", prefix)
+			}
+			name = fmt.Sprintf("CORS_ROUTES %q allow_credentials", prefix)
+		}
+		p := cors[prefix]
+		if p.AllowCredentials && slices.Contains(p.AllowOrigins, "*") {
+			bad("%s cannot be used with origin *", name)
+		}
+		if p.MaxAge < 0 {
+			bad("CORS max age must not be negative")
+		}
+	}
+
+	if c.RateLimitPerSubject <= 0 || c.RateLimitPerIP <= 0 {
+		bad("RATE_LIMIT_PER_SUBJECT and RATE_LIMIT_PER_IP must be positive")
+	}
+	if c.AnomalyIPSubjects < 0 || c.AnomalySubjectIPs < 0 || c.AnomalyReplays < 0 {
+		bad("ANOMALY_IP_SUBJECTS, ANOMALY_SUBJECT_IPS and ANOMALY_REPLAYS must not be negative")
+	}
+	if (c.AnomalyIPSubjects > 0 || c.AnomalySubjectIPs > 0 || c.AnomalyReplays > 0) && c.AnomalyWindow <= 0 {
+		bad("ANOMALY_WINDOW must be positive when an anomaly threshold is set")
+	}
+	if c.AnomalyBlockTTL < 0 {
+		bad("ANOMALY_BLOCK_TTL must not be negative")
+	}
+	if c.QRMaxSize <= 0 || c.QRSize <= 0 || c.QRSize > c.QRMaxSize {
+		bad("QR_SIZE must be between 1 and QR_MAX_SIZE (%d), got %d", c.QRMaxSize, c.QRSize)
+	}
+	switch strings.ToUpper(c.QRErrorCorrection) {
+	case "L", "M", "Q", "H":
+	default:
+		bad("QR_ERROR_CORRECTION %q must be L, M, Q or H", c.QRErrorCorrection)
+	}
+
+	for _, name := range c.AuditSinks {
+		switch name {
+		case "stdout", "redis":
+		case "file":
+			if c.AuditFilePath == "" || c.AuditFileMaxSizeMB <= 0 || c.AuditFileMaxBackups < 0 {
+				bad("AUDIT_FILE_PATH must be set and AUDIT_FILE_MAX_SIZE_MB positive for the file audit sink")
+			}
+		default:
+			bad("AUDIT_SINKS: unknown sink %q (want stdout, file or redis)", name)
+		}
+	}
+	if c.AuditStreamMaxLen <= 0 || c.AuditSubjectMaxLen <= 0 {
+		bad("AUDIT_STREAM_MAXLEN and AUDIT_SUBJECT_MAXLEN must be positive")
+	}
+	if c.AuditSubjectRetention < 0 {
+		bad("AUDIT_SUBJECT_RETENTION must not be negative")
+	}
+
+	if len(c.WebhookURLs) > 0 {
+		if c.WebhookSecret == "" {
+			bad("WEBHOOK_SECRET is required with WEBHOOK_URLS; webhook payloads are always signed")
+		}
+		if c.WebhookMaxAttempts < 1 {
+			bad("WEBHOOK_MAX_ATTEMPTS must be >= 1, got %d", c.WebhookMaxAttempts)
+		}
+		if c.WebhookBackoff <= 0 || c.WebhookMaxBackoff < c.WebhookBackoff {
+			bad("WEBHOOK_BACKOFF must be positive and not above WEBHOOK_MAX_BACKOFF")
+		}
+		if c.WebhookTimeout <= 0 || c.WebhookPollInterval <= 0 {
+			bad("WEBHOOK_TIMEOUT and WEBHOOK_POLL_INTERVAL must be positive")
+		}
+	}
+
+	if c.ReloadInterval < 0 {
+		bad("HERALD_TOTP_CONFIG_RELOAD_INTERVAL must not be negative")
+	}
+	if c.MetricsInventoryInterval < 0 {
+		bad("METRICS_INVENTORY_INTERVAL must not be negative")
+	}
+	switch c.TracingExporter {
+	case "", "none", "stdout", "otlp":
+	default:
+		bad("TRACING_EXPORTER %q must be none, stdout or otlp", c.TracingExporter)
+	}
+	if c.TracingOTLPEndpoint != "" {
+		if u, err := url.Parse(c.TracingOTLPEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			bad("TRACING_OTLP_ENDPOINT %q must be an http or https URL", c.TracingOTLPEndpoint)
+		}
+	}
+
+	if len(p) > 0 {
+		return &ValidationError{Problems: p}
+	}
+	return nil
+}
+
+// Insecure lists settings that are acceptable for local development but not in production.
+func (c *Config) Insecure() []string {
+	var out []string
+	if len(c.EncryptionKey) < minEncryptionKeyLen {
+		out = append(out, fmt.Sprintf("HERALD_TOTP_ENCRYPTION_KEY must be at least %d bytes", minEncryptionKeyLen))
+	}
+	if c.AllowNoAuth() {
+		out = append(out, "no API_KEY, HMAC_SECRET, HERALD_TOTP_HMAC_KEYS or TLS_CLIENT_CA_FILE set; requests are not authenticated")
+	}
+	if c.APIKey != "" && len(c.APIKey) < minAPIKeyLen {
+		out = append(out, fmt.Sprintf("API_KEY must be at least %d bytes", minAPIKeyLen))
+	}
+	if c.AdminAPIKey != "" && len(c.AdminAPIKey) < minAPIKeyLen {
+		out = append(out, fmt.Sprintf("ADMIN_API_KEY must be at least %d bytes", minAPIKeyLen))
+	}
+	if c.HMACSecret != "" && len(c.HMACSecret) < minHMACSecretLen {
+		out = append(out, fmt.Sprintf("HMAC_SECRET must be at least %d bytes", minHMACSecretLen))
+	}
+	for _, keyID := range sortedKeys(c.HMACKeys) {
+		if len(c.HMACKeys[keyID]) < minHMACSecretLen {
+			out = append(out, fmt.Sprintf("HERALD_TOTP_HMAC_KEYS: secret for key %q must be at least %d bytes", keyID, minHMACSecretLen))
+		}
+	}
+	cors := c.CORS()
+	for _, prefix := range sortedKeys(cors) {
+		// Public routes such as /healthz may allow any origin; the API must not.
+		if !slices.Contains(cors[prefix].AllowOrigins, "*") || !(prefix == "" || prefix == "/" || strings.HasPrefix(prefix, "/v1")) {
+			continue
+		}
+		if prefix == "" {
+			out = append(out, "CORS_ALLOW_ORIGINS allows any origin (*)")
+		} else {
+			out = append(out, fmt.Sprintf("CORS_ROUTES %q allows any origin (*)", prefix))
+		}
+	}
+	return out
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// splitList splits a comma-separated setting, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,104 @@
+package grpcapi
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/subtle"
+	"crypto/x509"
+	"net/http"
+	"strconv"
+	"time"
+
+	middlewarekit "github.com/soulteary/middleware-kit"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/soulteary/herald-totp/internal/config"
+	"github.com/soulteary/herald-totp/internal/tlsauth"
+	"github.com/soulteary/herald-totp/pkg/totpservice"
+)
+
+// maxTimeDrift is how far an HMAC timestamp may be from now, as in CombinedAuth.
+const maxTimeDrift = 5 * time.Minute
+
+// authenticate applies the HTTP API's auth to an RPC, in the same order as the /v1 middleware: a
+// verified client certificate mapped by TLS_IDENTITIES, then an HMAC signature over the request
+// message, then the API key. The handler runs with the caller in its context.
+func (s *Server) authenticate(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	identity, apiErr := s.identify(ctx, md, req)
+	if apiErr != nil {
+		return nil, statusError(apiErr)
+	}
+	return handler(context.WithValue(ctx, callerKey{}, newCaller(ctx, md, identity)), req)
+}
+
+// identify checks the credentials of an RPC. It returns the mTLS identity, or "" for other callers.
+func (s *Server) identify(ctx context.Context, md metadata.MD, req any) (string, *totpservice.Error) {
+	cfg := s.config()
+	if cert := peerCertificate(ctx); cfg.MTLS() && cert != nil {
+		id, err := tlsauth.Identify(cert, cfg.TLSIdentities)
+		if err != nil {
+			s.log.Warn().Str("cn", cert.Subject.CommonName).Msg("mTLS: " + err.Error())
+			return "", &totpservice.Error{Status: http.StatusUnauthorized, Reason: "certificate_unknown", Message: err.Error()}
+		}
+		return id, nil
+	}
+	if validHMAC(md, req, cfg) {
+		return "", nil
+	}
+	if key := first(md, "x-api-key"); cfg.APIKey != "" && key != "" &&
+		subtle.ConstantTimeCompare([]byte(key), []byte(cfg.APIKey)) == 1 {
+		return "", nil
+	}
+	if cfg.AllowNoAuth() {
+		return "", nil
+	}
+	return "", &totpservice.Error{Status: http.StatusUnauthorized, Reason: "unauthorized"}
+}
+
+// peerCertificate returns the verified client certificate of an RPC over TLS, or nil.
+func peerCertificate(ctx context.Context) *x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 {
+		return nil
+	}
+	return info.State.VerifiedChains[0][0]
+}
+
+// validHMAC checks x-signature over "timestamp:service:message" with the secret of x-key-id. The
+// message is req serialized again, with its fields in field-number order as clients write it.
+func validHMAC(md metadata.MD, req any, cfg *config.Config) bool {
+	signature, timestamp := first(md, "x-signature"), first(md, "x-timestamp")
+	if signature == "" || timestamp == "" {
+		return false
+	}
+	secret := cfg.HMACSecretFor(first(md, "x-key-id"))
+	if secret == "" {
+		return false
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if drift := time.Since(time.Unix(ts, 0)).Abs(); drift > maxTimeDrift {
+		return false
+	}
+	m, ok := req.(proto.Message)
+	if !ok {
+		return false
+	}
+	msg, err := proto.MarshalOptions{Deterministic: true}.Marshal(m)
+	if err != nil {
+		return false
+	}
+	expected := middlewarekit.ComputeHMAC(timestamp, first(md, "x-service"), string(msg), secret)
+	return hmac.Equal([]byte(signature), []byte(expected))
+}
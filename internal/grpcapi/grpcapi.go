@@ -0,0 +1,228 @@
+package grpcapi
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	logger "github.com/soulteary/logger-kit"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	grpccodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/soulteary/herald-totp/internal/config"
+	"github.com/soulteary/herald-totp/internal/grpcpb"
+	"github.com/soulteary/herald-totp/internal/tracing"
+	"github.com/soulteary/herald-totp/pkg/totpservice"
+)
+
+// ErrorDomain is the ErrorInfo domain of the API's error reasons.
+const ErrorDomain = "herald-totp"
+
+// maxMessageSize bounds a single request message.
+const maxMessageSize = 1 << 20
+
+// Server is the gRPC API. Each RPC makes the same service call as its HTTP route; the interceptors
+// of GRPCServer trace, measure and authenticate every call first.
+type Server struct {
+	grpcpb.UnimplementedTOTPServiceServer
+
+	svc     *totpservice.Service
+	config  func() *config.Config
+	log     *logger.Logger
+	metrics *totpservice.Metrics
+}
+
+// New returns the gRPC API over svc, authenticating callers with the current settings from cfg.
+func New(svc *totpservice.Service, cfg func() *config.Config, log *logger.Logger) *Server {
+	return &Server{svc: svc, config: cfg, log: log, metrics: svc.Metrics()}
+}
+
+// GRPCServer returns a grpc.Server serving s. creds secures the listener, e.g.
+// credentials.NewTLS(certs.TLSConfig("h2")); nil serves cleartext HTTP/2 (h2c).
+func (s *Server) GRPCServer(creds credentials.TransportCredentials) *grpc.Server {
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(s.observe, s.authenticate),
+		grpc.MaxRecvMsgSize(maxMessageSize),
+	}
+	if creds != nil {
+		opts = append(opts, grpc.Creds(creds))
+	}
+	srv := grpc.NewServer(opts...)
+	grpcpb.RegisterTOTPServiceServer(srv, s)
+	return srv
+}
+
+// EnrollStart implements grpcpb.TOTPServiceServer.
+func (s *Server) EnrollStart(ctx context.Context, in *grpcpb.EnrollStartRequest) (*grpcpb.EnrollStartResponse, error) {
+	resp, apiErr := s.svc.StartEnrollment(ctx, callerFrom(ctx), totpservice.EnrollStartRequest{
+		Subject: in.GetSubject(), Label: in.GetLabel(), Type: in.GetType(),
+		QRFormat: in.GetQrFormat(), QRSize: int(in.GetQrSize()), QRLevel: in.GetQrLevel(),
+	})
+	if apiErr != nil {
+		return nil, statusError(apiErr)
+	}
+	return &grpcpb.EnrollStartResponse{
+		EnrollId: resp.EnrollID, SecretBase32: resp.SecretBase32, OtpauthUri: resp.OtpauthURI, QrCode: resp.QRCode,
+	}, nil
+}
+
+// EnrollConfirm implements grpcpb.TOTPServiceServer.
+func (s *Server) EnrollConfirm(ctx context.Context, in *grpcpb.EnrollConfirmRequest) (*grpcpb.EnrollConfirmResponse, error) {
+	resp, apiErr := s.svc.ConfirmEnrollment(ctx, callerFrom(ctx), totpservice.EnrollConfirmRequest{
+		EnrollID: in.GetEnrollId(), Code: in.GetCode(), CurrentCode: in.GetCurrentCode(),
+	})
+	if apiErr != nil {
+		return nil, statusError(apiErr)
+	}
+	return &grpcpb.EnrollConfirmResponse{
+		Subject: resp.Subject, TotpEnabled: resp.TotpEnabled, BackupCodes: resp.BackupCodes,
+	}, nil
+}
+
+// Verify implements grpcpb.TOTPServiceServer.
+func (s *Server) Verify(ctx context.Context, in *grpcpb.VerifyRequest) (*grpcpb.VerifyResponse, error) {
+	resp, apiErr := s.svc.Verify(ctx, callerFrom(ctx), totpservice.VerifyRequest{
+		Subject: in.GetSubject(), Code: in.GetCode(), ChallengeID: in.GetChallengeId(),
+	})
+	if apiErr != nil {
+		return nil, statusError(apiErr)
+	}
+	return &grpcpb.VerifyResponse{Ok: resp.OK, Subject: resp.Subject, Amr: resp.AMR, IssuedAt: resp.IssuedAt}, nil
+}
+
+// Revoke implements grpcpb.TOTPServiceServer.
+func (s *Server) Revoke(ctx context.Context, in *grpcpb.SubjectRequest) (*grpcpb.RevokeResponse, error) {
+	resp, apiErr := s.svc.Revoke(ctx, callerFrom(ctx), totpservice.RevokeRequest{Subject: in.GetSubject()})
+	if apiErr != nil {
+		return nil, statusError(apiErr)
+	}
+	return &grpcpb.RevokeResponse{Ok: resp.OK, Subject: resp.Subject}, nil
+}
+
+// Status implements grpcpb.TOTPServiceServer.
+func (s *Server) Status(ctx context.Context, in *grpcpb.SubjectRequest) (*grpcpb.StatusResponse, error) {
+	resp, apiErr := s.svc.Status(ctx, in.GetSubject())
+	if apiErr != nil {
+		return nil, statusError(apiErr)
+	}
+	return &grpcpb.StatusResponse{Subject: resp.Subject, TotpEnabled: resp.TotpEnabled}, nil
+}
+
+// observe runs a call in a server span continuing the caller's trace and records its duration.
+func (s *Server) observe(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = tracing.Propagator.Extract(ctx, metadataCarrier(md))
+	ctx, span := tracing.Tracer().Start(ctx, info.FullMethod,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.RPCSystemNameGRPC, semconv.RPCMethod(info.FullMethod)),
+	)
+	defer span.End()
+
+	resp, err := handler(ctx, req)
+	st := status.Convert(err)
+	code := strconv.FormatUint(uint64(st.Code()), 10)
+	span.SetAttributes(semconv.RPCResponseStatusCode(code))
+	if st.Code() == grpccodes.Internal {
+		span.SetStatus(codes.Error, st.Message())
+	}
+	s.metrics.ObserveRequest("grpc", info.FullMethod, code, time.Since(start))
+	return resp, err
+}
+
+// callerKey is the context key of the totpservice.Caller set by authenticate.
+type callerKey struct{}
+
+// callerFrom returns the caller of an authenticated RPC.
+func callerFrom(ctx context.Context) totpservice.Caller {
+	caller, _ := ctx.Value(callerKey{}).(totpservice.Caller)
+	return caller
+}
+
+// newCaller returns the totpservice.Caller of an RPC, read from the same metadata keys as HTTP headers.
+func newCaller(ctx context.Context, md metadata.MD, identity string) totpservice.Caller {
+	var ip string
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		ip = p.Addr.String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+	}
+	caller := totpservice.Caller{IP: ip, Service: first(md, "x-service"), KeyID: first(md, "x-key-id")}
+	if identity != "" {
+		caller.Service, caller.KeyID = identity, "mtls"
+	} else if caller.KeyID == "" && first(md, "x-api-key") != "" {
+		caller.KeyID = "api_key"
+	}
+	return caller
+}
+
+// first returns the first value of a metadata key, or "".
+func first(md metadata.MD, key string) string {
+	if v := md.Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// statusError converts an API error to a gRPC status carrying its reason in an ErrorInfo detail.
+func statusError(e *totpservice.Error) error {
+	msg := e.Message
+	if msg == "" {
+		msg = e.Reason
+	}
+	st := status.New(codeForHTTPStatus(e.Status), msg)
+	if e.Reason != "" {
+		if withInfo, err := st.WithDetails(&errdetails.ErrorInfo{Reason: e.Reason, Domain: ErrorDomain}); err == nil {
+			st = withInfo
+		}
+	}
+	return st.Err()
+}
+
+// codeForHTTPStatus maps the HTTP status of an API error to the gRPC code carrying the same meaning.
+func codeForHTTPStatus(httpStatus int) grpccodes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest:
+		return grpccodes.InvalidArgument
+	case http.StatusUnauthorized:
+		return grpccodes.Unauthenticated
+	case http.StatusForbidden:
+		return grpccodes.PermissionDenied
+	case http.StatusNotFound:
+		return grpccodes.NotFound
+	case http.StatusConflict:
+		return grpccodes.FailedPrecondition
+	case http.StatusTooManyRequests:
+		return grpccodes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		return grpccodes.Unavailable
+	default:
+		return grpccodes.Internal
+	}
+}
+
+// metadataCarrier adapts incoming metadata to propagation.TextMapCarrier.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string { return first(metadata.MD(c), key) }
+
+func (c metadataCarrier) Set(key, value string) { metadata.MD(c).Set(key, value) }
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
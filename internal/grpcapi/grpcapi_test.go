@@ -0,0 +1,320 @@
+package grpcapi
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	pqtotp "github.com/pquerna/otp/totp"
+	"github.com/redis/go-redis/v9"
+	logger "github.com/soulteary/logger-kit"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/soulteary/herald-totp/internal/config"
+	"github.com/soulteary/herald-totp/internal/grpcpb"
+	"github.com/soulteary/herald-totp/internal/router"
+	"github.com/soulteary/herald-totp/internal/totp"
+	"github.com/soulteary/herald-totp/pkg/heraldtotp"
+	"github.com/soulteary/herald-totp/pkg/heraldtotpgrpc"
+	"github.com/soulteary/herald-totp/pkg/totpservice"
+)
+
+// startServer serves the gRPC API over h2c on a random port and returns its address.
+func startServer(t *testing.T) string {
+	return startServerWith(t, nil)
+}
+
+// startServerWith serves the gRPC API with creds on a random port and returns its address.
+func startServerWith(t *testing.T, creds credentials.TransportCredentials) string {
+	t.Helper()
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis: %v", err)
+	}
+	t.Cleanup(mr.Close)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	log := logger.New(logger.Config{Level: logger.Disabled})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc, err := totpservice.New(rdb, totpservice.Options{
+		Reload: func() totpservice.Config { return router.ServiceConfig(config.Get()) },
+		Log:    log,
+	})
+	if err != nil {
+		t.Fatalf("totpservice.New: %v", err)
+	}
+	srv := New(svc, config.Get, log).GRPCServer(creds)
+	go func() { _ = srv.Serve(ln) }()
+	t.Cleanup(srv.Stop)
+	return ln.Addr().String()
+}
+
+func newClient(t *testing.T, opts *heraldtotpgrpc.Options) *heraldtotpgrpc.Client {
+	t.Helper()
+	c, err := heraldtotpgrpc.NewClient(opts)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+// wantError checks that err is a *heraldtotpgrpc.Error with the given code and reason.
+func wantError(t *testing.T, call string, err error, code codes.Code, reason string) {
+	t.Helper()
+	var e *heraldtotpgrpc.Error
+	if !errors.As(err, &e) {
+		t.Fatalf("%s: error = %v, want *heraldtotpgrpc.Error", call, err)
+	}
+	if e.Code != code || e.Reason != reason {
+		t.Errorf("%s: code %s reason %q, want %s %q", call, e.Code, e.Reason, code, reason)
+	}
+}
+
+func TestServer_EnrollVerifyRevoke(t *testing.T) {
+	defer config.Set(config.Get())
+	config.Update(func(c *config.Config) {
+		c.EncryptionKey = "0123456789abcdef0123456789abcdef"
+		c.ExposeSecretInEnroll = true
+		c.APIKey = "api-key-0123456789"
+		c.HMACSecret, c.HMACKeys = "", nil
+		c.RateLimitPerSubject, c.RateLimitPerIP = 100, 100
+	})
+	addr := startServer(t)
+	client := newClient(t, heraldtotpgrpc.DefaultOptions().WithAddress(addr).WithAPIKey("api-key-0123456789"))
+	ctx := context.Background()
+
+	start, err := client.EnrollStart(ctx, &heraldtotp.EnrollStartRequest{Subject: "alice"})
+	if err != nil {
+		t.Fatalf("EnrollStart: %v", err)
+	}
+	if start.EnrollID == "" || start.SecretBase32 == "" || start.OtpauthURI == "" {
+		t.Fatalf("EnrollStart = %+v", start)
+	}
+	cfg := config.Get()
+	code, err := pqtotp.GenerateCodeCustom(start.SecretBase32, time.Now(), pqtotp.ValidateOpts{
+		Period: uint(cfg.TOTPPeriod), Digits: totp.DigitsFromInt(cfg.TOTPDigits), Algorithm: totp.AlgorithmSHA1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.EnrollConfirm(ctx, &heraldtotp.EnrollConfirmRequest{EnrollID: "e_missing", Code: code})
+	wantError(t, "EnrollConfirm unknown enrollment", err, codes.InvalidArgument, "expired")
+	confirm, err := client.EnrollConfirm(ctx, &heraldtotp.EnrollConfirmRequest{EnrollID: start.EnrollID, Code: code})
+	if err != nil {
+		t.Fatalf("EnrollConfirm: %v", err)
+	}
+	if !confirm.TotpEnabled || len(confirm.BackupCodes) != cfg.BackupCodeCount {
+		t.Errorf("EnrollConfirm = %+v", confirm)
+	}
+
+	resp, err := client.Verify(ctx, &heraldtotp.VerifyRequest{Subject: "alice", Code: code})
+	if err != nil || !resp.OK {
+		t.Fatalf("Verify = %+v, %v", resp, err)
+	}
+	_, err = client.Verify(ctx, &heraldtotp.VerifyRequest{Subject: "alice", Code: code})
+	wantError(t, "Verify reused code", err, codes.InvalidArgument, "replay")
+	if !heraldtotp.IsReplay(err) {
+		t.Errorf("heraldtotp.IsReplay(%v) = false", err)
+	}
+	_, err = client.Verify(ctx, &heraldtotp.VerifyRequest{Subject: "alice", Code: "00000000"})
+	wantError(t, "Verify wrong code", err, codes.Unauthenticated, "invalid")
+	resp, err = client.Verify(ctx, &heraldtotp.VerifyRequest{Subject: "alice", Code: confirm.BackupCodes[0]})
+	if err != nil || !resp.OK {
+		t.Errorf("Verify backup code = %+v, %v", resp, err)
+	}
+
+	status, err := client.Status(ctx, "alice")
+	if err != nil || !status.TotpEnabled {
+		t.Errorf("Status = %+v, %v", status, err)
+	}
+	_, err = client.Status(ctx, "")
+	wantError(t, "Status without subject", err, codes.InvalidArgument, "invalid_request")
+
+	if out, err := client.Revoke(ctx, "alice"); err != nil || !out.OK {
+		t.Fatalf("Revoke = %+v, %v", out, err)
+	}
+	if status, err := client.Status(ctx, "alice"); err != nil || status.TotpEnabled {
+		t.Errorf("Status after revoke = %+v, %v", status, err)
+	}
+}
+
+func TestServer_Auth(t *testing.T) {
+	defer config.Set(config.Get())
+	const hmacSecret = "hmac-secret-0123456789abcdef0123"
+	config.Update(func(c *config.Config) {
+		c.APIKey = "api-key-0123456789"
+		c.HMACSecret, c.HMACKeys = "", map[string]string{"k1": hmacSecret}
+	})
+	addr := startServer(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		opts *heraldtotpgrpc.Options
+		ok   bool
+	}{
+		{"api key", heraldtotpgrpc.DefaultOptions().WithAPIKey("api-key-0123456789"), true},
+		{"wrong api key", heraldtotpgrpc.DefaultOptions().WithAPIKey("wrong-key-0123456"), false},
+		{"no credentials", heraldtotpgrpc.DefaultOptions(), false},
+		{"hmac", heraldtotpgrpc.DefaultOptions().WithHMACSecret(hmacSecret), true},
+		{"wrong hmac secret", heraldtotpgrpc.DefaultOptions().WithHMACSecret("other-secret-0123456789abcdef012"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newClient(t, tt.opts.WithAddress(addr))
+			_, err := client.Status(ctx, "alice")
+			if tt.ok {
+				if err != nil {
+					t.Errorf("Status: %v", err)
+				}
+				return
+			}
+			wantError(t, "Status", err, codes.Unauthenticated, "unauthorized")
+		})
+	}
+}
+
+// TestServer_GRPCGoClient calls the API through the generated stubs alone, as a caller in any
+// language would, with credentials set as plain metadata.
+func TestServer_GRPCGoClient(t *testing.T) {
+	defer config.Set(config.Get())
+	const hmacSecret = "hmac-secret-0123456789abcdef0123"
+	config.Update(func(c *config.Config) {
+		c.APIKey = "api-key-0123456789"
+		c.HMACSecret, c.HMACKeys = hmacSecret, nil
+		c.RateLimitPerSubject, c.RateLimitPerIP = 100, 100
+	})
+	addr := startServer(t)
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("grpc.NewClient: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	client := grpcpb.NewTOTPServiceClient(conn)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "api-key-0123456789")
+
+	resp, err := client.Status(ctx, &grpcpb.SubjectRequest{Subject: "bob"})
+	if err != nil || resp.GetSubject() != "bob" || resp.GetTotpEnabled() {
+		t.Fatalf("Status = %v, %v", resp, err)
+	}
+
+	_, err = client.Verify(ctx, &grpcpb.VerifyRequest{Subject: "bob", Code: "123456"})
+	st := status.Convert(err)
+	if st.Code() == codes.OK {
+		t.Fatal("Verify for a subject without TOTP succeeded")
+	}
+	var info *errdetails.ErrorInfo
+	for _, d := range st.Details() {
+		if i, ok := d.(*errdetails.ErrorInfo); ok {
+			info = i
+		}
+	}
+	if info == nil || info.GetDomain() != ErrorDomain || info.GetReason() == "" {
+		t.Errorf("Verify error details = %v, want an ErrorInfo in domain %q", st.Details(), ErrorDomain)
+	}
+
+	// HMAC over the serialized request message.
+	req := &grpcpb.SubjectRequest{Subject: "bob"}
+	body, _ := proto.Marshal(req)
+	signer := &heraldtotp.HMACSigner{Secret: hmacSecret, Service: "billing"}
+	hreq := httptest.NewRequest("POST", "/", nil)
+	if err := signer.Sign(hreq, body); err != nil {
+		t.Fatal(err)
+	}
+	signed := metadata.AppendToOutgoingContext(context.Background(),
+		"x-timestamp", hreq.Header.Get("X-Timestamp"), "x-service", "billing", "x-signature", hreq.Header.Get("X-Signature"))
+	if _, err := client.Status(signed, req); err != nil {
+		t.Errorf("Status with HMAC metadata: %v", err)
+	}
+	if _, err := client.Status(signed, &grpcpb.SubjectRequest{Subject: "mallory"}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Status with a signature over another message = %v, want Unauthenticated", err)
+	}
+}
+
+// issue returns a certificate for tmpl signed by parent, or self-signed as a CA when parent is nil.
+func issue(t *testing.T, tmpl *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore, tmpl.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	signer, signerKey := tmpl, any(key)
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid, tmpl.KeyUsage = true, true, x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestServer_MTLSIdentity(t *testing.T) {
+	ca := issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "mesh CA"}}, nil)
+	server := issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "herald-totp"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+	client := func(cn string) tls.Certificate {
+		return issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: cn}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, &ca)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	defer config.Set(config.Get())
+	config.Update(func(c *config.Config) {
+		c.APIKey = "api-key-0123456789"
+		c.HMACSecret, c.HMACKeys = "", nil
+		// Only MTLS() reads these names here; the server credentials below hold the certificates.
+		c.TLSCertFile, c.TLSKeyFile, c.TLSClientCAFile = "server.pem", "server-key.pem", "mesh-ca.pem"
+		c.TLSIdentities = map[string]string{"cn:stargate": "stargate"}
+	})
+	addr := startServerWith(t, credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{server}, ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven,
+	}))
+	ctx := context.Background()
+	status := func(cert *tls.Certificate) error {
+		tlsCfg := &tls.Config{RootCAs: pool}
+		if cert != nil {
+			tlsCfg.Certificates = []tls.Certificate{*cert}
+		}
+		_, err := newClient(t, heraldtotpgrpc.DefaultOptions().WithAddress(addr).WithTLSConfig(tlsCfg)).Status(ctx, "alice")
+		return err
+	}
+
+	stargate, stranger := client("stargate"), client("stranger")
+	if err := status(&stargate); err != nil {
+		t.Errorf("mapped client certificate: %v", err)
+	}
+	wantError(t, "unmapped client certificate", status(&stranger), codes.Unauthenticated, "certificate_unknown")
+	wantError(t, "no client certificate", status(nil), codes.Unauthenticated, "unauthorized")
+}
@@ -0,0 +1,5 @@
+// Package grpcpb is the protoc-gen-go and protoc-gen-go-grpc output for proto/herald_totp.proto.
+// Regenerate it with go generate after editing the .proto file.
+package grpcpb
+
+//go:generate protoc -I ../../proto --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative herald_totp.proto
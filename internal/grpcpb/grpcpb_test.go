@@ -0,0 +1,85 @@
+package grpcpb
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+var (
+	protoBlock = regexp.MustCompile(`(?m)^(message|service) (\w+) \{\n((?:.*\n)*?)\}`)
+	protoField = regexp.MustCompile(`^(repeated )?(\w+) (\w+) = (\d+);`)
+	protoRPC   = regexp.MustCompile(`^rpc (\w+)\((\w+)\) returns \((\w+)\);`)
+)
+
+// declarations lists the messages, fields and RPCs in proto/herald_totp.proto, one line each.
+func declarations(t *testing.T) []string {
+	t.Helper()
+	src, err := os.ReadFile("../../proto/herald_totp.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, block := range protoBlock.FindAllStringSubmatch(string(src), -1) {
+		kind, name := block[1], block[2]
+		out = append(out, kind+" "+name)
+		for _, line := range strings.Split(block[3], "\n") {
+			line = strings.TrimSpace(line)
+			if m := protoField.FindStringSubmatch(line); m != nil {
+				out = append(out, fmt.Sprintf("%s.%s = %s %s%s", name, m[3], m[4], m[1], m[2]))
+			} else if m := protoRPC.FindStringSubmatch(line); m != nil {
+				out = append(out, fmt.Sprintf("%s.%s(%s) %s", name, m[1], m[2], m[3]))
+			}
+		}
+	}
+	return out
+}
+
+// described lists the same declarations from the descriptor compiled into this package.
+func described() []string {
+	fd := File_herald_totp_proto
+	var out []string
+	for i := 0; i < fd.Services().Len(); i++ {
+		s := fd.Services().Get(i)
+		out = append(out, "service "+string(s.Name()))
+		for j := 0; j < s.Methods().Len(); j++ {
+			m := s.Methods().Get(j)
+			out = append(out, fmt.Sprintf("%s.%s(%s) %s", s.Name(), m.Name(), m.Input().Name(), m.Output().Name()))
+		}
+	}
+	for i := 0; i < fd.Messages().Len(); i++ {
+		m := fd.Messages().Get(i)
+		out = append(out, "message "+string(m.Name()))
+		for j := 0; j < m.Fields().Len(); j++ {
+			f := m.Fields().Get(j)
+			repeated := ""
+			if f.Cardinality() == protoreflect.Repeated {
+				repeated = "repeated "
+			}
+			out = append(out, fmt.Sprintf("%s.%s = %d %s%s", m.Name(), f.Name(), f.Number(), repeated, f.Kind()))
+		}
+	}
+	return out
+}
+
+// TestDescriptorMatchesProto fails when proto/herald_totp.proto was edited without regenerating
+// this package.
+func TestDescriptorMatchesProto(t *testing.T) {
+	want, got := declarations(t), described()
+	if len(want) < 10 {
+		t.Fatalf("parsed only %d declarations from the .proto file", len(want))
+	}
+	slices.Sort(want)
+	slices.Sort(got)
+	if !slices.Equal(want, got) {
+		t.Errorf("generated descriptor differs from proto/herald_totp.proto; run go generate ./internal/grpcpb\n.proto:     %q\ngenerated:  %q", want, got)
+	}
+	if pkg := File_herald_totp_proto.Package(); pkg != "herald.totp.v1" {
+		t.Errorf("package = %q", pkg)
+	}
+}
@@ -0,0 +1,695 @@
+// gRPC API of herald-totp. It mirrors the HTTP routes of the same name and returns the same error
+// reasons: a failed call carries a google.rpc.ErrorInfo detail (domain "herald-totp") whose reason is
+// the HTTP API's "reason" field, e.g. "invalid", "replay" or "rate_limited".
+//
+// Callers authenticate with the HTTP API's credentials sent as metadata: x-api-key, or x-signature,
+// x-timestamp, x-service and x-key-id for HMAC, where the signed body is the serialized request
+// message with its fields in field-number order, as the protobuf runtimes write them. A client
+// certificate mapped by TLS_IDENTITIES also authenticates the caller.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.12
+// 	protoc        (unknown)
+// source: herald_totp.proto
+
+package grpcpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type EnrollStartRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Subject       string                 `protobuf:"bytes,1,opt,name=subject,proto3" json:"subject,omitempty"`
+	Label         string                 `protobuf:"bytes,2,opt,name=label,proto3" json:"label,omitempty"`
+	Type          string                 `protobuf:"bytes,3,opt,name=type,proto3" json:"type,omitempty"`                         // "totp" (default) or "hotp"
+	QrFormat      string                 `protobuf:"bytes,4,opt,name=qr_format,json=qrFormat,proto3" json:"qr_format,omitempty"` // "png" or "svg" to receive qr_code
+	QrSize        int32                  `protobuf:"varint,5,opt,name=qr_size,json=qrSize,proto3" json:"qr_size,omitempty"`
+	QrLevel       string                 `protobuf:"bytes,6,opt,name=qr_level,json=qrLevel,proto3" json:"qr_level,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *EnrollStartRequest) Reset() {
+	*x = EnrollStartRequest{}
+	mi := &file_herald_totp_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *EnrollStartRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*EnrollStartRequest) ProtoMessage() {}
+
+func (x *EnrollStartRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_herald_totp_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use EnrollStartRequest.ProtoReflect.Descriptor instead.
+func (*EnrollStartRequest) Descriptor() ([]byte, []int) {
+	return file_herald_totp_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *EnrollStartRequest) GetSubject() string {
+	if x != nil {
+		return x.Subject
+	}
+	return ""
+}
+
+func (x *EnrollStartRequest) GetLabel() string {
+	if x != nil {
+		return x.Label
+	}
+	return ""
+}
+
+func (x *EnrollStartRequest) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *EnrollStartRequest) GetQrFormat() string {
+	if x != nil {
+		return x.QrFormat
+	}
+	return ""
+}
+
+func (x *EnrollStartRequest) GetQrSize() int32 {
+	if x != nil {
+		return x.QrSize
+	}
+	return 0
+}
+
+func (x *EnrollStartRequest) GetQrLevel() string {
+	if x != nil {
+		return x.QrLevel
+	}
+	return ""
+}
+
+type EnrollStartResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	EnrollId      string                 `protobuf:"bytes,1,opt,name=enroll_id,json=enrollId,proto3" json:"enroll_id,omitempty"`
+	SecretBase32  string                 `protobuf:"bytes,2,opt,name=secret_base32,json=secretBase32,proto3" json:"secret_base32,omitempty"` // only with EXPOSE_SECRET_IN_ENROLL
+	OtpauthUri    string                 `protobuf:"bytes,3,opt,name=otpauth_uri,json=otpauthUri,proto3" json:"otpauth_uri,omitempty"`
+	QrCode        string                 `protobuf:"bytes,4,opt,name=qr_code,json=qrCode,proto3" json:"qr_code,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *EnrollStartResponse) Reset() {
+	*x = EnrollStartResponse{}
+	mi := &file_herald_totp_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *EnrollStartResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*EnrollStartResponse) ProtoMessage() {}
+
+func (x *EnrollStartResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_herald_totp_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use EnrollStartResponse.ProtoReflect.Descriptor instead.
+func (*EnrollStartResponse) Descriptor() ([]byte, []int) {
+	return file_herald_totp_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *EnrollStartResponse) GetEnrollId() string {
+	if x != nil {
+		return x.EnrollId
+	}
+	return ""
+}
+
+func (x *EnrollStartResponse) GetSecretBase32() string {
+	if x != nil {
+		return x.SecretBase32
+	}
+	return ""
+}
+
+func (x *EnrollStartResponse) GetOtpauthUri() string {
+	if x != nil {
+		return x.OtpauthUri
+	}
+	return ""
+}
+
+func (x *EnrollStartResponse) GetQrCode() string {
+	if x != nil {
+		return x.QrCode
+	}
+	return ""
+}
+
+type EnrollConfirmRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	EnrollId      string                 `protobuf:"bytes,1,opt,name=enroll_id,json=enrollId,proto3" json:"enroll_id,omitempty"`
+	Code          string                 `protobuf:"bytes,2,opt,name=code,proto3" json:"code,omitempty"`
+	CurrentCode   string                 `protobuf:"bytes,3,opt,name=current_code,json=currentCode,proto3" json:"current_code,omitempty"` // required to replace a credential under REENROLL_POLICY=require_code
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *EnrollConfirmRequest) Reset() {
+	*x = EnrollConfirmRequest{}
+	mi := &file_herald_totp_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *EnrollConfirmRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*EnrollConfirmRequest) ProtoMessage() {}
+
+func (x *EnrollConfirmRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_herald_totp_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use EnrollConfirmRequest.ProtoReflect.Descriptor instead.
+func (*EnrollConfirmRequest) Descriptor() ([]byte, []int) {
+	return file_herald_totp_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *EnrollConfirmRequest) GetEnrollId() string {
+	if x != nil {
+		return x.EnrollId
+	}
+	return ""
+}
+
+func (x *EnrollConfirmRequest) GetCode() string {
+	if x != nil {
+		return x.Code
+	}
+	return ""
+}
+
+func (x *EnrollConfirmRequest) GetCurrentCode() string {
+	if x != nil {
+		return x.CurrentCode
+	}
+	return ""
+}
+
+type EnrollConfirmResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Subject       string                 `protobuf:"bytes,1,opt,name=subject,proto3" json:"subject,omitempty"`
+	TotpEnabled   bool                   `protobuf:"varint,2,opt,name=totp_enabled,json=totpEnabled,proto3" json:"totp_enabled,omitempty"`
+	BackupCodes   []string               `protobuf:"bytes,3,rep,name=backup_codes,json=backupCodes,proto3" json:"backup_codes,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *EnrollConfirmResponse) Reset() {
+	*x = EnrollConfirmResponse{}
+	mi := &file_herald_totp_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *EnrollConfirmResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*EnrollConfirmResponse) ProtoMessage() {}
+
+func (x *EnrollConfirmResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_herald_totp_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use EnrollConfirmResponse.ProtoReflect.Descriptor instead.
+func (*EnrollConfirmResponse) Descriptor() ([]byte, []int) {
+	return file_herald_totp_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *EnrollConfirmResponse) GetSubject() string {
+	if x != nil {
+		return x.Subject
+	}
+	return ""
+}
+
+func (x *EnrollConfirmResponse) GetTotpEnabled() bool {
+	if x != nil {
+		return x.TotpEnabled
+	}
+	return false
+}
+
+func (x *EnrollConfirmResponse) GetBackupCodes() []string {
+	if x != nil {
+		return x.BackupCodes
+	}
+	return nil
+}
+
+type VerifyRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Subject       string                 `protobuf:"bytes,1,opt,name=subject,proto3" json:"subject,omitempty"`
+	Code          string                 `protobuf:"bytes,2,opt,name=code,proto3" json:"code,omitempty"`
+	ChallengeId   string                 `protobuf:"bytes,3,opt,name=challenge_id,json=challengeId,proto3" json:"challenge_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *VerifyRequest) Reset() {
+	*x = VerifyRequest{}
+	mi := &file_herald_totp_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *VerifyRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*VerifyRequest) ProtoMessage() {}
+
+func (x *VerifyRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_herald_totp_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use VerifyRequest.ProtoReflect.Descriptor instead.
+func (*VerifyRequest) Descriptor() ([]byte, []int) {
+	return file_herald_totp_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *VerifyRequest) GetSubject() string {
+	if x != nil {
+		return x.Subject
+	}
+	return ""
+}
+
+func (x *VerifyRequest) GetCode() string {
+	if x != nil {
+		return x.Code
+	}
+	return ""
+}
+
+func (x *VerifyRequest) GetChallengeId() string {
+	if x != nil {
+		return x.ChallengeId
+	}
+	return ""
+}
+
+type VerifyResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Ok            bool                   `protobuf:"varint,1,opt,name=ok,proto3" json:"ok,omitempty"`
+	Subject       string                 `protobuf:"bytes,2,opt,name=subject,proto3" json:"subject,omitempty"`
+	Amr           []string               `protobuf:"bytes,3,rep,name=amr,proto3" json:"amr,omitempty"`
+	IssuedAt      int64                  `protobuf:"varint,4,opt,name=issued_at,json=issuedAt,proto3" json:"issued_at,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *VerifyResponse) Reset() {
+	*x = VerifyResponse{}
+	mi := &file_herald_totp_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *VerifyResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*VerifyResponse) ProtoMessage() {}
+
+func (x *VerifyResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_herald_totp_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use VerifyResponse.ProtoReflect.Descriptor instead.
+func (*VerifyResponse) Descriptor() ([]byte, []int) {
+	return file_herald_totp_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *VerifyResponse) GetOk() bool {
+	if x != nil {
+		return x.Ok
+	}
+	return false
+}
+
+func (x *VerifyResponse) GetSubject() string {
+	if x != nil {
+		return x.Subject
+	}
+	return ""
+}
+
+func (x *VerifyResponse) GetAmr() []string {
+	if x != nil {
+		return x.Amr
+	}
+	return nil
+}
+
+func (x *VerifyResponse) GetIssuedAt() int64 {
+	if x != nil {
+		return x.IssuedAt
+	}
+	return 0
+}
+
+type SubjectRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Subject       string                 `protobuf:"bytes,1,opt,name=subject,proto3" json:"subject,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SubjectRequest) Reset() {
+	*x = SubjectRequest{}
+	mi := &file_herald_totp_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SubjectRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SubjectRequest) ProtoMessage() {}
+
+func (x *SubjectRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_herald_totp_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SubjectRequest.ProtoReflect.Descriptor instead.
+func (*SubjectRequest) Descriptor() ([]byte, []int) {
+	return file_herald_totp_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *SubjectRequest) GetSubject() string {
+	if x != nil {
+		return x.Subject
+	}
+	return ""
+}
+
+type RevokeResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Ok            bool                   `protobuf:"varint,1,opt,name=ok,proto3" json:"ok,omitempty"`
+	Subject       string                 `protobuf:"bytes,2,opt,name=subject,proto3" json:"subject,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RevokeResponse) Reset() {
+	*x = RevokeResponse{}
+	mi := &file_herald_totp_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RevokeResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RevokeResponse) ProtoMessage() {}
+
+func (x *RevokeResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_herald_totp_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RevokeResponse.ProtoReflect.Descriptor instead.
+func (*RevokeResponse) Descriptor() ([]byte, []int) {
+	return file_herald_totp_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *RevokeResponse) GetOk() bool {
+	if x != nil {
+		return x.Ok
+	}
+	return false
+}
+
+func (x *RevokeResponse) GetSubject() string {
+	if x != nil {
+		return x.Subject
+	}
+	return ""
+}
+
+type StatusResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Subject       string                 `protobuf:"bytes,1,opt,name=subject,proto3" json:"subject,omitempty"`
+	TotpEnabled   bool                   `protobuf:"varint,2,opt,name=totp_enabled,json=totpEnabled,proto3" json:"totp_enabled,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StatusResponse) Reset() {
+	*x = StatusResponse{}
+	mi := &file_herald_totp_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StatusResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StatusResponse) ProtoMessage() {}
+
+func (x *StatusResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_herald_totp_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StatusResponse.ProtoReflect.Descriptor instead.
+func (*StatusResponse) Descriptor() ([]byte, []int) {
+	return file_herald_totp_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *StatusResponse) GetSubject() string {
+	if x != nil {
+		return x.Subject
+	}
+	return ""
+}
+
+func (x *StatusResponse) GetTotpEnabled() bool {
+	if x != nil {
+		return x.TotpEnabled
+	}
+	return false
+}
+
+var File_herald_totp_proto protoreflect.FileDescriptor
+
+const file_herald_totp_proto_rawDesc = "" +
+	"\n" +
+	"\x11herald_totp.proto\x12\x0eherald.totp.v1\"\xa9\x01\n" +
+	"\x12EnrollStartRequest\x12\x18\n" +
+	"\asubject\x18\x01 \x01(\tR\asubject\x12\x14\n" +
+	"\x05label\x18\x02 \x01(\tR\x05label\x12\x12\n" +
+	"\x04type\x18\x03 \x01(\tR\x04type\x12\x1b\n" +
+	"\tqr_format\x18\x04 \x01(\tR\bqrFormat\x12\x17\n" +
+	"\aqr_size\x18\x05 \x01(\x05R\x06qrSize\x12\x19\n" +
+	"\bqr_level\x18\x06 \x01(\tR\aqrLevel\"\x91\x01\n" +
+	"\x13EnrollStartResponse\x12\x1b\n" +
+	"\tenroll_id\x18\x01 \x01(\tR\benrollId\x12#\n" +
+	"\rsecret_base32\x18\x02 \x01(\tR\fsecretBase32\x12\x1f\n" +
+	"\votpauth_uri\x18\x03 \x01(\tR\n" +
+	"otpauthUri\x12\x17\n" +
+	"\aqr_code\x18\x04 \x01(\tR\x06qrCode\"j\n" +
+	"\x14EnrollConfirmRequest\x12\x1b\n" +
+	"\tenroll_id\x18\x01 \x01(\tR\benrollId\x12\x12\n" +
+	"\x04code\x18\x02 \x01(\tR\x04code\x12!\n" +
+	"\fcurrent_code\x18\x03 \x01(\tR\vcurrentCode\"w\n" +
+	"\x15EnrollConfirmResponse\x12\x18\n" +
+	"\asubject\x18\x01 \x01(\tR\asubject\x12!\n" +
+	"\ftotp_enabled\x18\x02 \x01(\bR\vtotpEnabled\x12!\n" +
+	"\fbackup_codes\x18\x03 \x03(\tR\vbackupCodes\"`\n" +
+	"\rVerifyRequest\x12\x18\n" +
+	"\asubject\x18\x01 \x01(\tR\asubject\x12\x12\n" +
+	"\x04code\x18\x02 \x01(\tR\x04code\x12!\n" +
+	"\fchallenge_id\x18\x03 \x01(\tR\vchallengeId\"i\n" +
+	"\x0eVerifyResponse\x12\x0e\n" +
+	"\x02ok\x18\x01 \x01(\bR\x02ok\x12\x18\n" +
+	"\asubject\x18\x02 \x01(\tR\asubject\x12\x10\n" +
+	"\x03amr\x18\x03 \x03(\tR\x03amr\x12\x1b\n" +
+	"\tissued_at\x18\x04 \x01(\x03R\bissuedAt\"*\n" +
+	"\x0eSubjectRequest\x12\x18\n" +
+	"\asubject\x18\x01 \x01(\tR\asubject\":\n" +
+	"\x0eRevokeResponse\x12\x0e\n" +
+	"\x02ok\x18\x01 \x01(\bR\x02ok\x12\x18\n" +
+	"\asubject\x18\x02 \x01(\tR\asubject\"M\n" +
+	"\x0eStatusResponse\x12\x18\n" +
+	"\asubject\x18\x01 \x01(\tR\asubject\x12!\n" +
+	"\ftotp_enabled\x18\x02 \x01(\bR\vtotpEnabled2\xa0\x03\n" +
+	"\vTOTPService\x12V\n" +
+	"\vEnrollStart\x12\".herald.totp.v1.EnrollStartRequest\x1a#.herald.totp.v1.EnrollStartResponse\x12\\\n" +
+	"\rEnrollConfirm\x12$.herald.totp.v1.EnrollConfirmRequest\x1a%.herald.totp.v1.EnrollConfirmResponse\x12G\n" +
+	"\x06Verify\x12\x1d.herald.totp.v1.VerifyRequest\x1a\x1e.herald.totp.v1.VerifyResponse\x12H\n" +
+	"\x06Revoke\x12\x1e.herald.totp.v1.SubjectRequest\x1a\x1e.herald.totp.v1.RevokeResponse\x12H\n" +
+	"\x06Status\x12\x1e.herald.totp.v1.SubjectRequest\x1a\x1e.herald.totp.v1.StatusResponseB2Z0github.com/soulteary/herald-totp/internal/grpcpbb\x06proto3"
+
+var (
+	file_herald_totp_proto_rawDescOnce sync.Once
+	file_herald_totp_proto_rawDescData []byte
+)
+
+func file_herald_totp_proto_rawDescGZIP() []byte {
+	file_herald_totp_proto_rawDescOnce.Do(func() {
+		file_herald_totp_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_herald_totp_proto_rawDesc), len(file_herald_totp_proto_rawDesc)))
+	})
+	return file_herald_totp_proto_rawDescData
+}
+
+var file_herald_totp_proto_msgTypes = make([]protoimpl.MessageInfo, 9)
+var file_herald_totp_proto_goTypes = []any{
+	(*EnrollStartRequest)(nil),    // 0: herald.totp.v1.EnrollStartRequest
+	(*EnrollStartResponse)(nil),   // 1: herald.totp.v1.EnrollStartResponse
+	(*EnrollConfirmRequest)(nil),  // 2: herald.totp.v1.EnrollConfirmRequest
+	(*EnrollConfirmResponse)(nil), // 3: herald.totp.v1.EnrollConfirmResponse
+	(*VerifyRequest)(nil),         // 4: herald.totp.v1.VerifyRequest
+	(*VerifyResponse)(nil),        // 5: herald.totp.v1.VerifyResponse
+	(*SubjectRequest)(nil),        // 6: herald.totp.v1.SubjectRequest
+	(*RevokeResponse)(nil),        // 7: herald.totp.v1.RevokeResponse
+	(*StatusResponse)(nil),        // 8: herald.totp.v1.StatusResponse
+}
+var file_herald_totp_proto_depIdxs = []int32{
+	0, // 0: herald.totp.v1.TOTPService.EnrollStart:input_type -> herald.totp.v1.EnrollStartRequest
+	2, // 1: herald.totp.v1.TOTPService.EnrollConfirm:input_type -> herald.totp.v1.EnrollConfirmRequest
+	4, // 2: herald.totp.v1.TOTPService.Verify:input_type -> herald.totp.v1.VerifyRequest
+	6, // 3: herald.totp.v1.TOTPService.Revoke:input_type -> herald.totp.v1.SubjectRequest
+	6, // 4: herald.totp.v1.TOTPService.Status:input_type -> herald.totp.v1.SubjectRequest
+	1, // 5: herald.totp.v1.TOTPService.EnrollStart:output_type -> herald.totp.v1.EnrollStartResponse
+	3, // 6: herald.totp.v1.TOTPService.EnrollConfirm:output_type -> herald.totp.v1.EnrollConfirmResponse
+	5, // 7: herald.totp.v1.TOTPService.Verify:output_type -> herald.totp.v1.VerifyResponse
+	7, // 8: herald.totp.v1.TOTPService.Revoke:output_type -> herald.totp.v1.RevokeResponse
+	8, // 9: herald.totp.v1.TOTPService.Status:output_type -> herald.totp.v1.StatusResponse
+	5, // [5:10] is the sub-list for method output_type
+	0, // [0:5] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_herald_totp_proto_init() }
+func file_herald_totp_proto_init() {
+	if File_herald_totp_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_herald_totp_proto_rawDesc), len(file_herald_totp_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   9,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_herald_totp_proto_goTypes,
+		DependencyIndexes: file_herald_totp_proto_depIdxs,
+		MessageInfos:      file_herald_totp_proto_msgTypes,
+	}.Build()
+	File_herald_totp_proto = out.File
+	file_herald_totp_proto_goTypes = nil
+	file_herald_totp_proto_depIdxs = nil
+}
@@ -0,0 +1,46 @@
+package handler
+
+import (
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/soulteary/herald-totp/internal/tlsauth"
+	"github.com/soulteary/herald-totp/pkg/totpservice"
+)
+
+const (
+	defaultAuditLimit = 20
+	maxAuditLimit     = 100
+)
+
+// CallerFrom returns the Caller of a request. For a caller authenticated by client certificate the
+// service is its mapped identity.
+func CallerFrom(c *fiber.Ctx) totpservice.Caller {
+	caller := totpservice.Caller{IP: c.IP(), Service: c.Get("X-Service"), KeyID: c.Get("X-Key-Id")}
+	if id := tlsauth.IdentityFrom(c); id != "" {
+		caller.Service, caller.KeyID = id, "mtls"
+	} else if caller.KeyID == "" && c.Get("X-API-Key") != "" {
+		caller.KeyID = "api_key"
+	}
+	return caller
+}
+
+// AuditEvents handles GET /v1/audit?subject=xxx&limit=n: recent audit events for one subject, newest first.
+func AuditEvents(svc *totpservice.Service) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		limit := defaultAuditLimit
+		if v := c.Query("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				return respondBadRequest(c, "invalid_request", "limit must be a positive integer")
+			}
+			limit = min(n, maxAuditLimit)
+		}
+		resp, apiErr := svc.AuditEvents(c.UserContext(), c.Query("subject"), limit)
+		if apiErr != nil {
+			return respondError(c, apiErr)
+		}
+		return c.JSON(resp)
+	}
+}
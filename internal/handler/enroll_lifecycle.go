@@ -0,0 +1,34 @@
+package handler
+
+import (
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/soulteary/herald-totp/pkg/totpservice"
+)
+
+// EnrollStatus handles GET /v1/enroll/:enroll_id[?include_uri=true]: pending enrollment status and expiry.
+// With include_uri=true the otpauth URI is rebuilt so a frontend that lost it can show the QR again.
+func EnrollStatus(svc *totpservice.Service) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		resp, apiErr := svc.EnrollmentStatus(c.UserContext(), c.Params("enroll_id"), c.QueryBool("include_uri"))
+		if apiErr != nil {
+			return respondError(c, apiErr)
+		}
+		return c.JSON(resp)
+	}
+}
+
+// EnrollCancel handles POST /v1/enroll/cancel: discard a pending enrollment before it expires.
+func EnrollCancel(svc *totpservice.Service) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var req totpservice.EnrollCancelRequest
+		if err := c.BodyParser(&req); err != nil {
+			return respondBadRequest(c, "invalid_request", err.Error())
+		}
+		resp, apiErr := svc.CancelEnrollment(c.UserContext(), CallerFrom(c), req)
+		if apiErr != nil {
+			return respondError(c, apiErr)
+		}
+		return c.JSON(resp)
+	}
+}
@@ -1,9 +1,11 @@
-package handler
+package handler_test
 
 import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"io"
+	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
@@ -11,14 +13,19 @@ import (
 
 	"github.com/alicebob/miniredis/v2"
 	"github.com/gofiber/fiber/v2"
+	"github.com/pquerna/otp/hotp"
 	pqtotp "github.com/pquerna/otp/totp"
 	"github.com/redis/go-redis/v9"
 	logger "github.com/soulteary/logger-kit"
 
+	"github.com/soulteary/herald-totp/internal/audit"
 	"github.com/soulteary/herald-totp/internal/config"
+	"github.com/soulteary/herald-totp/internal/handler"
+	"github.com/soulteary/herald-totp/internal/router"
 	"github.com/soulteary/herald-totp/internal/secret"
 	"github.com/soulteary/herald-totp/internal/store"
 	"github.com/soulteary/herald-totp/internal/totp"
+	"github.com/soulteary/herald-totp/pkg/totpservice"
 )
 
 const testEncryptionKey = "0123456789abcdef0123456789abcdef" // 32 bytes
@@ -38,12 +45,32 @@ func setupHandlerTest(t *testing.T) (*store.Store, *miniredis.Miniredis, *logger
 	return st, mr, log
 }
 
+// newTestService returns a service on st's Redis using the active config; set the encryption key first.
+func newTestService(t *testing.T, st *store.Store, log *logger.Logger) *totpservice.Service {
+	t.Helper()
+	return newAuditedTestService(t, st, log, nil)
+}
+
+// newAuditedTestService is newTestService recording audit events to rec.
+func newAuditedTestService(t *testing.T, st *store.Store, log *logger.Logger, rec *audit.Recorder) *totpservice.Service {
+	t.Helper()
+	svc, err := totpservice.New(st.Client(), totpservice.Options{
+		Reload: func() totpservice.Config { return router.ServiceConfig(config.Get()) },
+		Audit:  func(ctx context.Context, e totpservice.AuditEvent) { rec.Record(ctx, audit.Event(e)) },
+		Log:    log,
+	})
+	if err != nil {
+		t.Fatalf("totpservice.New: %v", err)
+	}
+	return svc
+}
+
 func TestEnrollStart_BadRequest(t *testing.T) {
 	st, mr, log := setupHandlerTest(t)
 	defer mr.Close()
 
 	app := fiber.New()
-	app.Post("/enroll/start", EnrollStart(st, log))
+	app.Post("/enroll/start", handler.EnrollStart(newTestService(t, st, log)))
 
 	// invalid JSON
 	req := httptest.NewRequest("POST", "/enroll/start", bytes.NewReader([]byte("{")))
@@ -69,12 +96,12 @@ func TestEnrollStart_BadRequest(t *testing.T) {
 func TestEnrollStart_ConfigError(t *testing.T) {
 	st, mr, log := setupHandlerTest(t)
 	defer mr.Close()
-	oldKey := config.EncryptionKey
-	config.EncryptionKey = "" // invalid
-	defer func() { config.EncryptionKey = oldKey }()
+	oldKey := config.Get().EncryptionKey
+	config.Update(func(c *config.Config) { c.EncryptionKey = "" }) // invalid
+	defer func() { config.Update(func(c *config.Config) { c.EncryptionKey = oldKey }) }()
 
 	app := fiber.New()
-	app.Post("/enroll/start", EnrollStart(st, log))
+	app.Post("/enroll/start", handler.EnrollStart(newTestService(t, st, log)))
 	body := `{"subject":"user1","label":"u1"}`
 	req := httptest.NewRequest("POST", "/enroll/start", bytes.NewReader([]byte(body)))
 	req.Header.Set("Content-Type", "application/json")
@@ -90,20 +117,24 @@ func TestEnrollStart_ConfigError(t *testing.T) {
 func TestEnrollStart_Success(t *testing.T) {
 	st, mr, log := setupHandlerTest(t)
 	defer mr.Close()
-	oldKey := config.EncryptionKey
-	config.EncryptionKey = testEncryptionKey
-	oldSub := config.RateLimitPerSubject
-	oldIP := config.RateLimitPerIP
-	config.RateLimitPerSubject = 100
-	config.RateLimitPerIP = 100
+	oldKey := config.Get().EncryptionKey
+	config.Update(func(c *config.Config) { c.EncryptionKey = testEncryptionKey })
+	oldSub := config.Get().RateLimitPerSubject
+	oldIP := config.Get().RateLimitPerIP
+	config.Update(func(c *config.Config) {
+		c.RateLimitPerSubject = 100
+		c.RateLimitPerIP = 100
+	})
 	defer func() {
-		config.EncryptionKey = oldKey
-		config.RateLimitPerSubject = oldSub
-		config.RateLimitPerIP = oldIP
+		config.Update(func(c *config.Config) {
+			c.EncryptionKey = oldKey
+			c.RateLimitPerSubject = oldSub
+			c.RateLimitPerIP = oldIP
+		})
 	}()
 
 	app := fiber.New()
-	app.Post("/enroll/start", EnrollStart(st, log))
+	app.Post("/enroll/start", handler.EnrollStart(newTestService(t, st, log)))
 	body := `{"subject":"user1","label":"u1"}`
 	req := httptest.NewRequest("POST", "/enroll/start", bytes.NewReader([]byte(body)))
 	req.Header.Set("Content-Type", "application/json")
@@ -114,7 +145,7 @@ func TestEnrollStart_Success(t *testing.T) {
 	if resp.StatusCode != 200 {
 		t.Errorf("status = %d, want 200", resp.StatusCode)
 	}
-	var out EnrollStartResponse
+	var out totpservice.EnrollStartResponse
 	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
 		t.Fatalf("decode: %v", err)
 	}
@@ -129,21 +160,25 @@ func TestEnrollStart_Success(t *testing.T) {
 func TestEnrollStart_ExposeSecretInEnrollFalse(t *testing.T) {
 	st, mr, log := setupHandlerTest(t)
 	defer mr.Close()
-	oldKey := config.EncryptionKey
-	oldExpose := config.ExposeSecretInEnroll
-	config.EncryptionKey = testEncryptionKey
-	config.ExposeSecretInEnroll = false
-	config.RateLimitPerSubject = 100
-	config.RateLimitPerIP = 100
+	oldKey := config.Get().EncryptionKey
+	oldExpose := config.Get().ExposeSecretInEnroll
+	config.Update(func(c *config.Config) {
+		c.EncryptionKey = testEncryptionKey
+		c.ExposeSecretInEnroll = false
+		c.RateLimitPerSubject = 100
+		c.RateLimitPerIP = 100
+	})
 	defer func() {
-		config.EncryptionKey = oldKey
-		config.ExposeSecretInEnroll = oldExpose
-		config.RateLimitPerSubject = 20
-		config.RateLimitPerIP = 30
+		config.Update(func(c *config.Config) {
+			c.EncryptionKey = oldKey
+			c.ExposeSecretInEnroll = oldExpose
+			c.RateLimitPerSubject = 20
+			c.RateLimitPerIP = 30
+		})
 	}()
 
 	app := fiber.New()
-	app.Post("/enroll/start", EnrollStart(st, log))
+	app.Post("/enroll/start", handler.EnrollStart(newTestService(t, st, log)))
 	body := `{"subject":"nosecret","label":"u"}`
 	req := httptest.NewRequest("POST", "/enroll/start", bytes.NewReader([]byte(body)))
 	req.Header.Set("Content-Type", "application/json")
@@ -154,7 +189,7 @@ func TestEnrollStart_ExposeSecretInEnrollFalse(t *testing.T) {
 	if resp.StatusCode != 200 {
 		t.Errorf("status = %d, want 200", resp.StatusCode)
 	}
-	var out EnrollStartResponse
+	var out totpservice.EnrollStartResponse
 	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
 		t.Fatalf("decode: %v", err)
 	}
@@ -169,11 +204,11 @@ func TestEnrollStart_ExposeSecretInEnrollFalse(t *testing.T) {
 func TestEnrollConfirm_BadRequest(t *testing.T) {
 	st, mr, log := setupHandlerTest(t)
 	defer mr.Close()
-	config.EncryptionKey = testEncryptionKey
-	defer func() { config.EncryptionKey = "" }()
+	config.Update(func(c *config.Config) { c.EncryptionKey = testEncryptionKey })
+	defer func() { config.Update(func(c *config.Config) { c.EncryptionKey = "" }) }()
 
 	app := fiber.New()
-	app.Post("/enroll/confirm", EnrollConfirm(st, log))
+	app.Post("/enroll/confirm", handler.EnrollConfirm(newTestService(t, st, log)))
 	body := `{}`
 	req := httptest.NewRequest("POST", "/enroll/confirm", bytes.NewReader([]byte(body)))
 	req.Header.Set("Content-Type", "application/json")
@@ -186,11 +221,11 @@ func TestEnrollConfirm_BadRequest(t *testing.T) {
 func TestEnrollConfirm_Expired(t *testing.T) {
 	st, mr, log := setupHandlerTest(t)
 	defer mr.Close()
-	config.EncryptionKey = testEncryptionKey
-	defer func() { config.EncryptionKey = "" }()
+	config.Update(func(c *config.Config) { c.EncryptionKey = testEncryptionKey })
+	defer func() { config.Update(func(c *config.Config) { c.EncryptionKey = "" }) }()
 
 	app := fiber.New()
-	app.Post("/enroll/confirm", EnrollConfirm(st, log))
+	app.Post("/enroll/confirm", handler.EnrollConfirm(newTestService(t, st, log)))
 	body := `{"enroll_id":"e_nonexistent","code":"123456"}`
 	req := httptest.NewRequest("POST", "/enroll/confirm", bytes.NewReader([]byte(body)))
 	req.Header.Set("Content-Type", "application/json")
@@ -203,43 +238,45 @@ func TestEnrollConfirm_Expired(t *testing.T) {
 func TestEnrollConfirm_Success(t *testing.T) {
 	st, mr, log := setupHandlerTest(t)
 	defer mr.Close()
-	oldKey := config.EncryptionKey
-	config.EncryptionKey = testEncryptionKey
-	config.RateLimitPerSubject = 100
-	config.RateLimitPerIP = 100
-	defer func() { config.EncryptionKey = oldKey }()
+	oldKey := config.Get().EncryptionKey
+	config.Update(func(c *config.Config) {
+		c.EncryptionKey = testEncryptionKey
+		c.RateLimitPerSubject = 100
+		c.RateLimitPerIP = 100
+	})
+	defer func() { config.Update(func(c *config.Config) { c.EncryptionKey = oldKey }) }()
 
 	// 1) Enroll start
 	app := fiber.New()
-	app.Post("/enroll/start", EnrollStart(st, log))
-	app.Post("/enroll/confirm", EnrollConfirm(st, log))
+	app.Post("/enroll/start", handler.EnrollStart(newTestService(t, st, log)))
+	app.Post("/enroll/confirm", handler.EnrollConfirm(newTestService(t, st, log)))
 	req := httptest.NewRequest("POST", "/enroll/start", bytes.NewReader([]byte(`{"subject":"user2","label":"u2"}`)))
 	req.Header.Set("Content-Type", "application/json")
 	resp, _ := app.Test(req)
 	if resp.StatusCode != 200 {
 		t.Fatalf("enroll start status = %d", resp.StatusCode)
 	}
-	var startOut EnrollStartResponse
+	var startOut totpservice.EnrollStartResponse
 	_ = json.NewDecoder(resp.Body).Decode(&startOut)
 
 	// 2) Generate valid TOTP code at current time
 	code, err := pqtotp.GenerateCodeCustom(startOut.SecretBase32, time.Now(), pqtotp.ValidateOpts{
-		Period: uint(config.TOTPPeriod), Skew: uint(config.TOTPSkew),
-		Digits: totp.DigitsFromInt(config.TOTPDigits), Algorithm: totp.AlgorithmSHA1,
+		Period: uint(config.Get().TOTPPeriod), Skew: uint(config.Get().TOTPSkew),
+		Digits: totp.DigitsFromInt(config.Get().TOTPDigits), Algorithm: totp.AlgorithmSHA1,
 	})
 	if err != nil {
 		t.Fatalf("GenerateCodeCustom: %v", err)
 	}
 
 	// 3) Confirm
-	confirmBody, _ := json.Marshal(EnrollConfirmRequest{EnrollID: startOut.EnrollID, Code: code})
+	confirmBody, _ := json.Marshal(totpservice.EnrollConfirmRequest{EnrollID: startOut.EnrollID, Code: code})
 	req = httptest.NewRequest("POST", "/enroll/confirm", bytes.NewReader(confirmBody))
 	req.Header.Set("Content-Type", "application/json")
 	resp, _ = app.Test(req)
 	if resp.StatusCode != 200 {
 		t.Errorf("enroll confirm status = %d", resp.StatusCode)
 	}
-	var confirmOut EnrollConfirmResponse
+	var confirmOut totpservice.EnrollConfirmResponse
 	_ = json.NewDecoder(resp.Body).Decode(&confirmOut)
 	if !confirmOut.TotpEnabled || confirmOut.Subject != "user2" {
 		t.Errorf("confirm response = %+v", confirmOut)
@@ -250,7 +287,7 @@ func TestVerify_BadRequest(t *testing.T) {
 	st, mr, log := setupHandlerTest(t)
 	defer mr.Close()
 	app := fiber.New()
-	app.Post("/verify", Verify(st, log))
+	app.Post("/verify", handler.Verify(newTestService(t, st, log)))
 	req := httptest.NewRequest("POST", "/verify", bytes.NewReader([]byte(`{}`)))
 	req.Header.Set("Content-Type", "application/json")
 	resp, _ := app.Test(req)
@@ -262,12 +299,14 @@ func TestVerify_BadRequest(t *testing.T) {
 func TestVerify_NoCredential(t *testing.T) {
 	st, mr, log := setupHandlerTest(t)
 	defer mr.Close()
-	config.EncryptionKey = testEncryptionKey
-	config.RateLimitPerSubject = 100
-	config.RateLimitPerIP = 100
-	defer func() { config.EncryptionKey = "" }()
+	config.Update(func(c *config.Config) {
+		c.EncryptionKey = testEncryptionKey
+		c.RateLimitPerSubject = 100
+		c.RateLimitPerIP = 100
+	})
+	defer func() { config.Update(func(c *config.Config) { c.EncryptionKey = "" }) }()
 	app := fiber.New()
-	app.Post("/verify", Verify(st, log))
+	app.Post("/verify", handler.Verify(newTestService(t, st, log)))
 	body := `{"subject":"nobody","code":"123456"}`
 	req := httptest.NewRequest("POST", "/verify", bytes.NewReader([]byte(body)))
 	req.Header.Set("Content-Type", "application/json")
@@ -280,28 +319,30 @@ func TestVerify_NoCredential(t *testing.T) {
 func TestVerify_Success(t *testing.T) {
 	st, mr, log := setupHandlerTest(t)
 	defer mr.Close()
-	config.EncryptionKey = testEncryptionKey
-	config.RateLimitPerSubject = 100
-	config.RateLimitPerIP = 100
-	defer func() { config.EncryptionKey = "" }()
+	config.Update(func(c *config.Config) {
+		c.EncryptionKey = testEncryptionKey
+		c.RateLimitPerSubject = 100
+		c.RateLimitPerIP = 100
+	})
+	defer func() { config.Update(func(c *config.Config) { c.EncryptionKey = "" }) }()
 	// Enroll user then verify with valid code
 	app := fiber.New()
-	app.Post("/enroll/start", EnrollStart(st, log))
-	app.Post("/enroll/confirm", EnrollConfirm(st, log))
-	app.Post("/verify", Verify(st, log))
+	app.Post("/enroll/start", handler.EnrollStart(newTestService(t, st, log)))
+	app.Post("/enroll/confirm", handler.EnrollConfirm(newTestService(t, st, log)))
+	app.Post("/verify", handler.Verify(newTestService(t, st, log)))
 	req := httptest.NewRequest("POST", "/enroll/start", bytes.NewReader([]byte(`{"subject":"vuser","label":"vuser"}`)))
 	req.Header.Set("Content-Type", "application/json")
 	resp, _ := app.Test(req)
 	if resp.StatusCode != 200 {
 		t.Fatalf("enroll start = %d", resp.StatusCode)
 	}
-	var startOut EnrollStartResponse
+	var startOut totpservice.EnrollStartResponse
 	_ = json.NewDecoder(resp.Body).Decode(&startOut)
 	code, _ := pqtotp.GenerateCodeCustom(startOut.SecretBase32, time.Now(), pqtotp.ValidateOpts{
-		Period: uint(config.TOTPPeriod), Skew: uint(config.TOTPSkew),
-		Digits: totp.DigitsFromInt(config.TOTPDigits), Algorithm: totp.AlgorithmSHA1,
+		Period: uint(config.Get().TOTPPeriod), Skew: uint(config.Get().TOTPSkew),
+		Digits: totp.DigitsFromInt(config.Get().TOTPDigits), Algorithm: totp.AlgorithmSHA1,
 	})
-	confirmBody, _ := json.Marshal(EnrollConfirmRequest{EnrollID: startOut.EnrollID, Code: code})
+	confirmBody, _ := json.Marshal(totpservice.EnrollConfirmRequest{EnrollID: startOut.EnrollID, Code: code})
 	req = httptest.NewRequest("POST", "/enroll/confirm", bytes.NewReader(confirmBody))
 	req.Header.Set("Content-Type", "application/json")
 	if _, err := app.Test(req); err != nil {
@@ -309,29 +350,29 @@ func TestVerify_Success(t *testing.T) {
 	}
 	// Now verify with same code (same time step) - might fail if step advanced; use fresh code
 	code2, _ := pqtotp.GenerateCodeCustom(startOut.SecretBase32, time.Now(), pqtotp.ValidateOpts{
-		Period: uint(config.TOTPPeriod), Skew: uint(config.TOTPSkew),
-		Digits: totp.DigitsFromInt(config.TOTPDigits), Algorithm: totp.AlgorithmSHA1,
+		Period: uint(config.Get().TOTPPeriod), Skew: uint(config.Get().TOTPSkew),
+		Digits: totp.DigitsFromInt(config.Get().TOTPDigits), Algorithm: totp.AlgorithmSHA1,
 	})
-	verifyBody, _ := json.Marshal(VerifyRequest{Subject: "vuser", Code: code2})
+	verifyBody, _ := json.Marshal(totpservice.VerifyRequest{Subject: "vuser", Code: code2})
 	req = httptest.NewRequest("POST", "/verify", bytes.NewReader(verifyBody))
 	req.Header.Set("Content-Type", "application/json")
 	resp, _ = app.Test(req)
 	if resp.StatusCode != 200 {
 		t.Errorf("verify status = %d, want 200", resp.StatusCode)
 	}
-	var vOut VerifyResponse
+	var vOut totpservice.VerifyResponse
 	_ = json.NewDecoder(resp.Body).Decode(&vOut)
 	if !vOut.OK {
-		t.Error("VerifyResponse.OK = false")
+		t.Error("totpservice.VerifyResponse.OK = false")
 	}
 	if vOut.Subject != "vuser" {
-		t.Errorf("VerifyResponse.Subject = %q, want vuser", vOut.Subject)
+		t.Errorf("totpservice.VerifyResponse.Subject = %q, want vuser", vOut.Subject)
 	}
 	if len(vOut.AMR) == 0 || vOut.AMR[0] != "totp" {
-		t.Errorf("VerifyResponse.AMR = %v, want [totp]", vOut.AMR)
+		t.Errorf("totpservice.VerifyResponse.AMR = %v, want [totp]", vOut.AMR)
 	}
 	if vOut.IssuedAt <= 0 {
-		t.Errorf("VerifyResponse.IssuedAt = %d, want > 0", vOut.IssuedAt)
+		t.Errorf("totpservice.VerifyResponse.IssuedAt = %d, want > 0", vOut.IssuedAt)
 	}
 }
 
@@ -339,7 +380,7 @@ func TestStatus_BadRequest(t *testing.T) {
 	st, mr, _ := setupHandlerTest(t)
 	defer mr.Close()
 	app := fiber.New()
-	app.Get("/status", Status(st))
+	app.Get("/status", handler.Status(newTestService(t, st, nil)))
 	req := httptest.NewRequest("GET", "/status", nil)
 	resp, _ := app.Test(req)
 	if resp.StatusCode != 400 {
@@ -354,16 +395,16 @@ func TestStatus_Success(t *testing.T) {
 	cred := &store.Credential{Subject: "s1", SecretEnc: "e", Issuer: "Herald", Label: "s1", Period: 30, Digits: 6, Algo: "SHA1", Enabled: true, CreatedAt: 1, UpdatedAt: 1}
 	_ = st.SaveCredential(ctx, cred)
 	app := fiber.New()
-	app.Get("/status", Status(st))
+	app.Get("/status", handler.Status(newTestService(t, st, nil)))
 	req := httptest.NewRequest("GET", "/status?subject=s1", nil)
 	resp, _ := app.Test(req)
 	if resp.StatusCode != 200 {
 		t.Errorf("status = %d, want 200", resp.StatusCode)
 	}
-	var out StatusResponse
+	var out totpservice.StatusResponse
 	_ = json.NewDecoder(resp.Body).Decode(&out)
 	if out.Subject != "s1" || !out.TotpEnabled {
-		t.Errorf("StatusResponse = %+v", out)
+		t.Errorf("totpservice.StatusResponse = %+v", out)
 	}
 	req = httptest.NewRequest("GET", "/status?subject=none", nil)
 	resp, _ = app.Test(req)
@@ -383,13 +424,15 @@ func TestVerify_ConfigError(t *testing.T) {
 	// Save credential so we pass cred check and hit config (EncryptionKey) check
 	cred := &store.Credential{Subject: "any", SecretEnc: "enc", Issuer: "Herald", Label: "any", Period: 30, Digits: 6, Algo: "SHA1", Enabled: true, CreatedAt: 1, UpdatedAt: 1}
 	_ = st.SaveCredential(ctx, cred)
-	oldKey := config.EncryptionKey
-	config.EncryptionKey = ""
-	config.RateLimitPerSubject = 100
-	config.RateLimitPerIP = 100
-	defer func() { config.EncryptionKey = oldKey }()
+	oldKey := config.Get().EncryptionKey
+	config.Update(func(c *config.Config) {
+		c.EncryptionKey = ""
+		c.RateLimitPerSubject = 100
+		c.RateLimitPerIP = 100
+	})
+	defer func() { config.Update(func(c *config.Config) { c.EncryptionKey = oldKey }) }()
 	app := fiber.New()
-	app.Post("/verify", Verify(st, log))
+	app.Post("/verify", handler.Verify(newTestService(t, st, log)))
 	body := `{"subject":"any","code":"123456"}`
 	req := httptest.NewRequest("POST", "/verify", bytes.NewReader([]byte(body)))
 	req.Header.Set("Content-Type", "application/json")
@@ -404,12 +447,14 @@ func TestVerify_ReplayChallenge(t *testing.T) {
 	defer mr.Close()
 	ctx := context.Background()
 	_ = st.MarkChallengeUsed(ctx, "c_already_used")
-	config.EncryptionKey = testEncryptionKey
-	config.RateLimitPerSubject = 100
-	config.RateLimitPerIP = 100
-	defer func() { config.EncryptionKey = "" }()
+	config.Update(func(c *config.Config) {
+		c.EncryptionKey = testEncryptionKey
+		c.RateLimitPerSubject = 100
+		c.RateLimitPerIP = 100
+	})
+	defer func() { config.Update(func(c *config.Config) { c.EncryptionKey = "" }) }()
 	app := fiber.New()
-	app.Post("/verify", Verify(st, log))
+	app.Post("/verify", handler.Verify(newTestService(t, st, log)))
 	body := `{"subject":"any","code":"123456","challenge_id":"c_already_used"}`
 	req := httptest.NewRequest("POST", "/verify", bytes.NewReader([]byte(body)))
 	req.Header.Set("Content-Type", "application/json")
@@ -429,12 +474,14 @@ func TestVerify_InvalidCode(t *testing.T) {
 	secretEnc, _ := secret.Encrypt(keyBytes, secretBase32)
 	cred := &store.Credential{Subject: "inv", SecretEnc: secretEnc, Issuer: "Herald", Label: "inv", Period: 30, Digits: 6, Algo: "SHA1", Enabled: true, CreatedAt: 1, UpdatedAt: 1}
 	_ = st.SaveCredential(ctx, cred)
-	config.EncryptionKey = testEncryptionKey
-	config.RateLimitPerSubject = 100
-	config.RateLimitPerIP = 100
-	defer func() { config.EncryptionKey = "" }()
+	config.Update(func(c *config.Config) {
+		c.EncryptionKey = testEncryptionKey
+		c.RateLimitPerSubject = 100
+		c.RateLimitPerIP = 100
+	})
+	defer func() { config.Update(func(c *config.Config) { c.EncryptionKey = "" }) }()
 	app := fiber.New()
-	app.Post("/verify", Verify(st, log))
+	app.Post("/verify", handler.Verify(newTestService(t, st, log)))
 	body := `{"subject":"inv","code":"000000"}`
 	req := httptest.NewRequest("POST", "/verify", bytes.NewReader([]byte(body)))
 	req.Header.Set("Content-Type", "application/json")
@@ -450,12 +497,14 @@ func TestVerify_DisabledCredential(t *testing.T) {
 	ctx := context.Background()
 	cred := &store.Credential{Subject: "dis", SecretEnc: "enc", Issuer: "Herald", Label: "dis", Period: 30, Digits: 6, Algo: "SHA1", Enabled: false, CreatedAt: 1, UpdatedAt: 1}
 	_ = st.SaveCredential(ctx, cred)
-	config.EncryptionKey = testEncryptionKey
-	config.RateLimitPerSubject = 100
-	config.RateLimitPerIP = 100
-	defer func() { config.EncryptionKey = "" }()
+	config.Update(func(c *config.Config) {
+		c.EncryptionKey = testEncryptionKey
+		c.RateLimitPerSubject = 100
+		c.RateLimitPerIP = 100
+	})
+	defer func() { config.Update(func(c *config.Config) { c.EncryptionKey = "" }) }()
 	app := fiber.New()
-	app.Post("/verify", Verify(st, log))
+	app.Post("/verify", handler.Verify(newTestService(t, st, log)))
 	body := `{"subject":"dis","code":"123456"}`
 	req := httptest.NewRequest("POST", "/verify", bytes.NewReader([]byte(body)))
 	req.Header.Set("Content-Type", "application/json")
@@ -468,15 +517,19 @@ func TestVerify_DisabledCredential(t *testing.T) {
 func TestEnrollStart_RateLimited(t *testing.T) {
 	st, mr, log := setupHandlerTest(t)
 	defer mr.Close()
-	config.EncryptionKey = testEncryptionKey
-	config.RateLimitPerSubject = 0 // allow 0 per hour
-	config.RateLimitPerIP = 100
+	config.Update(func(c *config.Config) {
+		c.EncryptionKey = testEncryptionKey
+		c.RateLimitPerSubject = 0 // allow 0 per hour
+		c.RateLimitPerIP = 100
+	})
 	defer func() {
-		config.EncryptionKey = ""
-		config.RateLimitPerSubject = 20
+		config.Update(func(c *config.Config) {
+			c.EncryptionKey = ""
+			c.RateLimitPerSubject = 20
+		})
 	}()
 	app := fiber.New()
-	app.Post("/enroll/start", EnrollStart(st, log))
+	app.Post("/enroll/start", handler.EnrollStart(newTestService(t, st, log)))
 	body := `{"subject":"rateuser","label":"u"}`
 	req := httptest.NewRequest("POST", "/enroll/start", bytes.NewReader([]byte(body)))
 	req.Header.Set("Content-Type", "application/json")
@@ -489,14 +542,16 @@ func TestEnrollStart_RateLimited(t *testing.T) {
 func TestVerify_BackupCodeSuccess(t *testing.T) {
 	st, mr, log := setupHandlerTest(t)
 	defer mr.Close()
-	config.EncryptionKey = testEncryptionKey
-	config.RateLimitPerSubject = 100
-	config.RateLimitPerIP = 100
-	defer func() { config.EncryptionKey = "" }()
+	config.Update(func(c *config.Config) {
+		c.EncryptionKey = testEncryptionKey
+		c.RateLimitPerSubject = 100
+		c.RateLimitPerIP = 100
+	})
+	defer func() { config.Update(func(c *config.Config) { c.EncryptionKey = "" }) }()
 	app := fiber.New()
-	app.Post("/enroll/start", EnrollStart(st, log))
-	app.Post("/enroll/confirm", EnrollConfirm(st, log))
-	app.Post("/verify", Verify(st, log))
+	app.Post("/enroll/start", handler.EnrollStart(newTestService(t, st, log)))
+	app.Post("/enroll/confirm", handler.EnrollConfirm(newTestService(t, st, log)))
+	app.Post("/verify", handler.Verify(newTestService(t, st, log)))
 	// Enroll user to get backup codes
 	req := httptest.NewRequest("POST", "/enroll/start", bytes.NewReader([]byte(`{"subject":"backupuser","label":"bu"}`)))
 	req.Header.Set("Content-Type", "application/json")
@@ -504,36 +559,36 @@ func TestVerify_BackupCodeSuccess(t *testing.T) {
 	if resp.StatusCode != 200 {
 		t.Fatalf("enroll start = %d", resp.StatusCode)
 	}
-	var startOut EnrollStartResponse
+	var startOut totpservice.EnrollStartResponse
 	_ = json.NewDecoder(resp.Body).Decode(&startOut)
 	code, _ := pqtotp.GenerateCodeCustom(startOut.SecretBase32, time.Now(), pqtotp.ValidateOpts{
-		Period: uint(config.TOTPPeriod), Skew: uint(config.TOTPSkew),
-		Digits: totp.DigitsFromInt(config.TOTPDigits), Algorithm: totp.AlgorithmSHA1,
+		Period: uint(config.Get().TOTPPeriod), Skew: uint(config.Get().TOTPSkew),
+		Digits: totp.DigitsFromInt(config.Get().TOTPDigits), Algorithm: totp.AlgorithmSHA1,
 	})
-	confirmBody, _ := json.Marshal(EnrollConfirmRequest{EnrollID: startOut.EnrollID, Code: code})
+	confirmBody, _ := json.Marshal(totpservice.EnrollConfirmRequest{EnrollID: startOut.EnrollID, Code: code})
 	req = httptest.NewRequest("POST", "/enroll/confirm", bytes.NewReader(confirmBody))
 	req.Header.Set("Content-Type", "application/json")
 	resp, _ = app.Test(req)
 	if resp.StatusCode != 200 {
 		t.Fatalf("enroll confirm = %d", resp.StatusCode)
 	}
-	var confirmOut EnrollConfirmResponse
+	var confirmOut totpservice.EnrollConfirmResponse
 	_ = json.NewDecoder(resp.Body).Decode(&confirmOut)
 	if len(confirmOut.BackupCodes) == 0 {
 		t.Fatal("no backup codes returned")
 	}
 	backupCode := confirmOut.BackupCodes[0]
-	verifyBody, _ := json.Marshal(VerifyRequest{Subject: "backupuser", Code: backupCode})
+	verifyBody, _ := json.Marshal(totpservice.VerifyRequest{Subject: "backupuser", Code: backupCode})
 	req = httptest.NewRequest("POST", "/verify", bytes.NewReader(verifyBody))
 	req.Header.Set("Content-Type", "application/json")
 	resp, _ = app.Test(req)
 	if resp.StatusCode != 200 {
 		t.Errorf("verify with backup code status = %d, want 200", resp.StatusCode)
 	}
-	var vOut VerifyResponse
+	var vOut totpservice.VerifyResponse
 	_ = json.NewDecoder(resp.Body).Decode(&vOut)
 	if !vOut.OK || vOut.Subject != "backupuser" {
-		t.Errorf("VerifyResponse = %+v", vOut)
+		t.Errorf("totpservice.VerifyResponse = %+v", vOut)
 	}
 }
 
@@ -541,7 +596,7 @@ func TestRevoke_BadRequest(t *testing.T) {
 	st, mr, _ := setupHandlerTest(t)
 	defer mr.Close()
 	app := fiber.New()
-	app.Post("/revoke", Revoke(st))
+	app.Post("/revoke", handler.Revoke(newTestService(t, st, nil)))
 	req := httptest.NewRequest("POST", "/revoke", bytes.NewReader([]byte(`{}`)))
 	req.Header.Set("Content-Type", "application/json")
 	resp, _ := app.Test(req)
@@ -554,25 +609,30 @@ func TestRevoke_Success(t *testing.T) {
 	st, mr, _ := setupHandlerTest(t)
 	defer mr.Close()
 	ctx := context.Background()
-	config.RateLimitPerSubject = 100
-	config.RateLimitPerIP = 100
-	defer func() { config.RateLimitPerSubject = 20; config.RateLimitPerIP = 30 }()
+	config.Update(func(c *config.Config) {
+		c.RateLimitPerSubject = 100
+		c.RateLimitPerIP = 100
+	})
+	defer func() {
+		config.Update(func(c *config.Config) { c.RateLimitPerSubject = 20 })
+		config.Update(func(c *config.Config) { c.RateLimitPerIP = 30 })
+	}()
 	cred := &store.Credential{Subject: "revuser", SecretEnc: "enc", Issuer: "Herald", Label: "revuser", Period: 30, Digits: 6, Algo: "SHA1", Enabled: true, CreatedAt: 1, UpdatedAt: 1}
 	_ = st.SaveCredential(ctx, cred)
 	entries := []store.BackupCodeEntry{{CodeHash: "h1", UsedAt: 0}}
 	_ = st.SaveBackupCodes(ctx, "revuser", entries)
 	app := fiber.New()
-	app.Post("/revoke", Revoke(st))
+	app.Post("/revoke", handler.Revoke(newTestService(t, st, nil)))
 	req := httptest.NewRequest("POST", "/revoke", bytes.NewReader([]byte(`{"subject":"revuser"}`)))
 	req.Header.Set("Content-Type", "application/json")
 	resp, _ := app.Test(req)
 	if resp.StatusCode != 200 {
 		t.Errorf("status = %d, want 200", resp.StatusCode)
 	}
-	var out RevokeResponse
+	var out totpservice.RevokeResponse
 	_ = json.NewDecoder(resp.Body).Decode(&out)
 	if !out.OK || out.Subject != "revuser" {
-		t.Errorf("RevokeResponse = %+v", out)
+		t.Errorf("totpservice.RevokeResponse = %+v", out)
 	}
 	credGot, _ := st.GetCredential(ctx, "revuser")
 	if credGot != nil {
@@ -587,11 +647,16 @@ func TestRevoke_Success(t *testing.T) {
 func TestRevoke_RateLimited(t *testing.T) {
 	st, mr, _ := setupHandlerTest(t)
 	defer mr.Close()
-	config.RateLimitPerSubject = 0
-	config.RateLimitPerIP = 100
-	defer func() { config.RateLimitPerSubject = 20; config.RateLimitPerIP = 30 }()
+	config.Update(func(c *config.Config) {
+		c.RateLimitPerSubject = 0
+		c.RateLimitPerIP = 100
+	})
+	defer func() {
+		config.Update(func(c *config.Config) { c.RateLimitPerSubject = 20 })
+		config.Update(func(c *config.Config) { c.RateLimitPerIP = 30 })
+	}()
 	app := fiber.New()
-	app.Post("/revoke", Revoke(st))
+	app.Post("/revoke", handler.Revoke(newTestService(t, st, nil)))
 	req := httptest.NewRequest("POST", "/revoke", bytes.NewReader([]byte(`{"subject":"rateuser"}`)))
 	req.Header.Set("Content-Type", "application/json")
 	resp, _ := app.Test(req)
@@ -599,3 +664,591 @@ func TestRevoke_RateLimited(t *testing.T) {
 		t.Errorf("revoke rate limited status = %d, want 429", resp.StatusCode)
 	}
 }
+
+func TestAuditEvents(t *testing.T) {
+	st, mr, _ := setupHandlerTest(t)
+	defer mr.Close()
+	rec := audit.NewRecorder(nil, audit.NewRedisSink(st, 0, 0, 0))
+	config.Update(func(c *config.Config) {
+		c.RateLimitPerSubject = 100
+		c.RateLimitPerIP = 100
+	})
+	defer func() {
+		config.Update(func(c *config.Config) { c.RateLimitPerSubject = 20 })
+		config.Update(func(c *config.Config) { c.RateLimitPerIP = 30 })
+	}()
+
+	app := fiber.New()
+	app.Post("/revoke", handler.Revoke(newAuditedTestService(t, st, nil, rec)))
+	app.Get("/audit", handler.AuditEvents(newAuditedTestService(t, st, nil, rec)))
+
+	req := httptest.NewRequest("GET", "/audit", nil)
+	resp, _ := app.Test(req)
+	if resp.StatusCode != 400 {
+		t.Errorf("audit without subject status = %d, want 400", resp.StatusCode)
+	}
+
+	req = httptest.NewRequest("POST", "/revoke", bytes.NewReader([]byte(`{"subject":"audituser"}`)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Service", "stargate")
+	req.Header.Set("X-Key-Id", "k1")
+	if _, err := app.Test(req); err != nil {
+		t.Fatalf("app.Test revoke: %v", err)
+	}
+
+	req = httptest.NewRequest("GET", "/audit?subject=audituser&limit=5", nil)
+	resp, _ = app.Test(req)
+	if resp.StatusCode != 200 {
+		t.Fatalf("audit status = %d, want 200", resp.StatusCode)
+	}
+	var out totpservice.AuditResponse
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	if out.Subject != "audituser" || len(out.Events) != 1 {
+		t.Fatalf("totpservice.AuditResponse = %+v, want one event", out)
+	}
+	e := out.Events[0]
+	if e.Type != audit.EventRevoke || e.Outcome != audit.OutcomeSuccess || e.Service != "stargate" || e.KeyID != "k1" || e.Timestamp == 0 {
+		t.Errorf("audit event = %+v", e)
+	}
+}
+
+// startAndConfirm runs enroll/start and enroll/confirm for subject and returns the secret and the confirm response.
+func startAndConfirm(t *testing.T, app *fiber.App, subject, currentCode string) (string, *http.Response) {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/enroll/start", bytes.NewReader([]byte(`{"subject":"`+subject+`"}`)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ := app.Test(req)
+	if resp.StatusCode != 200 {
+		return "", resp
+	}
+	var startOut totpservice.EnrollStartResponse
+	_ = json.NewDecoder(resp.Body).Decode(&startOut)
+	code, _ := pqtotp.GenerateCodeCustom(startOut.SecretBase32, time.Now(), pqtotp.ValidateOpts{
+		Period: uint(config.Get().TOTPPeriod), Digits: totp.DigitsFromInt(config.Get().TOTPDigits), Algorithm: totp.AlgorithmSHA1,
+	})
+	body, _ := json.Marshal(totpservice.EnrollConfirmRequest{EnrollID: startOut.EnrollID, Code: code, CurrentCode: currentCode})
+	req = httptest.NewRequest("POST", "/enroll/confirm", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ = app.Test(req)
+	return startOut.SecretBase32, resp
+}
+
+func setupReenrollTest(t *testing.T, policy string) (*store.Store, *fiber.App, func()) {
+	st, mr, log := setupHandlerTest(t)
+	oldPolicy := config.Get().ReenrollPolicy
+	config.Update(func(c *config.Config) {
+		c.ReenrollPolicy = policy
+		c.EncryptionKey = testEncryptionKey
+		c.RateLimitPerSubject = 100
+		c.RateLimitPerIP = 100
+	})
+	app := fiber.New()
+	app.Post("/enroll/start", handler.EnrollStart(newTestService(t, st, log)))
+	app.Post("/enroll/confirm", handler.EnrollConfirm(newTestService(t, st, log)))
+	app.Post("/verify", handler.Verify(newTestService(t, st, log)))
+	app.Post("/admin/tokens/import", handler.TokensImport(newTestService(t, st, log)))
+	app.Post("/admin/tokens/assign", handler.TokensAssign(newTestService(t, st, log)))
+	return st, app, func() {
+		mr.Close()
+		config.Update(func(c *config.Config) {
+			c.ReenrollPolicy = oldPolicy
+			c.EncryptionKey = ""
+			c.RateLimitPerSubject = 20
+			c.RateLimitPerIP = 30
+		})
+	}
+}
+
+func decodeReason(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	var out handler.ErrorResponse
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	return out.Reason
+}
+
+func TestEnrollConfirm_ReenrollReject(t *testing.T) {
+	_, app, done := setupReenrollTest(t, config.ReenrollReject)
+	defer done()
+
+	if _, resp := startAndConfirm(t, app, "reuser", ""); resp.StatusCode != 200 {
+		t.Fatalf("first enroll status = %d", resp.StatusCode)
+	}
+	_, resp := startAndConfirm(t, app, "reuser", "")
+	if resp.StatusCode != 409 {
+		t.Fatalf("re-enroll status = %d, want 409", resp.StatusCode)
+	}
+	if reason := decodeReason(t, resp); reason != "already_enrolled" {
+		t.Errorf("reason = %q, want already_enrolled", reason)
+	}
+}
+
+func TestEnrollConfirm_ReenrollRequireCode(t *testing.T) {
+	st, app, done := setupReenrollTest(t, config.ReenrollRequireCode)
+	defer done()
+	ctx := context.Background()
+
+	_, resp := startAndConfirm(t, app, "reuser", "")
+	if resp.StatusCode != 200 {
+		t.Fatalf("first enroll status = %d", resp.StatusCode)
+	}
+	var first totpservice.EnrollConfirmResponse
+	_ = json.NewDecoder(resp.Body).Decode(&first)
+	oldCred, _ := st.GetCredential(ctx, "reuser")
+
+	_, resp = startAndConfirm(t, app, "reuser", "")
+	if resp.StatusCode != 403 || decodeReason(t, resp) != "reauth_required" {
+		t.Errorf("re-enroll without current_code status = %d, want 403 reauth_required", resp.StatusCode)
+	}
+	_, resp = startAndConfirm(t, app, "reuser", "ZZZZ-ZZZZ")
+	if resp.StatusCode != 401 || decodeReason(t, resp) != "reauth_invalid" {
+		t.Errorf("re-enroll with wrong current_code status = %d, want 401 reauth_invalid", resp.StatusCode)
+	}
+	got, _ := st.GetCredential(ctx, "reuser")
+	if got.SecretEnc != oldCred.SecretEnc {
+		t.Fatal("credential must not change without authorisation")
+	}
+
+	_, resp = startAndConfirm(t, app, "reuser", first.BackupCodes[0])
+	if resp.StatusCode != 200 {
+		t.Fatalf("re-enroll with backup code status = %d, want 200", resp.StatusCode)
+	}
+	var second totpservice.EnrollConfirmResponse
+	_ = json.NewDecoder(resp.Body).Decode(&second)
+	if len(second.BackupCodes) == 0 || second.BackupCodes[0] == first.BackupCodes[0] {
+		t.Errorf("replacement should issue new backup codes: %v", second.BackupCodes)
+	}
+	got, _ = st.GetCredential(ctx, "reuser")
+	if got.SecretEnc == oldCred.SecretEnc {
+		t.Error("credential should be replaced after authorised re-enrollment")
+	}
+}
+
+func TestEnrollConfirm_ReenrollAdd(t *testing.T) {
+	st, app, done := setupReenrollTest(t, config.ReenrollAdd)
+	defer done()
+	ctx := context.Background()
+	oldMax := config.Get().MaxCredentialsPerSubject
+	config.Update(func(c *config.Config) { c.MaxCredentialsPerSubject = 2 })
+	defer func() { config.Update(func(c *config.Config) { c.MaxCredentialsPerSubject = oldMax }) }()
+
+	secret1, resp := startAndConfirm(t, app, "adduser", "")
+	if resp.StatusCode != 200 {
+		t.Fatalf("first enroll status = %d", resp.StatusCode)
+	}
+	secret2, resp := startAndConfirm(t, app, "adduser", "")
+	if resp.StatusCode != 200 {
+		t.Fatalf("second enroll status = %d, want 200", resp.StatusCode)
+	}
+	var out totpservice.EnrollConfirmResponse
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	if len(out.BackupCodes) != 0 {
+		t.Errorf("added authenticator should keep existing backup codes, got new %v", out.BackupCodes)
+	}
+	creds, _ := st.GetCredentials(ctx, "adduser")
+	if len(creds) != 2 || creds[0].ID != "" || creds[1].ID == "" {
+		t.Fatalf("credentials = %+v, want primary + one extra", creds)
+	}
+
+	// The added authenticator verifies; the primary still works too.
+	code2, _ := pqtotp.GenerateCode(secret2, time.Now())
+	body, _ := json.Marshal(totpservice.VerifyRequest{Subject: "adduser", Code: code2})
+	req := httptest.NewRequest("POST", "/verify", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if resp, _ := app.Test(req); resp.StatusCode != 200 {
+		t.Errorf("verify with added authenticator status = %d, want 200", resp.StatusCode)
+	}
+	code1, _ := pqtotp.GenerateCode(secret1, time.Now())
+	if code1 != code2 {
+		body, _ = json.Marshal(totpservice.VerifyRequest{Subject: "adduser", Code: code1})
+		req = httptest.NewRequest("POST", "/verify", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if resp, _ := app.Test(req); resp.StatusCode != 200 {
+			t.Errorf("verify with primary status = %d, want 200", resp.StatusCode)
+		}
+	}
+
+	_, resp = startAndConfirm(t, app, "adduser", "")
+	if resp.StatusCode != 409 || decodeReason(t, resp) != "too_many_credentials" {
+		t.Errorf("third enroll status = %d, want 409 too_many_credentials", resp.StatusCode)
+	}
+}
+
+func TestEnrollLifecycle_StatusCancelAndCap(t *testing.T) {
+	st, mr, log := setupHandlerTest(t)
+	defer mr.Close()
+	config.Update(func(c *config.Config) {
+		c.EncryptionKey = testEncryptionKey
+		c.RateLimitPerSubject = 100
+		c.RateLimitPerIP = 100
+	})
+	oldMax := config.Get().MaxPendingEnrollments
+	config.Update(func(c *config.Config) { c.MaxPendingEnrollments = 2 })
+	defer func() {
+		config.Update(func(c *config.Config) {
+			c.EncryptionKey = ""
+			c.RateLimitPerSubject = 20
+			c.RateLimitPerIP = 30
+			c.MaxPendingEnrollments = oldMax
+		})
+	}()
+
+	app := fiber.New()
+	app.Post("/enroll/start", handler.EnrollStart(newTestService(t, st, log)))
+	app.Post("/enroll/cancel", handler.EnrollCancel(newTestService(t, st, nil)))
+	app.Get("/enroll/:enroll_id", handler.EnrollStatus(newTestService(t, st, log)))
+	start := func() (*http.Response, totpservice.EnrollStartResponse) {
+		req := httptest.NewRequest("POST", "/enroll/start", bytes.NewReader([]byte(`{"subject":"lcuser"}`)))
+		req.Header.Set("Content-Type", "application/json")
+		resp, _ := app.Test(req)
+		var out totpservice.EnrollStartResponse
+		if resp.StatusCode == 200 {
+			_ = json.NewDecoder(resp.Body).Decode(&out)
+		}
+		return resp, out
+	}
+
+	_, first := start()
+	resp, _ := start()
+	if resp.StatusCode != 200 {
+		t.Fatalf("second start status = %d", resp.StatusCode)
+	}
+	resp, _ = start()
+	if resp.StatusCode != 429 || decodeReason(t, resp) != "too_many_enrollments" {
+		t.Fatalf("third start status = %d, want 429 too_many_enrollments", resp.StatusCode)
+	}
+
+	// status without URI
+	resp, _ = app.Test(httptest.NewRequest("GET", "/enroll/"+first.EnrollID, nil))
+	if resp.StatusCode != 200 {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	var status totpservice.EnrollStatusResponse
+	_ = json.NewDecoder(resp.Body).Decode(&status)
+	if status.Status != "pending" || status.Subject != "lcuser" || status.ExpiresAt <= status.CreatedAt || status.OtpauthURI != "" {
+		t.Errorf("status = %+v", status)
+	}
+	// status with URI re-fetch
+	resp, _ = app.Test(httptest.NewRequest("GET", "/enroll/"+first.EnrollID+"?include_uri=true", nil))
+	status = totpservice.EnrollStatusResponse{}
+	_ = json.NewDecoder(resp.Body).Decode(&status)
+	if status.OtpauthURI != first.OtpauthURI || status.SecretBase32 != first.SecretBase32 {
+		t.Errorf("re-fetched URI = %q, want %q", status.OtpauthURI, first.OtpauthURI)
+	}
+
+	// cancel frees a slot
+	req := httptest.NewRequest("POST", "/enroll/cancel", bytes.NewReader([]byte(`{"enroll_id":"`+first.EnrollID+`"}`)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ = app.Test(req)
+	if resp.StatusCode != 200 {
+		t.Fatalf("cancel status = %d, want 200", resp.StatusCode)
+	}
+	resp, _ = app.Test(httptest.NewRequest("GET", "/enroll/"+first.EnrollID, nil))
+	if resp.StatusCode != 404 {
+		t.Errorf("status after cancel = %d, want 404", resp.StatusCode)
+	}
+	req = httptest.NewRequest("POST", "/enroll/cancel", bytes.NewReader([]byte(`{"enroll_id":"`+first.EnrollID+`"}`)))
+	req.Header.Set("Content-Type", "application/json")
+	if resp, _ = app.Test(req); resp.StatusCode != 404 {
+		t.Errorf("second cancel status = %d, want 404", resp.StatusCode)
+	}
+	if resp, _ = start(); resp.StatusCode != 200 {
+		t.Errorf("start after cancel status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestEnrollQR(t *testing.T) {
+	st, mr, log := setupHandlerTest(t)
+	defer mr.Close()
+	config.Update(func(c *config.Config) { c.EncryptionKey = testEncryptionKey })
+	defer func() { config.Update(func(c *config.Config) { c.EncryptionKey = "" }) }()
+
+	app := fiber.New()
+	app.Post("/enroll/start", handler.EnrollStart(newTestService(t, st, log)))
+	app.Get("/enroll/:enroll_id/qr", handler.EnrollQR(newTestService(t, st, log)))
+
+	req := httptest.NewRequest("POST", "/enroll/start", bytes.NewReader([]byte(`{"subject":"qruser","qr_format":"png","qr_size":128}`)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ := app.Test(req)
+	if resp.StatusCode != 200 {
+		t.Fatalf("start status = %d", resp.StatusCode)
+	}
+	var out totpservice.EnrollStartResponse
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	if !strings.HasPrefix(out.QRCode, "data:image/png;base64,") {
+		t.Errorf("qr_code = %.40q, want PNG data URI", out.QRCode)
+	}
+
+	req = httptest.NewRequest("POST", "/enroll/start", bytes.NewReader([]byte(`{"subject":"qruser","qr_format":"gif"}`)))
+	req.Header.Set("Content-Type", "application/json")
+	if resp, _ = app.Test(req); resp.StatusCode != 400 {
+		t.Errorf("unknown qr_format status = %d, want 400", resp.StatusCode)
+	}
+
+	resp, _ = app.Test(httptest.NewRequest("GET", "/enroll/"+out.EnrollID+"/qr?format=svg&level=H", nil))
+	if resp.StatusCode != 200 {
+		t.Fatalf("qr status = %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "image/svg+xml" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if cc := resp.Header.Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", cc)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if !bytes.HasPrefix(body, []byte("<svg")) {
+		t.Errorf("body = %.40q, want SVG", body)
+	}
+
+	if resp, _ = app.Test(httptest.NewRequest("GET", "/enroll/"+out.EnrollID+"/qr?size=999999", nil)); resp.StatusCode != 400 {
+		t.Errorf("oversized qr status = %d, want 400", resp.StatusCode)
+	}
+	if resp, _ = app.Test(httptest.NewRequest("GET", "/enroll/e_missing/qr", nil)); resp.StatusCode != 404 {
+		t.Errorf("missing enrollment qr status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestHOTP_EnrollVerifyResync(t *testing.T) {
+	st, mr, log := setupHandlerTest(t)
+	defer mr.Close()
+	config.Update(func(c *config.Config) {
+		c.EncryptionKey = testEncryptionKey
+		c.RateLimitPerSubject = 100
+		c.RateLimitPerIP = 100
+	})
+	defer func() {
+		config.Update(func(c *config.Config) {
+			c.EncryptionKey = ""
+			c.RateLimitPerSubject = 20
+			c.RateLimitPerIP = 30
+		})
+	}()
+
+	app := fiber.New()
+	app.Post("/enroll/start", handler.EnrollStart(newTestService(t, st, log)))
+	app.Post("/enroll/confirm", handler.EnrollConfirm(newTestService(t, st, log)))
+	app.Post("/verify", handler.Verify(newTestService(t, st, log)))
+	app.Post("/hotp/resync", handler.HOTPResync(newTestService(t, st, log)))
+	post := func(path, body string) *http.Response {
+		req := httptest.NewRequest("POST", path, bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		resp, _ := app.Test(req)
+		return resp
+	}
+
+	resp := post("/enroll/start", `{"subject":"hotpuser","type":"hotp"}`)
+	if resp.StatusCode != 200 {
+		t.Fatalf("start status = %d", resp.StatusCode)
+	}
+	var start totpservice.EnrollStartResponse
+	_ = json.NewDecoder(resp.Body).Decode(&start)
+	if !strings.HasPrefix(start.OtpauthURI, "otpauth://hotp/") {
+		t.Fatalf("otpauth_uri = %q, want hotp", start.OtpauthURI)
+	}
+	code := func(counter uint64) string {
+		c, err := hotp.GenerateCode(start.SecretBase32, counter)
+		if err != nil {
+			t.Fatalf("GenerateCode: %v", err)
+		}
+		return c
+	}
+
+	if resp = post("/enroll/confirm", `{"enroll_id":"`+start.EnrollID+`","code":"`+code(0)+`"}`); resp.StatusCode != 200 {
+		t.Fatalf("confirm status = %d", resp.StatusCode)
+	}
+
+	resp = post("/verify", `{"subject":"hotpuser","code":"`+code(2)+`"}`)
+	if resp.StatusCode != 200 {
+		t.Fatalf("verify status = %d", resp.StatusCode)
+	}
+	var vr totpservice.VerifyResponse
+	_ = json.NewDecoder(resp.Body).Decode(&vr)
+	if len(vr.AMR) != 1 || vr.AMR[0] != "hotp" {
+		t.Errorf("AMR = %v, want [hotp]", vr.AMR)
+	}
+	// Codes at or below the last accepted counter are rejected.
+	if resp = post("/verify", `{"subject":"hotpuser","code":"`+code(2)+`"}`); resp.StatusCode != 401 {
+		t.Errorf("reused code status = %d, want 401", resp.StatusCode)
+	}
+	if resp = post("/verify", `{"subject":"hotpuser","code":"`+code(1)+`"}`); resp.StatusCode != 401 {
+		t.Errorf("old code status = %d, want 401", resp.StatusCode)
+	}
+
+	// Token pressed far beyond the look-ahead window: resync with two consecutive codes.
+	if resp = post("/verify", `{"subject":"hotpuser","code":"`+code(60)+`"}`); resp.StatusCode != 401 {
+		t.Errorf("out-of-window verify status = %d, want 401", resp.StatusCode)
+	}
+	if resp = post("/hotp/resync", `{"subject":"hotpuser","code1":"`+code(60)+`","code2":"`+code(62)+`"}`); resp.StatusCode != 401 {
+		t.Errorf("non-consecutive resync status = %d, want 401", resp.StatusCode)
+	}
+	if resp = post("/hotp/resync", `{"subject":"hotpuser","code1":"`+code(60)+`","code2":"`+code(61)+`"}`); resp.StatusCode != 200 {
+		t.Fatalf("resync status = %d, want 200", resp.StatusCode)
+	}
+	if resp = post("/verify", `{"subject":"hotpuser","code":"`+code(61)+`"}`); resp.StatusCode != 401 {
+		t.Errorf("resync code reuse status = %d, want 401", resp.StatusCode)
+	}
+	if resp = post("/verify", `{"subject":"hotpuser","code":"`+code(62)+`"}`); resp.StatusCode != 200 {
+		t.Errorf("verify after resync status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestTokens_ImportAssignVerify(t *testing.T) {
+	st, mr, log := setupHandlerTest(t)
+	defer mr.Close()
+	config.Update(func(c *config.Config) { c.EncryptionKey = testEncryptionKey })
+	defer func() { config.Update(func(c *config.Config) { c.EncryptionKey = "" }) }()
+
+	app := fiber.New()
+	app.Post("/admin/tokens/import", handler.TokensImport(newTestService(t, st, log)))
+	app.Get("/admin/tokens", handler.TokensList(newTestService(t, st, nil)))
+	app.Post("/admin/tokens/assign", handler.TokensAssign(newTestService(t, st, log)))
+	app.Post("/verify", handler.Verify(newTestService(t, st, log)))
+
+	const seedB32 = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	csv := "serial,secret,type\nHW100," + seedB32 + ",totp\nHW101," + seedB32 + ",hotp\n"
+	importCSV := func() totpservice.TokensImportResponse {
+		req := httptest.NewRequest("POST", "/admin/tokens/import", strings.NewReader(csv))
+		req.Header.Set("Content-Type", "text/csv")
+		resp, _ := app.Test(req)
+		if resp.StatusCode != 200 {
+			t.Fatalf("import status = %d", resp.StatusCode)
+		}
+		var out totpservice.TokensImportResponse
+		_ = json.NewDecoder(resp.Body).Decode(&out)
+		return out
+	}
+	if out := importCSV(); out.Imported != 2 {
+		t.Errorf("imported = %d, want 2", out.Imported)
+	}
+	if out := importCSV(); out.Imported != 0 || len(out.Skipped) != 2 {
+		t.Errorf("re-import = %+v, want 2 skipped", out)
+	}
+	req := httptest.NewRequest("POST", "/admin/tokens/import", strings.NewReader("serial\nHW1\n"))
+	req.Header.Set("Content-Type", "text/csv")
+	if resp, _ := app.Test(req); resp.StatusCode != 400 {
+		t.Errorf("bad seed file status = %d, want 400", resp.StatusCode)
+	}
+
+	resp, _ := app.Test(httptest.NewRequest("GET", "/admin/tokens", nil))
+	body, _ := io.ReadAll(resp.Body)
+	if strings.Contains(string(body), "secret") || !strings.Contains(string(body), "HW101") {
+		t.Errorf("inventory = %s", body)
+	}
+
+	assign := func(serial string) *http.Response {
+		req := httptest.NewRequest("POST", "/admin/tokens/assign", bytes.NewReader([]byte(`{"serial":"`+serial+`","subject":"hwuser"}`)))
+		req.Header.Set("Content-Type", "application/json")
+		resp, _ := app.Test(req)
+		return resp
+	}
+	resp = assign("HW100")
+	if resp.StatusCode != 200 {
+		t.Fatalf("assign status = %d", resp.StatusCode)
+	}
+	var ar totpservice.TokensAssignResponse
+	_ = json.NewDecoder(resp.Body).Decode(&ar)
+	if !ar.TotpEnabled || len(ar.BackupCodes) != 10 {
+		t.Errorf("assign = %+v, want backup codes for the first authenticator", ar)
+	}
+	req = httptest.NewRequest("POST", "/admin/tokens/assign", bytes.NewReader([]byte(`{"serial":"HW100","subject":"hwother"}`)))
+	req.Header.Set("Content-Type", "application/json")
+	if resp, _ = app.Test(req); resp.StatusCode != 404 {
+		t.Errorf("re-assign status = %d, want 404", resp.StatusCode)
+	}
+
+	code, _ := pqtotp.GenerateCode(seedB32, time.Now())
+	req = httptest.NewRequest("POST", "/verify", bytes.NewReader([]byte(`{"subject":"hwuser","code":"`+code+`"}`)))
+	req.Header.Set("Content-Type", "application/json")
+	if resp, _ = app.Test(req); resp.StatusCode != 200 {
+		t.Errorf("verify with hardware token status = %d, want 200", resp.StatusCode)
+	}
+}
+
+// importAndAssign imports a TOTP token with the given serial and assigns it to subject.
+func importAndAssign(t *testing.T, app *fiber.App, serial, subject, currentCode string) *http.Response {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/admin/tokens/import", strings.NewReader("serial,secret\n"+serial+",GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ\n"))
+	req.Header.Set("Content-Type", "text/csv")
+	if resp, _ := app.Test(req); resp.StatusCode != 200 {
+		t.Fatalf("import status = %d", resp.StatusCode)
+	}
+	body, _ := json.Marshal(totpservice.TokensAssignRequest{Serial: serial, Subject: subject, CurrentCode: currentCode})
+	req = httptest.NewRequest("POST", "/admin/tokens/assign", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ := app.Test(req)
+	return resp
+}
+
+func TestTokensAssign_ReenrollReject(t *testing.T) {
+	_, app, done := setupReenrollTest(t, config.ReenrollReject)
+	defer done()
+
+	if _, resp := startAndConfirm(t, app, "hwre", ""); resp.StatusCode != 200 {
+		t.Fatalf("enroll status = %d", resp.StatusCode)
+	}
+	resp := importAndAssign(t, app, "HW200", "hwre", "")
+	if resp.StatusCode != 409 || decodeReason(t, resp) != "already_enrolled" {
+		t.Errorf("assign status = %d, want 409 already_enrolled", resp.StatusCode)
+	}
+}
+
+func TestTokensAssign_ReenrollRequireCode(t *testing.T) {
+	st, app, done := setupReenrollTest(t, config.ReenrollRequireCode)
+	defer done()
+	ctx := context.Background()
+
+	_, resp := startAndConfirm(t, app, "hwre", "")
+	if resp.StatusCode != 200 {
+		t.Fatalf("enroll status = %d", resp.StatusCode)
+	}
+	var first totpservice.EnrollConfirmResponse
+	_ = json.NewDecoder(resp.Body).Decode(&first)
+
+	resp = importAndAssign(t, app, "HW201", "hwre", "")
+	if resp.StatusCode != 403 || decodeReason(t, resp) != "reauth_required" {
+		t.Errorf("assign without current_code status = %d, want 403 reauth_required", resp.StatusCode)
+	}
+	resp = importAndAssign(t, app, "HW202", "hwre", "ZZZZ-ZZZZ")
+	if resp.StatusCode != 401 || decodeReason(t, resp) != "reauth_invalid" {
+		t.Errorf("assign with wrong current_code status = %d, want 401 reauth_invalid", resp.StatusCode)
+	}
+	if creds, _ := st.GetCredentials(ctx, "hwre"); len(creds) != 1 || creds[0].Serial != "" {
+		t.Fatalf("credentials = %+v, want the app authenticator unchanged", creds)
+	}
+	if tokens, _ := st.ListHardwareTokens(ctx); len(tokens) != 2 {
+		t.Errorf("inventory = %d tokens, want both refused tokens kept", len(tokens))
+	}
+
+	resp = importAndAssign(t, app, "HW203", "hwre", first.BackupCodes[0])
+	if resp.StatusCode != 200 {
+		t.Fatalf("assign with backup code status = %d, want 200", resp.StatusCode)
+	}
+	var out totpservice.TokensAssignResponse
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	if len(out.BackupCodes) == 0 {
+		t.Error("replacement should issue new backup codes")
+	}
+	if creds, _ := st.GetCredentials(ctx, "hwre"); len(creds) != 1 || creds[0].Serial != "HW203" {
+		t.Errorf("credentials = %+v, want only the token", creds)
+	}
+}
+
+func TestTokensAssign_ReenrollAdd(t *testing.T) {
+	st, app, done := setupReenrollTest(t, config.ReenrollAdd)
+	defer done()
+
+	if _, resp := startAndConfirm(t, app, "hwadd", ""); resp.StatusCode != 200 {
+		t.Fatalf("enroll status = %d", resp.StatusCode)
+	}
+	resp := importAndAssign(t, app, "HW204", "hwadd", "")
+	if resp.StatusCode != 200 {
+		t.Fatalf("assign status = %d, want 200", resp.StatusCode)
+	}
+	var out totpservice.TokensAssignResponse
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	if len(out.BackupCodes) != 0 {
+		t.Errorf("added token should keep existing backup codes, got %v", out.BackupCodes)
+	}
+	if creds, _ := st.GetCredentials(context.Background(), "hwadd"); len(creds) != 2 {
+		t.Errorf("credentials = %d, want 2", len(creds))
+	}
+}
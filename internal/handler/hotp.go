@@ -0,0 +1,23 @@
+package handler
+
+import (
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/soulteary/herald-totp/pkg/totpservice"
+)
+
+// HOTPResync handles POST /v1/hotp/resync: when a HOTP token was pressed more than HOTP_LOOK_AHEAD
+// times without verifying, find two consecutive codes within HOTP_RESYNC_WINDOW and move the counter past them.
+func HOTPResync(svc *totpservice.Service) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var req totpservice.HOTPResyncRequest
+		if err := c.BodyParser(&req); err != nil {
+			return respondBadRequest(c, "invalid_request", err.Error())
+		}
+		resp, apiErr := svc.ResyncHOTP(c.UserContext(), CallerFrom(c), req)
+		if apiErr != nil {
+			return respondError(c, apiErr)
+		}
+		return c.JSON(resp)
+	}
+}
@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/soulteary/herald-totp/pkg/totpservice"
+)
+
+// TokensImport handles POST /v1/admin/tokens/import[?format=csv|pskc&overwrite=true]: parse a hardware
+// token seed file from the request body and add the tokens to the unassigned inventory.
+// Without format, text/csv is parsed as CSV and XML content types as PSKC.
+func TokensImport(svc *totpservice.Service) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		format := strings.ToLower(c.Query("format"))
+		if format == "" {
+			format = "csv"
+			if strings.Contains(string(c.Request().Header.ContentType()), "xml") {
+				format = "pskc"
+			}
+		}
+		resp, apiErr := svc.ImportTokens(c.UserContext(), format, bytes.NewReader(c.Body()), c.QueryBool("overwrite"))
+		if apiErr != nil {
+			return respondError(c, apiErr)
+		}
+		return c.JSON(resp)
+	}
+}
+
+// TokensList handles GET /v1/admin/tokens: the unassigned hardware token inventory.
+func TokensList(svc *totpservice.Service) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		resp, apiErr := svc.ListTokens(c.UserContext())
+		if apiErr != nil {
+			return respondError(c, apiErr)
+		}
+		return c.JSON(resp)
+	}
+}
+
+// TokensAssign handles POST /v1/admin/tokens/assign: take a token out of the inventory and make it a
+// credential of the subject. A subject with authenticators is handled by REENROLL_POLICY: require_code
+// (the default) replaces them once current_code is verified, add keeps them (up to
+// MAX_CREDENTIALS_PER_SUBJECT), and reject fails.
+func TokensAssign(svc *totpservice.Service) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var req totpservice.TokensAssignRequest
+		if err := c.BodyParser(&req); err != nil {
+			return respondBadRequest(c, "invalid_request", err.Error())
+		}
+		resp, apiErr := svc.AssignToken(c.UserContext(), CallerFrom(c), req)
+		if apiErr != nil {
+			return respondError(c, apiErr)
+		}
+		return c.JSON(resp)
+	}
+}
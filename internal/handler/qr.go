@@ -0,0 +1,23 @@
+package handler
+
+import (
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/soulteary/herald-totp/pkg/totpservice"
+)
+
+// EnrollQR handles GET /v1/enroll/:enroll_id/qr[?format=png|svg&size=&level=]: the otpauth URI of a
+// pending enrollment rendered as an image. It stops working once the enrollment is confirmed,
+// cancelled or expired.
+func EnrollQR(svc *totpservice.Service) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		img, contentType, apiErr := svc.EnrollmentQR(c.UserContext(), c.Params("enroll_id"), c.Query("format"), c.QueryInt("size"), c.Query("level"))
+		if apiErr != nil {
+			return respondError(c, apiErr)
+		}
+		// The image embeds the TOTP secret: never let proxies or browsers keep it.
+		c.Set(fiber.HeaderCacheControl, "no-store")
+		c.Set(fiber.HeaderContentType, contentType)
+		return c.Send(img)
+	}
+}
@@ -0,0 +1,91 @@
+package hwtoken
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ParseCSV reads a seed file with a header row. Columns (case-insensitive, any order):
+// serial and one of secret (base32) or secret_hex are required; type, algorithm, digits, period,
+// counter and issuer are optional. Unknown columns are ignored.
+func ParseCSV(r io.Reader) ([]Seed, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	cr.Comment = '#'
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("read CSV header: %w", err)
+	}
+	col := make(map[string]int, len(header))
+	for i, h := range header {
+		col[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	if _, ok := col["serial"]; !ok {
+		return nil, fmt.Errorf("CSV header has no serial column")
+	}
+	_, hasB32 := col["secret"]
+	_, hasHex := col["secret_hex"]
+	if !hasB32 && !hasHex {
+		return nil, fmt.Errorf("CSV header has no secret or secret_hex column")
+	}
+
+	var seeds []Seed
+	for line := 2; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("CSV line %d: %w", line, err)
+		}
+		field := func(name string) string {
+			if i, ok := col[name]; ok && i < len(rec) {
+				return strings.TrimSpace(rec[i])
+			}
+			return ""
+		}
+		s := Seed{
+			Serial:    field("serial"),
+			Type:      field("type"),
+			Algorithm: field("algorithm"),
+			Issuer:    field("issuer"),
+		}
+		if v := field("secret_hex"); v != "" {
+			if s.Secret, err = hex.DecodeString(v); err != nil {
+				return nil, fmt.Errorf("CSV line %d: secret_hex: %w", line, err)
+			}
+		} else {
+			v = strings.ToUpper(strings.ReplaceAll(field("secret"), " ", ""))
+			if s.Secret, err = b32NoPadding.DecodeString(strings.TrimRight(v, "=")); err != nil {
+				return nil, fmt.Errorf("CSV line %d: secret: %w", line, err)
+			}
+		}
+		if s.Digits, err = atoiOrZero(field("digits")); err != nil {
+			return nil, fmt.Errorf("CSV line %d: digits: %w", line, err)
+		}
+		if s.Period, err = atoiOrZero(field("period")); err != nil {
+			return nil, fmt.Errorf("CSV line %d: period: %w", line, err)
+		}
+		if v := field("counter"); v != "" {
+			if s.Counter, err = strconv.ParseUint(v, 10, 64); err != nil {
+				return nil, fmt.Errorf("CSV line %d: counter: %w", line, err)
+			}
+		}
+		if err := s.normalize(); err != nil {
+			return nil, fmt.Errorf("CSV line %d: %w", line, err)
+		}
+		seeds = append(seeds, s)
+	}
+	return seeds, nil
+}
+
+func atoiOrZero(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(s)
+}
@@ -0,0 +1,73 @@
+package hwtoken
+
+import (
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Seed is one hardware token's key material and OATH parameters.
+type Seed struct {
+	Serial    string
+	Type      string // totp or hotp
+	Secret    []byte
+	Algorithm string // SHA1, SHA256 or SHA512
+	Digits    int
+	Period    int    // TOTP time step in seconds
+	Counter   uint64 // HOTP starting counter
+	Issuer    string
+}
+
+// Token types.
+const (
+	TypeTOTP = "totp"
+	TypeHOTP = "hotp"
+)
+
+var b32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// SecretBase32 returns the secret as unpadded base32, the form stored in credentials.
+func (s Seed) SecretBase32() string {
+	return b32NoPadding.EncodeToString(s.Secret)
+}
+
+// normalize fills defaults and rejects seeds the service cannot verify.
+func (s *Seed) normalize() error {
+	s.Serial = strings.TrimSpace(s.Serial)
+	if s.Serial == "" {
+		return errors.New("missing serial number")
+	}
+	s.Type = strings.ToLower(strings.TrimSpace(s.Type))
+	if s.Type == "" {
+		s.Type = TypeTOTP
+	}
+	if s.Type != TypeTOTP && s.Type != TypeHOTP {
+		return fmt.Errorf("token %s: unsupported type %q", s.Serial, s.Type)
+	}
+	if len(s.Secret) < 10 {
+		return fmt.Errorf("token %s: secret shorter than 80 bits", s.Serial)
+	}
+	s.Algorithm = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(s.Algorithm), "-", ""))
+	s.Algorithm = strings.TrimPrefix(s.Algorithm, "HMAC")
+	switch s.Algorithm {
+	case "":
+		s.Algorithm = "SHA1"
+	case "SHA1", "SHA256", "SHA512":
+	default:
+		return fmt.Errorf("token %s: unsupported algorithm %q", s.Serial, s.Algorithm)
+	}
+	if s.Digits == 0 {
+		s.Digits = 6
+	}
+	if s.Digits != 6 && s.Digits != 8 {
+		return fmt.Errorf("token %s: unsupported digits %d (want 6 or 8)", s.Serial, s.Digits)
+	}
+	if s.Type == TypeTOTP && s.Period == 0 {
+		s.Period = 30
+	}
+	if s.Period < 0 {
+		return fmt.Errorf("token %s: invalid period %d", s.Serial, s.Period)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package hwtoken
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+var testSeed = []byte("12345678901234567890") // RFC 4226 test secret
+
+func TestParseCSV(t *testing.T) {
+	in := `# vendor export
+serial,secret_hex,type,digits,counter,algorithm
+HW001,3132333435363738393031323334353637383930,hotp,6,5,
+HW002,3132333435363738393031323334353637383930,totp,8,,HMAC-SHA256
+`
+	seeds, err := ParseCSV(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("ParseCSV: %v", err)
+	}
+	if len(seeds) != 2 {
+		t.Fatalf("len = %d, want 2", len(seeds))
+	}
+	if s := seeds[0]; s.Serial != "HW001" || s.Type != TypeHOTP || s.Counter != 5 || s.Algorithm != "SHA1" || !bytes.Equal(s.Secret, testSeed) {
+		t.Errorf("seed 0 = %+v", s)
+	}
+	if s := seeds[1]; s.Type != TypeTOTP || s.Digits != 8 || s.Period != 30 || s.Algorithm != "SHA256" {
+		t.Errorf("seed 1 = %+v", s)
+	}
+
+	b32 := "serial,secret\nHW003,GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ\n"
+	seeds, err = ParseCSV(strings.NewReader(b32))
+	if err != nil || len(seeds) != 1 || seeds[0].SecretBase32() != "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" {
+		t.Errorf("base32 CSV = %+v, %v", seeds, err)
+	}
+
+	for _, bad := range []string{
+		"secret\nGEZDGNBVGY3TQOJQ\n",                                // no serial column
+		"serial,secret\nHW004,not-base32!\n",                        // bad secret
+		"serial,secret,digits\nHW005,GEZDGNBVGY3TQOJQGEZDGNBV,7\n",  // bad digits
+		"serial,secret,type\nHW006,GEZDGNBVGY3TQOJQGEZDGNBV,ocra\n", // unsupported type
+	} {
+		if _, err := ParseCSV(strings.NewReader(bad)); err == nil {
+			t.Errorf("ParseCSV(%q) should fail", bad)
+		}
+	}
+}
+
+const plainPSKC = `<?xml version="1.0" encoding="UTF-8"?>
+<KeyContainer Version="1.0" xmlns="urn:ietf:params:xml:ns:keyprov:pskc">
+  <KeyPackage>
+    <DeviceInfo><Manufacturer>Manufacturer</Manufacturer><SerialNo>987654321</SerialNo></DeviceInfo>
+    <Key Id="12345678" Algorithm="urn:ietf:params:xml:ns:keyprov:pskc:hotp">
+      <Issuer>Issuer-A</Issuer>
+      <AlgorithmParameters><ResponseFormat Length="8" Encoding="DECIMAL"/></AlgorithmParameters>
+      <Data>
+        <Secret><PlainValue>MTIzNDU2Nzg5MDEyMzQ1Njc4OTA=</PlainValue></Secret>
+        <Counter><PlainValue>0</PlainValue></Counter>
+      </Data>
+    </Key>
+  </KeyPackage>
+</KeyContainer>`
+
+func TestParsePSKC_Plain(t *testing.T) {
+	seeds, err := ParsePSKC(strings.NewReader(plainPSKC), nil)
+	if err != nil {
+		t.Fatalf("ParsePSKC: %v", err)
+	}
+	if len(seeds) != 1 {
+		t.Fatalf("len = %d, want 1", len(seeds))
+	}
+	s := seeds[0]
+	if s.Serial != "987654321" || s.Type != TypeHOTP || s.Digits != 8 || s.Issuer != "Issuer-A" || !bytes.Equal(s.Secret, testSeed) {
+		t.Errorf("seed = %+v", s)
+	}
+}
+
+// encryptCBC returns IV || AES-CBC(PKCS#7(plain)) as PSKC expects.
+func encryptCBC(t *testing.T, key, plain []byte) []byte {
+	t.Helper()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pad := aes.BlockSize - len(plain)%aes.BlockSize
+	padded := append(append([]byte{}, plain...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	out := make([]byte, aes.BlockSize+len(padded))
+	copy(out, []byte("0123456789abcdef"))
+	cipher.NewCBCEncrypter(block, out[:aes.BlockSize]).CryptBlocks(out[aes.BlockSize:], padded)
+	return out
+}
+
+func TestParsePSKC_Encrypted(t *testing.T) {
+	psk := []byte("0123456789ABCDEF")
+	macKey := []byte("mac-key-for-this-file")
+	encMAC := encryptCBC(t, psk, macKey)
+	encSecret := encryptCBC(t, psk, testSeed)
+	mac := hmac.New(sha1.New, macKey)
+	mac.Write(encSecret)
+	valueMAC := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	doc := func(valueMAC string) string {
+		return `<?xml version="1.0" encoding="UTF-8"?>
+<pskc:KeyContainer Version="1.0" xmlns:pskc="urn:ietf:params:xml:ns:keyprov:pskc" xmlns:xenc="http://www.w3.org/2001/04/xmlenc#" xmlns:ds="http://www.w3.org/2000/09/xmldsig#">
+  <pskc:EncryptionKey><ds:KeyName>Pre-shared-key</ds:KeyName></pskc:EncryptionKey>
+  <pskc:MACMethod Algorithm="http://www.w3.org/2000/09/xmldsig#hmac-sha1">
+    <pskc:MACKey>
+      <xenc:EncryptionMethod Algorithm="http://www.w3.org/2001/04/xmlenc#aes128-cbc"/>
+      <xenc:CipherData><xenc:CipherValue>` + base64.StdEncoding.EncodeToString(encMAC) + `</xenc:CipherValue></xenc:CipherData>
+    </pskc:MACKey>
+  </pskc:MACMethod>
+  <pskc:KeyPackage>
+    <pskc:DeviceInfo><pskc:SerialNo>TOTP-0001</pskc:SerialNo></pskc:DeviceInfo>
+    <pskc:Key Id="k1" Algorithm="urn:ietf:params:xml:ns:keyprov:pskc:totp">
+      <pskc:AlgorithmParameters><pskc:ResponseFormat Length="6" Encoding="DECIMAL"/></pskc:AlgorithmParameters>
+      <pskc:Data>
+        <pskc:Secret>
+          <pskc:EncryptedValue>
+            <xenc:EncryptionMethod Algorithm="http://www.w3.org/2001/04/xmlenc#aes128-cbc"/>
+            <xenc:CipherData><xenc:CipherValue>` + base64.StdEncoding.EncodeToString(encSecret) + `</xenc:CipherValue></xenc:CipherData>
+          </pskc:EncryptedValue>
+          <pskc:ValueMAC>` + valueMAC + `</pskc:ValueMAC>
+        </pskc:Secret>
+        <pskc:TimeInterval><pskc:PlainValue>60</pskc:PlainValue></pskc:TimeInterval>
+      </pskc:Data>
+    </pskc:Key>
+  </pskc:KeyPackage>
+</pskc:KeyContainer>`
+	}
+
+	seeds, err := ParsePSKC(strings.NewReader(doc(valueMAC)), psk)
+	if err != nil {
+		t.Fatalf("ParsePSKC: %v", err)
+	}
+	if s := seeds[0]; s.Serial != "TOTP-0001" || s.Type != TypeTOTP || s.Period != 60 || !bytes.Equal(s.Secret, testSeed) {
+		t.Errorf("seed = %+v", s)
+	}
+	if _, err := ParsePSKC(strings.NewReader(doc(valueMAC)), []byte("wrong-key-16byte")); err == nil {
+		t.Error("wrong pre-shared key should fail")
+	}
+	if _, err := ParsePSKC(strings.NewReader(doc(base64.StdEncoding.EncodeToString(make([]byte, 20)))), psk); err == nil {
+		t.Error("bad ValueMAC should fail")
+	}
+	if _, err := ParsePSKC(strings.NewReader(doc(valueMAC)), nil); err == nil {
+		t.Error("missing pre-shared key should fail")
+	}
+}
@@ -0,0 +1,214 @@
+package hwtoken
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// PSKC (RFC 6030) algorithm identifiers.
+const (
+	pskcHOTP = "urn:ietf:params:xml:ns:keyprov:pskc:hotp"
+	pskcTOTP = "urn:ietf:params:xml:ns:keyprov:pskc:totp"
+
+	xmlencAES128CBC = "http://www.w3.org/2001/04/xmlenc#aes128-cbc"
+	xmlencAES192CBC = "http://www.w3.org/2001/04/xmlenc#aes192-cbc"
+	xmlencAES256CBC = "http://www.w3.org/2001/04/xmlenc#aes256-cbc"
+
+	macHMACSHA1   = "http://www.w3.org/2000/09/xmldsig#hmac-sha1"
+	macHMACSHA256 = "http://www.w3.org/2001/04/xmldsig-more#hmac-sha256"
+)
+
+// Element names are matched without namespace, so both prefixed (pskc:, xenc:) and default-namespace
+// documents parse.
+type pskcContainer struct {
+	MACMethod *struct {
+		Algorithm string         `xml:"Algorithm,attr"`
+		MACKey    *pskcEncrypted `xml:"MACKey"`
+	} `xml:"MACMethod"`
+	KeyPackages []struct {
+		DeviceInfo struct {
+			SerialNo string `xml:"SerialNo"`
+		} `xml:"DeviceInfo"`
+		Key struct {
+			ID                  string `xml:"Id,attr"`
+			Algorithm           string `xml:"Algorithm,attr"`
+			Issuer              string `xml:"Issuer"`
+			AlgorithmParameters struct {
+				Suite          string `xml:"Suite"`
+				ResponseFormat struct {
+					Length int `xml:"Length,attr"`
+				} `xml:"ResponseFormat"`
+			} `xml:"AlgorithmParameters"`
+			Data struct {
+				Secret       pskcValue `xml:"Secret"`
+				Counter      pskcValue `xml:"Counter"`
+				TimeInterval pskcValue `xml:"TimeInterval"`
+			} `xml:"Data"`
+		} `xml:"Key"`
+	} `xml:"KeyPackage"`
+}
+
+type pskcValue struct {
+	PlainValue     string         `xml:"PlainValue"`
+	EncryptedValue *pskcEncrypted `xml:"EncryptedValue"`
+	ValueMAC       string         `xml:"ValueMAC"`
+}
+
+type pskcEncrypted struct {
+	EncryptionMethod struct {
+		Algorithm string `xml:"Algorithm,attr"`
+	} `xml:"EncryptionMethod"`
+	CipherValue string `xml:"CipherData>CipherValue"`
+}
+
+// ParsePSKC reads an RFC 6030 key container. Secrets may be plain or encrypted with a pre-shared AES key
+// (aes128/192/256-cbc); when the container declares a MACMethod, each encrypted secret's ValueMAC is checked.
+// preSharedKey may be nil when the file only has plain values.
+func ParsePSKC(r io.Reader, preSharedKey []byte) ([]Seed, error) {
+	var kc pskcContainer
+	if err := xml.NewDecoder(r).Decode(&kc); err != nil {
+		return nil, fmt.Errorf("parse PSKC: %w", err)
+	}
+
+	var macKey []byte
+	var macHash func() hash.Hash
+	if kc.MACMethod != nil && kc.MACMethod.MACKey != nil {
+		switch kc.MACMethod.Algorithm {
+		case macHMACSHA1:
+			macHash = sha1.New
+		case macHMACSHA256:
+			macHash = sha256.New
+		default:
+			return nil, fmt.Errorf("PSKC: unsupported MAC algorithm %q", kc.MACMethod.Algorithm)
+		}
+		var err error
+		if macKey, _, err = decryptPSKC(kc.MACMethod.MACKey, preSharedKey); err != nil {
+			return nil, fmt.Errorf("PSKC MAC key: %w", err)
+		}
+	}
+
+	seeds := make([]Seed, 0, len(kc.KeyPackages))
+	for i, kp := range kc.KeyPackages {
+		k := kp.Key
+		s := Seed{
+			Serial:    kp.DeviceInfo.SerialNo,
+			Issuer:    strings.TrimSpace(k.Issuer),
+			Algorithm: k.AlgorithmParameters.Suite,
+			Digits:    k.AlgorithmParameters.ResponseFormat.Length,
+		}
+		if s.Serial == "" {
+			s.Serial = k.ID
+		}
+		switch strings.TrimSpace(k.Algorithm) {
+		case pskcHOTP:
+			s.Type = TypeHOTP
+		case pskcTOTP:
+			s.Type = TypeTOTP
+		default:
+			return nil, fmt.Errorf("PSKC key %d: unsupported algorithm %q", i+1, k.Algorithm)
+		}
+
+		secret := k.Data.Secret
+		switch {
+		case secret.EncryptedValue != nil:
+			plain, cipherValue, err := decryptPSKC(secret.EncryptedValue, preSharedKey)
+			if err != nil {
+				return nil, fmt.Errorf("PSKC key %d: %w", i+1, err)
+			}
+			if macKey != nil {
+				if err := checkValueMAC(macHash, macKey, cipherValue, secret.ValueMAC); err != nil {
+					return nil, fmt.Errorf("PSKC key %d: %w", i+1, err)
+				}
+			}
+			s.Secret = plain
+		case secret.PlainValue != "":
+			b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(secret.PlainValue))
+			if err != nil {
+				return nil, fmt.Errorf("PSKC key %d: secret: %w", i+1, err)
+			}
+			s.Secret = b
+		default:
+			return nil, fmt.Errorf("PSKC key %d: no secret", i+1)
+		}
+
+		if v := strings.TrimSpace(k.Data.Counter.PlainValue); v != "" {
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("PSKC key %d: counter: %w", i+1, err)
+			}
+			s.Counter = n
+		}
+		if v := strings.TrimSpace(k.Data.TimeInterval.PlainValue); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("PSKC key %d: time interval: %w", i+1, err)
+			}
+			s.Period = n
+		}
+		if err := s.normalize(); err != nil {
+			return nil, fmt.Errorf("PSKC key %d: %w", i+1, err)
+		}
+		seeds = append(seeds, s)
+	}
+	return seeds, nil
+}
+
+// decryptPSKC decrypts an xmlenc AES-CBC value (IV || ciphertext, PKCS#7 padded) and also returns the
+// raw cipher value for MAC checking.
+func decryptPSKC(v *pskcEncrypted, key []byte) (plain, cipherValue []byte, err error) {
+	want := map[string]int{xmlencAES128CBC: 16, xmlencAES192CBC: 24, xmlencAES256CBC: 32}[v.EncryptionMethod.Algorithm]
+	if want == 0 {
+		return nil, nil, fmt.Errorf("unsupported encryption algorithm %q", v.EncryptionMethod.Algorithm)
+	}
+	if len(key) != want {
+		return nil, nil, fmt.Errorf("pre-shared key must be %d bytes for %s", want, v.EncryptionMethod.Algorithm)
+	}
+	cipherValue, err = base64.StdEncoding.DecodeString(strings.TrimSpace(v.CipherValue))
+	if err != nil {
+		return nil, nil, fmt.Errorf("cipher value: %w", err)
+	}
+	if len(cipherValue) < 2*aes.BlockSize || len(cipherValue)%aes.BlockSize != 0 {
+		return nil, nil, errors.New("cipher value has invalid length")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	iv, ct := cipherValue[:aes.BlockSize], cipherValue[aes.BlockSize:]
+	plain = make([]byte, len(ct))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, ct)
+	pad := int(plain[len(plain)-1])
+	if pad == 0 || pad > aes.BlockSize {
+		return nil, nil, errors.New("decrypt failed (wrong pre-shared key?)")
+	}
+	for _, b := range plain[len(plain)-pad:] {
+		if int(b) != pad {
+			return nil, nil, errors.New("decrypt failed (wrong pre-shared key?)")
+		}
+	}
+	return plain[:len(plain)-pad], cipherValue, nil
+}
+
+func checkValueMAC(h func() hash.Hash, macKey, cipherValue []byte, valueMAC string) error {
+	want, err := base64.StdEncoding.DecodeString(strings.TrimSpace(valueMAC))
+	if err != nil || len(want) == 0 {
+		return errors.New("missing or invalid ValueMAC")
+	}
+	mac := hmac.New(h, macKey)
+	mac.Write(cipherValue)
+	if !hmac.Equal(mac.Sum(nil), want) {
+		return errors.New("ValueMAC mismatch")
+	}
+	return nil
+}
@@ -1,61 +1,204 @@
 package metrics
 
 import (
+	"context"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 	metrics "github.com/soulteary/metrics-kit"
+
+	"github.com/soulteary/herald-totp/internal/store"
 )
 
-var (
-	// Registry is the Prometheus registry for herald-totp metrics
-	Registry *metrics.Registry
+// Metrics is one set of herald-totp collectors. Services record to their own set, so tests and
+// embedded instances can use a private registry. A nil *Metrics records nothing.
+//
+// Labels are bounded: routes are route patterns, operations are store method names, and no metric is
+// labelled by subject or IP.
+type Metrics struct {
+	VerifyTotal        *prometheus.CounterVec
+	EnrollStartTotal   prometheus.Counter
+	EnrollConfirmTotal *prometheus.CounterVec
 
-	// VerifyTotal counts verify attempts by result and reason
-	VerifyTotal *prometheus.CounterVec
+	RequestDuration          *prometheus.HistogramVec
+	RedisDuration            *prometheus.HistogramVec
+	StoreErrorsTotal         *prometheus.CounterVec
+	DecryptFailuresTotal     prometheus.Counter
+	RateLimitedTotal         *prometheus.CounterVec
+	BackupCodesConsumedTotal prometheus.Counter
+	AnomaliesTotal           *prometheus.CounterVec
+	AnomalyBlocksTotal       *prometheus.CounterVec
 
-	// EnrollStartTotal counts enroll/start calls
-	EnrollStartTotal prometheus.Counter
+	EnrolledSubjects   prometheus.Gauge
+	ActiveCredentials  prometheus.Gauge
+	PendingEnrollments prometheus.Gauge
+}
 
-	// EnrollConfirmTotal counts enroll/confirm by result
-	EnrollConfirmTotal *prometheus.CounterVec
-)
+// redisBuckets are the latency buckets of Redis operations, from 0.5ms to 1s.
+var redisBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
 
-func init() {
-	Init()
+// NewRegistry returns an empty registry for the herald_totp metrics, served on /metrics.
+func NewRegistry() *metrics.Registry {
+	return metrics.NewRegistry("herald_totp")
 }
 
-// Init initializes herald-totp metrics
-func Init() {
-	Registry = metrics.NewRegistry("herald_totp")
-	VerifyTotal = Registry.Counter("verify_total").
-		Help("Total TOTP verify attempts").
-		Labels("result", "reason").
-		BuildVec()
-	EnrollStartTotal = Registry.Counter("enroll_start_total").
-		Help("Total TOTP enroll/start calls").
-		Build()
-	EnrollConfirmTotal = Registry.Counter("enroll_confirm_total").
-		Help("Total TOTP enroll/confirm by result").
-		Labels("result").
-		BuildVec()
+// New registers a metrics set on reg.
+func New(reg *metrics.Registry) *Metrics {
+	return &Metrics{
+		VerifyTotal: reg.Counter("verify_total").
+			Help("Total TOTP verify attempts").
+			Labels("result", "reason").
+			BuildVec(),
+		EnrollStartTotal: reg.Counter("enroll_start_total").
+			Help("Total TOTP enroll/start calls").
+			Build(),
+		EnrollConfirmTotal: reg.Counter("enroll_confirm_total").
+			Help("Total TOTP enroll/confirm by result").
+			Labels("result").
+			BuildVec(),
+		RequestDuration: reg.Histogram("request_duration_seconds").
+			Help("API request latency by transport (http, grpc), route pattern or RPC method, and status").
+			Labels("transport", "route", "status").
+			Buckets(prometheus.DefBuckets).
+			BuildVec(),
+		RedisDuration: reg.Histogram("redis_operation_duration_seconds").
+			Help("Store operation latency by operation").
+			Labels("operation").
+			Buckets(redisBuckets).
+			BuildVec(),
+		StoreErrorsTotal: reg.Counter("store_errors_total").
+			Help("Store operations that failed, by operation").
+			Labels("operation").
+			BuildVec(),
+		DecryptFailuresTotal: reg.Counter("decrypt_failures_total").
+			Help("Stored secrets that could not be decrypted").
+			Build(),
+		RateLimitedTotal: reg.Counter("rate_limited_total").
+			Help("Requests rejected by a rate limit, by dimension (subject, ip)").
+			Labels("dimension").
+			BuildVec(),
+		BackupCodesConsumedTotal: reg.Counter("backup_codes_consumed_total").
+			Help("Backup codes used to verify").
+			Build(),
+		AnomaliesTotal: reg.Counter("anomalies_total").
+			Help("Anomalies detected on verify traffic, by signal").
+			Labels("signal").
+			BuildVec(),
+		AnomalyBlocksTotal: reg.Counter("anomaly_blocks_total").
+			Help("Temporary blocks applied after an anomaly, by dimension (subject, ip)").
+			Labels("dimension").
+			BuildVec(),
+		EnrolledSubjects: reg.Gauge("enrolled_subjects").
+			Help("Subjects with at least one credential, as of the last gauge update").
+			Build(),
+		ActiveCredentials: reg.Gauge("active_credentials").
+			Help("Credentials, including additional authenticators, as of the last gauge update").
+			Build(),
+		PendingEnrollments: reg.Gauge("pending_enrollments").
+			Help("Unexpired enrollments awaiting confirmation, as of the last gauge update").
+			Build(),
+	}
 }
 
 // RecordVerify records a verify attempt (result: "success" or "failure", reason: e.g. "invalid", "replay")
-func RecordVerify(result, reason string) {
-	if VerifyTotal != nil {
-		VerifyTotal.WithLabelValues(result, reason).Inc()
+func (m *Metrics) RecordVerify(result, reason string) {
+	if m != nil && m.VerifyTotal != nil {
+		m.VerifyTotal.WithLabelValues(result, reason).Inc()
 	}
 }
 
 // RecordEnrollStart records an enroll/start call
-func RecordEnrollStart() {
-	if EnrollStartTotal != nil {
-		EnrollStartTotal.Inc()
+func (m *Metrics) RecordEnrollStart() {
+	if m != nil && m.EnrollStartTotal != nil {
+		m.EnrollStartTotal.Inc()
 	}
 }
 
 // RecordEnrollConfirm records an enroll/confirm (result: "success" or "failure")
-func RecordEnrollConfirm(result string) {
-	if EnrollConfirmTotal != nil {
-		EnrollConfirmTotal.WithLabelValues(result).Inc()
+func (m *Metrics) RecordEnrollConfirm(result string) {
+	if m != nil && m.EnrollConfirmTotal != nil {
+		m.EnrollConfirmTotal.WithLabelValues(result).Inc()
+	}
+}
+
+// ObserveRequest records the latency of an API request (transport: "http" or "grpc"; route: the route
+// pattern or RPC method; status: the HTTP status or gRPC code).
+func (m *Metrics) ObserveRequest(transport, route, status string, d time.Duration) {
+	if m != nil && m.RequestDuration != nil {
+		m.RequestDuration.WithLabelValues(transport, route, status).Observe(d.Seconds())
+	}
+}
+
+// StoreHook returns a store hook recording the latency and errors of every store operation.
+func (m *Metrics) StoreHook() store.Hook {
+	return func(ctx context.Context, op string) (context.Context, func(error)) {
+		start := time.Now()
+		return ctx, func(err error) {
+			m.ObserveStoreOperation(op, time.Since(start), err)
+		}
+	}
+}
+
+// ObserveStoreOperation records the latency of a store operation and counts it when it failed.
+func (m *Metrics) ObserveStoreOperation(op string, d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	if m.RedisDuration != nil {
+		m.RedisDuration.WithLabelValues(op).Observe(d.Seconds())
+	}
+	if err != nil && m.StoreErrorsTotal != nil {
+		m.StoreErrorsTotal.WithLabelValues(op).Inc()
+	}
+}
+
+// RecordDecryptFailure records a stored secret that could not be decrypted
+func (m *Metrics) RecordDecryptFailure() {
+	if m != nil && m.DecryptFailuresTotal != nil {
+		m.DecryptFailuresTotal.Inc()
+	}
+}
+
+// RecordRateLimited records a request rejected by a rate limit (dimension: "subject" or "ip")
+func (m *Metrics) RecordRateLimited(dimension string) {
+	if m != nil && m.RateLimitedTotal != nil {
+		m.RateLimitedTotal.WithLabelValues(dimension).Inc()
+	}
+}
+
+// RecordBackupCodeConsumed records a backup code used to verify
+func (m *Metrics) RecordBackupCodeConsumed() {
+	if m != nil && m.BackupCodesConsumedTotal != nil {
+		m.BackupCodesConsumedTotal.Inc()
+	}
+}
+
+// RecordAnomaly records an anomaly detected on verify traffic (signal: e.g. "credential_stuffing")
+func (m *Metrics) RecordAnomaly(signal string) {
+	if m != nil && m.AnomaliesTotal != nil {
+		m.AnomaliesTotal.WithLabelValues(signal).Inc()
+	}
+}
+
+// RecordAnomalyBlock records a temporary block applied after an anomaly (dimension: "subject" or "ip")
+func (m *Metrics) RecordAnomalyBlock(dimension string) {
+	if m != nil && m.AnomalyBlocksTotal != nil {
+		m.AnomalyBlocksTotal.WithLabelValues(dimension).Inc()
+	}
+}
+
+// SetInventory sets the enrolled subject, credential and pending enrollment gauges.
+func (m *Metrics) SetInventory(subjects, credentials, pending int64) {
+	if m == nil {
+		return
+	}
+	if m.EnrolledSubjects != nil {
+		m.EnrolledSubjects.Set(float64(subjects))
+	}
+	if m.ActiveCredentials != nil {
+		m.ActiveCredentials.Set(float64(credentials))
+	}
+	if m.PendingEnrollments != nil {
+		m.PendingEnrollments.Set(float64(pending))
 	}
 }
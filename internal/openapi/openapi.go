@@ -0,0 +1,26 @@
+package openapi
+
+import (
+	_ "embed"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// spec is the hand-maintained OpenAPI 3 document of the HTTP API. Contract tests keep it in step
+// with the routes in internal/router and the request and response structs in internal/handler.
+//
+//go:embed openapi.json
+var spec []byte
+
+// Spec returns the OpenAPI document.
+func Spec() []byte {
+	return spec
+}
+
+// Handler serves the OpenAPI document (GET /openapi.json).
+func Handler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		return c.Send(spec)
+	}
+}
@@ -0,0 +1,191 @@
+package openapi
+
+import (
+	"encoding/json"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/soulteary/herald-totp/internal/handler"
+	"github.com/soulteary/herald-totp/pkg/totpservice"
+)
+
+type schema struct {
+	Ref        string             `json:"$ref"`
+	Type       string             `json:"type"`
+	Properties map[string]*schema `json:"properties"`
+	Required   []string           `json:"required"`
+	Items      *schema            `json:"items"`
+}
+
+type document struct {
+	Components struct {
+		Schemas   map[string]*schema        `json:"schemas"`
+		Responses map[string]map[string]any `json:"responses"`
+	} `json:"components"`
+}
+
+// contract maps each component schema to the Go struct the handlers encode or decode. For response
+// structs, required must list exactly the fields without omitempty (the ones always present).
+var contract = []struct {
+	schema   string
+	typ      reflect.Type
+	response bool
+}{
+	{"ErrorResponse", reflect.TypeFor[handler.ErrorResponse](), true},
+	{"EnrollStartRequest", reflect.TypeFor[totpservice.EnrollStartRequest](), false},
+	{"EnrollStartResponse", reflect.TypeFor[totpservice.EnrollStartResponse](), true},
+	{"EnrollConfirmRequest", reflect.TypeFor[totpservice.EnrollConfirmRequest](), false},
+	{"EnrollConfirmResponse", reflect.TypeFor[totpservice.EnrollConfirmResponse](), true},
+	{"EnrollStatusResponse", reflect.TypeFor[totpservice.EnrollStatusResponse](), true},
+	{"EnrollCancelRequest", reflect.TypeFor[totpservice.EnrollCancelRequest](), false},
+	{"EnrollCancelResponse", reflect.TypeFor[totpservice.EnrollCancelResponse](), true},
+	{"VerifyRequest", reflect.TypeFor[totpservice.VerifyRequest](), false},
+	{"VerifyResponse", reflect.TypeFor[totpservice.VerifyResponse](), true},
+	{"HOTPResyncRequest", reflect.TypeFor[totpservice.HOTPResyncRequest](), false},
+	{"HOTPResyncResponse", reflect.TypeFor[totpservice.HOTPResyncResponse](), true},
+	{"RevokeRequest", reflect.TypeFor[totpservice.RevokeRequest](), false},
+	{"RevokeResponse", reflect.TypeFor[totpservice.RevokeResponse](), true},
+	{"StatusResponse", reflect.TypeFor[totpservice.StatusResponse](), true},
+	{"AuditEvent", reflect.TypeFor[totpservice.AuditEvent](), true},
+	{"AuditResponse", reflect.TypeFor[totpservice.AuditResponse](), true},
+	{"TokensImportResponse", reflect.TypeFor[totpservice.TokensImportResponse](), true},
+	{"HardwareTokenInfo", reflect.TypeFor[totpservice.HardwareTokenInfo](), true},
+	{"TokensListResponse", reflect.TypeFor[totpservice.TokensListResponse](), true},
+	{"TokensAssignRequest", reflect.TypeFor[totpservice.TokensAssignRequest](), false},
+	{"TokensAssignResponse", reflect.TypeFor[totpservice.TokensAssignResponse](), true},
+}
+
+func loadSpec(t *testing.T) *document {
+	t.Helper()
+	var doc document
+	if err := json.Unmarshal(Spec(), &doc); err != nil {
+		t.Fatalf("openapi.json: %v", err)
+	}
+	return &doc
+}
+
+func TestSpec_SchemasMatchStructs(t *testing.T) {
+	doc := loadSpec(t)
+	schemaFor := map[reflect.Type]string{}
+	for _, c := range contract {
+		schemaFor[c.typ] = c.schema
+	}
+	covered := map[string]bool{}
+	for _, c := range contract {
+		covered[c.schema] = true
+		t.Run(c.schema, func(t *testing.T) {
+			s := doc.Components.Schemas[c.schema]
+			if s == nil {
+				t.Fatalf("openapi.json has no schema %s for %s", c.schema, c.typ)
+			}
+			var alwaysPresent []string
+			fields := map[string]bool{}
+			for i := range c.typ.NumField() {
+				f := c.typ.Field(i)
+				name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+				if name == "-" || !f.IsExported() {
+					continue
+				}
+				fields[name] = true
+				if !strings.Contains(opts, "omitempty") {
+					alwaysPresent = append(alwaysPresent, name)
+				}
+				prop := s.Properties[name]
+				if prop == nil {
+					t.Errorf("%s.%s (json %q) is not a property of the schema", c.typ.Name(), f.Name, name)
+					continue
+				}
+				if want, got := typeOf(f.Type, schemaFor), describe(prop); want != got {
+					t.Errorf("property %q is %s in the spec, %s in %s", name, got, want, c.typ.Name())
+				}
+			}
+			for name := range s.Properties {
+				if !fields[name] {
+					t.Errorf("property %q has no field in %s", name, c.typ.Name())
+				}
+			}
+			for _, name := range s.Required {
+				if !fields[name] {
+					t.Errorf("required property %q has no field in %s", name, c.typ.Name())
+				}
+			}
+			if c.response {
+				required := slices.Clone(s.Required)
+				sort.Strings(required)
+				sort.Strings(alwaysPresent)
+				if !slices.Equal(required, alwaysPresent) {
+					t.Errorf("required = %v, want the fields without omitempty %v", required, alwaysPresent)
+				}
+			}
+		})
+	}
+	for name := range doc.Components.Schemas {
+		if !covered[name] {
+			t.Errorf("schema %s is not checked against a struct; add it to contract", name)
+		}
+	}
+}
+
+// typeOf describes the JSON encoding of a Go type in the terms of describe.
+func typeOf(t reflect.Type, schemaFor map[reflect.Type]string) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Slice:
+		return "array of " + typeOf(t.Elem(), schemaFor)
+	case reflect.Struct:
+		if name, ok := schemaFor[t]; ok {
+			return "#/components/schemas/" + name
+		}
+	}
+	return "unsupported " + t.String()
+}
+
+func describe(s *schema) string {
+	if s.Ref != "" {
+		return s.Ref
+	}
+	if s.Type == "array" && s.Items != nil {
+		return "array of " + describe(s.Items)
+	}
+	return s.Type
+}
+
+// TestSpec_RefsResolve checks that every $ref names a component schema or response.
+func TestSpec_RefsResolve(t *testing.T) {
+	doc := loadSpec(t)
+	var raw any
+	if err := json.Unmarshal(Spec(), &raw); err != nil {
+		t.Fatal(err)
+	}
+	var walk func(v any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			if ref, ok := v["$ref"].(string); ok {
+				if name, found := strings.CutPrefix(ref, "#/components/responses/"); found {
+					if doc.Components.Responses[name] == nil {
+						t.Errorf("unresolved $ref %q", ref)
+					}
+				} else if name, found := strings.CutPrefix(ref, "#/components/schemas/"); !found || doc.Components.Schemas[name] == nil {
+					t.Errorf("unresolved $ref %q", ref)
+				}
+			}
+			for _, child := range v {
+				walk(child)
+			}
+		case []any:
+			for _, child := range v {
+				walk(child)
+			}
+		}
+	}
+	walk(raw)
+}
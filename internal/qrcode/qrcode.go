@@ -0,0 +1,157 @@
+package qrcode
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/qr"
+)
+
+// Output formats.
+const (
+	FormatPNG = "png"
+	FormatSVG = "svg"
+)
+
+// Content types for each format.
+const (
+	ContentTypePNG = "image/png"
+	ContentTypeSVG = "image/svg+xml"
+)
+
+// quietZone is the margin in modules around the symbol required by the QR spec.
+const quietZone = 4
+
+// Options controls QR rendering.
+type Options struct {
+	Format string // png or svg
+	Size   int    // width and height in pixels
+	Level  string // error-correction level: L, M, Q or H
+}
+
+// ParseLevel maps L/M/Q/H (case-insensitive) to a QR error-correction level.
+func ParseLevel(s string) (qr.ErrorCorrectionLevel, error) {
+	switch strings.ToUpper(strings.TrimSpace(s)) {
+	case "L":
+		return qr.L, nil
+	case "M":
+		return qr.M, nil
+	case "Q":
+		return qr.Q, nil
+	case "H":
+		return qr.H, nil
+	}
+	return qr.M, fmt.Errorf("unknown QR error-correction level %q (want L, M, Q or H)", s)
+}
+
+// Validate checks format, size (1..maxSize) and level.
+func (o Options) Validate(maxSize int) error {
+	if o.Format != FormatPNG && o.Format != FormatSVG {
+		return fmt.Errorf("unknown QR format %q (want png or svg)", o.Format)
+	}
+	if o.Size <= 0 || o.Size > maxSize {
+		return fmt.Errorf("QR size must be between 1 and %d", maxSize)
+	}
+	_, err := ParseLevel(o.Level)
+	return err
+}
+
+// Render encodes content as a QR code and returns the image and its content type.
+func Render(content string, opts Options) ([]byte, string, error) {
+	level, err := ParseLevel(opts.Level)
+	if err != nil {
+		return nil, "", err
+	}
+	code, err := qr.Encode(content, level, qr.Auto)
+	if err != nil {
+		return nil, "", err
+	}
+	switch opts.Format {
+	case FormatPNG:
+		b, err := renderPNG(code, opts.Size)
+		return b, ContentTypePNG, err
+	case FormatSVG:
+		return renderSVG(code, opts.Size), ContentTypeSVG, nil
+	}
+	return nil, "", fmt.Errorf("unknown QR format %q (want png or svg)", opts.Format)
+}
+
+// Inline renders content for embedding in a JSON response: a base64 PNG data URI, or SVG markup.
+func Inline(content string, opts Options) (string, error) {
+	b, contentType, err := Render(content, opts)
+	if err != nil {
+		return "", err
+	}
+	if contentType == ContentTypePNG {
+		return "data:" + ContentTypePNG + ";base64," + base64.StdEncoding.EncodeToString(b), nil
+	}
+	return string(b), nil
+}
+
+// renderPNG scales the symbol (plus quiet zone) to size x size pixels.
+func renderPNG(code barcode.Barcode, size int) ([]byte, error) {
+	modules := code.Bounds().Dx() + 2*quietZone
+	if size < modules {
+		size = modules
+	}
+	// Scale the symbol so its quiet zone is included in the requested size.
+	inner := size * code.Bounds().Dx() / modules
+	scaled, err := barcode.Scale(code, inner, inner)
+	if err != nil {
+		return nil, err
+	}
+	padded := &paddedImage{Image: scaled, pad: (size - inner) / 2, size: size}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, padded); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// renderSVG emits one rect per dark module; the viewBox includes the quiet zone so the SVG scales cleanly.
+func renderSVG(code barcode.Barcode, size int) []byte {
+	bounds := code.Bounds()
+	modules := bounds.Dx() + 2*quietZone
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size, modules, modules)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, modules, modules)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if isDark(code, x, y) {
+				fmt.Fprintf(&buf, "M%d %dh1v1h-1z", x-bounds.Min.X+quietZone, y-bounds.Min.Y+quietZone)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes()
+}
+
+func isDark(code barcode.Barcode, x, y int) bool {
+	r, _, _, _ := code.At(x, y).RGBA()
+	return r < 0x8000
+}
+
+// paddedImage centres an image on a white size x size canvas (the quiet zone).
+type paddedImage struct {
+	image.Image
+	pad  int
+	size int
+}
+
+func (p *paddedImage) ColorModel() color.Model { return color.GrayModel }
+
+func (p *paddedImage) Bounds() image.Rectangle { return image.Rect(0, 0, p.size, p.size) }
+
+func (p *paddedImage) At(x, y int) color.Color {
+	pt := image.Pt(x-p.pad, y-p.pad).Add(p.Image.Bounds().Min)
+	if !pt.In(p.Image.Bounds()) {
+		return color.White
+	}
+	return color.GrayModel.Convert(p.Image.At(pt.X, pt.Y))
+}
@@ -0,0 +1,93 @@
+package qrcode
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+const testURI = "otpauth://totp/Herald:user@example.com?secret=JBSWY3DPEHPK3PXP&issuer=Herald"
+
+func TestParseLevel(t *testing.T) {
+	for _, s := range []string{"L", "m", " Q ", "h"} {
+		if _, err := ParseLevel(s); err != nil {
+			t.Errorf("ParseLevel(%q): %v", s, err)
+		}
+	}
+	if _, err := ParseLevel("X"); err == nil {
+		t.Error("ParseLevel(X) should fail")
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	ok := Options{Format: FormatPNG, Size: 256, Level: "M"}
+	if err := ok.Validate(1024); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+	bad := []Options{
+		{Format: "gif", Size: 256, Level: "M"},
+		{Format: FormatSVG, Size: 0, Level: "M"},
+		{Format: FormatSVG, Size: 2048, Level: "M"},
+		{Format: FormatSVG, Size: 256, Level: "Z"},
+	}
+	for _, o := range bad {
+		if err := o.Validate(1024); err == nil {
+			t.Errorf("Validate(%+v) should fail", o)
+		}
+	}
+}
+
+func TestRender_PNG(t *testing.T) {
+	b, contentType, err := Render(testURI, Options{Format: FormatPNG, Size: 200, Level: "M"})
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	if contentType != ContentTypePNG {
+		t.Errorf("content type = %q", contentType)
+	}
+	img, err := png.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("png.Decode: %v", err)
+	}
+	if got := img.Bounds().Dx(); got != 200 || img.Bounds().Dy() != 200 {
+		t.Errorf("size = %v, want 200x200", img.Bounds())
+	}
+	// The quiet zone keeps the corners white.
+	if r, _, _, _ := img.At(0, 0).RGBA(); r != 0xffff {
+		t.Errorf("corner pixel is not white")
+	}
+}
+
+func TestRender_SVG(t *testing.T) {
+	b, contentType, err := Render(testURI, Options{Format: FormatSVG, Size: 300, Level: "H"})
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	if contentType != ContentTypeSVG {
+		t.Errorf("content type = %q", contentType)
+	}
+	s := string(b)
+	if !strings.HasPrefix(s, "<svg") || !strings.Contains(s, `width="300"`) || !strings.Contains(s, "h1v1h-1z") {
+		t.Errorf("unexpected SVG: %.120s", s)
+	}
+}
+
+func TestInline(t *testing.T) {
+	s, err := Inline(testURI, Options{Format: FormatPNG, Size: 128, Level: "L"})
+	if err != nil {
+		t.Fatalf("Inline: %v", err)
+	}
+	data, ok := strings.CutPrefix(s, "data:image/png;base64,")
+	if !ok {
+		t.Fatalf("Inline png = %.40q, want data URI", s)
+	}
+	if _, err := base64.StdEncoding.DecodeString(data); err != nil {
+		t.Errorf("data URI payload: %v", err)
+	}
+	s, err = Inline(testURI, Options{Format: FormatSVG, Size: 128, Level: "L"})
+	if err != nil || !strings.HasPrefix(s, "<svg") {
+		t.Errorf("Inline svg = %.40q, %v", s, err)
+	}
+}
@@ -0,0 +1,98 @@
+package router
+
+import (
+	"crypto/subtle"
+	"slices"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+	logger "github.com/soulteary/logger-kit"
+	middlewarekit "github.com/soulteary/middleware-kit"
+
+	"github.com/soulteary/herald-totp/internal/config"
+	"github.com/soulteary/herald-totp/internal/handler"
+	"github.com/soulteary/herald-totp/internal/tlsauth"
+)
+
+// auth is the /v1 auth middleware. A verified client certificate mapped by TLS_IDENTITIES authenticates
+// the caller first; otherwise HMAC or the API key must. It follows config reloads: HMAC secrets and
+// identities are looked up per request, and the combined handler is rebuilt when API_KEY or the no-auth
+// fallback changes.
+type auth struct {
+	config func() *config.Config
+	log    *logger.Logger
+
+	mu          sync.Mutex
+	apiKey      string
+	allowNoAuth bool
+	next        fiber.Handler
+}
+
+func newAuth(cfg func() *config.Config, log *logger.Logger) *auth {
+	return &auth{config: cfg, log: log}
+}
+
+func (a *auth) handle(c *fiber.Ctx) error {
+	if cfg := a.config(); cfg.MTLS() {
+		if cert := tlsauth.PeerCertificate(c); cert != nil {
+			id, err := tlsauth.Identify(cert, cfg.TLSIdentities)
+			if err != nil {
+				a.log.Warn().Str("cn", cert.Subject.CommonName).Msg("mTLS: " + err.Error())
+				return c.Status(fiber.StatusUnauthorized).JSON(handler.ErrorResponse{
+					OK: false, Reason: "certificate_unknown", Message: err.Error(),
+				})
+			}
+			tlsauth.SetIdentity(c, id)
+			return c.Next()
+		}
+	}
+	return a.current()(c)
+}
+
+func (a *auth) current() fiber.Handler {
+	cfg := a.config()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.next != nil && a.apiKey == cfg.APIKey && a.allowNoAuth == cfg.AllowNoAuth() {
+		return a.next
+	}
+	zerologLogger := a.log.Zerolog()
+	a.apiKey, a.allowNoAuth = cfg.APIKey, cfg.AllowNoAuth()
+	a.next = middlewarekit.CombinedAuth(middlewarekit.AuthConfig{
+		HMACConfig: &middlewarekit.HMACConfig{
+			KeyProvider: func(keyID string) string { return a.config().HMACSecretFor(keyID) },
+		},
+		APIKeyConfig: &middlewarekit.APIKeyConfig{
+			APIKey: a.apiKey,
+		},
+		AllowNoAuth: a.allowNoAuth,
+		Logger:      &zerologLogger,
+	})
+	return a.next
+}
+
+// admin is the /v1/admin auth middleware. The service credentials do not open it: a caller needs a
+// verified client certificate mapped to one of ADMIN_IDENTITIES, or ADMIN_API_KEY in X-API-Key. Without
+// either setting every admin request is refused.
+func (a *auth) admin(c *fiber.Ctx) error {
+	cfg := a.config()
+	if cfg.AdminAPIKey == "" && len(cfg.AdminIdentities) == 0 {
+		return c.Status(fiber.StatusForbidden).JSON(handler.ErrorResponse{
+			OK: false, Reason: "admin_disabled", Message: "set ADMIN_API_KEY or ADMIN_IDENTITIES to enable the admin API",
+		})
+	}
+	if cfg.MTLS() {
+		if cert := tlsauth.PeerCertificate(c); cert != nil {
+			if id, err := tlsauth.Identify(cert, cfg.TLSIdentities); err == nil && slices.Contains(cfg.AdminIdentities, id) {
+				tlsauth.SetIdentity(c, id)
+				return c.Next()
+			}
+		}
+	}
+	if key := c.Get("X-API-Key"); cfg.AdminAPIKey != "" && key != "" &&
+		subtle.ConstantTimeCompare([]byte(key), []byte(cfg.AdminAPIKey)) == 1 {
+		return c.Next()
+	}
+	a.log.Warn().Str("ip", c.IP()).Str("path", c.Path()).Msg("admin: unauthorized")
+	return c.Status(fiber.StatusUnauthorized).JSON(handler.ErrorResponse{OK: false, Reason: "unauthorized"})
+}
@@ -0,0 +1,96 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gofiber/fiber/v2"
+	logger "github.com/soulteary/logger-kit"
+
+	"github.com/soulteary/herald-totp/internal/config"
+	"github.com/soulteary/herald-totp/pkg/heraldtotp"
+)
+
+// TestSetup_ClientHMACKeys runs pkg/heraldtotp against the real routes with several HMAC keys, the
+// way callers rotate keys: each signs with its own key ID.
+func TestSetup_ClientHMACKeys(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis: %v", err)
+	}
+	defer mr.Close()
+	const (
+		oldSecret = "old-hmac-secret-0123456789abcdef"
+		newSecret = "new-hmac-secret-0123456789abcdef"
+	)
+	defer config.Set(config.Get())
+	config.Update(func(c *config.Config) {
+		c.RedisAddr = mr.Addr()
+		c.APIKey = ""
+		c.HMACSecret = ""
+		c.HMACKeys = map[string]string{"2025": oldSecret, "2026": newSecret}
+	})
+
+	log := logger.New(logger.Config{Level: logger.Disabled})
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	if _, err := setup(app, log); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = app.Listener(ln) }()
+	defer func() { _ = app.Shutdown() }()
+	baseURL := "http://" + ln.Addr().String()
+
+	var signed atomic.Int32
+	custom := heraldtotp.SignerFunc(func(req *http.Request, body []byte) error {
+		signed.Add(1)
+		return (&heraldtotp.HMACSigner{KeyID: "2026", Secret: newSecret, Service: "billing"}).Sign(req, body)
+	})
+
+	tests := []struct {
+		name string
+		opts *heraldtotp.Options
+		ok   bool
+	}{
+		{"new key", heraldtotp.DefaultOptions().WithHMACKeyID("2026").WithHMACSecret(newSecret).WithService("billing"), true},
+		{"old key", heraldtotp.DefaultOptions().WithHMACKeyID("2025").WithHMACSecret(oldSecret), true},
+		{"no key id uses the lowest key", heraldtotp.DefaultOptions().WithHMACSecret(oldSecret), true},
+		{"secret of another key", heraldtotp.DefaultOptions().WithHMACKeyID("2025").WithHMACSecret(newSecret), false},
+		{"unknown key id", heraldtotp.DefaultOptions().WithHMACKeyID("2024").WithHMACSecret(oldSecret), false},
+		{"custom signer", heraldtotp.DefaultOptions().WithSigner(custom), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := heraldtotp.NewClient(tt.opts.WithBaseURL(baseURL).WithRetry(0, 0, 0))
+			if err != nil {
+				t.Fatalf("NewClient: %v", err)
+			}
+			ctx := context.Background()
+			_, statusErr := client.Status(ctx, "u1")
+			_, revokeErr := client.Revoke(ctx, "u1") // signs a request body
+			for _, err := range []error{statusErr, revokeErr} {
+				if tt.ok {
+					if err != nil {
+						t.Errorf("call failed: %v", err)
+					}
+					continue
+				}
+				var apiErr *heraldtotp.APIError
+				if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+					t.Errorf("error = %v, want 401", err)
+				}
+			}
+		})
+	}
+	if signed.Load() != 2 {
+		t.Errorf("custom signer ran %d times, want 2", signed.Load())
+	}
+}
@@ -0,0 +1,56 @@
+package router
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/cors"
+
+	"github.com/soulteary/herald-totp/internal/config"
+)
+
+type corsRoute struct {
+	prefix  string
+	handler fiber.Handler // nil: CORS disabled for the route
+}
+
+// corsMiddleware applies the CORS policy of the longest route prefix matching the request path, or nil
+// when CORS is off everywhere.
+func corsMiddleware(cfg *config.Config) fiber.Handler {
+	policies := cfg.CORS()
+	var routes []corsRoute
+	enabled := false
+	for prefix, p := range policies {
+		r := corsRoute{prefix: prefix}
+		if len(p.AllowOrigins) > 0 {
+			r.handler = cors.New(cors.Config{
+				AllowOrigins:     strings.Join(p.AllowOrigins, ","),
+				AllowMethods:     strings.Join(p.AllowMethods, ","),
+				AllowHeaders:     strings.Join(p.AllowHeaders, ","),
+				AllowCredentials: p.AllowCredentials,
+				MaxAge:           p.MaxAge,
+			})
+			enabled = true
+		}
+		routes = append(routes, r)
+	}
+	if !enabled {
+		return nil
+	}
+	sort.Slice(routes, func(i, j int) bool { return len(routes[i].prefix) > len(routes[j].prefix) })
+
+	return func(c *fiber.Ctx) error {
+		path := c.Path()
+		for _, r := range routes {
+			if !strings.HasPrefix(path, r.prefix) {
+				continue
+			}
+			if r.handler == nil {
+				return c.Next()
+			}
+			return r.handler(c)
+		}
+		return c.Next()
+	}
+}
@@ -0,0 +1,47 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/soulteary/herald-totp/internal/store"
+	"github.com/soulteary/herald-totp/pkg/totpservice"
+)
+
+// requestObserver records request latencies; *totpservice.Metrics is one.
+type requestObserver interface {
+	ObserveRequest(transport, route, status string, d time.Duration)
+}
+
+// metricsMiddleware records the latency of every request by route pattern and status.
+func metricsMiddleware(m requestObserver) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+		status := c.Response().StatusCode()
+		if err != nil {
+			status = fiber.StatusInternalServerError
+			var fe *fiber.Error
+			if errors.As(err, &fe) {
+				status = fe.Code
+			}
+		}
+		m.ObserveRequest("http", c.Route().Path, strconv.Itoa(status), time.Since(start))
+		return err
+	}
+}
+
+// storeMetricsHook records the operations of the server's own store (audit streams, webhook queue) in
+// the service's Redis metrics.
+func storeMetricsHook(m *totpservice.Metrics) store.Hook {
+	return func(ctx context.Context, op string) (context.Context, func(error)) {
+		start := time.Now()
+		return ctx, func(err error) {
+			m.ObserveStoreOperation(op, time.Since(start), err)
+		}
+	}
+}
@@ -1,78 +1,217 @@
 package router
 
 import (
-	"time"
+	"context"
+	"fmt"
+	"io"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/recover"
 	health "github.com/soulteary/health-kit"
 	logger "github.com/soulteary/logger-kit"
 	metricskit "github.com/soulteary/metrics-kit"
-	middlewarekit "github.com/soulteary/middleware-kit"
 	rediskit "github.com/soulteary/redis-kit/client"
 
+	"github.com/soulteary/herald-totp/internal/audit"
+	"github.com/soulteary/herald-totp/internal/clock"
 	"github.com/soulteary/herald-totp/internal/config"
 	"github.com/soulteary/herald-totp/internal/handler"
 	"github.com/soulteary/herald-totp/internal/metrics"
+	"github.com/soulteary/herald-totp/internal/openapi"
 	"github.com/soulteary/herald-totp/internal/store"
+	"github.com/soulteary/herald-totp/internal/tracing"
+	"github.com/soulteary/herald-totp/internal/webhook"
+	"github.com/soulteary/herald-totp/pkg/totpservice"
 )
 
-// Setup creates the Fiber app and mounts routes. Call config.Initialize(log) before this.
-func Setup(app *fiber.App, log *logger.Logger) (*store.Store, error) {
-	cfg := rediskit.DefaultConfig().
-		WithAddr(config.RedisAddr).
-		WithPassword(config.RedisPassword).
-		WithDB(config.RedisDB)
-	redisClient, err := rediskit.NewClient(cfg)
+// NewStore connects to the Redis of cfg and returns a store on the totpservice's keys.
+func NewStore(cfg *config.Config) (*store.Store, error) {
+	redisCfg := rediskit.DefaultConfig().
+		WithAddr(cfg.RedisAddr).
+		WithPassword(cfg.RedisPassword).
+		WithDB(cfg.RedisDB)
+	redisClient, err := rediskit.NewClient(redisCfg)
 	if err != nil {
 		return nil, err
 	}
+	return store.NewStore(redisClient, cfg.EnrollTTL, 0, store.ChallengeUsedTTL, store.RateSubjectWindow, store.RateIPWindow), nil
+}
 
-	enrollTTL := config.EnrollTTL
-	chUsedTTL := 5 * time.Minute
-	rateSubTTL := time.Hour
-	rateIPTTL := time.Minute
-	st := store.NewStore(redisClient, enrollTTL, 0, chUsedTTL, rateSubTTL, rateIPTTL)
+// Options are what Setup builds the server from.
+type Options struct {
+	// Config returns the current settings; required. Auth and the service call it per request, so
+	// reloaded settings apply without a restart. The rest are read once by Setup.
+	Config func() *config.Config
+	// Store is the server's store, from NewStore; required. Setup adds its metrics and tracing hooks.
+	// The service keeps its own store over the same client, with the same TTLs.
+	Store *store.Store
+	// Clock is read by the service and Store. Nil uses the wall clock.
+	Clock clock.Clock
+	// Registry receives the metrics served on /metrics. Nil uses a new herald_totp registry.
+	Registry *metricskit.Registry
+	// Audit receives audit events, usually from NewAuditRecorder. Nil records none.
+	Audit *audit.Recorder
+	// Log receives the request log and warnings.
+	Log *logger.Logger
+}
+
+// Setup builds the service over opts.Store and mounts its routes on app.
+func Setup(app *fiber.App, opts Options) (*totpservice.Service, error) {
+	cfg := opts.Config()
+	clk, reg, log := opts.Clock, opts.Registry, opts.Log
+	if clk == nil {
+		clk = clock.System()
+	}
+	if reg == nil {
+		reg = metrics.NewRegistry()
+	}
+	svc, err := totpservice.New(opts.Store.Client(), totpservice.Options{
+		Reload:  func() totpservice.Config { return ServiceConfig(opts.Config()) },
+		Clock:   clk,
+		Metrics: totpservice.NewMetrics(reg),
+		Audit:   func(ctx context.Context, e totpservice.AuditEvent) { opts.Audit.Record(ctx, audit.Event(e)) },
+		Log:     log,
+	})
+	if err != nil {
+		return nil, err
+	}
+	opts.Store.WithClock(clk).WithHook(storeMetricsHook(svc.Metrics())).WithHook(tracing.StoreHook())
+
+	if interval := cfg.MetricsInventoryInterval; interval > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		go svc.RunInventoryMetrics(ctx, interval)
+		app.Hooks().OnShutdown(func() error {
+			cancel()
+			return nil
+		})
+	}
 
 	app.Use(recover.New())
+	app.Use(metricsMiddleware(svc.Metrics()))
+	app.Use(tracingMiddleware())
 	app.Use(logger.FiberMiddleware(logger.MiddlewareConfig{
 		Logger:           log,
 		SkipPaths:        []string{"/healthz"},
 		IncludeRequestID: true,
 		IncludeLatency:   true,
 	}))
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,OPTIONS",
-		AllowHeaders: "Content-Type,Authorization,X-Service,X-Signature,X-Timestamp,X-API-Key,X-Key-Id",
-	}))
+	if h := corsMiddleware(cfg); h != nil {
+		app.Use(h)
+	}
 
-	healthConfig := health.DefaultConfig().WithServiceName(config.ServiceName)
+	healthConfig := health.DefaultConfig().WithServiceName(cfg.ServiceName)
 	healthAgg := health.NewAggregator(healthConfig)
-	healthAgg.AddChecker(health.NewRedisChecker(redisClient))
+	healthAgg.AddChecker(health.NewRedisChecker(opts.Store.Client()))
 	app.Get("/healthz", health.FiberHandler(healthAgg))
 
-	app.Get("/metrics", metricskit.FiberHandlerFor(metrics.Registry))
+	app.Get("/metrics", metricskit.FiberHandlerFor(reg))
+	app.Get("/openapi.json", openapi.Handler())
 
 	v1 := app.Group("/v1")
-	zerologLogger := log.Zerolog()
-	authHandler := middlewarekit.CombinedAuth(middlewarekit.AuthConfig{
-		HMACConfig: &middlewarekit.HMACConfig{
-			KeyProvider: config.GetHMACSecret,
-		},
-		APIKeyConfig: &middlewarekit.APIKeyConfig{
-			APIKey: config.APIKey,
-		},
-		AllowNoAuth: config.AllowNoAuth(),
-		Logger:      &zerologLogger,
-	})
+	auth := newAuth(opts.Config, log)
+	authHandler := auth.handle
+
+	v1.Post("/enroll/start", authHandler, handler.EnrollStart(svc))
+	v1.Post("/enroll/confirm", authHandler, handler.EnrollConfirm(svc))
+	v1.Post("/enroll/cancel", authHandler, handler.EnrollCancel(svc))
+	v1.Get("/enroll/:enroll_id/qr", authHandler, handler.EnrollQR(svc))
+	v1.Get("/enroll/:enroll_id", authHandler, handler.EnrollStatus(svc))
+	v1.Post("/verify", authHandler, handler.Verify(svc))
+	v1.Post("/hotp/resync", authHandler, handler.HOTPResync(svc))
+	v1.Post("/revoke", authHandler, handler.Revoke(svc))
+	v1.Get("/status", authHandler, handler.Status(svc))
+	v1.Get("/audit", authHandler, handler.AuditEvents(svc))
 
-	v1.Post("/enroll/start", authHandler, handler.EnrollStart(st, log))
-	v1.Post("/enroll/confirm", authHandler, handler.EnrollConfirm(st, log))
-	v1.Post("/verify", authHandler, handler.Verify(st, log))
-	v1.Post("/revoke", authHandler, handler.Revoke(st))
-	v1.Get("/status", authHandler, handler.Status(st))
+	admin := v1.Group("/admin", auth.admin)
+	admin.Post("/tokens/import", handler.TokensImport(svc))
+	admin.Get("/tokens", handler.TokensList(svc))
+	admin.Post("/tokens/assign", handler.TokensAssign(svc))
 
-	return st, nil
+	return svc, nil
+}
+
+// ServiceConfig returns the settings of cfg that the enroll and verify service applies.
+func ServiceConfig(cfg *config.Config) totpservice.Config {
+	return totpservice.Config{
+		EncryptionKey:            cfg.EncryptionKey,
+		TOTPIssuer:               cfg.TOTPIssuer,
+		TOTPPeriod:               cfg.TOTPPeriod,
+		TOTPDigits:               cfg.TOTPDigits,
+		TOTPSkew:                 cfg.TOTPSkew,
+		HOTPLookAhead:            cfg.HOTPLookAhead,
+		HOTPResyncWindow:         cfg.HOTPResyncWindow,
+		EnrollTTL:                cfg.EnrollTTL,
+		MaxPendingEnrollments:    cfg.MaxPendingEnrollments,
+		ReenrollPolicy:           cfg.ReenrollPolicy,
+		MaxCredentialsPerSubject: cfg.MaxCredentialsPerSubject,
+		ExposeSecretInEnroll:     cfg.ExposeSecretInEnroll,
+		BackupCodeCount:          cfg.BackupCodeCount,
+		RateLimitPerSubject:      cfg.RateLimitPerSubject,
+		RateLimitPerIP:           cfg.RateLimitPerIP,
+		QRSize:                   cfg.QRSize,
+		QRMaxSize:                cfg.QRMaxSize,
+		QRErrorCorrection:        cfg.QRErrorCorrection,
+		PSKCPreSharedKey:         cfg.PSKCPreSharedKey,
+		AnomalyWindow:            cfg.AnomalyWindow,
+		AnomalyIPSubjects:        cfg.AnomalyIPSubjects,
+		AnomalySubjectIPs:        cfg.AnomalySubjectIPs,
+		AnomalyReplays:           cfg.AnomalyReplays,
+		AnomalyBlockTTL:          cfg.AnomalyBlockTTL,
+	}
+}
+
+// NewAuditRecorder returns the audit recorder for the AUDIT_SINKS and WEBHOOK_URLS of cfg over st, the
+// stdout sink writing to stdout, and the webhook dispatcher among its sinks (nil without webhooks),
+// timing deliveries with clk. The caller starts the dispatcher's Run loop and closes the recorder.
+func NewAuditRecorder(cfg *config.Config, st *store.Store, clk clock.Clock, stdout io.Writer, log *logger.Logger) (*audit.Recorder, *webhook.Dispatcher, error) {
+	sinks, err := AuditSinks(cfg, st, stdout)
+	if err != nil {
+		return nil, nil, err
+	}
+	dispatcher := WebhookDispatcher(cfg, st, clk, log)
+	if dispatcher != nil {
+		sinks = append(sinks, dispatcher)
+	}
+	return audit.NewRecorder(log, sinks...), dispatcher, nil
+}
+
+// WebhookDispatcher returns the dispatcher for the WEBHOOK_URLS of cfg, or nil when no webhooks are configured.
+// Events written to it are queued in Redis; only a dispatcher whose Run loop is active delivers them.
+func WebhookDispatcher(cfg *config.Config, st *store.Store, clk clock.Clock, log *logger.Logger) *webhook.Dispatcher {
+	if len(cfg.WebhookURLs) == 0 {
+		return nil
+	}
+	return webhook.NewDispatcher(st, webhook.Config{
+		URLs:           cfg.WebhookURLs,
+		Secret:         cfg.WebhookSecret,
+		MaxAttempts:    cfg.WebhookMaxAttempts,
+		Backoff:        cfg.WebhookBackoff,
+		MaxBackoff:     cfg.WebhookMaxBackoff,
+		Timeout:        cfg.WebhookTimeout,
+		PollInterval:   cfg.WebhookPollInterval,
+		LowBackupCodes: cfg.WebhookLowBackupCodes,
+		DeadLetterMax:  int64(cfg.WebhookDeadLetterMax),
+	}, clk, log)
+}
+
+// AuditSinks builds the audit sinks listed in the AUDIT_SINKS of cfg; the stdout sink writes to stdout.
+func AuditSinks(cfg *config.Config, st *store.Store, stdout io.Writer) ([]audit.Sink, error) {
+	var sinks []audit.Sink
+	for _, name := range cfg.AuditSinks {
+		switch name {
+		case "stdout":
+			sinks = append(sinks, audit.NewWriterSink(stdout))
+		case "file":
+			fs, err := audit.NewFileSink(cfg.AuditFilePath, int64(cfg.AuditFileMaxSizeMB)<<20, cfg.AuditFileMaxBackups)
+			if err != nil {
+				return nil, fmt.Errorf("audit file sink: %w", err)
+			}
+			sinks = append(sinks, fs)
+		case "redis":
+			sinks = append(sinks, audit.NewRedisSink(st, int64(cfg.AuditStreamMaxLen), int64(cfg.AuditSubjectMaxLen), cfg.AuditSubjectRetention))
+		default:
+			return nil, fmt.Errorf("unknown audit sink %q", name)
+		}
+	}
+	return sinks, nil
 }
@@ -2,17 +2,57 @@ package router
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/alicebob/miniredis/v2"
 	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	logger "github.com/soulteary/logger-kit"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 
 	"github.com/soulteary/herald-totp/internal/config"
+	"github.com/soulteary/herald-totp/internal/handler"
+	"github.com/soulteary/herald-totp/internal/metrics"
+	"github.com/soulteary/herald-totp/internal/tlsauth"
+	"github.com/soulteary/herald-totp/pkg/totpservice"
 )
 
+// setup mounts the routes on app the way the server does, with the active config and its audit sinks.
+func setup(app *fiber.App, log *logger.Logger) (*totpservice.Service, error) {
+	cfg := config.Get()
+	st, err := NewStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	rec, _, err := NewAuditRecorder(cfg, st, nil, io.Discard, log)
+	if err != nil {
+		return nil, err
+	}
+	return Setup(app, Options{Config: config.Get, Store: st, Audit: rec, Log: log})
+}
+
 func TestSetup(t *testing.T) {
 	mr, err := miniredis.Run()
 	if err != nil {
@@ -20,26 +60,30 @@ func TestSetup(t *testing.T) {
 	}
 	defer mr.Close()
 
-	oldAddr := config.RedisAddr
-	oldPass := config.RedisPassword
-	oldDB := config.RedisDB
-	config.RedisAddr = mr.Addr()
-	config.RedisPassword = ""
-	config.RedisDB = 0
+	oldAddr := config.Get().RedisAddr
+	oldPass := config.Get().RedisPassword
+	oldDB := config.Get().RedisDB
+	config.Update(func(c *config.Config) {
+		c.RedisAddr = mr.Addr()
+		c.RedisPassword = ""
+		c.RedisDB = 0
+	})
 	defer func() {
-		config.RedisAddr = oldAddr
-		config.RedisPassword = oldPass
-		config.RedisDB = oldDB
+		config.Update(func(c *config.Config) {
+			c.RedisAddr = oldAddr
+			c.RedisPassword = oldPass
+			c.RedisDB = oldDB
+		})
 	}()
 
 	log := logger.New(logger.Config{Level: logger.Disabled})
 	app := fiber.New(fiber.Config{DisableStartupMessage: true})
-	st, err := Setup(app, log)
+	svc, err := setup(app, log)
 	if err != nil {
 		t.Fatalf("Setup: %v", err)
 	}
-	if st == nil {
-		t.Fatal("Store is nil")
+	if svc == nil {
+		t.Fatal("Service is nil")
 	}
 
 	// Health check
@@ -59,13 +103,13 @@ func TestSetup_RevokeRoute(t *testing.T) {
 		t.Fatalf("miniredis: %v", err)
 	}
 	defer mr.Close()
-	oldAddr := config.RedisAddr
-	config.RedisAddr = mr.Addr()
-	defer func() { config.RedisAddr = oldAddr }()
+	oldAddr := config.Get().RedisAddr
+	config.Update(func(c *config.Config) { c.RedisAddr = mr.Addr() })
+	defer func() { config.Update(func(c *config.Config) { c.RedisAddr = oldAddr }) }()
 
 	log := logger.New(logger.Config{Level: logger.Disabled})
 	app := fiber.New(fiber.Config{DisableStartupMessage: true})
-	_, err = Setup(app, log)
+	_, err = setup(app, log)
 	if err != nil {
 		t.Fatalf("Setup: %v", err)
 	}
@@ -87,13 +131,13 @@ func TestSetup_StatusRoute(t *testing.T) {
 		t.Fatalf("miniredis: %v", err)
 	}
 	defer mr.Close()
-	oldAddr := config.RedisAddr
-	config.RedisAddr = mr.Addr()
-	defer func() { config.RedisAddr = oldAddr }()
+	oldAddr := config.Get().RedisAddr
+	config.Update(func(c *config.Config) { c.RedisAddr = mr.Addr() })
+	defer func() { config.Update(func(c *config.Config) { c.RedisAddr = oldAddr }) }()
 
 	log := logger.New(logger.Config{Level: logger.Disabled})
 	app := fiber.New(fiber.Config{DisableStartupMessage: true})
-	_, err = Setup(app, log)
+	_, err = setup(app, log)
 	if err != nil {
 		t.Fatalf("Setup: %v", err)
 	}
@@ -107,3 +151,441 @@ func TestSetup_StatusRoute(t *testing.T) {
 		t.Errorf("GET /v1/status status = %d, want 400 or 401", resp.StatusCode)
 	}
 }
+
+func TestSetup_AuthFollowsReload(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis: %v", err)
+	}
+	defer mr.Close()
+	defer config.Set(config.Get())
+	config.Update(func(c *config.Config) {
+		c.RedisAddr = mr.Addr()
+		c.APIKey = "first-api-key-0123"
+		c.HMACSecret = ""
+		c.HMACKeys = nil
+	})
+
+	log := logger.New(logger.Config{Level: logger.Disabled})
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	if _, err := setup(app, log); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	status := func(apiKey string) int {
+		req := httptest.NewRequest("GET", "/v1/status?subject=u1", nil)
+		req.Header.Set("X-API-Key", apiKey)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test: %v", err)
+		}
+		return resp.StatusCode
+	}
+
+	if got := status("first-api-key-0123"); got != http.StatusOK {
+		t.Fatalf("first key status = %d, want 200", got)
+	}
+	config.Update(func(c *config.Config) { c.APIKey = "second-api-key-0123" })
+	if got := status("first-api-key-0123"); got != http.StatusUnauthorized {
+		t.Errorf("old key after reload status = %d, want 401", got)
+	}
+	// The middleware's 401 body is the spec's ErrorResponse.
+	resp, err := app.Test(httptest.NewRequest("GET", "/v1/status?subject=u1", nil))
+	if err != nil {
+		t.Fatalf("app.Test: %v", err)
+	}
+	var out handler.ErrorResponse
+	dec := json.NewDecoder(resp.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&out); err != nil || out.OK || out.Reason != "unauthorized" {
+		t.Errorf("401 body = %+v, %v; want ErrorResponse{OK: false, Reason: unauthorized}", out, err)
+	}
+	if got := status("second-api-key-0123"); got != http.StatusOK {
+		t.Errorf("new key after reload status = %d, want 200", got)
+	}
+}
+
+func TestSetup_AdminAuth(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis: %v", err)
+	}
+	defer mr.Close()
+	defer config.Set(config.Get())
+	config.Update(func(c *config.Config) {
+		c.RedisAddr = mr.Addr()
+		c.APIKey = "service-api-key-0123"
+		c.AdminAPIKey = ""
+		c.HMACSecret = ""
+		c.HMACKeys = nil
+	})
+
+	log := logger.New(logger.Config{Level: logger.Disabled})
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	if _, err := setup(app, log); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	list := func(apiKey string) (int, string) {
+		req := httptest.NewRequest("GET", "/v1/admin/tokens", nil)
+		req.Header.Set("X-API-Key", apiKey)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test: %v", err)
+		}
+		var out handler.ErrorResponse
+		_ = json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out.Reason
+	}
+
+	if got, reason := list("service-api-key-0123"); got != http.StatusForbidden || reason != "admin_disabled" {
+		t.Errorf("admin API without admin credentials configured = %d %q, want 403 admin_disabled", got, reason)
+	}
+	config.Update(func(c *config.Config) { c.AdminAPIKey = "admin-api-key-0123" })
+	if got, _ := list("service-api-key-0123"); got != http.StatusUnauthorized {
+		t.Errorf("service API key on admin route status = %d, want 401", got)
+	}
+	if got, _ := list("admin-api-key-0123"); got != http.StatusOK {
+		t.Errorf("admin API key status = %d, want 200", got)
+	}
+	req := httptest.NewRequest("GET", "/v1/status?subject=u1", nil)
+	req.Header.Set("X-API-Key", "admin-api-key-0123")
+	if resp, _ := app.Test(req); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("admin API key on service route status = %d, want 401", resp.StatusCode)
+	}
+}
+
+// writeCert writes a certificate for tmpl, signed by parent (self-signed CA when parent is nil), and
+// returns it with its key.
+func writeCert(t *testing.T, dir, name string, tmpl *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore, tmpl.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	signer, signerKey := tmpl, any(key)
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid, tmpl.KeyUsage = true, true, x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	_ = os.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	_ = os.WriteFile(filepath.Join(dir, name+"-key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestSetup_MTLSIdentity(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis: %v", err)
+	}
+	defer mr.Close()
+
+	dir := t.TempDir()
+	ca := writeCert(t, dir, "ca", &x509.Certificate{Subject: pkix.Name{CommonName: "mesh CA"}}, nil)
+	writeCert(t, dir, "server", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "herald-totp"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+	clientTmpl := func(cn string) *x509.Certificate {
+		return &x509.Certificate{Subject: pkix.Name{CommonName: cn}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}
+	}
+	stargate := writeCert(t, dir, "stargate", clientTmpl("stargate"), &ca)
+	stranger := writeCert(t, dir, "stranger", clientTmpl("stranger"), &ca)
+	ops := writeCert(t, dir, "ops", clientTmpl("ops"), &ca)
+
+	defer config.Set(config.Get())
+	config.Update(func(c *config.Config) {
+		c.RedisAddr = mr.Addr()
+		c.APIKey = "api-key-0123456789"
+		c.HMACSecret, c.HMACKeys = "", nil
+		c.TLSCertFile, c.TLSKeyFile = filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem")
+		c.TLSClientCAFile = filepath.Join(dir, "ca.pem")
+		c.TLSIdentities = map[string]string{"cn:stargate": "stargate", "cn:ops": "ops"}
+		c.AdminIdentities = []string{"ops"}
+		c.AuditSinks = []string{"redis"}
+	})
+	cfg := config.Get()
+	certs, err := tlsauth.NewReloader(tlsauth.Files{CertFile: cfg.TLSCertFile, KeyFile: cfg.TLSKeyFile, ClientCAFile: cfg.TLSClientCAFile, ClientAuth: cfg.TLSClientAuth})
+	if err != nil {
+		t.Fatalf("NewReloader: %v", err)
+	}
+
+	log := logger.New(logger.Config{Level: logger.Disabled})
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	svc, err := setup(app, log)
+	if err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = app.Listener(tls.NewListener(ln, certs.TLSConfig())) }()
+	defer func() { _ = app.Shutdown() }()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	do := func(client *tls.Certificate, apiKey, method, path, body string) int {
+		tlsCfg := &tls.Config{RootCAs: roots}
+		if client != nil {
+			tlsCfg.Certificates = []tls.Certificate{*client}
+		}
+		hc := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg}, Timeout: 5 * time.Second}
+		req, _ := http.NewRequest(method, "https://"+ln.Addr().String()+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		resp, err := hc.Do(req)
+		if err != nil {
+			t.Fatalf("request: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	post := func(client *tls.Certificate, apiKey string) int {
+		return do(client, apiKey, "POST", "/v1/revoke", `{"subject":"u1"}`)
+	}
+
+	if got := post(&stargate, ""); got != http.StatusOK {
+		t.Errorf("mapped client certificate status = %d, want 200", got)
+	}
+	if got := post(&stranger, "api-key-0123456789"); got != http.StatusUnauthorized {
+		t.Errorf("unmapped client certificate status = %d, want 401", got)
+	}
+	if got := post(nil, "api-key-0123456789"); got != http.StatusOK {
+		t.Errorf("API key without certificate status = %d, want 200", got)
+	}
+	if got := post(nil, ""); got != http.StatusUnauthorized {
+		t.Errorf("no credentials status = %d, want 401", got)
+	}
+
+	if got := do(&ops, "", "GET", "/v1/admin/tokens", ""); got != http.StatusOK {
+		t.Errorf("admin identity on admin route status = %d, want 200", got)
+	}
+	if got := do(&stargate, "", "GET", "/v1/admin/tokens", ""); got != http.StatusUnauthorized {
+		t.Errorf("service identity on admin route status = %d, want 401", got)
+	}
+
+	recent, apiErr := svc.AuditEvents(context.Background(), "u1", 10)
+	if apiErr != nil || len(recent.Events) != 2 {
+		t.Fatalf("audit events = %v, %v", recent, apiErr)
+	}
+	events := recent.Events
+	// Newest first: the API key revoke, then the mTLS one.
+	if ev := events[1]; ev.Service != "stargate" || ev.KeyID != "mtls" {
+		t.Errorf("mTLS revoke audit = service %q key %q, want stargate/mtls", ev.Service, ev.KeyID)
+	}
+}
+
+func TestSetup_CORSPerRoute(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis: %v", err)
+	}
+	defer mr.Close()
+	defer config.Set(config.Get())
+	config.Update(func(c *config.Config) {
+		c.RedisAddr = mr.Addr()
+		c.CORSEnabled = true
+		c.CORSAllowOrigins = []string{"https://admin.example.com"}
+		c.CORSAllowCredentials = true
+		c.CORSRoutes = map[string]config.CORSPolicy{
+			"/healthz":   {AllowOrigins: []string{"*"}},
+			"/v1/revoke": {AllowOrigins: []string{}},
+		}
+	})
+
+	log := logger.New(logger.Config{Level: logger.Disabled})
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	if _, err := setup(app, log); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	preflight := func(path, origin string) http.Header {
+		req := httptest.NewRequest("OPTIONS", path, nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test: %v", err)
+		}
+		return resp.Header
+	}
+
+	h := preflight("/v1/verify", "https://admin.example.com")
+	if h.Get("Access-Control-Allow-Origin") != "https://admin.example.com" || h.Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("/v1/verify allowed origin: headers = %v", h)
+	}
+	if h := preflight("/v1/verify", "https://evil.example"); h.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("/v1/verify other origin: Access-Control-Allow-Origin = %q", h.Get("Access-Control-Allow-Origin"))
+	}
+	if h := preflight("/healthz", "https://status.example"); h.Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("/healthz: Access-Control-Allow-Origin = %q, want *", h.Get("Access-Control-Allow-Origin"))
+	}
+	if h := preflight("/v1/revoke", "https://admin.example.com"); h.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("/v1/revoke (CORS off): Access-Control-Allow-Origin = %q", h.Get("Access-Control-Allow-Origin"))
+	}
+}
+
+// TestSetup_RoutesMatchOpenAPI checks that /openapi.json documents exactly the /v1 routes Setup registers.
+func TestSetup_RoutesMatchOpenAPI(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis: %v", err)
+	}
+	defer mr.Close()
+	defer config.Set(config.Get())
+	config.Update(func(c *config.Config) { c.RedisAddr = mr.Addr() })
+
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	if _, err := setup(app, logger.New(logger.Config{Level: logger.Disabled})); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/openapi.json", nil))
+	if err != nil {
+		t.Fatalf("app.Test: %v", err)
+	}
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&spec) != nil {
+		t.Fatalf("GET /openapi.json status = %d, want a JSON document", resp.StatusCode)
+	}
+	documented := map[string]bool{}
+	for path, ops := range spec.Paths {
+		for method := range ops {
+			documented[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+
+	registered := map[string]bool{}
+	for _, r := range app.GetRoutes(true) {
+		if !strings.HasPrefix(r.Path, "/v1/") || r.Method == fiber.MethodHead {
+			continue
+		}
+		segments := strings.Split(r.Path, "/")
+		for i, seg := range segments {
+			if strings.HasPrefix(seg, ":") {
+				segments[i] = "{" + seg[1:] + "}"
+			}
+		}
+		registered[r.Method+" "+strings.Join(segments, "/")] = true
+	}
+
+	for route := range registered {
+		if !documented[route] {
+			t.Errorf("route %s is not in openapi.json", route)
+		}
+	}
+	for route := range documented {
+		if !registered[route] {
+			t.Errorf("openapi.json documents %s, which is not a route", route)
+		}
+	}
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	m := metrics.New(metrics.NewRegistry())
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Use(metricsMiddleware(m))
+	app.Get("/v1/enroll/:enroll_id", func(c *fiber.Ctx) error { return c.SendStatus(fiber.StatusNotFound) })
+	sampleCount := func(route, status string) uint64 {
+		var out dto.Metric
+		if err := m.RequestDuration.WithLabelValues("http", route, status).(prometheus.Metric).Write(&out); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		return out.GetHistogram().GetSampleCount()
+	}
+
+	for _, path := range []string{"/v1/enroll/e1", "/v1/enroll/e2"} {
+		resp, err := app.Test(httptest.NewRequest("GET", path, nil))
+		if err != nil {
+			t.Fatalf("app.Test: %v", err)
+		}
+		if resp.StatusCode != fiber.StatusNotFound {
+			t.Fatalf("GET %s status = %d", path, resp.StatusCode)
+		}
+	}
+	if got := sampleCount("/v1/enroll/:enroll_id", strconv.Itoa(fiber.StatusNotFound)); got != 2 {
+		t.Errorf("request_duration_seconds samples for the route pattern = %d, want 2", got)
+	}
+}
+
+func TestSetup_Tracing(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis: %v", err)
+	}
+	defer mr.Close()
+	old := *config.Get()
+	config.Update(func(c *config.Config) {
+		c.RedisAddr = mr.Addr()
+		c.APIKey = "api-key-0123456789"
+	})
+	defer func() {
+		config.Update(func(c *config.Config) { c.RedisAddr, c.APIKey = old.RedisAddr, old.APIKey })
+	}()
+	rec := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	defer otel.SetTracerProvider(prev)
+
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	if _, err := setup(app, logger.New(logger.Config{Level: logger.Disabled})); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	req := httptest.NewRequest("GET", "/v1/status?subject=alice", nil)
+	req.Header.Set("X-API-Key", "api-key-0123456789")
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /v1/status = %d", resp.StatusCode)
+	}
+
+	var server sdktrace.ReadOnlySpan
+	stores := 0
+	for _, s := range rec.Ended() {
+		switch {
+		case s.Name() == "GET /v1/status":
+			server = s
+		case strings.HasPrefix(s.Name(), "store."):
+			stores++
+		}
+	}
+	if server == nil {
+		t.Fatalf("no GET /v1/status span among %d spans", len(rec.Ended()))
+	}
+	if got := server.SpanContext().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("server span trace ID = %s, want the incoming traceparent's", got)
+	}
+	if got := server.Parent().SpanID().String(); got != "00f067aa0ba902b7" || !server.Parent().IsRemote() {
+		t.Errorf("server span parent = %s (remote %v), want the caller's span", got, server.Parent().IsRemote())
+	}
+	if stores == 0 {
+		t.Error("no store spans under the request")
+	}
+	for _, s := range rec.Ended() {
+		if strings.HasPrefix(s.Name(), "store.") && s.SpanContext().TraceID() != server.SpanContext().TraceID() {
+			t.Errorf("%s is in trace %s, not the request's", s.Name(), s.SpanContext().TraceID())
+		}
+	}
+}
+
+func TestServiceConfig_DefaultsMatchEmbedded(t *testing.T) {
+	// pkg/totpservice.DefaultConfig is what embedders start from; it must match the server defaults.
+	if got, want := ServiceConfig(config.Defaults()), totpservice.DefaultConfig(); got != want {
+		t.Errorf("ServiceConfig(Defaults()) = %+v, want totpservice.DefaultConfig() %+v", got, want)
+	}
+}
@@ -12,30 +12,39 @@ import (
 // ErrKeySize is returned when the encryption key is not 16, 24, or 32 bytes.
 var ErrKeySize = errors.New("encryption key must be 16, 24, or 32 bytes for AES")
 
-// Encrypt encrypts plaintext with AES-GCM using the given key. Key must be 16, 24, or 32 bytes.
-// Returns base64-encoded nonce+ciphertext.
-func Encrypt(key []byte, plaintext string) (string, error) {
-	if len(plaintext) == 0 {
-		return "", nil
-	}
+// Cipher encrypts and decrypts stored secrets with one AES-GCM key.
+type Cipher struct {
+	gcm cipher.AEAD
+}
+
+// NewCipher returns a Cipher for key, which must be 16, 24, or 32 bytes.
+func NewCipher(key []byte) (*Cipher, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return "", err
+		return nil, ErrKeySize
 	}
 	gcm, err := cipher.NewGCM(block)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	return &Cipher{gcm: gcm}, nil
+}
+
+// Encrypt encrypts plaintext and returns base64-encoded nonce+ciphertext.
+func (c *Cipher) Encrypt(plaintext string) (string, error) {
+	if len(plaintext) == 0 {
+		return "", nil
 	}
-	nonce := make([]byte, gcm.NonceSize())
+	nonce := make([]byte, c.gcm.NonceSize())
 	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return "", err
 	}
-	ciphertext := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	ciphertext := c.gcm.Seal(nonce, nonce, []byte(plaintext), nil)
 	return base64.StdEncoding.EncodeToString(ciphertext), nil
 }
 
-// Decrypt decrypts base64-encoded nonce+ciphertext with AES-GCM.
-func Decrypt(key []byte, encoded string) (string, error) {
+// Decrypt decrypts base64-encoded nonce+ciphertext.
+func (c *Cipher) Decrypt(encoded string) (string, error) {
 	if encoded == "" {
 		return "", nil
 	}
@@ -43,24 +52,35 @@ func Decrypt(key []byte, encoded string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	block, err := aes.NewCipher(key)
+	nonceSize := c.gcm.NonceSize()
+	if len(raw) < nonceSize {
+		return "", errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := raw[:nonceSize], raw[nonceSize:]
+	plaintext, err := c.gcm.Open(nil, nonce, ciphertext, nil)
 	if err != nil {
 		return "", err
 	}
-	gcm, err := cipher.NewGCM(block)
+	return string(plaintext), nil
+}
+
+// Encrypt encrypts plaintext with AES-GCM using the given key. Key must be 16, 24, or 32 bytes.
+// Returns base64-encoded nonce+ciphertext.
+func Encrypt(key []byte, plaintext string) (string, error) {
+	c, err := NewCipher(key)
 	if err != nil {
 		return "", err
 	}
-	nonceSize := gcm.NonceSize()
-	if len(raw) < nonceSize {
-		return "", errors.New("ciphertext too short")
-	}
-	nonce, ciphertext := raw[:nonceSize], raw[nonceSize:]
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	return c.Encrypt(plaintext)
+}
+
+// Decrypt decrypts base64-encoded nonce+ciphertext with AES-GCM.
+func Decrypt(key []byte, encoded string) (string, error) {
+	c, err := NewCipher(key)
 	if err != nil {
 		return "", err
 	}
-	return string(plaintext), nil
+	return c.Decrypt(encoded)
 }
 
 // KeyBytes returns the key as bytes, truncating or zero-padding to 32 bytes for AES-256.
@@ -120,3 +120,25 @@ func TestEncryptInvalidKey(t *testing.T) {
 		t.Error("Decrypt with wrong key should error")
 	}
 }
+
+func TestCipher(t *testing.T) {
+	if _, err := NewCipher([]byte("short")); err != ErrKeySize {
+		t.Errorf("NewCipher(short) err = %v, want ErrKeySize", err)
+	}
+	key := bytes.Repeat([]byte("k"), 32)
+	c, err := NewCipher(key)
+	if err != nil {
+		t.Fatalf("NewCipher: %v", err)
+	}
+	enc, err := c.Encrypt("my-secret-base32-key")
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	// Interchangeable with the package functions for the same key.
+	if dec, err := Decrypt(key, enc); err != nil || dec != "my-secret-base32-key" {
+		t.Errorf("Decrypt = %q, %v", dec, err)
+	}
+	if _, err := c.Decrypt(enc[:8]); err == nil {
+		t.Error("Decrypt truncated ciphertext: want error")
+	}
+}
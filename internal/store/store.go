@@ -2,23 +2,53 @@ package store
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
+
+	"github.com/soulteary/herald-totp/internal/clock"
 )
 
 const (
-	credPrefix        = "totp:cred:"
-	enrollPrefix      = "totp:enroll:"
-	backupPrefix      = "totp:backup:"
-	chUsedPrefix      = "totp:ch_used:"
-	rateSubjectPrefix = "totp:rate:subject:"
-	rateIPPrefix      = "totp:rate:ip:"
+	credExtraPrefix      = "totp:cred_extra:"
+	credPrefix           = "totp:cred:"
+	enrollPrefix         = "totp:enroll:"
+	enrollPendingPrefix  = "totp:enroll_pending:"
+	enrollSubjectPrefix  = "totp:enroll_subject:"
+	enrollAttemptsPrefix = "totp:enroll_attempts:"
+	assignAttemptsPrefix = "totp:assign_attempts:"
+	backupPrefix         = "totp:backup:"
+	chUsedPrefix         = "totp:ch_used:"
+	rateSubjectPrefix    = "totp:rate:subject:"
+	rateIPPrefix         = "totp:rate:ip:"
+	auditStream          = "totp:audit"
+	auditSubjectPrefix   = "totp:audit:subject:"
+	webhookDeliveries    = "totp:webhook:deliveries"
+	webhookQueue         = "totp:webhook:queue"
+	webhookDead          = "totp:webhook:dead"
+	hwTokenInventory     = "totp:hwtoken:inventory"
+	ipSubjectsPrefix     = "totp:anomaly:ip_subjects:"
+	subjectIPsPrefix     = "totp:anomaly:subject_ips:"
+	replaysPrefix        = "totp:anomaly:replays:"
+	blockIPPrefix        = "totp:block:ip:"
+	blockSubjectPrefix   = "totp:block:subject:"
 )
 
+// enrollSubjectGrace is how long an enrollment's subject stays known after the enrollment expires, so
+// late confirms can be attributed to it.
+const enrollSubjectGrace = 24 * time.Hour
+
 // Credential is the persisted TOTP credential for a subject.
+// The primary credential has an empty ID; additional authenticators (re-enrollment policy "add") have one.
 type Credential struct {
+	ID           string `json:"id,omitempty"`
+	Type         string `json:"type,omitempty"` // "totp" (default when empty) or "hotp"
 	Subject      string `json:"subject"`
 	SecretEnc    string `json:"secret_enc"`
 	Issuer       string `json:"issuer"`
@@ -28,6 +58,8 @@ type Credential struct {
 	Algo         string `json:"algo"`
 	Enabled      bool   `json:"enabled"`
 	LastUsedStep int64  `json:"last_used_step"`
+	Counter      uint64 `json:"counter,omitempty"` // HOTP: next counter value expected
+	Serial       string `json:"serial,omitempty"`  // hardware token serial number, if assigned from inventory
 	CreatedAt    int64  `json:"created_at"`
 	UpdatedAt    int64  `json:"updated_at"`
 }
@@ -35,6 +67,7 @@ type Credential struct {
 // Enrollment is the temporary enrollment state.
 type Enrollment struct {
 	EnrollID  string `json:"enroll_id"`
+	Type      string `json:"type,omitempty"` // "totp" (default when empty) or "hotp"
 	Subject   string `json:"subject"`
 	SecretEnc string `json:"secret_enc"`
 	Issuer    string `json:"issuer"`
@@ -51,6 +84,31 @@ type BackupCodeEntry struct {
 	UsedAt   int64  `json:"used_at"` // 0 = not used
 }
 
+// WebhookDelivery is one queued webhook POST to a single target URL.
+type WebhookDelivery struct {
+	ID            string `json:"id"`
+	Event         string `json:"event"`
+	URL           string `json:"url"`
+	Payload       string `json:"payload"`
+	Attempts      int    `json:"attempts"`
+	NextAttemptAt int64  `json:"next_attempt_at"`
+	LastError     string `json:"last_error,omitempty"`
+	CreatedAt     int64  `json:"created_at"`
+}
+
+// HardwareToken is an imported, not yet assigned hardware token (seed encrypted like credential secrets).
+type HardwareToken struct {
+	Serial     string `json:"serial"`
+	Type       string `json:"type"`
+	SecretEnc  string `json:"secret_enc"`
+	Algo       string `json:"algo"`
+	Digits     int    `json:"digits"`
+	Period     uint   `json:"period,omitempty"`
+	Counter    uint64 `json:"counter,omitempty"`
+	Issuer     string `json:"issuer,omitempty"`
+	ImportedAt int64  `json:"imported_at"`
+}
+
 // Store handles Redis persistence for credentials, enrollments, backup codes, and rate limits.
 type Store struct {
 	rdb        *redis.Client
@@ -59,8 +117,23 @@ type Store struct {
 	chUsedTTL  time.Duration
 	rateSubTTL time.Duration
 	rateIPTTL  time.Duration
+	clock      clock.Clock
+	hooks      []Hook
 }
 
+// Hook instruments store operations. It is called when an operation starts, with the operation name
+// (e.g. "get_credential"), and returns the context for the operation's Redis calls and a func the store
+// calls with the operation's error when it returns. Not-found results are not errors.
+type Hook func(ctx context.Context, op string) (context.Context, func(err error))
+
+// Windows of the used-challenge marks and the per-subject and per-IP rate limit counters. The server's
+// store and the service's store use them both, so they agree on the keys they share.
+const (
+	ChallengeUsedTTL  = 5 * time.Minute
+	RateSubjectWindow = time.Hour
+	RateIPWindow      = time.Minute
+)
+
 // NewStore creates a Store with the given Redis client and TTLs.
 func NewStore(rdb *redis.Client, enrollTTL, credTTL, chUsedTTL, rateSubTTL, rateIPTTL time.Duration) *Store {
 	return &Store{
@@ -70,15 +143,54 @@ func NewStore(rdb *redis.Client, enrollTTL, credTTL, chUsedTTL, rateSubTTL, rate
 		chUsedTTL:  chUsedTTL,
 		rateSubTTL: rateSubTTL,
 		rateIPTTL:  rateIPTTL,
+		clock:      clock.System(),
+	}
+}
+
+// Client returns the Redis client the store runs on.
+func (s *Store) Client() *redis.Client { return s.rdb }
+
+// WithClock makes the store timestamp records (such as a backup code's use) with c, and returns s.
+func (s *Store) WithClock(c clock.Clock) *Store {
+	s.clock = c
+	return s
+}
+
+// WithHook adds h to the hooks run around every operation, and returns s. Add hooks before the store is
+// shared between goroutines.
+func (s *Store) WithHook(h Hook) *Store {
+	s.hooks = append(s.hooks, h)
+	return s
+}
+
+// begin runs the hooks for the start of op and returns its context and a func ending it with err.
+// Each exported method is one op; methods that build on others call their unexported, unhooked forms.
+func (s *Store) begin(ctx context.Context, op string) (context.Context, func(err error)) {
+	if len(s.hooks) == 0 {
+		return ctx, func(error) {}
+	}
+	ends := make([]func(error), len(s.hooks))
+	for i, h := range s.hooks {
+		ctx, ends[i] = h(ctx, op)
+	}
+	return ctx, func(err error) {
+		for i := len(ends) - 1; i >= 0; i-- {
+			ends[i](err)
+		}
 	}
 }
 
-// SaveCredential persists a credential.
-func (s *Store) SaveCredential(ctx context.Context, c *Credential) error {
+// SaveCredential persists a credential (primary, or an additional authenticator when c.ID is set).
+func (s *Store) SaveCredential(ctx context.Context, c *Credential) (err error) {
+	ctx, done := s.begin(ctx, "save_credential")
+	defer func() { done(err) }()
 	data, err := json.Marshal(c)
 	if err != nil {
 		return err
 	}
+	if c.ID != "" {
+		return s.rdb.HSet(ctx, credExtraPrefix+c.Subject, c.ID, data).Err()
+	}
 	key := credPrefix + c.Subject
 	if s.credTTL > 0 {
 		return s.rdb.Set(ctx, key, data, s.credTTL).Err()
@@ -87,9 +199,15 @@ func (s *Store) SaveCredential(ctx context.Context, c *Credential) error {
 }
 
 // GetCredential returns the credential for the subject, or nil if not found.
-func (s *Store) GetCredential(ctx context.Context, subject string) (*Credential, error) {
-	key := credPrefix + subject
-	data, err := s.rdb.Get(ctx, key).Bytes()
+func (s *Store) GetCredential(ctx context.Context, subject string) (_ *Credential, err error) {
+	ctx, done := s.begin(ctx, "get_credential")
+	defer func() { done(err) }()
+	return s.getCredential(ctx, subject)
+}
+
+// getCredential is GetCredential without the hooks, for operations that read the credential themselves.
+func (s *Store) getCredential(ctx context.Context, subject string) (*Credential, error) {
+	data, err := s.rdb.Get(ctx, credPrefix+subject).Bytes()
 	if err == redis.Nil {
 		return nil, nil
 	}
@@ -103,30 +221,124 @@ func (s *Store) GetCredential(ctx context.Context, subject string) (*Credential,
 	return &c, nil
 }
 
-// DeleteCredential removes the credential for the subject.
-func (s *Store) DeleteCredential(ctx context.Context, subject string) error {
-	return s.rdb.Del(ctx, credPrefix+subject).Err()
+// GetCredentials returns the primary credential followed by any additional authenticators (oldest first).
+func (s *Store) GetCredentials(ctx context.Context, subject string) (_ []*Credential, err error) {
+	ctx, done := s.begin(ctx, "get_credentials")
+	defer func() { done(err) }()
+	primary, err := s.getCredential(ctx, subject)
+	if err != nil {
+		return nil, err
+	}
+	var out []*Credential
+	if primary != nil {
+		out = append(out, primary)
+	}
+	raw, err := s.rdb.HGetAll(ctx, credExtraPrefix+subject).Result()
+	if err != nil {
+		return nil, err
+	}
+	extras := make([]*Credential, 0, len(raw))
+	for _, v := range raw {
+		var c Credential
+		if err := json.Unmarshal([]byte(v), &c); err != nil {
+			return nil, err
+		}
+		extras = append(extras, &c)
+	}
+	sort.Slice(extras, func(i, j int) bool {
+		if extras[i].CreatedAt != extras[j].CreatedAt {
+			return extras[i].CreatedAt < extras[j].CreatedAt
+		}
+		return extras[i].ID < extras[j].ID
+	})
+	return append(out, extras...), nil
+}
+
+// DeleteCredential removes the credential and any additional authenticators for the subject.
+func (s *Store) DeleteCredential(ctx context.Context, subject string) (err error) {
+	ctx, done := s.begin(ctx, "delete_credential")
+	defer func() { done(err) }()
+	return s.rdb.Del(ctx, credPrefix+subject, credExtraPrefix+subject).Err()
 }
 
 // DeleteBackupCodes removes backup codes for the subject.
-func (s *Store) DeleteBackupCodes(ctx context.Context, subject string) error {
+func (s *Store) DeleteBackupCodes(ctx context.Context, subject string) (err error) {
+	ctx, done := s.begin(ctx, "delete_backup_codes")
+	defer func() { done(err) }()
 	return s.rdb.Del(ctx, backupPrefix+subject).Err()
 }
 
-// SaveEnrollment saves a temporary enrollment; TTL is applied.
-func (s *Store) SaveEnrollment(ctx context.Context, e *Enrollment) error {
+// SaveEnrollment saves a temporary enrollment; TTL is applied. The enrollment is also indexed
+// under its subject (scored by ExpiresAt) so pending enrollments can be counted.
+func (s *Store) SaveEnrollment(ctx context.Context, e *Enrollment) (err error) {
+	ctx, done := s.begin(ctx, "save_enrollment")
+	defer func() { done(err) }()
 	data, err := json.Marshal(e)
 	if err != nil {
 		return err
 	}
 	key := enrollPrefix + e.EnrollID
-	return s.rdb.Set(ctx, key, data, s.enrollTTL).Err()
+	pendingKey := enrollPendingPrefix + e.Subject
+	pipe := s.rdb.TxPipeline()
+	pipe.Set(ctx, key, data, s.enrollTTL)
+	pipe.Set(ctx, enrollSubjectPrefix+e.EnrollID, e.Subject, s.enrollTTL+enrollSubjectGrace)
+	pipe.ZAdd(ctx, pendingKey, redis.Z{Score: float64(e.ExpiresAt), Member: e.EnrollID})
+	pipe.Expire(ctx, pendingKey, s.enrollTTL)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// IncrEnrollmentAttempts counts a failed re-authentication attempt against the enrollment and returns
+// the attempts so far. The counter expires with the enrollment.
+func (s *Store) IncrEnrollmentAttempts(ctx context.Context, enrollID string) (_ int64, err error) {
+	ctx, done := s.begin(ctx, "incr_enrollment_attempts")
+	defer func() { done(err) }()
+	key := enrollAttemptsPrefix + enrollID
+	pipe := s.rdb.TxPipeline()
+	incr := pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, s.enrollTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+// EnrollmentSubject returns the subject of an enrollment, including one that expired or was cancelled
+// within the last day; "" when unknown.
+func (s *Store) EnrollmentSubject(ctx context.Context, enrollID string) (_ string, err error) {
+	ctx, done := s.begin(ctx, "enrollment_subject")
+	defer func() { done(err) }()
+	subject, err := s.rdb.Get(ctx, enrollSubjectPrefix+enrollID).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return subject, err
+}
+
+// CountPendingEnrollments prunes expired entries and returns the subject's unexpired enrollments at now (Unix seconds).
+func (s *Store) CountPendingEnrollments(ctx context.Context, subject string, now int64) (_ int64, err error) {
+	ctx, done := s.begin(ctx, "count_pending_enrollments")
+	defer func() { done(err) }()
+	key := enrollPendingPrefix + subject
+	pipe := s.rdb.TxPipeline()
+	pipe.ZRemRangeByScore(ctx, key, "-inf", strconv.FormatInt(now, 10))
+	card := pipe.ZCard(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return card.Val(), nil
 }
 
 // GetEnrollment returns the enrollment by enroll_id, or nil if not found/expired.
-func (s *Store) GetEnrollment(ctx context.Context, enrollID string) (*Enrollment, error) {
-	key := enrollPrefix + enrollID
-	data, err := s.rdb.Get(ctx, key).Bytes()
+func (s *Store) GetEnrollment(ctx context.Context, enrollID string) (_ *Enrollment, err error) {
+	ctx, done := s.begin(ctx, "get_enrollment")
+	defer func() { done(err) }()
+	return s.getEnrollment(ctx, enrollID)
+}
+
+// getEnrollment is GetEnrollment without the hooks, for operations that read the enrollment themselves.
+func (s *Store) getEnrollment(ctx context.Context, enrollID string) (*Enrollment, error) {
+	data, err := s.rdb.Get(ctx, enrollPrefix+enrollID).Bytes()
 	if err == redis.Nil {
 		return nil, nil
 	}
@@ -140,19 +352,35 @@ func (s *Store) GetEnrollment(ctx context.Context, enrollID string) (*Enrollment
 	return &e, nil
 }
 
-// DeleteEnrollment removes the enrollment (after confirm).
-func (s *Store) DeleteEnrollment(ctx context.Context, enrollID string) error {
-	return s.rdb.Del(ctx, enrollPrefix+enrollID).Err()
+// DeleteEnrollment removes the enrollment (after confirm or cancel) and its pending index entry.
+func (s *Store) DeleteEnrollment(ctx context.Context, enrollID string) (err error) {
+	ctx, done := s.begin(ctx, "delete_enrollment")
+	defer func() { done(err) }()
+	e, err := s.getEnrollment(ctx, enrollID)
+	if err != nil {
+		return err
+	}
+	pipe := s.rdb.TxPipeline()
+	pipe.Del(ctx, enrollPrefix+enrollID, enrollAttemptsPrefix+enrollID)
+	if e != nil {
+		pipe.ZRem(ctx, enrollPendingPrefix+e.Subject, enrollID)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
 }
 
 // MarkChallengeUsed records that a challenge_id was used (for replay protection).
-func (s *Store) MarkChallengeUsed(ctx context.Context, challengeID string) error {
+func (s *Store) MarkChallengeUsed(ctx context.Context, challengeID string) (err error) {
+	ctx, done := s.begin(ctx, "mark_challenge_used")
+	defer func() { done(err) }()
 	key := chUsedPrefix + challengeID
 	return s.rdb.Set(ctx, key, "1", s.chUsedTTL).Err()
 }
 
 // IsChallengeUsed returns true if the challenge was already used.
-func (s *Store) IsChallengeUsed(ctx context.Context, challengeID string) (bool, error) {
+func (s *Store) IsChallengeUsed(ctx context.Context, challengeID string) (_ bool, err error) {
+	ctx, done := s.begin(ctx, "is_challenge_used")
+	defer func() { done(err) }()
 	key := chUsedPrefix + challengeID
 	n, err := s.rdb.Exists(ctx, key).Result()
 	if err != nil {
@@ -162,12 +390,14 @@ func (s *Store) IsChallengeUsed(ctx context.Context, challengeID string) (bool,
 }
 
 // IncrRateSubject increments subject rate counter; returns new count.
-func (s *Store) IncrRateSubject(ctx context.Context, subject string) (int64, error) {
+func (s *Store) IncrRateSubject(ctx context.Context, subject string) (_ int64, err error) {
+	ctx, done := s.begin(ctx, "incr_rate_subject")
+	defer func() { done(err) }()
 	key := rateSubjectPrefix + subject
 	pipe := s.rdb.Pipeline()
 	incr := pipe.Incr(ctx, key)
 	pipe.Expire(ctx, key, s.rateSubTTL)
-	_, err := pipe.Exec(ctx)
+	_, err = pipe.Exec(ctx)
 	if err != nil {
 		return 0, err
 	}
@@ -175,12 +405,14 @@ func (s *Store) IncrRateSubject(ctx context.Context, subject string) (int64, err
 }
 
 // IncrRateIP increments IP rate counter; returns new count.
-func (s *Store) IncrRateIP(ctx context.Context, ip string) (int64, error) {
+func (s *Store) IncrRateIP(ctx context.Context, ip string) (_ int64, err error) {
+	ctx, done := s.begin(ctx, "incr_rate_ip")
+	defer func() { done(err) }()
 	key := rateIPPrefix + ip
 	pipe := s.rdb.Pipeline()
 	incr := pipe.Incr(ctx, key)
 	pipe.Expire(ctx, key, s.rateIPTTL)
-	_, err := pipe.Exec(ctx)
+	_, err = pipe.Exec(ctx)
 	if err != nil {
 		return 0, err
 	}
@@ -188,19 +420,31 @@ func (s *Store) IncrRateIP(ctx context.Context, ip string) (int64, error) {
 }
 
 // SaveBackupCodes stores backup code hashes for a subject (JSON array).
-func (s *Store) SaveBackupCodes(ctx context.Context, subject string, entries []BackupCodeEntry) error {
+func (s *Store) SaveBackupCodes(ctx context.Context, subject string, entries []BackupCodeEntry) (err error) {
+	ctx, done := s.begin(ctx, "save_backup_codes")
+	defer func() { done(err) }()
+	return s.saveBackupCodes(ctx, subject, entries)
+}
+
+// saveBackupCodes is SaveBackupCodes without the hooks.
+func (s *Store) saveBackupCodes(ctx context.Context, subject string, entries []BackupCodeEntry) error {
 	data, err := json.Marshal(entries)
 	if err != nil {
 		return err
 	}
-	key := backupPrefix + subject
-	return s.rdb.Set(ctx, key, data, 0).Err()
+	return s.rdb.Set(ctx, backupPrefix+subject, data, 0).Err()
 }
 
 // GetBackupCodes returns backup code entries for the subject.
-func (s *Store) GetBackupCodes(ctx context.Context, subject string) ([]BackupCodeEntry, error) {
-	key := backupPrefix + subject
-	data, err := s.rdb.Get(ctx, key).Bytes()
+func (s *Store) GetBackupCodes(ctx context.Context, subject string) (_ []BackupCodeEntry, err error) {
+	ctx, done := s.begin(ctx, "get_backup_codes")
+	defer func() { done(err) }()
+	return s.getBackupCodes(ctx, subject)
+}
+
+// getBackupCodes is GetBackupCodes without the hooks.
+func (s *Store) getBackupCodes(ctx context.Context, subject string) ([]BackupCodeEntry, error) {
+	data, err := s.rdb.Get(ctx, backupPrefix+subject).Bytes()
 	if err == redis.Nil {
 		return nil, nil
 	}
@@ -215,17 +459,474 @@ func (s *Store) GetBackupCodes(ctx context.Context, subject string) ([]BackupCod
 }
 
 // ConsumeBackupCode finds a matching unused backup code by hash, marks it used, returns true.
-func (s *Store) ConsumeBackupCode(ctx context.Context, subject string, codeHash string) (bool, error) {
-	entries, err := s.GetBackupCodes(ctx, subject)
+func (s *Store) ConsumeBackupCode(ctx context.Context, subject string, codeHash string) (_ bool, err error) {
+	ctx, done := s.begin(ctx, "consume_backup_code")
+	defer func() { done(err) }()
+	entries, err := s.getBackupCodes(ctx, subject)
 	if err != nil || len(entries) == 0 {
 		return false, err
 	}
-	now := time.Now().Unix()
+	now := s.clock.Now().Unix()
 	for i := range entries {
 		if entries[i].CodeHash == codeHash && entries[i].UsedAt == 0 {
 			entries[i].UsedAt = now
-			return s.SaveBackupCodes(ctx, subject, entries) == nil, nil
+			return s.saveBackupCodes(ctx, subject, entries) == nil, nil
 		}
 	}
 	return false, nil
 }
+
+// AppendAuditEvent appends an encoded audit event to the global audit stream and to the subject's stream.
+// Streams are trimmed approximately to maxLen / subjectMaxLen entries (0 = no trimming), and a subject's
+// stream is deleted subjectRetention after its last event (0 = kept).
+func (s *Store) AppendAuditEvent(ctx context.Context, subject string, event []byte, maxLen, subjectMaxLen int64, subjectRetention time.Duration) (err error) {
+	ctx, done := s.begin(ctx, "append_audit_event")
+	defer func() { done(err) }()
+	pipe := s.rdb.Pipeline()
+	pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: auditStream,
+		MaxLen: maxLen,
+		Approx: maxLen > 0,
+		Values: map[string]interface{}{"event": event},
+	})
+	if subject != "" {
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: auditSubjectPrefix + subject,
+			MaxLen: subjectMaxLen,
+			Approx: subjectMaxLen > 0,
+			Values: map[string]interface{}{"event": event},
+		})
+		if subjectRetention > 0 {
+			pipe.Expire(ctx, auditSubjectPrefix+subject, subjectRetention)
+		}
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// ListAuditEvents returns up to count encoded audit events for the subject, newest first.
+func (s *Store) ListAuditEvents(ctx context.Context, subject string, count int64) (_ [][]byte, err error) {
+	ctx, done := s.begin(ctx, "list_audit_events")
+	defer func() { done(err) }()
+	msgs, err := s.rdb.XRevRangeN(ctx, auditSubjectPrefix+subject, "+", "-", count).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make([][]byte, 0, len(msgs))
+	for _, m := range msgs {
+		if v, ok := m.Values["event"].(string); ok {
+			out = append(out, []byte(v))
+		}
+	}
+	return out, nil
+}
+
+// RemainingBackupCodes returns the number of unused backup codes for the subject.
+func (s *Store) RemainingBackupCodes(ctx context.Context, subject string) (_ int, err error) {
+	ctx, done := s.begin(ctx, "remaining_backup_codes")
+	defer func() { done(err) }()
+	entries, err := s.getBackupCodes(ctx, subject)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, e := range entries {
+		if e.UsedAt == 0 {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// claimWebhookScript moves a due delivery's score forward by the lease so only one worker sends it.
+var claimWebhookScript = redis.NewScript(`
+local score = redis.call("ZSCORE", KEYS[1], ARGV[1])
+if not score or tonumber(score) > tonumber(ARGV[2]) then
+	return 0
+end
+redis.call("ZADD", KEYS[1], ARGV[3], ARGV[1])
+return 1
+`)
+
+// SaveWebhookDelivery stores the delivery and schedules it at NextAttemptAt (enqueue or reschedule).
+func (s *Store) SaveWebhookDelivery(ctx context.Context, d *WebhookDelivery) (err error) {
+	ctx, done := s.begin(ctx, "save_webhook_delivery")
+	defer func() { done(err) }()
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	pipe := s.rdb.TxPipeline()
+	pipe.HSet(ctx, webhookDeliveries, d.ID, data)
+	pipe.ZAdd(ctx, webhookQueue, redis.Z{Score: float64(d.NextAttemptAt), Member: d.ID})
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// DueWebhookIDs returns up to limit delivery IDs whose next attempt is at or before now (Unix seconds).
+func (s *Store) DueWebhookIDs(ctx context.Context, now int64, limit int64) (_ []string, err error) {
+	ctx, done := s.begin(ctx, "due_webhook_ids")
+	defer func() { done(err) }()
+	return s.rdb.ZRangeByScore(ctx, webhookQueue, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now, 10),
+		Count: limit,
+	}).Result()
+}
+
+// ClaimWebhookDelivery leases a due delivery until leaseUntil and returns it, or nil if it is not due
+// or another worker claimed it first.
+func (s *Store) ClaimWebhookDelivery(ctx context.Context, id string, now, leaseUntil int64) (_ *WebhookDelivery, err error) {
+	ctx, done := s.begin(ctx, "claim_webhook_delivery")
+	defer func() { done(err) }()
+	ok, err := claimWebhookScript.Run(ctx, s.rdb, []string{webhookQueue}, id, now, leaseUntil).Int()
+	if err != nil || ok == 0 {
+		return nil, err
+	}
+	data, err := s.rdb.HGet(ctx, webhookDeliveries, id).Bytes()
+	if err == redis.Nil {
+		_ = s.rdb.ZRem(ctx, webhookQueue, id).Err()
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var d WebhookDelivery
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// DeleteWebhookDelivery removes a delivered webhook from the queue.
+func (s *Store) DeleteWebhookDelivery(ctx context.Context, id string) (err error) {
+	ctx, done := s.begin(ctx, "delete_webhook_delivery")
+	defer func() { done(err) }()
+	pipe := s.rdb.TxPipeline()
+	pipe.ZRem(ctx, webhookQueue, id)
+	pipe.HDel(ctx, webhookDeliveries, id)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// DeadLetterWebhook removes the delivery from the queue and pushes it to the dead-letter list,
+// keeping at most maxLen entries (0 = unbounded).
+func (s *Store) DeadLetterWebhook(ctx context.Context, d *WebhookDelivery, maxLen int64) (err error) {
+	ctx, done := s.begin(ctx, "dead_letter_webhook")
+	defer func() { done(err) }()
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	pipe := s.rdb.TxPipeline()
+	pipe.ZRem(ctx, webhookQueue, d.ID)
+	pipe.HDel(ctx, webhookDeliveries, d.ID)
+	pipe.LPush(ctx, webhookDead, data)
+	if maxLen > 0 {
+		pipe.LTrim(ctx, webhookDead, 0, maxLen-1)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// ListDeadWebhooks returns up to count dead-lettered deliveries, newest first.
+func (s *Store) ListDeadWebhooks(ctx context.Context, count int64) (_ []WebhookDelivery, err error) {
+	ctx, done := s.begin(ctx, "list_dead_webhooks")
+	defer func() { done(err) }()
+	raw, err := s.rdb.LRange(ctx, webhookDead, 0, count-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]WebhookDelivery, 0, len(raw))
+	for _, r := range raw {
+		var d WebhookDelivery
+		if err := json.Unmarshal([]byte(r), &d); err != nil {
+			continue
+		}
+		out = append(out, d)
+	}
+	return out, nil
+}
+
+// takeHWTokenScript removes a token from the inventory and returns it, so two assigns cannot get the same token.
+var takeHWTokenScript = redis.NewScript(`
+local v = redis.call("HGET", KEYS[1], ARGV[1])
+if v then
+	redis.call("HDEL", KEYS[1], ARGV[1])
+end
+return v
+`)
+
+// AddHardwareTokens stores imported tokens in the inventory. Serials already in the inventory are
+// returned as skipped unless overwrite is set.
+func (s *Store) AddHardwareTokens(ctx context.Context, tokens []*HardwareToken, overwrite bool) (skipped []string, err error) {
+	ctx, done := s.begin(ctx, "add_hardware_tokens")
+	defer func() { done(err) }()
+	for _, t := range tokens {
+		data, err := json.Marshal(t)
+		if err != nil {
+			return skipped, err
+		}
+		if overwrite {
+			if err := s.rdb.HSet(ctx, hwTokenInventory, t.Serial, data).Err(); err != nil {
+				return skipped, err
+			}
+			continue
+		}
+		added, err := s.rdb.HSetNX(ctx, hwTokenInventory, t.Serial, data).Result()
+		if err != nil {
+			return skipped, err
+		}
+		if !added {
+			skipped = append(skipped, t.Serial)
+		}
+	}
+	return skipped, nil
+}
+
+// ListHardwareTokens returns the unassigned tokens sorted by serial.
+func (s *Store) ListHardwareTokens(ctx context.Context) (_ []*HardwareToken, err error) {
+	ctx, done := s.begin(ctx, "list_hardware_tokens")
+	defer func() { done(err) }()
+	raw, err := s.rdb.HGetAll(ctx, hwTokenInventory).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*HardwareToken, 0, len(raw))
+	for _, v := range raw {
+		var t HardwareToken
+		if err := json.Unmarshal([]byte(v), &t); err != nil {
+			continue
+		}
+		out = append(out, &t)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Serial < out[j].Serial })
+	return out, nil
+}
+
+// TakeHardwareToken atomically removes a token from the inventory and returns it, or nil if not found.
+func (s *Store) TakeHardwareToken(ctx context.Context, serial string) (_ *HardwareToken, err error) {
+	ctx, done := s.begin(ctx, "take_hardware_token")
+	defer func() { done(err) }()
+	data, err := takeHWTokenScript.Run(ctx, s.rdb, []string{hwTokenInventory}, serial).Text()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var t HardwareToken
+	if err := json.Unmarshal([]byte(data), &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// IncrAssignAttempts counts a failed re-authentication attempt against token assignments to the
+// subject and returns the attempts so far. The counter expires after the enrollment TTL.
+func (s *Store) IncrAssignAttempts(ctx context.Context, subject string) (_ int64, err error) {
+	ctx, done := s.begin(ctx, "incr_assign_attempts")
+	defer func() { done(err) }()
+	key := assignAttemptsPrefix + subject
+	pipe := s.rdb.TxPipeline()
+	incr := pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, s.enrollTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+// AssignAttempts returns the failed re-authentication attempts counted by IncrAssignAttempts.
+func (s *Store) AssignAttempts(ctx context.Context, subject string) (_ int64, err error) {
+	ctx, done := s.begin(ctx, "assign_attempts")
+	defer func() { done(err) }()
+	n, err := s.rdb.Get(ctx, assignAttemptsPrefix+subject).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return n, err
+}
+
+// ListSubjects returns every subject that has a credential or backup codes, sorted.
+func (s *Store) ListSubjects(ctx context.Context) (_ []string, err error) {
+	ctx, done := s.begin(ctx, "list_subjects")
+	defer func() { done(err) }()
+	seen := make(map[string]struct{})
+	for _, prefix := range []string{credPrefix, credExtraPrefix, backupPrefix} {
+		iter := s.rdb.Scan(ctx, 0, prefix+"*", 500).Iterator()
+		for iter.Next(ctx) {
+			seen[strings.TrimPrefix(iter.Val(), prefix)] = struct{}{}
+		}
+		if err := iter.Err(); err != nil {
+			return nil, err
+		}
+	}
+	out := make([]string, 0, len(seen))
+	for subject := range seen {
+		out = append(out, subject)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// CountCredentials returns the number of subjects with at least one credential and the number of
+// credentials (primary and additional authenticators).
+func (s *Store) CountCredentials(ctx context.Context) (subjects, credentials int64, err error) {
+	ctx, done := s.begin(ctx, "count_credentials")
+	defer func() { done(err) }()
+	seen := make(map[string]struct{})
+	iter := s.rdb.Scan(ctx, 0, credPrefix+"*", 500).Iterator()
+	for iter.Next(ctx) {
+		seen[strings.TrimPrefix(iter.Val(), credPrefix)] = struct{}{}
+		credentials++
+	}
+	if err := iter.Err(); err != nil {
+		return 0, 0, err
+	}
+	iter = s.rdb.Scan(ctx, 0, credExtraPrefix+"*", 500).Iterator()
+	for iter.Next(ctx) {
+		n, err := s.rdb.HLen(ctx, iter.Val()).Result()
+		if err != nil {
+			return 0, 0, err
+		}
+		if n > 0 {
+			seen[strings.TrimPrefix(iter.Val(), credExtraPrefix)] = struct{}{}
+			credentials += n
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return 0, 0, err
+	}
+	return int64(len(seen)), credentials, nil
+}
+
+// CountEnrollments returns the number of unexpired enrollments.
+func (s *Store) CountEnrollments(ctx context.Context) (n int64, err error) {
+	ctx, done := s.begin(ctx, "count_enrollments")
+	defer func() { done(err) }()
+	iter := s.rdb.Scan(ctx, 0, enrollPrefix+"*", 500).Iterator()
+	for iter.Next(ctx) {
+		n++
+	}
+	if err := iter.Err(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// slidingAdd queues adding member to the sliding window at key, dropping entries older than window, and
+// returns the command that counts the entries left.
+func (s *Store) slidingAdd(ctx context.Context, pipe redis.Pipeliner, key, member string, window time.Duration) *redis.IntCmd {
+	now := s.clock.Now()
+	pipe.ZRemRangeByScore(ctx, key, "-inf", strconv.FormatInt(now.Add(-window).UnixMilli(), 10))
+	pipe.ZAdd(ctx, key, redis.Z{Score: float64(now.UnixMilli()), Member: member})
+	card := pipe.ZCard(ctx, key)
+	pipe.PExpire(ctx, key, window)
+	return card
+}
+
+// TrackVerifyFailure records a failed verification of subject from ip and returns, within the last
+// window, the number of distinct subjects that failed from ip and of distinct IPs that failed for subject.
+func (s *Store) TrackVerifyFailure(ctx context.Context, subject, ip string, window time.Duration) (subjectsFromIP, ipsForSubject int64, err error) {
+	ctx, done := s.begin(ctx, "track_verify_failure")
+	defer func() { done(err) }()
+	pipe := s.rdb.TxPipeline()
+	subjects := s.slidingAdd(ctx, pipe, ipSubjectsPrefix+ip, subject, window)
+	ips := s.slidingAdd(ctx, pipe, subjectIPsPrefix+subject, ip, window)
+	if _, err = pipe.Exec(ctx); err != nil {
+		return 0, 0, err
+	}
+	return subjects.Val(), ips.Val(), nil
+}
+
+// TrackReplay records a replayed code or challenge against a dimension ("ip" or "subject") and value,
+// and returns the number of replays recorded for it within the last window.
+func (s *Store) TrackReplay(ctx context.Context, dimension, value string, window time.Duration) (_ int64, err error) {
+	ctx, done := s.begin(ctx, "track_replay")
+	defer func() { done(err) }()
+	b := make([]byte, 8)
+	if _, err = rand.Read(b); err != nil {
+		return 0, err
+	}
+	pipe := s.rdb.TxPipeline()
+	replays := s.slidingAdd(ctx, pipe, replaysPrefix+dimension+":"+value, hex.EncodeToString(b), window)
+	if _, err = pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return replays.Val(), nil
+}
+
+// BlockIP blocks verification from ip for ttl.
+func (s *Store) BlockIP(ctx context.Context, ip string, ttl time.Duration) (err error) {
+	ctx, done := s.begin(ctx, "block_ip")
+	defer func() { done(err) }()
+	return s.rdb.Set(ctx, blockIPPrefix+ip, "1", ttl).Err()
+}
+
+// BlockSubject blocks verification of subject for ttl.
+func (s *Store) BlockSubject(ctx context.Context, subject string, ttl time.Duration) (err error) {
+	ctx, done := s.begin(ctx, "block_subject")
+	defer func() { done(err) }()
+	return s.rdb.Set(ctx, blockSubjectPrefix+subject, "1", ttl).Err()
+}
+
+// IsBlocked reports whether verification of subject or from ip is blocked.
+func (s *Store) IsBlocked(ctx context.Context, subject, ip string) (_ bool, err error) {
+	ctx, done := s.begin(ctx, "is_blocked")
+	defer func() { done(err) }()
+	keys := []string{blockSubjectPrefix + subject}
+	if ip != "" {
+		keys = append(keys, blockIPPrefix+ip)
+	}
+	n, err := s.rdb.Exists(ctx, keys...).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// Ping checks the Redis connection.
+func (s *Store) Ping(ctx context.Context) (err error) {
+	ctx, done := s.begin(ctx, "ping")
+	defer func() { done(err) }()
+	return s.rdb.Ping(ctx).Err()
+}
+
+// ListEnrollments returns every unexpired enrollment, sorted by enroll_id.
+func (s *Store) ListEnrollments(ctx context.Context) (_ []*Enrollment, err error) {
+	ctx, done := s.begin(ctx, "list_enrollments")
+	defer func() { done(err) }()
+	var out []*Enrollment
+	iter := s.rdb.Scan(ctx, 0, enrollPrefix+"*", 500).Iterator()
+	for iter.Next(ctx) {
+		e, err := s.getEnrollment(ctx, strings.TrimPrefix(iter.Val(), enrollPrefix))
+		if err != nil {
+			return nil, err
+		}
+		if e != nil {
+			out = append(out, e)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].EnrollID < out[j].EnrollID })
+	return out, nil
+}
+
+// UpdateEnrollment rewrites an existing enrollment without changing its expiry. It is a no-op when the
+// enrollment has expired in the meantime.
+func (s *Store) UpdateEnrollment(ctx context.Context, e *Enrollment) (err error) {
+	ctx, done := s.begin(ctx, "update_enrollment")
+	defer func() { done(err) }()
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	err = s.rdb.SetArgs(ctx, enrollPrefix+e.EnrollID, data, redis.SetArgs{Mode: "XX", KeepTTL: true}).Err()
+	if err == redis.Nil {
+		return nil
+	}
+	return err
+}
@@ -7,6 +7,8 @@ import (
 
 	"github.com/alicebob/miniredis/v2"
 	"github.com/redis/go-redis/v9"
+
+	"github.com/soulteary/herald-totp/internal/clock"
 )
 
 func newTestStore(t *testing.T) (*Store, *miniredis.Miniredis) {
@@ -254,3 +256,355 @@ func TestGetBackupCodes_InvalidJSON(t *testing.T) {
 		t.Errorf("GetBackupCodes(invalid JSON) should return nil")
 	}
 }
+
+func TestAppendListAuditEvents(t *testing.T) {
+	st, mr := newTestStore(t)
+	defer mr.Close()
+	ctx := context.Background()
+
+	for _, ev := range []string{`{"n":1}`, `{"n":2}`, `{"n":3}`} {
+		if err := st.AppendAuditEvent(ctx, "user1", []byte(ev), 0, 0, 0); err != nil {
+			t.Fatalf("AppendAuditEvent: %v", err)
+		}
+	}
+	if err := st.AppendAuditEvent(ctx, "", []byte(`{"n":4}`), 0, 0, 0); err != nil {
+		t.Fatalf("AppendAuditEvent(no subject): %v", err)
+	}
+	got, err := st.ListAuditEvents(ctx, "user1", 2)
+	if err != nil {
+		t.Fatalf("ListAuditEvents: %v", err)
+	}
+	if len(got) != 2 || string(got[0]) != `{"n":3}` || string(got[1]) != `{"n":2}` {
+		t.Errorf("ListAuditEvents = %q, want newest two", got)
+	}
+	n, _ := st.rdb.XLen(ctx, auditStream).Result()
+	if n != 4 {
+		t.Errorf("global audit stream len = %d, want 4", n)
+	}
+	got, _ = st.ListAuditEvents(ctx, "nobody", 10)
+	if len(got) != 0 {
+		t.Errorf("ListAuditEvents(nobody) = %q, want empty", got)
+	}
+	if ttl := mr.TTL(auditSubjectPrefix + "user1"); ttl != 0 {
+		t.Errorf("subject stream TTL without retention = %v, want none", ttl)
+	}
+
+	if err := st.AppendAuditEvent(ctx, "user2", []byte(`{"n":5}`), 0, 0, time.Hour); err != nil {
+		t.Fatalf("AppendAuditEvent(retention): %v", err)
+	}
+	if ttl := mr.TTL(auditSubjectPrefix + "user2"); ttl != time.Hour {
+		t.Errorf("subject stream TTL = %v, want 1h", ttl)
+	}
+	mr.FastForward(time.Hour)
+	if got, _ := st.ListAuditEvents(ctx, "user2", 10); len(got) != 0 {
+		t.Errorf("ListAuditEvents after retention = %q, want empty", got)
+	}
+}
+
+func TestWebhookQueue_Claim(t *testing.T) {
+	st, mr := newTestStore(t)
+	defer mr.Close()
+	ctx := context.Background()
+
+	d := &WebhookDelivery{ID: "w_1", Event: "revoked", URL: "http://x", Payload: "{}", NextAttemptAt: 100}
+	if err := st.SaveWebhookDelivery(ctx, d); err != nil {
+		t.Fatalf("SaveWebhookDelivery: %v", err)
+	}
+	ids, _ := st.DueWebhookIDs(ctx, 99, 10)
+	if len(ids) != 0 {
+		t.Errorf("DueWebhookIDs(before) = %v, want empty", ids)
+	}
+	ids, _ = st.DueWebhookIDs(ctx, 100, 10)
+	if len(ids) != 1 || ids[0] != "w_1" {
+		t.Fatalf("DueWebhookIDs = %v, want [w_1]", ids)
+	}
+	got, err := st.ClaimWebhookDelivery(ctx, "w_1", 100, 200)
+	if err != nil || got == nil || got.URL != "http://x" {
+		t.Fatalf("ClaimWebhookDelivery = %+v, %v", got, err)
+	}
+	// leased: a second worker cannot claim it
+	got, _ = st.ClaimWebhookDelivery(ctx, "w_1", 100, 200)
+	if got != nil {
+		t.Errorf("second claim = %+v, want nil", got)
+	}
+	if err := st.DeleteWebhookDelivery(ctx, "w_1"); err != nil {
+		t.Fatalf("DeleteWebhookDelivery: %v", err)
+	}
+	ids, _ = st.DueWebhookIDs(ctx, 1000, 10)
+	if len(ids) != 0 {
+		t.Errorf("DueWebhookIDs after delete = %v, want empty", ids)
+	}
+}
+
+func TestGetCredentials_Extra(t *testing.T) {
+	st, mr := newTestStore(t)
+	defer mr.Close()
+	ctx := context.Background()
+
+	_ = st.SaveCredential(ctx, &Credential{Subject: "multi", SecretEnc: "p", Enabled: true, CreatedAt: 1})
+	_ = st.SaveCredential(ctx, &Credential{ID: "a_2", Subject: "multi", SecretEnc: "x2", Enabled: true, CreatedAt: 3})
+	_ = st.SaveCredential(ctx, &Credential{ID: "a_1", Subject: "multi", SecretEnc: "x1", Enabled: true, CreatedAt: 2})
+
+	got, err := st.GetCredentials(ctx, "multi")
+	if err != nil {
+		t.Fatalf("GetCredentials: %v", err)
+	}
+	if len(got) != 3 || got[0].SecretEnc != "p" || got[1].ID != "a_1" || got[2].ID != "a_2" {
+		t.Fatalf("GetCredentials = %+v, want primary then extras oldest first", got)
+	}
+	primary, _ := st.GetCredential(ctx, "multi")
+	if primary == nil || primary.ID != "" {
+		t.Errorf("GetCredential = %+v, want primary", primary)
+	}
+
+	if err := st.DeleteCredential(ctx, "multi"); err != nil {
+		t.Fatalf("DeleteCredential: %v", err)
+	}
+	got, _ = st.GetCredentials(ctx, "multi")
+	if len(got) != 0 {
+		t.Errorf("GetCredentials after delete = %+v, want empty", got)
+	}
+}
+
+func TestCountPendingEnrollments(t *testing.T) {
+	st, mr := newTestStore(t)
+	defer mr.Close()
+	ctx := context.Background()
+
+	_ = st.SaveEnrollment(ctx, &Enrollment{EnrollID: "e_1", Subject: "pend", ExpiresAt: 100})
+	_ = st.SaveEnrollment(ctx, &Enrollment{EnrollID: "e_2", Subject: "pend", ExpiresAt: 200})
+	n, err := st.CountPendingEnrollments(ctx, "pend", 50)
+	if err != nil {
+		t.Fatalf("CountPendingEnrollments: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("CountPendingEnrollments = %d, want 2", n)
+	}
+	// expired entries are pruned
+	if n, _ = st.CountPendingEnrollments(ctx, "pend", 150); n != 1 {
+		t.Errorf("CountPendingEnrollments(after e_1 expiry) = %d, want 1", n)
+	}
+	_ = st.DeleteEnrollment(ctx, "e_2")
+	if n, _ = st.CountPendingEnrollments(ctx, "pend", 150); n != 0 {
+		t.Errorf("CountPendingEnrollments(after delete) = %d, want 0", n)
+	}
+}
+
+func TestHardwareTokenInventory(t *testing.T) {
+	st, mr := newTestStore(t)
+	defer mr.Close()
+	ctx := context.Background()
+
+	tokens := []*HardwareToken{{Serial: "HW2", Type: "totp", SecretEnc: "enc2"}, {Serial: "HW1", Type: "hotp", SecretEnc: "enc1"}}
+	skipped, err := st.AddHardwareTokens(ctx, tokens, false)
+	if err != nil || len(skipped) != 0 {
+		t.Fatalf("AddHardwareTokens = %v, %v", skipped, err)
+	}
+	skipped, _ = st.AddHardwareTokens(ctx, []*HardwareToken{{Serial: "HW1", SecretEnc: "other"}}, false)
+	if len(skipped) != 1 || skipped[0] != "HW1" {
+		t.Errorf("duplicate import skipped = %v, want [HW1]", skipped)
+	}
+	list, err := st.ListHardwareTokens(ctx)
+	if err != nil || len(list) != 2 || list[0].Serial != "HW1" || list[0].SecretEnc != "enc1" {
+		t.Fatalf("ListHardwareTokens = %+v, %v", list, err)
+	}
+
+	tok, err := st.TakeHardwareToken(ctx, "HW1")
+	if err != nil || tok == nil || tok.Type != "hotp" {
+		t.Fatalf("TakeHardwareToken = %+v, %v", tok, err)
+	}
+	if tok, _ = st.TakeHardwareToken(ctx, "HW1"); tok != nil {
+		t.Error("token taken twice")
+	}
+	if list, _ = st.ListHardwareTokens(ctx); len(list) != 1 {
+		t.Errorf("inventory after take = %d, want 1", len(list))
+	}
+}
+
+func TestListSubjects_ListUpdateEnrollments(t *testing.T) {
+	st, mr := newTestStore(t)
+	defer mr.Close()
+	ctx := context.Background()
+
+	_ = st.SaveCredential(ctx, &Credential{Subject: "bob", SecretEnc: "e"})
+	_ = st.SaveCredential(ctx, &Credential{ID: "a_1", Subject: "alice", SecretEnc: "e"})
+	_ = st.SaveBackupCodes(ctx, "carol", []BackupCodeEntry{{CodeHash: "h"}})
+	_ = st.SaveCredential(ctx, &Credential{Subject: "alice", SecretEnc: "e"})
+	subjects, err := st.ListSubjects(ctx)
+	if err != nil || len(subjects) != 3 || subjects[0] != "alice" || subjects[2] != "carol" {
+		t.Fatalf("ListSubjects = %v, %v", subjects, err)
+	}
+
+	_ = st.SaveEnrollment(ctx, &Enrollment{EnrollID: "e2", Subject: "bob", SecretEnc: "old"})
+	_ = st.SaveEnrollment(ctx, &Enrollment{EnrollID: "e1", Subject: "bob", SecretEnc: "old"})
+	mr.FastForward(time.Minute)
+	list, err := st.ListEnrollments(ctx)
+	if err != nil || len(list) != 2 || list[0].EnrollID != "e1" {
+		t.Fatalf("ListEnrollments = %v, %v", list, err)
+	}
+	list[0].SecretEnc = "new"
+	if err := st.UpdateEnrollment(ctx, list[0]); err != nil {
+		t.Fatalf("UpdateEnrollment: %v", err)
+	}
+	if got, _ := st.GetEnrollment(ctx, "e1"); got == nil || got.SecretEnc != "new" {
+		t.Errorf("updated enrollment = %+v", got)
+	}
+	if ttl := mr.TTL("totp:enroll:e1"); ttl != 9*time.Minute {
+		t.Errorf("TTL after update = %v, want 9m (unchanged)", ttl)
+	}
+	mr.FastForward(10 * time.Minute)
+	if err := st.UpdateEnrollment(ctx, list[1]); err != nil {
+		t.Errorf("UpdateEnrollment of expired enrollment: %v", err)
+	}
+	if got, _ := st.GetEnrollment(ctx, "e2"); got != nil {
+		t.Error("UpdateEnrollment recreated an expired enrollment")
+	}
+}
+
+func TestHook(t *testing.T) {
+	st, mr := newTestStore(t)
+	defer mr.Close()
+	type call struct {
+		op  string
+		err bool
+	}
+	var calls []call
+	st.WithHook(func(ctx context.Context, op string) (context.Context, func(error)) {
+		return ctx, func(err error) { calls = append(calls, call{op, err != nil}) }
+	})
+	ctx := context.Background()
+
+	if _, err := st.GetCredential(ctx, "missing"); err != nil {
+		t.Fatalf("GetCredential: %v", err)
+	}
+	if err := st.rdb.Set(ctx, credPrefix+"badjson", "not-json", 0).Err(); err != nil {
+		t.Fatalf("set raw: %v", err)
+	}
+	if _, err := st.GetCredentials(ctx, "badjson"); err == nil {
+		t.Fatal("GetCredentials(invalid JSON) err = nil")
+	}
+	want := []call{
+		{"get_credential", false}, // not found is not an error
+		{"get_credentials", true}, // one op, reading the primary credential itself
+	}
+	if len(calls) != len(want) {
+		t.Fatalf("hook calls = %v, want %v", calls, want)
+	}
+	for i := range want {
+		if calls[i] != want[i] {
+			t.Errorf("hook call %d = %v, want %v", i, calls[i], want[i])
+		}
+	}
+}
+
+func TestCountCredentials_CountEnrollments(t *testing.T) {
+	st, mr := newTestStore(t)
+	defer mr.Close()
+	ctx := context.Background()
+	for _, c := range []*Credential{
+		{Subject: "alice"},
+		{Subject: "alice", ID: "a1"},
+		{Subject: "alice", ID: "a2"},
+		{Subject: "bob", ID: "b1"}, // additional authenticator only
+		{Subject: "carol"},
+	} {
+		if err := st.SaveCredential(ctx, c); err != nil {
+			t.Fatalf("SaveCredential: %v", err)
+		}
+	}
+	if err := st.SaveBackupCodes(ctx, "dave", []BackupCodeEntry{{CodeHash: "h"}}); err != nil {
+		t.Fatalf("SaveBackupCodes: %v", err)
+	}
+	for _, id := range []string{"e1", "e2"} {
+		if err := st.SaveEnrollment(ctx, &Enrollment{EnrollID: id, Subject: "erin"}); err != nil {
+			t.Fatalf("SaveEnrollment: %v", err)
+		}
+	}
+
+	subjects, credentials, err := st.CountCredentials(ctx)
+	if err != nil || subjects != 3 || credentials != 5 {
+		t.Errorf("CountCredentials = %d, %d, %v; want 3, 5", subjects, credentials, err)
+	}
+	if n, err := st.CountEnrollments(ctx); err != nil || n != 2 {
+		t.Errorf("CountEnrollments = %d, %v; want 2", n, err)
+	}
+	mr.FastForward(11 * time.Minute)
+	if n, err := st.CountEnrollments(ctx); err != nil || n != 0 {
+		t.Errorf("CountEnrollments after expiry = %d, %v; want 0", n, err)
+	}
+}
+
+func TestTrackVerifyFailure_TrackReplay(t *testing.T) {
+	st, mr := newTestStore(t)
+	defer mr.Close()
+	clk := clock.NewFake(time.Unix(1_700_000_000, 0))
+	st.WithClock(clk)
+	ctx := context.Background()
+	window := 10 * time.Minute
+
+	for _, subject := range []string{"user1", "user2", "user1"} {
+		if _, _, err := st.TrackVerifyFailure(ctx, subject, "1.2.3.4", window); err != nil {
+			t.Fatalf("TrackVerifyFailure: %v", err)
+		}
+	}
+	subjects, ips, _ := st.TrackVerifyFailure(ctx, "user1", "5.6.7.8", window)
+	if subjects != 1 || ips != 2 {
+		t.Errorf("TrackVerifyFailure = %d subjects, %d IPs, want 1, 2", subjects, ips)
+	}
+	clk.Advance(window)
+	subjects, ips, _ = st.TrackVerifyFailure(ctx, "user3", "1.2.3.4", window)
+	if subjects != 1 || ips != 1 {
+		t.Errorf("TrackVerifyFailure after the window = %d subjects, %d IPs, want 1, 1", subjects, ips)
+	}
+
+	for i := int64(1); i <= 3; i++ {
+		n, err := st.TrackReplay(ctx, "ip", "1.2.3.4", window)
+		if err != nil {
+			t.Fatalf("TrackReplay: %v", err)
+		}
+		if n != i {
+			t.Errorf("TrackReplay = %d, want %d", n, i)
+		}
+	}
+	if n, _ := st.TrackReplay(ctx, "subject", "1.2.3.4", window); n != 1 {
+		t.Errorf("TrackReplay for another dimension = %d, want 1", n)
+	}
+	clk.Advance(window)
+	if n, _ := st.TrackReplay(ctx, "ip", "1.2.3.4", window); n != 1 {
+		t.Errorf("TrackReplay after the window = %d, want 1", n)
+	}
+}
+
+func TestBlockIP_BlockSubject_IsBlocked(t *testing.T) {
+	st, mr := newTestStore(t)
+	defer mr.Close()
+	ctx := context.Background()
+
+	if blocked, err := st.IsBlocked(ctx, "user1", "1.2.3.4"); err != nil || blocked {
+		t.Fatalf("IsBlocked before blocking = %v, %v", blocked, err)
+	}
+	if err := st.BlockIP(ctx, "1.2.3.4", time.Minute); err != nil {
+		t.Fatalf("BlockIP: %v", err)
+	}
+	if err := st.BlockSubject(ctx, "user2", time.Hour); err != nil {
+		t.Fatalf("BlockSubject: %v", err)
+	}
+	tests := []struct {
+		subject, ip string
+		want        bool
+	}{
+		{"user1", "1.2.3.4", true},
+		{"user1", "5.6.7.8", false},
+		{"user1", "", false},
+		{"user2", "", true},
+	}
+	for _, tt := range tests {
+		if got, _ := st.IsBlocked(ctx, tt.subject, tt.ip); got != tt.want {
+			t.Errorf("IsBlocked(%q, %q) = %v, want %v", tt.subject, tt.ip, got, tt.want)
+		}
+	}
+	mr.FastForward(time.Minute)
+	if got, _ := st.IsBlocked(ctx, "user1", "1.2.3.4"); got {
+		t.Error("IP still blocked after its TTL")
+	}
+}
@@ -0,0 +1,220 @@
+package tlsauth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Client certificate policies (TLS_CLIENT_AUTH).
+const (
+	ClientAuthRequest = "request" // verify a client certificate when one is sent; callers may still use API key or HMAC
+	ClientAuthRequire = "require" // handshakes without a valid client certificate fail
+)
+
+// identityLocal is the fiber.Ctx local holding the caller identity of an mTLS-authenticated request.
+const identityLocal = "tlsauth_identity"
+
+// Files names the PEM files served by a Reloader.
+type Files struct {
+	CertFile     string // server certificate chain
+	KeyFile      string // server private key
+	ClientCAFile string // CA bundle client certificates are verified against; empty disables mTLS
+	ClientAuth   string // ClientAuthRequest or ClientAuthRequire
+}
+
+type loaded struct {
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+	mtimes   []time.Time
+}
+
+// Reloader serves the server certificate and client CA bundle from disk and picks up rotated files
+// without a restart. New handshakes use the new files; open connections keep theirs.
+type Reloader struct {
+	files Files
+	cur   atomic.Pointer[loaded]
+}
+
+// NewReloader loads the files once; it fails when they cannot be read or parsed.
+func NewReloader(files Files) (*Reloader, error) {
+	switch files.ClientAuth {
+	case "", ClientAuthRequest, ClientAuthRequire:
+	default:
+		return nil, fmt.Errorf("TLS_CLIENT_AUTH %q must be request or require", files.ClientAuth)
+	}
+	r := &Reloader{files: files}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the files again. On error the previous certificate and CA bundle stay in use.
+func (r *Reloader) Reload() error {
+	mtimes, err := r.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.files.CertFile, r.files.KeyFile)
+	if err != nil {
+		return fmt.Errorf("tls certificate: %w", err)
+	}
+	l := &loaded{cert: &cert, mtimes: mtimes}
+	if r.files.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.files.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("tls client CA: %w", err)
+		}
+		l.clientCA = x509.NewCertPool()
+		if !l.clientCA.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("tls client CA: no certificates in %s", r.files.ClientCAFile)
+		}
+	}
+	r.cur.Store(l)
+	return nil
+}
+
+func (r *Reloader) paths() []string {
+	paths := []string{r.files.CertFile, r.files.KeyFile}
+	if r.files.ClientCAFile != "" {
+		paths = append(paths, r.files.ClientCAFile)
+	}
+	return paths
+}
+
+func (r *Reloader) modTimes() ([]time.Time, error) {
+	paths := r.paths()
+	out := make([]time.Time, len(paths))
+	for i, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+		out[i] = fi.ModTime()
+	}
+	return out, nil
+}
+
+// changed reports whether any file's modification time differs from the loaded one.
+func (r *Reloader) changed() bool {
+	mtimes, err := r.modTimes()
+	if err != nil {
+		// A file missing mid-rotation: wait until it is back rather than failing the reload.
+		return false
+	}
+	for i, t := range r.cur.Load().mtimes {
+		if !t.Equal(mtimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch reloads the files whenever they change, checking every interval, until ctx is done.
+// onReload receives the outcome of each reload.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration, onReload func(error)) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if r.changed() {
+				onReload(r.Reload())
+			}
+		}
+	}
+}
+
+// TLSConfig returns a server config that always uses the most recently loaded files. nextProtos are
+// the ALPN protocols offered, e.g. "h2" for the gRPC listener.
+func (r *Reloader) TLSConfig(nextProtos ...string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: nextProtos,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			l := r.cur.Load()
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*l.cert},
+				NextProtos:   nextProtos,
+			}
+			if l.clientCA != nil {
+				cfg.ClientCAs = l.clientCA
+				cfg.ClientAuth = tls.VerifyClientCertIfGiven
+				if r.files.ClientAuth == ClientAuthRequire {
+					cfg.ClientAuth = tls.RequireAndVerifyClientCert
+				}
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// ErrUnknownCertificate is returned by Identify for a verified certificate that no mapping entry matches.
+var ErrUnknownCertificate = errors.New("client certificate is not mapped to a caller identity")
+
+// Identify maps a verified client certificate to a caller identity. Mapping keys name one certificate
+// field: "uri:<SAN URI>", "dns:<SAN DNS name>", "email:<SAN email>" or "cn:<subject common name>".
+// URI SANs are tried first, then DNS, email and finally the common name. With an empty mapping the
+// common name is the identity.
+func Identify(cert *x509.Certificate, mapping map[string]string) (string, error) {
+	if len(mapping) == 0 {
+		if cert.Subject.CommonName == "" {
+			return "", ErrUnknownCertificate
+		}
+		return cert.Subject.CommonName, nil
+	}
+	var keys []string
+	for _, u := range cert.URIs {
+		keys = append(keys, "uri:"+u.String())
+	}
+	for _, name := range cert.DNSNames {
+		keys = append(keys, "dns:"+strings.ToLower(name))
+	}
+	for _, email := range cert.EmailAddresses {
+		keys = append(keys, "email:"+email)
+	}
+	if cert.Subject.CommonName != "" {
+		keys = append(keys, "cn:"+cert.Subject.CommonName)
+	}
+	for _, key := range keys {
+		if id, ok := mapping[key]; ok {
+			return id, nil
+		}
+	}
+	return "", ErrUnknownCertificate
+}
+
+// PeerCertificate returns the verified client certificate of a TLS request, or nil.
+func PeerCertificate(c *fiber.Ctx) *x509.Certificate {
+	state := c.Context().TLSConnectionState()
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// SetIdentity records the caller identity of an mTLS-authenticated request.
+func SetIdentity(c *fiber.Ctx, id string) {
+	c.Locals(identityLocal, id)
+}
+
+// IdentityFrom returns the identity set by SetIdentity, or "".
+func IdentityFrom(c *fiber.Ctx) string {
+	id, _ := c.Locals(identityLocal).(string)
+	return id
+}
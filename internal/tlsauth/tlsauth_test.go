@@ -0,0 +1,216 @@
+package tlsauth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// issue creates a certificate signed by parent, or a self-signed CA when parent is nil.
+func issue(t *testing.T, tmpl *x509.Certificate, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) write(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+	certFile, keyFile = filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCert() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+func serverCert(t *testing.T, ca *testCert, cn string) *testCert {
+	return issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: cn},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+}
+
+// handshake connects to a TLS server using r and returns the server certificate's common name.
+func handshake(t *testing.T, r *Reloader, ca *testCert, client *testCert) (string, error) {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", r.TLSConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		_ = conn.(*tls.Conn).Handshake()
+		conn.Close()
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	cfg := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+	if client != nil {
+		cfg.Certificates = []tls.Certificate{client.tlsCert()}
+	}
+	conn, err := tls.Dial("tcp", ln.Addr().String(), cfg)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	// TLS 1.3 reports a rejected client certificate on the first read.
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName, nil
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	ca := issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "test CA"}}, nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := serverCert(t, ca, "server-1").write(t, dir, "server")
+
+	if _, err := NewReloader(Files{CertFile: certFile, KeyFile: keyFile, ClientAuth: "always"}); err == nil {
+		t.Error("NewReloader accepted an unknown client auth policy")
+	}
+	if _, err := NewReloader(Files{CertFile: certFile, KeyFile: filepath.Join(dir, "missing.pem")}); err == nil {
+		t.Error("NewReloader accepted a missing key file")
+	}
+	r, err := NewReloader(Files{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, ClientAuth: ClientAuthRequire})
+	if err != nil {
+		t.Fatalf("NewReloader: %v", err)
+	}
+
+	client := issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "stargate"}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, ca)
+	if cn, err := handshake(t, r, ca, client); err != nil || cn != "server-1" {
+		t.Fatalf("handshake = %q, %v", cn, err)
+	}
+	if _, err := handshake(t, r, ca, nil); err == nil {
+		t.Error("handshake without a client certificate succeeded under require")
+	}
+
+	// Rotate the server certificate; Watch picks it up for new handshakes.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloaded := make(chan error, 1)
+	go r.Watch(ctx, 10*time.Millisecond, func(err error) {
+		select {
+		case reloaded <- err:
+		default:
+		}
+	})
+	later := time.Now().Add(time.Minute)
+	serverCert(t, ca, "server-2").write(t, dir, "server")
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case err := <-reloaded:
+		if err != nil {
+			t.Fatalf("reload: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no reload after the certificate changed")
+	}
+	if cn, err := handshake(t, r, ca, client); err != nil || cn != "server-2" {
+		t.Errorf("handshake after rotation = %q, %v", cn, err)
+	}
+
+	// A broken file keeps the current certificate.
+	if err := os.WriteFile(certFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Error("Reload accepted a broken certificate")
+	}
+	if cn, err := handshake(t, r, ca, client); err != nil || cn != "server-2" {
+		t.Errorf("handshake after failed reload = %q, %v", cn, err)
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://mesh/stargate")
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "stargate-7f9c"},
+		URIs:     []*url.URL{spiffe},
+		DNSNames: []string{"Stargate.mesh.local"},
+	}
+	tests := []struct {
+		name    string
+		mapping map[string]string
+		want    string
+		wantErr bool
+	}{
+		{"common name by default", nil, "stargate-7f9c", false},
+		{"uri", map[string]string{"uri:spiffe://mesh/stargate": "stargate"}, "stargate", false},
+		{"dns is lower-cased", map[string]string{"dns:stargate.mesh.local": "stargate-dns"}, "stargate-dns", false},
+		{"uri before cn", map[string]string{"cn:stargate-7f9c": "by-cn", "uri:spiffe://mesh/stargate": "by-uri"}, "by-uri", false},
+		{"cn", map[string]string{"cn:stargate-7f9c": "by-cn"}, "by-cn", false},
+		{"unmapped", map[string]string{"cn:other": "other"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Identify(cert, tt.mapping)
+			if got != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("Identify = %q, %v; want %q (error %v)", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package totp
+
+import (
+	"encoding/base32"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pquerna/otp/hotp"
+)
+
+// Credential types.
+const (
+	TypeTOTP = "totp"
+	TypeHOTP = "hotp"
+)
+
+// hotpSecretSize matches the TOTP secret size (160 bits, as recommended by RFC 4226).
+const hotpSecretSize = 20
+
+// GenerateHOTP creates a new HOTP key and returns secret (base32) and otpauth://hotp/ URI with counter=0.
+func GenerateHOTP(accountName string, cfg Config) (secretBase32, otpauthURI string, err error) {
+	key, err := hotp.Generate(hotp.GenerateOpts{
+		Issuer:      cfg.Issuer,
+		AccountName: accountName,
+		SecretSize:  hotpSecretSize,
+		Digits:      cfg.Digits,
+		Algorithm:   cfg.Algo,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return key.Secret(), withCounter(key.URL(), 0), nil
+}
+
+// HOTPKeyURI rebuilds the otpauth://hotp/ URI for an existing base32 secret and counter.
+func HOTPKeyURI(accountName, secretBase32 string, counter uint64, cfg Config) (string, error) {
+	raw, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secretBase32))
+	if err != nil {
+		return "", err
+	}
+	key, err := hotp.Generate(hotp.GenerateOpts{
+		Issuer:      cfg.Issuer,
+		AccountName: accountName,
+		Digits:      cfg.Digits,
+		Algorithm:   cfg.Algo,
+		Secret:      raw,
+	})
+	if err != nil {
+		return "", err
+	}
+	return withCounter(key.URL(), counter), nil
+}
+
+// MatchHOTP looks for code at counters [counter, counter+lookAhead] and returns the counter that matched.
+func MatchHOTP(code, secretBase32 string, counter, lookAhead uint64, cfg Config) (uint64, bool) {
+	opts := hotp.ValidateOpts{Digits: cfg.Digits, Algorithm: cfg.Algo}
+	for i := counter; i <= counter+lookAhead; i++ {
+		if ok, err := hotp.ValidateCustom(code, i, secretBase32, opts); err == nil && ok {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// ResyncHOTP looks for two consecutive codes (code1 at c, code2 at c+1) with c in [counter, counter+window]
+// and returns the counter that matched code2.
+func ResyncHOTP(code1, code2, secretBase32 string, counter, window uint64, cfg Config) (uint64, bool) {
+	opts := hotp.ValidateOpts{Digits: cfg.Digits, Algorithm: cfg.Algo}
+	for i := counter; i <= counter+window; i++ {
+		ok, err := hotp.ValidateCustom(code1, i, secretBase32, opts)
+		if err != nil || !ok {
+			continue
+		}
+		if ok, err := hotp.ValidateCustom(code2, i+1, secretBase32, opts); err == nil && ok {
+			return i + 1, true
+		}
+	}
+	return 0, false
+}
+
+// withCounter adds the counter parameter that authenticator apps require for HOTP URIs.
+func withCounter(uri string, counter uint64) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	q := u.Query()
+	q.Set("counter", strconv.FormatUint(counter, 10))
+	u.RawQuery = q.Encode()
+	return u.String()
+}
@@ -1,6 +1,8 @@
 package totp
 
 import (
+	"encoding/base32"
+	"strings"
 	"time"
 
 	"github.com/pquerna/otp"
@@ -24,6 +26,17 @@ func DigitsFromInt(n int) otp.Digits {
 	return otp.DigitsSix
 }
 
+// AlgorithmFromString returns otp.Algorithm for "SHA256" or "SHA512"; anything else is SHA1.
+func AlgorithmFromString(name string) otp.Algorithm {
+	switch strings.ToUpper(name) {
+	case "SHA256":
+		return otp.AlgorithmSHA256
+	case "SHA512":
+		return otp.AlgorithmSHA512
+	}
+	return otp.AlgorithmSHA1
+}
+
 // AlgorithmSHA1 is the default TOTP algorithm (best compatibility).
 var AlgorithmSHA1 = otp.AlgorithmSHA1
 
@@ -53,6 +66,26 @@ func Generate(accountName string, cfg Config) (secretBase32, otpauthURI string,
 	return key.Secret(), key.URL(), nil
 }
 
+// KeyURI rebuilds the otpauth URI for an existing base32 secret (e.g. to re-show a QR code).
+func KeyURI(accountName, secretBase32 string, cfg Config) (string, error) {
+	raw, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secretBase32))
+	if err != nil {
+		return "", err
+	}
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      cfg.Issuer,
+		AccountName: accountName,
+		Period:      cfg.Period,
+		Digits:      cfg.Digits,
+		Algorithm:   cfg.Algo,
+		Secret:      raw,
+	})
+	if err != nil {
+		return "", err
+	}
+	return key.URL(), nil
+}
+
 // Validate verifies the code against the secret at the given time.
 func Validate(code, secretBase32 string, cfg Config, now time.Time) (bool, error) {
 	return totp.ValidateCustom(code, secretBase32, now, totp.ValidateOpts{
@@ -1,10 +1,12 @@
 package totp
 
 import (
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/hotp"
 	pqtotp "github.com/pquerna/otp/totp"
 )
 
@@ -97,3 +99,68 @@ func TestTimeStep(t *testing.T) {
 		t.Errorf("TimeStep(90s, 30) = %d, want 3", got)
 	}
 }
+
+func TestKeyURI(t *testing.T) {
+	cfg := DefaultConfig("Herald")
+	secret, uri, err := Generate("user1", cfg)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	got, err := KeyURI("user1", secret, cfg)
+	if err != nil {
+		t.Fatalf("KeyURI: %v", err)
+	}
+	if got != uri {
+		t.Errorf("KeyURI = %q, want %q", got, uri)
+	}
+	if _, err := KeyURI("user1", "not base32!", cfg); err == nil {
+		t.Error("KeyURI(invalid secret) should fail")
+	}
+}
+
+func TestHOTP_GenerateMatchResync(t *testing.T) {
+	cfg := DefaultConfig("TestIssuer")
+	secretBase32, uri, err := GenerateHOTP("user@example.com", cfg)
+	if err != nil {
+		t.Fatalf("GenerateHOTP: %v", err)
+	}
+	if !strings.HasPrefix(uri, "otpauth://hotp/") || !strings.Contains(uri, "counter=0") {
+		t.Errorf("uri = %q, want otpauth://hotp/ with counter=0", uri)
+	}
+	rebuilt, err := HOTPKeyURI("user@example.com", secretBase32, 7, cfg)
+	if err != nil || !strings.Contains(rebuilt, "counter=7") || !strings.Contains(rebuilt, "secret="+secretBase32) {
+		t.Errorf("HOTPKeyURI = %q, %v", rebuilt, err)
+	}
+
+	code := func(counter uint64) string {
+		c, err := hotp.GenerateCode(secretBase32, counter)
+		if err != nil {
+			t.Fatalf("GenerateCode: %v", err)
+		}
+		return c
+	}
+	if got, ok := MatchHOTP(code(3), secretBase32, 0, 5, cfg); !ok || got != 3 {
+		t.Errorf("MatchHOTP within look-ahead = %d, %v; want 3, true", got, ok)
+	}
+	if _, ok := MatchHOTP(code(9), secretBase32, 0, 5, cfg); ok {
+		t.Error("MatchHOTP beyond look-ahead should fail")
+	}
+	if _, ok := MatchHOTP(code(1), secretBase32, 2, 5, cfg); ok {
+		t.Error("MatchHOTP below the counter should fail")
+	}
+	if got, ok := ResyncHOTP(code(40), code(41), secretBase32, 0, 50, cfg); !ok || got != 41 {
+		t.Errorf("ResyncHOTP = %d, %v; want 41, true", got, ok)
+	}
+	if _, ok := ResyncHOTP(code(40), code(42), secretBase32, 0, 50, cfg); ok {
+		t.Error("ResyncHOTP with non-consecutive codes should fail")
+	}
+}
+
+func TestAlgorithmFromString(t *testing.T) {
+	cases := map[string]otp.Algorithm{"SHA1": otp.AlgorithmSHA1, "sha256": otp.AlgorithmSHA256, "SHA512": otp.AlgorithmSHA512, "": otp.AlgorithmSHA1}
+	for in, want := range cases {
+		if got := AlgorithmFromString(in); got != want {
+			t.Errorf("AlgorithmFromString(%q) = %v, want %v", in, got, want)
+		}
+	}
+}
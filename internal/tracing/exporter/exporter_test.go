@@ -0,0 +1,58 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+
+	"github.com/soulteary/herald-totp/internal/tracing"
+)
+
+func TestSetup_None(t *testing.T) {
+	prev := otel.GetTracerProvider()
+	shutdown, err := Setup(context.Background(), Config{Exporter: ExporterNone})
+	if err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	if otel.GetTracerProvider() != prev {
+		t.Error("Setup(none) replaced the tracer provider")
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown: %v", err)
+	}
+}
+
+func TestSetup_Stdout(t *testing.T) {
+	prev, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	defer func() {
+		otel.SetTracerProvider(prev)
+		otel.SetTextMapPropagator(prevPropagator)
+	}()
+	var out bytes.Buffer
+	shutdown, err := Setup(context.Background(), Config{Exporter: ExporterStdout, ServiceName: "herald-totp-test", Stdout: &out})
+	if err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	_, span := tracing.Tracer().Start(context.Background(), "GET /v1/status")
+	span.End()
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	for _, want := range []string{`"Name":"GET /v1/status"`, `"Value":"herald-totp-test"`} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("stdout exporter output lacks %s:\n%s", want, out.String())
+		}
+	}
+	if fields := otel.GetTextMapPropagator().Fields(); len(fields) == 0 || fields[0] != "traceparent" {
+		t.Errorf("propagator fields = %v, want traceparent", fields)
+	}
+}
+
+func TestSetup_UnknownExporter(t *testing.T) {
+	if _, err := Setup(context.Background(), Config{Exporter: "jaeger"}); err == nil {
+		t.Error("Setup(jaeger) err = nil")
+	}
+}
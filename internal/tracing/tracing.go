@@ -0,0 +1,45 @@
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/soulteary/herald-totp/internal/store"
+)
+
+// instrumentationName names the tracer of herald-totp spans.
+const instrumentationName = "github.com/soulteary/herald-totp"
+
+// Propagator reads and writes W3C trace context (traceparent, tracestate) headers.
+var Propagator propagation.TextMapPropagator = propagation.TraceContext{}
+
+// Tracer returns the tracer of herald-totp spans, from the global tracer provider.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// End records err on span, if any, and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// StoreHook returns a store hook running every store operation in a child span named after it
+// (e.g. "store.get_credential").
+func StoreHook() store.Hook {
+	return func(ctx context.Context, op string) (context.Context, func(error)) {
+		ctx, span := Tracer().Start(ctx, "store."+op,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(semconv.DBSystemNameRedis, semconv.DBOperationName(op)),
+		)
+		return ctx, func(err error) { End(span, err) }
+	}
+}
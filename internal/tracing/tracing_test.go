@@ -0,0 +1,49 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestStoreHook(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	defer otel.SetTracerProvider(prev)
+
+	ctx, parent := Tracer().Start(context.Background(), "POST /v1/verify")
+	hook := StoreHook()
+	opCtx, end := hook(ctx, "get_credentials")
+	if !trace.SpanFromContext(opCtx).SpanContext().IsValid() {
+		t.Fatal("hook context carries no span")
+	}
+	_, endNested := hook(opCtx, "get_credential")
+	endNested(errors.New("connection refused"))
+	end(nil)
+	parent.End()
+
+	spans := rec.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("ended spans = %d, want 3", len(spans))
+	}
+	nested, op := spans[0], spans[1]
+	if op.Name() != "store.get_credentials" || op.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("op span = %q with parent %v, want store.get_credentials under the request span", op.Name(), op.Parent().SpanID())
+	}
+	if op.SpanKind() != trace.SpanKindClient || op.Status().Code != codes.Unset {
+		t.Errorf("op span kind %v, status %v", op.SpanKind(), op.Status())
+	}
+	if nested.Name() != "store.get_credential" || nested.Parent().SpanID() != op.SpanContext().SpanID() {
+		t.Errorf("nested span = %q with parent %v, want store.get_credential under the op span", nested.Name(), nested.Parent().SpanID())
+	}
+	if nested.Status().Code != codes.Error || len(nested.Events()) != 1 {
+		t.Errorf("failed op span status %v with %d events, want an error and its event", nested.Status(), len(nested.Events()))
+	}
+}
@@ -0,0 +1,274 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	encoding "encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	logger "github.com/soulteary/logger-kit"
+
+	"github.com/soulteary/herald-totp/internal/audit"
+	"github.com/soulteary/herald-totp/internal/clock"
+	"github.com/soulteary/herald-totp/internal/store"
+)
+
+// Webhook event types sent to subscribers.
+const (
+	EventEnrolled       = "enrolled"
+	EventRevoked        = "revoked"
+	EventBackupCodeUsed = "backup_code_used"
+	EventBackupCodesLow = "backup_codes_low"
+)
+
+// Headers set on every delivery.
+const (
+	HeaderEvent     = "X-Herald-Event"
+	HeaderDelivery  = "X-Herald-Delivery"
+	HeaderTimestamp = "X-Herald-Timestamp"
+	HeaderSignature = "X-Herald-Signature"
+)
+
+const deliveryIDPrefix = "w_"
+
+// Config holds webhook targets and delivery policy.
+type Config struct {
+	URLs           map[string][]string // event type -> target URLs
+	Secret         string              // HMAC-SHA256 signing secret
+	MaxAttempts    int                 // attempts before dead-lettering
+	Backoff        time.Duration       // delay after the first failure; doubles per attempt
+	MaxBackoff     time.Duration       // cap on the retry delay
+	Timeout        time.Duration       // per-request timeout
+	PollInterval   time.Duration       // how often the worker checks the queue
+	LowBackupCodes int                 // send backup_codes_low when remaining codes <= this (0 = never)
+	DeadLetterMax  int64               // max entries kept in the dead-letter list
+}
+
+// Payload is the JSON body POSTed to webhook targets.
+type Payload struct {
+	ID        string         `json:"id"`
+	Event     string         `json:"event"`
+	Subject   string         `json:"subject"`
+	Timestamp int64          `json:"timestamp"`
+	Data      map[string]any `json:"data,omitempty"`
+}
+
+// Dispatcher enqueues webhook deliveries in the store and sends them with retry.
+// It implements audit.Sink so security events reach webhooks without extra handler wiring.
+type Dispatcher struct {
+	st     *store.Store
+	cfg    Config
+	client *http.Client
+	log    *logger.Logger
+	clock  clock.Clock
+}
+
+// NewDispatcher creates a dispatcher backed by the store. It times deliveries and retries with clk;
+// nil uses the wall clock.
+func NewDispatcher(st *store.Store, cfg Config, clk clock.Clock, log *logger.Logger) *Dispatcher {
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 1
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = time.Second
+	}
+	if clk == nil {
+		clk = clock.System()
+	}
+	return &Dispatcher{
+		st:     st,
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		log:    log,
+		clock:  clk,
+	}
+}
+
+// Sign returns the X-Herald-Signature value: "sha256=" + hex(HMAC-SHA256(secret, timestamp + "." + body)).
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Write maps successful audit events to webhook events and enqueues them.
+func (d *Dispatcher) Write(ctx context.Context, e audit.Event) error {
+	if e.Outcome != audit.OutcomeSuccess || e.Subject == "" {
+		return nil
+	}
+	switch e.Type {
+	case audit.EventEnrollConfirm:
+		return d.Enqueue(ctx, EventEnrolled, e.Subject, nil)
+	case audit.EventRevoke:
+		return d.Enqueue(ctx, EventRevoked, e.Subject, nil)
+	case audit.EventBackupCodeUsed:
+		remaining, err := d.st.RemainingBackupCodes(ctx, e.Subject)
+		if err != nil {
+			return err
+		}
+		data := map[string]any{"remaining_backup_codes": remaining}
+		if err := d.Enqueue(ctx, EventBackupCodeUsed, e.Subject, data); err != nil {
+			return err
+		}
+		if d.cfg.LowBackupCodes > 0 && remaining <= d.cfg.LowBackupCodes {
+			return d.Enqueue(ctx, EventBackupCodesLow, e.Subject, data)
+		}
+	}
+	return nil
+}
+
+// Enqueue stores one delivery per target URL configured for the event. Events without targets are dropped.
+func (d *Dispatcher) Enqueue(ctx context.Context, event, subject string, data map[string]any) error {
+	urls := d.cfg.URLs[event]
+	if len(urls) == 0 {
+		return nil
+	}
+	now := d.clock.Now().Unix()
+	for _, u := range urls {
+		id, err := newDeliveryID()
+		if err != nil {
+			return err
+		}
+		body, err := json.Marshal(Payload{ID: id, Event: event, Subject: subject, Timestamp: now, Data: data})
+		if err != nil {
+			return err
+		}
+		del := &store.WebhookDelivery{
+			ID:            id,
+			Event:         event,
+			URL:           u,
+			Payload:       string(body),
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		}
+		if err := d.st.SaveWebhookDelivery(ctx, del); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run processes the queue every PollInterval until ctx is cancelled.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := d.ProcessDue(ctx); err != nil && d.log != nil {
+				d.log.Warn().Err(err).Msg("webhook: process queue failed")
+			}
+		}
+	}
+}
+
+// ProcessDue sends every delivery that is due and returns how many were attempted.
+func (d *Dispatcher) ProcessDue(ctx context.Context) (int, error) {
+	now := d.clock.Now()
+	ids, err := d.st.DueWebhookIDs(ctx, now.Unix(), 100)
+	if err != nil {
+		return 0, err
+	}
+	// Lease claimed deliveries past the request timeout so a crashed worker's work is retried.
+	leaseUntil := now.Add(d.cfg.Timeout + time.Minute).Unix()
+	n := 0
+	for _, id := range ids {
+		del, err := d.st.ClaimWebhookDelivery(ctx, id, now.Unix(), leaseUntil)
+		if err != nil {
+			return n, err
+		}
+		if del == nil {
+			continue
+		}
+		n++
+		d.attempt(ctx, del)
+	}
+	return n, nil
+}
+
+// attempt sends one delivery and then deletes, reschedules or dead-letters it.
+func (d *Dispatcher) attempt(ctx context.Context, del *store.WebhookDelivery) {
+	del.Attempts++
+	err := d.send(ctx, del)
+	if err == nil {
+		if err := d.st.DeleteWebhookDelivery(ctx, del.ID); err != nil && d.log != nil {
+			d.log.Warn().Err(err).Str("delivery", del.ID).Msg("webhook: delete delivered failed")
+		}
+		return
+	}
+	del.LastError = err.Error()
+	if del.Attempts >= d.cfg.MaxAttempts {
+		if d.log != nil {
+			d.log.Warn().Err(err).Str("delivery", del.ID).Str("event", del.Event).Int("attempts", del.Attempts).Msg("webhook: delivery dead-lettered")
+		}
+		if err := d.st.DeadLetterWebhook(ctx, del, d.cfg.DeadLetterMax); err != nil && d.log != nil {
+			d.log.Warn().Err(err).Str("delivery", del.ID).Msg("webhook: dead-letter failed")
+		}
+		return
+	}
+	del.NextAttemptAt = d.clock.Now().Add(d.backoff(del.Attempts)).Unix()
+	if err := d.st.SaveWebhookDelivery(ctx, del); err != nil && d.log != nil {
+		d.log.Warn().Err(err).Str("delivery", del.ID).Msg("webhook: reschedule failed")
+	}
+}
+
+// backoff returns Backoff * 2^(attempts-1), capped at MaxBackoff.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.cfg.Backoff
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if d.cfg.MaxBackoff > 0 && delay >= d.cfg.MaxBackoff {
+			return d.cfg.MaxBackoff
+		}
+	}
+	return delay
+}
+
+// send POSTs the signed payload; any non-2xx status is an error.
+func (d *Dispatcher) send(ctx context.Context, del *store.WebhookDelivery) error {
+	body := []byte(del.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, del.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(d.clock.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, del.Event)
+	req.Header.Set(HeaderDelivery, del.ID)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	if d.cfg.Secret != "" {
+		req.Header.Set(HeaderSignature, Sign(d.cfg.Secret, timestamp, body))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook target returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// newDeliveryID returns a new delivery ID (w_xxxx).
+func newDeliveryID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return deliveryIDPrefix + encoding.URLEncoding.EncodeToString(b)[:16], nil
+}
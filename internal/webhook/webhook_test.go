@@ -0,0 +1,182 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/soulteary/herald-totp/internal/audit"
+	"github.com/soulteary/herald-totp/internal/clock"
+	"github.com/soulteary/herald-totp/internal/store"
+)
+
+type received struct {
+	header http.Header
+	body   []byte
+}
+
+func newTestDispatcher(t *testing.T, status int, cfg Config, clk clock.Clock) (*Dispatcher, *store.Store, *[]received, func()) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis: %v", err)
+	}
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	st := store.NewStore(rdb, 10*time.Minute, 0, 5*time.Minute, time.Hour, time.Minute)
+
+	var mu sync.Mutex
+	var got []received
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		got = append(got, received{header: r.Header.Clone(), body: body})
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	if cfg.URLs == nil {
+		cfg.URLs = map[string][]string{
+			EventEnrolled:       {server.URL},
+			EventRevoked:        {server.URL},
+			EventBackupCodeUsed: {server.URL},
+			EventBackupCodesLow: {server.URL},
+		}
+	}
+	cfg.Timeout = 5 * time.Second
+	d := NewDispatcher(st, cfg, clk, nil)
+	return d, st, &got, func() {
+		server.Close()
+		mr.Close()
+	}
+}
+
+func TestDispatcher_DeliverSigned(t *testing.T) {
+	d, _, got, done := newTestDispatcher(t, http.StatusOK, Config{Secret: "whsec", MaxAttempts: 3}, nil)
+	defer done()
+	ctx := context.Background()
+
+	if err := d.Write(ctx, audit.Event{Type: audit.EventEnrollConfirm, Subject: "user1", Outcome: audit.OutcomeSuccess}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	// failures and unrelated events are not delivered
+	_ = d.Write(ctx, audit.Event{Type: audit.EventEnrollConfirm, Subject: "user1", Outcome: audit.OutcomeFailure})
+	_ = d.Write(ctx, audit.Event{Type: audit.EventVerify, Subject: "user1", Outcome: audit.OutcomeSuccess})
+
+	n, err := d.ProcessDue(ctx)
+	if err != nil {
+		t.Fatalf("ProcessDue: %v", err)
+	}
+	if n != 1 || len(*got) != 1 {
+		t.Fatalf("attempted = %d, received = %d, want 1", n, len(*got))
+	}
+	r := (*got)[0]
+	if r.header.Get(HeaderEvent) != EventEnrolled {
+		t.Errorf("%s = %q", HeaderEvent, r.header.Get(HeaderEvent))
+	}
+	want := Sign("whsec", r.header.Get(HeaderTimestamp), r.body)
+	if r.header.Get(HeaderSignature) != want {
+		t.Errorf("signature = %q, want %q", r.header.Get(HeaderSignature), want)
+	}
+	var p Payload
+	if err := json.Unmarshal(r.body, &p); err != nil {
+		t.Fatalf("payload: %v", err)
+	}
+	if p.Event != EventEnrolled || p.Subject != "user1" || p.ID != r.header.Get(HeaderDelivery) {
+		t.Errorf("payload = %+v", p)
+	}
+
+	// delivered webhooks are removed from the queue
+	n, _ = d.ProcessDue(ctx)
+	if n != 0 {
+		t.Errorf("second ProcessDue attempted = %d, want 0", n)
+	}
+}
+
+func TestDispatcher_RetryThenDeadLetter(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	d, st, got, done := newTestDispatcher(t, http.StatusInternalServerError, Config{
+		MaxAttempts: 3, Backoff: 10 * time.Second, MaxBackoff: 15 * time.Second,
+	}, clk)
+	defer done()
+	ctx := context.Background()
+
+	if err := d.Enqueue(ctx, EventRevoked, "user1", nil); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	if n, _ := d.ProcessDue(ctx); n != 1 {
+		t.Fatalf("first attempt = %d, want 1", n)
+	}
+	// not due again until the backoff elapses
+	clk.Advance(9 * time.Second)
+	if n, _ := d.ProcessDue(ctx); n != 0 {
+		t.Errorf("attempt before backoff = %d, want 0", n)
+	}
+	clk.Advance(time.Second)
+	if n, _ := d.ProcessDue(ctx); n != 1 {
+		t.Errorf("second attempt = %d, want 1", n)
+	}
+	// second delay is 20s, capped at 15s
+	clk.Advance(15 * time.Second)
+	if n, _ := d.ProcessDue(ctx); n != 1 {
+		t.Errorf("third attempt = %d, want 1", n)
+	}
+	if len(*got) != 3 {
+		t.Errorf("received = %d, want 3", len(*got))
+	}
+
+	dead, err := st.ListDeadWebhooks(ctx, 10)
+	if err != nil {
+		t.Fatalf("ListDeadWebhooks: %v", err)
+	}
+	if len(dead) != 1 || dead[0].Attempts != 3 || dead[0].LastError == "" {
+		t.Fatalf("dead letters = %+v", dead)
+	}
+	clk.Advance(time.Hour)
+	if n, _ := d.ProcessDue(ctx); n != 0 {
+		t.Errorf("attempt after dead-letter = %d, want 0", n)
+	}
+}
+
+func TestDispatcher_BackupCodesLow(t *testing.T) {
+	d, st, got, done := newTestDispatcher(t, http.StatusNoContent, Config{MaxAttempts: 1, LowBackupCodes: 1}, nil)
+	defer done()
+	ctx := context.Background()
+	_ = st.SaveBackupCodes(ctx, "user1", []store.BackupCodeEntry{{CodeHash: "h1", UsedAt: 1}, {CodeHash: "h2"}})
+
+	if err := d.Write(ctx, audit.Event{Type: audit.EventBackupCodeUsed, Subject: "user1", Outcome: audit.OutcomeSuccess}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if n, _ := d.ProcessDue(ctx); n != 2 {
+		t.Fatalf("attempted = %d, want 2 (backup_code_used + backup_codes_low)", n)
+	}
+	events := map[string]bool{}
+	for _, r := range *got {
+		events[r.header.Get(HeaderEvent)] = true
+		var p Payload
+		_ = json.Unmarshal(r.body, &p)
+		if p.Data["remaining_backup_codes"] != float64(1) {
+			t.Errorf("remaining_backup_codes = %v, want 1", p.Data["remaining_backup_codes"])
+		}
+	}
+	if !events[EventBackupCodeUsed] || !events[EventBackupCodesLow] {
+		t.Errorf("events = %v", events)
+	}
+}
+
+func TestDispatcher_NoTargets(t *testing.T) {
+	d, _, got, done := newTestDispatcher(t, http.StatusOK, Config{URLs: map[string][]string{}}, nil)
+	defer done()
+	ctx := context.Background()
+	if err := d.Enqueue(ctx, EventRevoked, "user1", nil); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	if n, _ := d.ProcessDue(ctx); n != 0 || len(*got) != 0 {
+		t.Errorf("attempted = %d, received = %d, want 0", n, len(*got))
+	}
+}
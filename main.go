@@ -2,6 +2,9 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"flag"
+	"net"
 	"os"
 	"os/signal"
 	"strings"
@@ -11,10 +14,17 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/pterm/pterm"
 	"github.com/pterm/pterm/putils"
+	"github.com/soulteary/herald-totp/internal/clock"
 	"github.com/soulteary/herald-totp/internal/config"
+	"github.com/soulteary/herald-totp/internal/grpcapi"
+	"github.com/soulteary/herald-totp/internal/metrics"
 	"github.com/soulteary/herald-totp/internal/router"
+	"github.com/soulteary/herald-totp/internal/tlsauth"
+	"github.com/soulteary/herald-totp/internal/tracing/exporter"
 	"github.com/soulteary/logger-kit"
 	version "github.com/soulteary/version-kit"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 func showBanner() {
@@ -29,44 +39,214 @@ func showBanner() {
 }
 
 func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// runServe starts the HTTP server, and the gRPC API when GRPC_PORT is set, and blocks until SIGINT or
+// SIGTERM, or until a listener fails. Startup and listen failures return 1 after the deferred cleanup.
+func runServe(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
 	showBanner()
 
-	level := logger.ParseLevelFromEnv("LOG_LEVEL", logger.InfoLevel)
-	log := logger.New(logger.Config{
-		Level:          level,
-		ServiceName:    "herald-totp",
-		ServiceVersion: version.Version,
+	log, err := loadConfig(logger.InfoLevel)
+	if err != nil {
+		log.Error().Err(err).Msg("refusing to start")
+		return 1
+	}
+	cfg := config.Get()
+	log.SetLevel(logLevel(cfg.LogLevel, logger.InfoLevel))
+	if err := cfg.Validate(); err != nil {
+		log.Error().Err(err).Str("mode", cfg.Mode).Msg("refusing to start")
+		return 1
+	}
+	if cfg.Mode != config.ModeProduction {
+		for _, problem := range cfg.Insecure() {
+			log.Warn().Str("mode", cfg.Mode).Msg("insecure setting: " + problem)
+		}
+	}
+
+	port := listenAddr(cfg.Port)
+
+	stopTracing, err := exporter.Setup(context.Background(), exporter.Config{
+		Exporter:     cfg.TracingExporter,
+		OTLPEndpoint: cfg.TracingOTLPEndpoint,
+		ServiceName:  cfg.ServiceName,
+		Stdout:       os.Stdout,
 	})
-	config.Initialize(log)
+	if err != nil {
+		log.Error().Err(err).Msg("refusing to start")
+		return 1
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := stopTracing(ctx); err != nil {
+			log.Warn().Err(err).Msg("tracing shutdown error")
+		}
+	}()
 
-	port := config.Port
-	if !strings.HasPrefix(port, ":") {
-		port = ":" + port
+	ctx, stopWatch := context.WithCancel(context.Background())
+	defer stopWatch()
+	clk := clock.System()
+	st, err := router.NewStore(cfg)
+	if err != nil {
+		log.Error().Err(err).Msg("redis setup failed")
+		return 1
 	}
-	if config.EncryptionKey == "" || len(config.EncryptionKey) < 32 {
-		log.Warn().Msg("HERALD_TOTP_ENCRYPTION_KEY not set or shorter than 32 bytes; enroll/verify will fail")
+	auditRecorder, dispatcher, err := router.NewAuditRecorder(cfg, st, clk, os.Stdout, log)
+	if err != nil {
+		log.Error().Err(err).Msg("refusing to start")
+		return 1
+	}
+	defer func() {
+		if err := auditRecorder.Close(); err != nil {
+			log.Warn().Err(err).Msg("audit close error")
+		}
+	}()
+	if dispatcher != nil {
+		go dispatcher.Run(ctx)
 	}
 
 	app := fiber.New(fiber.Config{DisableStartupMessage: false})
-	st, err := router.Setup(app, log)
+	svc, err := router.Setup(app, router.Options{
+		Config:   config.Get,
+		Store:    st,
+		Clock:    clk,
+		Registry: metrics.NewRegistry(),
+		Audit:    auditRecorder,
+		Log:      log,
+	})
 	if err != nil {
-		log.Fatal().Err(err).Msg("router setup failed")
+		log.Error().Err(err).Msg("router setup failed")
+		return 1
 	}
-	_ = st
 
+	var certs *tlsauth.Reloader
+	if cfg.TLS() {
+		certs, err = tlsauth.NewReloader(tlsauth.Files{
+			CertFile:     cfg.TLSCertFile,
+			KeyFile:      cfg.TLSKeyFile,
+			ClientCAFile: cfg.TLSClientCAFile,
+			ClientAuth:   cfg.TLSClientAuth,
+		})
+		if err != nil {
+			log.Error().Err(err).Msg("refusing to start")
+			return 1
+		}
+		go certs.Watch(ctx, cfg.ReloadInterval, func(err error) { logCertReload(log, err) })
+	}
+	go config.Watch(ctx, func(res *config.ReloadResult, err error) {
+		if certs != nil {
+			logCertReload(log, certs.Reload())
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("config reload failed; keeping the current settings")
+			return
+		}
+		if len(res.RestartRequired) > 0 {
+			log.Warn().Strs("settings", res.RestartRequired).Msg("config reload: these changes need a restart")
+		}
+		if len(res.Applied) == 0 {
+			return
+		}
+		log.SetLevel(logLevel(config.Get().LogLevel, logger.InfoLevel))
+		log.Info().Strs("settings", res.Applied).Msg("config reloaded")
+	})
+
+	serveErr := make(chan error, 2)
 	go func() {
-		if err := app.Listen(port); err != nil {
-			log.Fatal().Err(err).Msg("listen failed")
+		if err := listen(app, port, certs); err != nil {
+			log.Error().Err(err).Msg("listen failed")
+			serveErr <- err
 		}
 	}()
+	var grpcServer *grpc.Server
+	if cfg.GRPCPort != "" {
+		var creds credentials.TransportCredentials
+		if certs != nil {
+			creds = credentials.NewTLS(certs.TLSConfig("h2"))
+		}
+		grpcServer = grpcapi.New(svc, config.Get, log).GRPCServer(creds)
+		go func() {
+			if err := listenGRPC(grpcServer, listenAddr(cfg.GRPCPort)); err != nil {
+				log.Error().Err(err).Msg("gRPC listen failed")
+				serveErr <- err
+			}
+		}()
+		log.Info().Str("port", cfg.GRPCPort).Msg("gRPC API listening")
+	}
 
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
-	<-quit
+	status := 0
+	select {
+	case <-quit:
+	case <-serveErr:
+		status = 1
+	}
 	log.Info().Msg("shutting down")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	stopWatch()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	if err := app.ShutdownWithContext(ctx); err != nil {
+	if grpcServer != nil {
+		stopGRPC(shutdownCtx, grpcServer)
+	}
+	if err := app.ShutdownWithContext(shutdownCtx); err != nil {
 		log.Warn().Err(err).Msg("shutdown error")
 	}
+	return status
+}
+
+// listen serves app on port, over TLS when certs is not nil.
+func listen(app *fiber.App, port string, certs *tlsauth.Reloader) error {
+	if certs == nil {
+		return app.Listen(port)
+	}
+	ln, err := net.Listen("tcp", port)
+	if err != nil {
+		return err
+	}
+	return app.Listener(tls.NewListener(ln, certs.TLSConfig()))
+}
+
+// listenGRPC serves the gRPC API on port; srv carries the TLS credentials, if any.
+func listenGRPC(srv *grpc.Server, port string) error {
+	ln, err := net.Listen("tcp", port)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(ln)
+}
+
+// stopGRPC stops srv gracefully, cutting off calls still running when ctx is done.
+func stopGRPC(ctx context.Context, srv *grpc.Server) {
+	done := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		srv.Stop()
+	}
+}
+
+// listenAddr turns a PORT-style setting ("8084" or ":8084") into a listen address.
+func listenAddr(port string) string {
+	if !strings.HasPrefix(port, ":") {
+		return ":" + port
+	}
+	return port
+}
+
+func logCertReload(log *logger.Logger, err error) {
+	if err != nil {
+		log.Error().Err(err).Msg("TLS certificate reload failed; keeping the current certificate")
+		return
+	}
+	log.Info().Msg("TLS certificate reloaded")
 }
@@ -3,9 +3,6 @@ package heraldtotp
 import (
 	"bytes"
 	"context"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -13,27 +10,36 @@ import (
 	"net/url"
 	"strconv"
 	"time"
+
+	"go.opentelemetry.io/otel/propagation"
 )
 
 // Client is the herald-totp HTTP client for Status, Verify, Enroll, and Revoke.
 type Client struct {
 	httpClient *http.Client
 	baseURL    string
-	apiKey     string
-	hmacSecret string
-	service    string
+	signer     Signer
+	propagator propagation.TextMapPropagator
+	retry      RetryOptions
+	breaker    *breaker
 }
 
 // Options for creating a client.
 type Options struct {
-	BaseURL    string
-	APIKey     string
-	HMACSecret string
-	Service    string
-	Timeout    time.Duration
+	BaseURL        string
+	APIKey         string
+	HMACSecret     string
+	HMACKeyID      string // sent as X-Key-Id to select one of HERALD_TOTP_HMAC_KEYS
+	Service        string // X-Service, signed with HMAC
+	Signer         Signer // replaces the API key and HMAC headers when set
+	Timeout        time.Duration
+	Retry          RetryOptions
+	CircuitBreaker CircuitBreakerOptions         // zero Threshold disables the breaker
+	Transport      http.RoundTripper             // nil uses http.DefaultTransport
+	Propagator     propagation.TextMapPropagator // writes the trace context of ctx to requests; nil uses W3C traceparent
 }
 
-// DefaultOptions returns default options.
+// DefaultOptions returns default options: no retries (see WithRetry) and no circuit breaker.
 func DefaultOptions() *Options {
 	return &Options{
 		Timeout: 10 * time.Second,
@@ -59,12 +65,59 @@ func (o *Options) WithHMACSecret(s string) *Options {
 	return o
 }
 
+// WithHMACKeyID sets the HMAC key ID, for servers with several HERALD_TOTP_HMAC_KEYS.
+func (o *Options) WithHMACKeyID(id string) *Options {
+	o.HMACKeyID = id
+	return o
+}
+
+// WithService sets the service name sent in X-Service.
+func (o *Options) WithService(s string) *Options {
+	o.Service = s
+	return o
+}
+
+// WithSigner authenticates requests with s instead of the API key and HMAC options.
+func (o *Options) WithSigner(s Signer) *Options {
+	o.Signer = s
+	return o
+}
+
 // WithTimeout sets the timeout.
 func (o *Options) WithTimeout(d time.Duration) *Options {
 	o.Timeout = d
 	return o
 }
 
+// WithRetry sets the retry policy; maxRetries 0 disables retries. Status, EnrollStatus, EnrollQR,
+// EnrollCancel and Revoke are retried after network errors and 5xx responses; EnrollStart,
+// EnrollConfirm, HOTPResync and Verify only when the connection could not be made, because the
+// server may already have consumed the code.
+func (o *Options) WithRetry(maxRetries int, backoff, maxBackoff time.Duration) *Options {
+	o.Retry = RetryOptions{MaxRetries: maxRetries, Backoff: backoff, MaxBackoff: maxBackoff}
+	return o
+}
+
+// WithCircuitBreaker fails calls fast with ErrCircuitOpen for cooldown after threshold consecutive
+// failed attempts.
+func (o *Options) WithCircuitBreaker(threshold int, cooldown time.Duration) *Options {
+	o.CircuitBreaker = CircuitBreakerOptions{Threshold: threshold, Cooldown: cooldown}
+	return o
+}
+
+// WithTransport sets the http.RoundTripper, e.g. for custom TLS, proxies or instrumentation.
+func (o *Options) WithTransport(rt http.RoundTripper) *Options {
+	o.Transport = rt
+	return o
+}
+
+// WithPropagator sets how the trace context of a call's ctx is written to the request headers, e.g.
+// otel.GetTextMapPropagator() to follow the process-wide setting. The default writes W3C traceparent.
+func (o *Options) WithPropagator(p propagation.TextMapPropagator) *Options {
+	o.Propagator = p
+	return o
+}
+
 // NewClient creates a new herald-totp client.
 func NewClient(opts *Options) (*Client, error) {
 	if opts == nil {
@@ -73,12 +126,21 @@ func NewClient(opts *Options) (*Client, error) {
 	if opts.BaseURL == "" {
 		return nil, fmt.Errorf("base URL is required")
 	}
+	signer := opts.Signer
+	if signer == nil {
+		signer = CredentialsSigner(opts.APIKey, opts.HMACKeyID, opts.HMACSecret, opts.Service)
+	}
+	propagator := opts.Propagator
+	if propagator == nil {
+		propagator = propagation.TraceContext{}
+	}
 	return &Client{
-		httpClient: &http.Client{Timeout: opts.Timeout},
+		httpClient: &http.Client{Transport: opts.Transport, Timeout: opts.Timeout},
 		baseURL:    opts.BaseURL,
-		apiKey:     opts.APIKey,
-		hmacSecret: opts.HMACSecret,
-		service:    opts.Service,
+		signer:     signer,
+		propagator: propagator,
+		retry:      opts.Retry,
+		breaker:    newBreaker(opts.CircuitBreaker),
 	}, nil
 }
 
@@ -90,25 +152,10 @@ type StatusResponse struct {
 
 // Status returns whether the subject has TOTP enabled.
 func (c *Client) Status(ctx context.Context, subject string) (*StatusResponse, error) {
-	u := c.baseURL + "/v1/status?subject=" + url.QueryEscape(subject)
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
-	if err != nil {
-		return nil, err
-	}
-	c.addAuthHeaders(req, nil)
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer func() { _ = resp.Body.Close() }()
-	body, _ := io.ReadAll(resp.Body)
 	var out StatusResponse
-	if err := json.Unmarshal(body, &out); err != nil {
+	if err := c.doJSON(ctx, retryIdempotent, http.MethodGet, "/v1/status?subject="+url.QueryEscape(subject), nil, &out); err != nil {
 		return nil, err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("status returned %d: %s", resp.StatusCode, string(body))
-	}
 	return &out, nil
 }
 
@@ -126,51 +173,40 @@ type VerifyResponse struct {
 }
 
 // EnrollStartRequest is the request for POST /v1/enroll/start.
+// Type is "totp" (default) or "hotp". Set QRFormat ("png" or "svg") to receive a rendered QR code in EnrollStartResponse.QRCode.
 type EnrollStartRequest struct {
-	Subject string `json:"subject"`
-	Label   string `json:"label"`
+	Subject  string `json:"subject"`
+	Label    string `json:"label"`
+	Type     string `json:"type,omitempty"`
+	QRFormat string `json:"qr_format,omitempty"`
+	QRSize   int    `json:"qr_size,omitempty"`
+	QRLevel  string `json:"qr_level,omitempty"`
 }
 
 // EnrollStartResponse is the response from POST /v1/enroll/start.
+// QRCode is a PNG data URI or SVG markup when QRFormat was set.
 type EnrollStartResponse struct {
 	EnrollID     string `json:"enroll_id"`
 	SecretBase32 string `json:"secret_base32,omitempty"`
 	OtpauthURI   string `json:"otpauth_uri"`
+	QRCode       string `json:"qr_code,omitempty"`
 }
 
 // EnrollStart starts TOTP enrollment and returns enroll_id and otpauth_uri for QR code.
 func (c *Client) EnrollStart(ctx context.Context, req *EnrollStartRequest) (*EnrollStartResponse, error) {
-	u := c.baseURL + "/v1/enroll/start"
-	body, err := json.Marshal(req)
-	if err != nil {
-		return nil, err
-	}
-	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
-	if err != nil {
-		return nil, err
-	}
-	httpReq.Header.Set("Content-Type", "application/json")
-	c.addAuthHeaders(httpReq, body)
-	resp, err := c.httpClient.Do(httpReq)
-	if err != nil {
-		return nil, err
-	}
-	defer func() { _ = resp.Body.Close() }()
-	respBody, _ := io.ReadAll(resp.Body)
 	var out EnrollStartResponse
-	if err := json.Unmarshal(respBody, &out); err != nil {
+	if err := c.doJSON(ctx, retryUnsent, http.MethodPost, "/v1/enroll/start", req, &out); err != nil {
 		return nil, err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("enroll/start returned %d: %s", resp.StatusCode, string(respBody))
-	}
 	return &out, nil
 }
 
 // EnrollConfirmRequest is the request for POST /v1/enroll/confirm.
+// CurrentCode (TOTP or backup code from the existing authenticator) authorises replacing a credential.
 type EnrollConfirmRequest struct {
-	EnrollID string `json:"enroll_id"`
-	Code     string `json:"code"`
+	EnrollID    string `json:"enroll_id"`
+	Code        string `json:"code"`
+	CurrentCode string `json:"current_code,omitempty"`
 }
 
 // EnrollConfirmResponse is the response from POST /v1/enroll/confirm.
@@ -182,29 +218,99 @@ type EnrollConfirmResponse struct {
 
 // EnrollConfirm confirms TOTP enrollment with a one-time code.
 func (c *Client) EnrollConfirm(ctx context.Context, req *EnrollConfirmRequest) (*EnrollConfirmResponse, error) {
-	u := c.baseURL + "/v1/enroll/confirm"
-	body, err := json.Marshal(req)
-	if err != nil {
+	var out EnrollConfirmResponse
+	if err := c.doJSON(ctx, retryUnsent, http.MethodPost, "/v1/enroll/confirm", req, &out); err != nil {
 		return nil, err
 	}
-	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
-	if err != nil {
+	return &out, nil
+}
+
+// EnrollStatusResponse is the response from GET /v1/enroll/{enroll_id}.
+type EnrollStatusResponse struct {
+	EnrollID     string `json:"enroll_id"`
+	Subject      string `json:"subject"`
+	Status       string `json:"status"`
+	ExpiresAt    int64  `json:"expires_at"`
+	CreatedAt    int64  `json:"created_at"`
+	SecretBase32 string `json:"secret_base32,omitempty"`
+	OtpauthURI   string `json:"otpauth_uri,omitempty"`
+}
+
+// EnrollStatus returns a pending enrollment's status and expiry. With includeURI the otpauth URI is returned again.
+func (c *Client) EnrollStatus(ctx context.Context, enrollID string, includeURI bool) (*EnrollStatusResponse, error) {
+	path := "/v1/enroll/" + url.PathEscape(enrollID)
+	if includeURI {
+		path += "?include_uri=true"
+	}
+	var out EnrollStatusResponse
+	if err := c.doJSON(ctx, retryIdempotent, http.MethodGet, path, nil, &out); err != nil {
 		return nil, err
 	}
-	httpReq.Header.Set("Content-Type", "application/json")
-	c.addAuthHeaders(httpReq, body)
-	resp, err := c.httpClient.Do(httpReq)
+	return &out, nil
+}
+
+// EnrollQR fetches a pending enrollment's QR code as an image. format is "png" or "svg"; size (pixels)
+// and level (L, M, Q, H) may be zero/empty to use the server defaults. It returns the image and its content type.
+func (c *Client) EnrollQR(ctx context.Context, enrollID, format string, size int, level string) ([]byte, string, error) {
+	q := url.Values{}
+	if format != "" {
+		q.Set("format", format)
+	}
+	if size > 0 {
+		q.Set("size", strconv.Itoa(size))
+	}
+	if level != "" {
+		q.Set("level", level)
+	}
+	path := "/v1/enroll/" + url.PathEscape(enrollID) + "/qr"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	body, header, err := c.do(ctx, retryIdempotent, http.MethodGet, path, nil)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	defer func() { _ = resp.Body.Close() }()
-	respBody, _ := io.ReadAll(resp.Body)
-	var out EnrollConfirmResponse
-	if err := json.Unmarshal(respBody, &out); err != nil {
+	return body, header.Get("Content-Type"), nil
+}
+
+// EnrollCancelRequest is the request for POST /v1/enroll/cancel.
+type EnrollCancelRequest struct {
+	EnrollID string `json:"enroll_id"`
+}
+
+// EnrollCancelResponse is the response from POST /v1/enroll/cancel.
+type EnrollCancelResponse struct {
+	OK       bool   `json:"ok"`
+	EnrollID string `json:"enroll_id"`
+}
+
+// EnrollCancel discards a pending enrollment.
+func (c *Client) EnrollCancel(ctx context.Context, enrollID string) (*EnrollCancelResponse, error) {
+	var out EnrollCancelResponse
+	if err := c.doJSON(ctx, retryIdempotent, http.MethodPost, "/v1/enroll/cancel", EnrollCancelRequest{EnrollID: enrollID}, &out); err != nil {
 		return nil, err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("enroll/confirm returned %d: %s", resp.StatusCode, string(respBody))
+	return &out, nil
+}
+
+// HOTPResyncRequest is the request for POST /v1/hotp/resync.
+type HOTPResyncRequest struct {
+	Subject string `json:"subject"`
+	Code1   string `json:"code1"`
+	Code2   string `json:"code2"`
+}
+
+// HOTPResyncResponse is the response from POST /v1/hotp/resync.
+type HOTPResyncResponse struct {
+	OK      bool   `json:"ok"`
+	Subject string `json:"subject"`
+}
+
+// HOTPResync resynchronises a HOTP token's counter using two consecutive codes.
+func (c *Client) HOTPResync(ctx context.Context, req *HOTPResyncRequest) (*HOTPResyncResponse, error) {
+	var out HOTPResyncResponse
+	if err := c.doJSON(ctx, retryUnsent, http.MethodPost, "/v1/hotp/resync", req, &out); err != nil {
+		return nil, err
 	}
 	return &out, nil
 }
@@ -222,84 +328,88 @@ type RevokeResponse struct {
 
 // Revoke removes TOTP credential and backup codes for the subject.
 func (c *Client) Revoke(ctx context.Context, subject string) (*RevokeResponse, error) {
-	u := c.baseURL + "/v1/revoke"
-	body, err := json.Marshal(RevokeRequest{Subject: subject})
-	if err != nil {
-		return nil, err
-	}
-	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
-	if err != nil {
+	var out RevokeResponse
+	if err := c.doJSON(ctx, retryIdempotent, http.MethodPost, "/v1/revoke", RevokeRequest{Subject: subject}, &out); err != nil {
 		return nil, err
 	}
-	httpReq.Header.Set("Content-Type", "application/json")
-	c.addAuthHeaders(httpReq, body)
-	resp, err := c.httpClient.Do(httpReq)
-	if err != nil {
+	return &out, nil
+}
+
+// Verify verifies a TOTP code for the subject. A rejected code is an *APIError whose Reason says
+// why (see IsInvalid, IsReplay and IsRateLimited); the response is only returned on success.
+func (c *Client) Verify(ctx context.Context, req *VerifyRequest) (*VerifyResponse, error) {
+	var out VerifyResponse
+	if err := c.doJSON(ctx, retryUnsent, http.MethodPost, "/v1/verify", req, &out); err != nil {
 		return nil, err
 	}
-	defer func() { _ = resp.Body.Close() }()
-	respBody, _ := io.ReadAll(resp.Body)
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("revoke returned %d: %s", resp.StatusCode, string(respBody))
+	return &out, nil
+}
+
+// do sends a request, JSON-encoding in when it is not nil, and returns the response body and headers.
+// A non-200 response is returned as an *APIError. Failed attempts are retried as retry allows, with
+// jittered exponential backoff, and every attempt passes through the circuit breaker when one is set.
+func (c *Client) do(ctx context.Context, retry retryPolicy, method, path string, in any) ([]byte, http.Header, error) {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return nil, nil, err
+		}
 	}
-	var out RevokeResponse
-	if err := json.Unmarshal(respBody, &out); err != nil {
-		trunc := string(respBody)
-		if len(trunc) > 200 {
-			trunc = trunc[:200] + "..."
+	for attempt := 0; ; attempt++ {
+		respBody, header, err := c.attempt(ctx, method, path, body)
+		if err == nil || attempt >= c.retry.MaxRetries || !retry.allows(err) || ctx.Err() != nil {
+			return respBody, header, err
+		}
+		if err := sleep(ctx, c.retry.backoff(attempt)); err != nil {
+			return nil, nil, err
 		}
-		return nil, fmt.Errorf("revoke returned %d: unexpected response (not JSON): %s", resp.StatusCode, trunc)
 	}
-	return &out, nil
 }
 
-// Verify verifies a TOTP code for the subject.
-func (c *Client) Verify(ctx context.Context, req *VerifyRequest) (*VerifyResponse, error) {
-	u := c.baseURL + "/v1/verify"
-	body, err := json.Marshal(req)
+// attempt makes one round trip.
+func (c *Client) attempt(ctx context.Context, method, path string, body []byte) ([]byte, http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bytes.NewReader(body))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
-	if err != nil {
-		return nil, err
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	c.propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+	if err := c.signer.Sign(req, body); err != nil {
+		return nil, nil, err
 	}
-	httpReq.Header.Set("Content-Type", "application/json")
-	c.addAuthHeaders(httpReq, body)
-	resp, err := c.httpClient.Do(httpReq)
+	// Ask the breaker last: a half-open trial must reach record, which every path after Do does.
+	if c.breaker != nil && !c.breaker.allow() {
+		return nil, nil, ErrCircuitOpen
+	}
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return nil, err
+		c.breaker.record(false)
+		return nil, nil, err
 	}
 	defer func() { _ = resp.Body.Close() }()
-	respBody, _ := io.ReadAll(resp.Body)
-	var out VerifyResponse
-	_ = json.Unmarshal(respBody, &out)
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.breaker.record(false)
+		return nil, nil, err
+	}
+	c.breaker.record(resp.StatusCode < http.StatusInternalServerError)
 	if resp.StatusCode != http.StatusOK {
-		return &out, fmt.Errorf("verify returned %d: %s", resp.StatusCode, string(respBody))
+		return nil, nil, newAPIError(method, path, resp.StatusCode, respBody)
 	}
-	return &out, nil
+	return respBody, resp.Header, nil
 }
 
-func (c *Client) addAuthHeaders(req *http.Request, body []byte) {
-	if c.apiKey != "" {
-		req.Header.Set("X-API-Key", c.apiKey)
-	}
-	if c.hmacSecret != "" {
-		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
-		signature := c.computeHMAC(timestamp, c.service, body)
-		req.Header.Set("X-Timestamp", timestamp)
-		req.Header.Set("X-Service", c.service)
-		req.Header.Set("X-Signature", signature)
+// doJSON is do followed by decoding the response body into out.
+func (c *Client) doJSON(ctx context.Context, retry retryPolicy, method, path string, in, out any) error {
+	body, _, err := c.do(ctx, retry, method, path, in)
+	if err != nil {
+		return err
 	}
-}
-
-func (c *Client) computeHMAC(timestamp, service string, body []byte) string {
-	var b []byte
-	if body != nil {
-		b = body
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("%s %s: decode response: %w", method, endpoint(path), err)
 	}
-	message := fmt.Sprintf("%s:%s:%s", timestamp, service, string(b))
-	mac := hmac.New(sha256.New, []byte(c.hmacSecret))
-	mac.Write([]byte(message))
-	return hex.EncodeToString(mac.Sum(nil))
+	return nil
 }
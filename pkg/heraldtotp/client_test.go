@@ -3,10 +3,13 @@ package heraldtotp
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 	"time"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 func TestNewClient_EmptyBaseURL(t *testing.T) {
@@ -159,6 +162,83 @@ func TestClient_Verify_NonOK(t *testing.T) {
 	}
 }
 
+func TestClient_APIError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/verify":
+			var req VerifyRequest
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			switch req.Code {
+			case "111111":
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"ok":false,"reason":"replay"}`))
+			case "222222":
+				w.WriteHeader(http.StatusTooManyRequests)
+				_, _ = w.Write([]byte(`{"ok":false,"reason":"rate_limited"}`))
+			default:
+				w.WriteHeader(http.StatusUnauthorized)
+				_, _ = w.Write([]byte(`{"ok":false,"reason":"invalid"}`))
+			}
+		case "/v1/enroll/confirm":
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"ok":false,"reason":"invalid_request","message":"code is required"}`))
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+			_, _ = w.Write([]byte("<html>bad gateway</html>"))
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewClient(DefaultOptions().WithBaseURL(server.URL))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	ctx := context.Background()
+
+	tests := []struct {
+		code      string
+		status    int
+		reason    string
+		predicate func(error) bool
+	}{
+		{"111111", http.StatusBadRequest, ReasonReplay, IsReplay},
+		{"222222", http.StatusTooManyRequests, ReasonRateLimited, IsRateLimited},
+		{"333333", http.StatusUnauthorized, ReasonInvalid, IsInvalid},
+	}
+	for _, tt := range tests {
+		resp, err := client.Verify(ctx, &VerifyRequest{Subject: "user1", Code: tt.code})
+		if resp != nil {
+			t.Errorf("Verify(%s) returned a response with the error: %+v", tt.code, resp)
+		}
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) {
+			t.Fatalf("Verify(%s) error = %v, want *APIError", tt.code, err)
+		}
+		if apiErr.StatusCode != tt.status || apiErr.Reason != tt.reason || apiErr.Endpoint != "/v1/verify" {
+			t.Errorf("Verify(%s) = %+v", tt.code, apiErr)
+		}
+		if !tt.predicate(err) || ReasonOf(err) != tt.reason {
+			t.Errorf("Verify(%s): reason helpers do not match %q", tt.code, tt.reason)
+		}
+	}
+
+	_, err = client.EnrollConfirm(ctx, &EnrollConfirmRequest{EnrollID: "e1"})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Reason != ReasonInvalidRequest || apiErr.Message != "code is required" {
+		t.Errorf("EnrollConfirm error = %#v", err)
+	}
+
+	// A body that is not a herald-totp error (e.g. from a proxy) keeps the status and the body text.
+	_, err = client.Status(ctx, "user1")
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadGateway || apiErr.Reason != "" ||
+		apiErr.Message != "<html>bad gateway</html>" || apiErr.Endpoint != "/v1/status" {
+		t.Errorf("Status error = %#v", err)
+	}
+	if IsRateLimited(err) || IsRateLimited(errors.New("rate_limited")) {
+		t.Error("IsRateLimited matched an error without that reason")
+	}
+}
+
 func TestClient_EnrollStart_NonOK(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
@@ -238,3 +318,137 @@ func TestClient_WithHMACSecret(t *testing.T) {
 		t.Errorf("Status: got subject=%q totp_enabled=%v", statusResp.Subject, statusResp.TotpEnabled)
 	}
 }
+
+func TestClient_EnrollStatus_EnrollCancel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/enroll/e1":
+			out := EnrollStatusResponse{EnrollID: "e1", Subject: "user1", Status: "pending", ExpiresAt: 200, CreatedAt: 100}
+			if r.URL.Query().Get("include_uri") == "true" {
+				out.OtpauthURI = "otpauth://totp/Test:user1?secret=JBSWY3DPEHPK3PXP"
+			}
+			_ = json.NewEncoder(w).Encode(out)
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/enroll/cancel":
+			_ = json.NewEncoder(w).Encode(EnrollCancelResponse{OK: true, EnrollID: "e1"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"ok":false,"reason":"expired"}`))
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewClient(DefaultOptions().WithBaseURL(server.URL))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	ctx := context.Background()
+
+	status, err := client.EnrollStatus(ctx, "e1", false)
+	if err != nil {
+		t.Fatalf("EnrollStatus: %v", err)
+	}
+	if status.Status != "pending" || status.ExpiresAt != 200 || status.OtpauthURI != "" {
+		t.Errorf("EnrollStatus = %+v", status)
+	}
+	status, err = client.EnrollStatus(ctx, "e1", true)
+	if err != nil || status.OtpauthURI == "" {
+		t.Errorf("EnrollStatus(includeURI) = %+v, %v", status, err)
+	}
+	if _, err := client.EnrollStatus(ctx, "e_missing", false); err == nil {
+		t.Error("expected error for 404 response")
+	}
+
+	cancel, err := client.EnrollCancel(ctx, "e1")
+	if err != nil {
+		t.Fatalf("EnrollCancel: %v", err)
+	}
+	if !cancel.OK || cancel.EnrollID != "e1" {
+		t.Errorf("EnrollCancel = %+v", cancel)
+	}
+}
+
+func TestClient_EnrollQR(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/enroll/e1/qr" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"ok":false,"reason":"expired"}`))
+			return
+		}
+		if r.URL.Query().Get("format") != "svg" || r.URL.Query().Get("size") != "128" {
+			t.Errorf("query = %s", r.URL.RawQuery)
+		}
+		w.Header().Set("Content-Type", "image/svg+xml")
+		_, _ = w.Write([]byte("<svg/>"))
+	}))
+	defer server.Close()
+
+	client, err := NewClient(DefaultOptions().WithBaseURL(server.URL))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	img, contentType, err := client.EnrollQR(context.Background(), "e1", "svg", 128, "")
+	if err != nil {
+		t.Fatalf("EnrollQR: %v", err)
+	}
+	if string(img) != "<svg/>" || contentType != "image/svg+xml" {
+		t.Errorf("EnrollQR = %q, %q", img, contentType)
+	}
+	if _, _, err := client.EnrollQR(context.Background(), "e_missing", "", 0, ""); err == nil {
+		t.Error("expected error for 404 response")
+	}
+}
+
+func TestClient_HOTPResync(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req HOTPResyncRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		if r.URL.Path != "/v1/hotp/resync" || req.Code1 != "111111" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"ok":false,"reason":"invalid"}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(HOTPResyncResponse{OK: true, Subject: req.Subject})
+	}))
+	defer server.Close()
+
+	client, err := NewClient(DefaultOptions().WithBaseURL(server.URL))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	out, err := client.HOTPResync(context.Background(), &HOTPResyncRequest{Subject: "user1", Code1: "111111", Code2: "222222"})
+	if err != nil || !out.OK || out.Subject != "user1" {
+		t.Errorf("HOTPResync = %+v, %v", out, err)
+	}
+	if _, err := client.HOTPResync(context.Background(), &HOTPResyncRequest{Subject: "user1", Code1: "000000", Code2: "222222"}); err == nil {
+		t.Error("expected error for 401 response")
+	}
+}
+
+func TestClient_TraceContext(t *testing.T) {
+	var got []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Get("Traceparent"))
+		_ = json.NewEncoder(w).Encode(StatusResponse{Subject: "user1"})
+	}))
+	defer server.Close()
+	client, err := NewClient(DefaultOptions().WithBaseURL(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36},
+		SpanID:     trace.SpanID{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+		TraceFlags: trace.FlagsSampled,
+	})
+	if _, err := client.Status(trace.ContextWithSpanContext(context.Background(), sc), "user1"); err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	if _, err := client.Status(context.Background(), "user1"); err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	want := []string{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", ""}
+	if len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("traceparent headers = %q, want %q", got, want)
+	}
+}
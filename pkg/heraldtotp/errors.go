@@ -0,0 +1,95 @@
+package heraldtotp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Reasons the server returns in the "reason" field of an error response.
+const (
+	ReasonInvalidRequest = "invalid_request"
+	ReasonInvalid        = "invalid"
+	ReasonReplay         = "replay"
+	ReasonRateLimited    = "rate_limited"
+	ReasonExpired        = "expired"
+	ReasonUnauthorized   = "unauthorized"
+	ReasonConfigError    = "config_error"
+	ReasonInternalError  = "internal_error"
+)
+
+// APIError is a non-200 response from herald-totp. Reason is the server's machine-readable reason
+// (one of the Reason constants, or empty when the body was not a herald-totp error, e.g. from a proxy).
+type APIError struct {
+	Method     string
+	Endpoint   string // request path without the query string
+	StatusCode int
+	Reason     string
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("herald-totp %s %s returned %d", e.Method, e.Endpoint, e.StatusCode)
+	if e.Reason != "" {
+		msg += " " + e.Reason
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// errorResponse is the server's error body (handler.ErrorResponse).
+type errorResponse struct {
+	OK      bool   `json:"ok"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+// newAPIError decodes an error response body. A body that is not a herald-totp error is kept,
+// truncated, as the message.
+func newAPIError(method, path string, status int, body []byte) *APIError {
+	e := &APIError{Method: method, Endpoint: endpoint(path), StatusCode: status}
+	var resp errorResponse
+	if err := json.Unmarshal(body, &resp); err == nil && resp.Reason != "" {
+		e.Reason, e.Message = resp.Reason, resp.Message
+		return e
+	}
+	msg := strings.TrimSpace(string(body))
+	if len(msg) > 200 {
+		msg = msg[:200] + "..."
+	}
+	if msg == "" {
+		msg = http.StatusText(status)
+	}
+	e.Message = msg
+	return e
+}
+
+func endpoint(path string) string {
+	p, _, _ := strings.Cut(path, "?")
+	return p
+}
+
+// ReasonOf returns the server's reason when err is an *APIError, or "" otherwise.
+func ReasonOf(err error) string {
+	var e *APIError
+	if errors.As(err, &e) {
+		return e.Reason
+	}
+	return ""
+}
+
+// IsInvalid reports whether the server rejected a code as wrong.
+func IsInvalid(err error) bool { return ReasonOf(err) == ReasonInvalid }
+
+// IsReplay reports whether the server rejected a code that was already used.
+func IsReplay(err error) bool { return ReasonOf(err) == ReasonReplay }
+
+// IsRateLimited reports whether the subject or caller IP is rate limited.
+func IsRateLimited(err error) bool { return ReasonOf(err) == ReasonRateLimited }
+
+// IsExpired reports whether the enrollment does not exist, expired or was already confirmed or cancelled.
+func IsExpired(err error) bool { return ReasonOf(err) == ReasonExpired }
@@ -0,0 +1,139 @@
+package heraldtotp
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without contacting the server while the circuit breaker is open.
+var ErrCircuitOpen = errors.New("herald-totp: circuit breaker open")
+
+// RetryOptions controls retries of failed attempts. Each attempt gets the full Options.Timeout.
+type RetryOptions struct {
+	MaxRetries int           // retries after the first attempt; 0 disables retries
+	Backoff    time.Duration // delay before the first retry, doubled for each further one and jittered
+	MaxBackoff time.Duration // upper bound on a single delay
+}
+
+// CircuitBreakerOptions opens the breaker after Threshold consecutive failed attempts (network
+// errors or 5xx responses). While open, calls fail with ErrCircuitOpen; after Cooldown one trial
+// attempt is let through, and its outcome closes or re-opens the breaker.
+type CircuitBreakerOptions struct {
+	Threshold int
+	Cooldown  time.Duration
+}
+
+// retryPolicy says which failures of a call may be retried.
+type retryPolicy int
+
+const (
+	// retryIdempotent retries network errors and 5xx responses: repeating the call has no further effect.
+	retryIdempotent retryPolicy = iota
+	// retryUnsent only retries when the request never left the client (the connection could not be
+	// made), for calls such as Verify where the server may consume the code.
+	retryUnsent
+)
+
+func (p retryPolicy) allows(err error) bool {
+	if errors.Is(err, ErrCircuitOpen) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if p == retryUnsent {
+		return notSent(err)
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode >= http.StatusInternalServerError && apiErr.StatusCode != http.StatusNotImplemented
+	}
+	return true
+}
+
+// notSent reports whether err happened before a connection existed, so no request bytes were written.
+func notSent(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// backoff returns the jittered delay before retry number attempt+1: half the exponential delay
+// plus a random share of the other half.
+func (o RetryOptions) backoff(attempt int) time.Duration {
+	d := o.Backoff
+	for i := 0; i < attempt && (o.MaxBackoff <= 0 || d < o.MaxBackoff); i++ {
+		d *= 2
+	}
+	if o.MaxBackoff > 0 && d > o.MaxBackoff {
+		d = o.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// breaker is a consecutive-failure circuit breaker. A nil *breaker lets every attempt through.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool // a half-open trial attempt is in flight
+}
+
+func newBreaker(o CircuitBreakerOptions) *breaker {
+	if o.Threshold <= 0 {
+		return nil
+	}
+	return &breaker{threshold: o.Threshold, cooldown: o.Cooldown}
+}
+
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.trial {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+func (b *breaker) record(ok bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	if ok {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
@@ -0,0 +1,209 @@
+package heraldtotp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// flakyServer answers the first failures requests with status and then succeeds, counting requests.
+func flakyServer(t *testing.T, failures int32, status int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(`{"ok":false,"reason":"internal_error"}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/status":
+			_ = json.NewEncoder(w).Encode(StatusResponse{Subject: "user1", TotpEnabled: true})
+		default:
+			_ = json.NewEncoder(w).Encode(map[string]any{"ok": true, "subject": "user1"})
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func TestClient_Retry(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name      string
+		failures  int32
+		status    int
+		call      func(*Client) error
+		wantErr   bool
+		wantCalls int32
+	}{
+		{"status retried after 503", 2, http.StatusServiceUnavailable, func(c *Client) error {
+			_, err := c.Status(ctx, "user1")
+			return err
+		}, false, 3},
+		{"status gives up after max retries", 5, http.StatusInternalServerError, func(c *Client) error {
+			_, err := c.Status(ctx, "user1")
+			return err
+		}, true, 3},
+		{"revoke retried after 500", 1, http.StatusInternalServerError, func(c *Client) error {
+			_, err := c.Revoke(ctx, "user1")
+			return err
+		}, false, 2},
+		{"revoke not retried after 429", 1, http.StatusTooManyRequests, func(c *Client) error {
+			_, err := c.Revoke(ctx, "user1")
+			return err
+		}, true, 1},
+		{"verify not retried after 503", 1, http.StatusServiceUnavailable, func(c *Client) error {
+			_, err := c.Verify(ctx, &VerifyRequest{Subject: "user1", Code: "123456"})
+			return err
+		}, true, 1},
+		{"enroll confirm not retried after 500", 1, http.StatusInternalServerError, func(c *Client) error {
+			_, err := c.EnrollConfirm(ctx, &EnrollConfirmRequest{EnrollID: "e1", Code: "123456"})
+			return err
+		}, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, calls := flakyServer(t, tt.failures, tt.status)
+			client, err := NewClient(DefaultOptions().WithBaseURL(server.URL).WithRetry(2, time.Millisecond, 5*time.Millisecond))
+			if err != nil {
+				t.Fatalf("NewClient: %v", err)
+			}
+			err = tt.call(client)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("server saw %d requests, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestClient_NoRetryByDefault(t *testing.T) {
+	server, calls := flakyServer(t, 1, http.StatusServiceUnavailable)
+	client, err := NewClient(DefaultOptions().WithBaseURL(server.URL))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	if _, err := client.Status(context.Background(), "user1"); err == nil {
+		t.Error("Status after 503 err = nil, want the error without a retry")
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("server saw %d requests, want 1", got)
+	}
+}
+
+func TestClient_Retry_VerifyOnlyBeforeSend(t *testing.T) {
+	server, calls := flakyServer(t, 0, http.StatusOK)
+	var attempts atomic.Int32
+	failWith := func(err error) http.RoundTripper {
+		attempts.Store(0)
+		calls.Store(0)
+		return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			if attempts.Add(1) == 1 {
+				return nil, err
+			}
+			return http.DefaultTransport.RoundTrip(r)
+		})
+	}
+	req := &VerifyRequest{Subject: "user1", Code: "123456"}
+
+	// The connection could not be made: the server never saw the code, so the client retries.
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	client, err := NewClient(DefaultOptions().WithBaseURL(server.URL).WithRetry(2, time.Millisecond, time.Millisecond).WithTransport(failWith(dialErr)))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	if _, err := client.Verify(context.Background(), req); err != nil || calls.Load() != 1 {
+		t.Errorf("Verify after dial error = %v, server saw %d requests", err, calls.Load())
+	}
+
+	// The connection broke after the request was written: the code may be consumed, so no retry.
+	resetErr := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+	client, err = NewClient(DefaultOptions().WithBaseURL(server.URL).WithRetry(2, time.Millisecond, time.Millisecond).WithTransport(failWith(resetErr)))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	if _, err := client.Verify(context.Background(), req); err == nil || attempts.Load() != 1 {
+		t.Errorf("Verify after reset = %v after %d attempts, want an error after 1", err, attempts.Load())
+	}
+}
+
+func TestClient_CircuitBreaker(t *testing.T) {
+	server, calls := flakyServer(t, 2, http.StatusServiceUnavailable)
+	client, err := NewClient(DefaultOptions().WithBaseURL(server.URL).WithRetry(0, 0, 0).WithCircuitBreaker(2, 50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	ctx := context.Background()
+	for range 2 {
+		if _, err := client.Status(ctx, "user1"); err == nil {
+			t.Fatal("expected 503 error")
+		}
+	}
+	if _, err := client.Status(ctx, "user1"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Status with open breaker = %v, want ErrCircuitOpen", err)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("server saw %d requests while the breaker was open, want 2", calls.Load())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, err := client.Status(ctx, "user1"); err != nil {
+		t.Errorf("Status after cooldown = %v", err)
+	}
+	if _, err := client.Status(ctx, "user1"); err != nil {
+		t.Errorf("Status after the breaker closed = %v", err)
+	}
+}
+
+func TestClient_CircuitBreakerTrialSignFailure(t *testing.T) {
+	server, _ := flakyServer(t, 1, http.StatusServiceUnavailable)
+	var failSign atomic.Bool
+	signer := SignerFunc(func(*http.Request, []byte) error {
+		if failSign.Load() {
+			return errors.New("sign failed")
+		}
+		return nil
+	})
+	client, err := NewClient(DefaultOptions().WithBaseURL(server.URL).WithSigner(signer).WithRetry(0, 0, 0).WithCircuitBreaker(1, 10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	ctx := context.Background()
+	if _, err := client.Status(ctx, "user1"); err == nil {
+		t.Fatal("expected 503 error")
+	}
+	time.Sleep(20 * time.Millisecond)
+	failSign.Store(true)
+	if _, err := client.Status(ctx, "user1"); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Status with a failing signer = %v, want the signer error", err)
+	}
+	failSign.Store(false)
+	if _, err := client.Status(ctx, "user1"); err != nil {
+		t.Errorf("Status after a failed trial sign = %v, want the trial to go through", err)
+	}
+}
+
+func TestRetryOptions_Backoff(t *testing.T) {
+	o := RetryOptions{Backoff: 100 * time.Millisecond, MaxBackoff: 300 * time.Millisecond}
+	for attempt, want := range []time.Duration{100, 200, 300, 300} {
+		want *= time.Millisecond
+		for range 20 {
+			if d := o.backoff(attempt); d < want/2 || d > want {
+				t.Fatalf("backoff(%d) = %v, want within [%v, %v]", attempt, d, want/2, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package heraldtotp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Signer authenticates a request before it is sent. body is exactly what is sent (nil for GET).
+// Signers run again for every retry, so timestamps stay fresh.
+type Signer interface {
+	Sign(req *http.Request, body []byte) error
+}
+
+// SignerFunc adapts a function to Signer.
+type SignerFunc func(req *http.Request, body []byte) error
+
+// Sign calls f.
+func (f SignerFunc) Sign(req *http.Request, body []byte) error { return f(req, body) }
+
+// APIKeySigner sends key in X-API-Key.
+func APIKeySigner(key string) Signer {
+	return SignerFunc(func(req *http.Request, _ []byte) error {
+		req.Header.Set("X-API-Key", key)
+		return nil
+	})
+}
+
+// HMACSigner signs "timestamp:service:body" with HMAC-SHA256 and sends X-Timestamp, X-Service and
+// X-Signature. KeyID, when set, is sent in X-Key-Id to select one of the server's HERALD_TOTP_HMAC_KEYS;
+// without it the server uses its lowest key ID (or HMAC_SECRET).
+type HMACSigner struct {
+	KeyID   string
+	Secret  string
+	Service string
+	Now     func() time.Time // nil uses time.Now
+}
+
+// Sign sets the HMAC headers on req.
+func (s *HMACSigner) Sign(req *http.Request, body []byte) error {
+	now := time.Now
+	if s.Now != nil {
+		now = s.Now
+	}
+	timestamp := strconv.FormatInt(now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(s.Secret))
+	mac.Write([]byte(timestamp + ":" + s.Service + ":" + string(body)))
+	req.Header.Set("X-Timestamp", timestamp)
+	req.Header.Set("X-Service", s.Service)
+	req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	if s.KeyID != "" {
+		req.Header.Set("X-Key-Id", s.KeyID)
+	}
+	return nil
+}
+
+// MultiSigner applies signers in order and stops at the first error.
+func MultiSigner(signers ...Signer) Signer {
+	return SignerFunc(func(req *http.Request, body []byte) error {
+		for _, s := range signers {
+			if err := s.Sign(req, body); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// CredentialsSigner is the signer clients use when no Signer is configured: the API key when set,
+// then an HMAC signature when secret is set.
+func CredentialsSigner(apiKey, keyID, secret, service string) Signer {
+	var signers []Signer
+	if apiKey != "" {
+		signers = append(signers, APIKeySigner(apiKey))
+	}
+	if secret != "" {
+		signers = append(signers, &HMACSigner{KeyID: keyID, Secret: secret, Service: service})
+	}
+	return MultiSigner(signers...)
+}
@@ -0,0 +1,294 @@
+package heraldtotpgrpc
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/propagation"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/soulteary/herald-totp/internal/grpcpb"
+	"github.com/soulteary/herald-totp/pkg/heraldtotp"
+)
+
+// Client is the herald-totp gRPC client. It takes and returns the same types as heraldtotp.Client,
+// so callers can switch transports without other changes.
+type Client struct {
+	conn       *grpc.ClientConn
+	rpc        grpcpb.TOTPServiceClient
+	timeout    time.Duration
+	signer     heraldtotp.Signer
+	propagator propagation.TextMapPropagator
+}
+
+// Options for creating a client.
+type Options struct {
+	Address    string // host:port of the gRPC listener (GRPC_PORT)
+	APIKey     string
+	HMACSecret string
+	HMACKeyID  string // sent as x-key-id to select one of HERALD_TOTP_HMAC_KEYS
+	Service    string
+	Signer     heraldtotp.Signer // replaces the API key and HMAC metadata when set; signs the request message
+	Timeout    time.Duration
+	TLSConfig  *tls.Config                   // nil connects over cleartext HTTP/2
+	Propagator propagation.TextMapPropagator // writes the trace context of ctx to call metadata; nil uses W3C traceparent
+}
+
+// DefaultOptions returns default options.
+func DefaultOptions() *Options {
+	return &Options{
+		Timeout: 10 * time.Second,
+		Service: "stargate",
+	}
+}
+
+// WithAddress sets the server address.
+func (o *Options) WithAddress(addr string) *Options {
+	o.Address = addr
+	return o
+}
+
+// WithAPIKey sets the API key.
+func (o *Options) WithAPIKey(k string) *Options {
+	o.APIKey = k
+	return o
+}
+
+// WithHMACSecret sets the HMAC secret.
+func (o *Options) WithHMACSecret(s string) *Options {
+	o.HMACSecret = s
+	return o
+}
+
+// WithHMACKeyID sets the HMAC key ID, for servers with several HERALD_TOTP_HMAC_KEYS.
+func (o *Options) WithHMACKeyID(id string) *Options {
+	o.HMACKeyID = id
+	return o
+}
+
+// WithService sets the service name sent in x-service.
+func (o *Options) WithService(s string) *Options {
+	o.Service = s
+	return o
+}
+
+// WithSigner authenticates calls with s instead of the API key and HMAC options.
+func (o *Options) WithSigner(s heraldtotp.Signer) *Options {
+	o.Signer = s
+	return o
+}
+
+// WithTimeout sets the timeout.
+func (o *Options) WithTimeout(d time.Duration) *Options {
+	o.Timeout = d
+	return o
+}
+
+// WithTLSConfig connects over TLS with cfg, e.g. to present a client certificate.
+func (o *Options) WithTLSConfig(cfg *tls.Config) *Options {
+	o.TLSConfig = cfg
+	return o
+}
+
+// WithPropagator sets how the trace context of a call's ctx is written to the call metadata. The
+// default writes W3C traceparent.
+func (o *Options) WithPropagator(p propagation.TextMapPropagator) *Options {
+	o.Propagator = p
+	return o
+}
+
+// NewClient creates a new herald-totp gRPC client. The connection is made on the first call; Close
+// releases it.
+func NewClient(opts *Options) (*Client, error) {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+	if opts.Address == "" {
+		return nil, fmt.Errorf("address is required")
+	}
+	creds := insecure.NewCredentials()
+	if opts.TLSConfig != nil {
+		creds = credentials.NewTLS(opts.TLSConfig)
+	}
+	signer := opts.Signer
+	if signer == nil {
+		signer = heraldtotp.CredentialsSigner(opts.APIKey, opts.HMACKeyID, opts.HMACSecret, opts.Service)
+	}
+	propagator := opts.Propagator
+	if propagator == nil {
+		propagator = propagation.TraceContext{}
+	}
+	c := &Client{timeout: opts.Timeout, signer: signer, propagator: propagator}
+	conn, err := grpc.NewClient(opts.Address, grpc.WithTransportCredentials(creds), grpc.WithUnaryInterceptor(c.intercept))
+	if err != nil {
+		return nil, err
+	}
+	c.conn, c.rpc = conn, grpcpb.NewTOTPServiceClient(conn)
+	return c, nil
+}
+
+// Close closes the connection to the server.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Error is a failed call: the gRPC status code plus the API error reason, e.g. "invalid",
+// "replay" or "rate_limited", the same reasons the HTTP API returns.
+type Error struct {
+	Code    codes.Code
+	Reason  string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("grpc status %s: %s", e.Code, e.Message)
+}
+
+// As lets errors.As convert e to a *heraldtotp.APIError, so the heraldtotp reason helpers
+// (IsRateLimited, IsReplay, ...) apply to both transports.
+func (e *Error) As(target any) bool {
+	t, ok := target.(**heraldtotp.APIError)
+	if !ok {
+		return false
+	}
+	*t = &heraldtotp.APIError{
+		Method: http.MethodPost, StatusCode: httpStatus[e.Code], Reason: e.Reason, Message: e.Message,
+	}
+	return true
+}
+
+// httpStatus maps the gRPC codes the server returns back to the HTTP status of the same API error.
+var httpStatus = map[codes.Code]int{
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.NotFound:           http.StatusNotFound,
+	codes.FailedPrecondition: http.StatusConflict,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.Internal:           http.StatusInternalServerError,
+}
+
+// EnrollStart starts enrollment and returns enroll_id and otpauth_uri.
+func (c *Client) EnrollStart(ctx context.Context, req *heraldtotp.EnrollStartRequest) (*heraldtotp.EnrollStartResponse, error) {
+	out, err := c.rpc.EnrollStart(ctx, &grpcpb.EnrollStartRequest{
+		Subject: req.Subject, Label: req.Label, Type: req.Type,
+		QrFormat: req.QRFormat, QrSize: int32(req.QRSize), QrLevel: req.QRLevel,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &heraldtotp.EnrollStartResponse{
+		EnrollID: out.GetEnrollId(), SecretBase32: out.GetSecretBase32(), OtpauthURI: out.GetOtpauthUri(), QRCode: out.GetQrCode(),
+	}, nil
+}
+
+// EnrollConfirm confirms enrollment with a one-time code.
+func (c *Client) EnrollConfirm(ctx context.Context, req *heraldtotp.EnrollConfirmRequest) (*heraldtotp.EnrollConfirmResponse, error) {
+	out, err := c.rpc.EnrollConfirm(ctx, &grpcpb.EnrollConfirmRequest{EnrollId: req.EnrollID, Code: req.Code, CurrentCode: req.CurrentCode})
+	if err != nil {
+		return nil, err
+	}
+	return &heraldtotp.EnrollConfirmResponse{
+		Subject: out.GetSubject(), TotpEnabled: out.GetTotpEnabled(), BackupCodes: out.GetBackupCodes(),
+	}, nil
+}
+
+// Verify verifies a code for the subject. A rejected code is an *Error whose Reason says why;
+// heraldtotp.IsInvalid, IsReplay and IsRateLimited work on it as on heraldtotp.Client errors.
+func (c *Client) Verify(ctx context.Context, req *heraldtotp.VerifyRequest) (*heraldtotp.VerifyResponse, error) {
+	out, err := c.rpc.Verify(ctx, &grpcpb.VerifyRequest{Subject: req.Subject, Code: req.Code, ChallengeId: req.ChallengeID})
+	if err != nil {
+		return nil, err
+	}
+	return &heraldtotp.VerifyResponse{OK: out.GetOk()}, nil
+}
+
+// Revoke removes the credentials and backup codes of the subject.
+func (c *Client) Revoke(ctx context.Context, subject string) (*heraldtotp.RevokeResponse, error) {
+	out, err := c.rpc.Revoke(ctx, &grpcpb.SubjectRequest{Subject: subject})
+	if err != nil {
+		return nil, err
+	}
+	return &heraldtotp.RevokeResponse{OK: out.GetOk(), Subject: out.GetSubject()}, nil
+}
+
+// Status returns whether the subject has TOTP enabled.
+func (c *Client) Status(ctx context.Context, subject string) (*heraldtotp.StatusResponse, error) {
+	out, err := c.rpc.Status(ctx, &grpcpb.SubjectRequest{Subject: subject})
+	if err != nil {
+		return nil, err
+	}
+	return &heraldtotp.StatusResponse{Subject: out.GetSubject(), TotpEnabled: out.GetTotpEnabled()}, nil
+}
+
+// intercept applies the timeout, sends the trace context of ctx and the signer's credentials as
+// metadata, and returns a failed status as *Error.
+func (c *Client) intercept(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	md, err := c.metadata(ctx, method, req.(proto.Message))
+	if err != nil {
+		return err
+	}
+	if out, ok := metadata.FromOutgoingContext(ctx); ok {
+		md = metadata.Join(out, md)
+	}
+	if err := invoker(metadata.NewOutgoingContext(ctx, md), method, req, reply, cc, opts...); err != nil {
+		return errorFrom(err)
+	}
+	return nil
+}
+
+// metadata returns the trace context and credentials of a call. Signers work on HTTP requests, so
+// they sign a stand-in request whose headers become the metadata; the signed body is the request
+// message as it is sent, with its fields in field-number order.
+func (c *Client) metadata(ctx context.Context, method string, req proto.Message) (metadata.MD, error) {
+	body, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, method, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.propagator.Inject(ctx, propagation.HeaderCarrier(r.Header))
+	if err := c.signer.Sign(r, body); err != nil {
+		return nil, err
+	}
+	md := metadata.MD{}
+	for k, v := range r.Header {
+		md.Append(strings.ToLower(k), v...)
+	}
+	return md, nil
+}
+
+// errorFrom converts a gRPC status error to *Error, taking the reason from its ErrorInfo detail.
+func errorFrom(err error) error {
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	e := &Error{Code: st.Code(), Message: st.Message()}
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok {
+			e.Reason = info.GetReason()
+			break
+		}
+	}
+	return e
+}
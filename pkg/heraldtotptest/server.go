@@ -0,0 +1,223 @@
+package heraldtotptest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	pqtotp "github.com/pquerna/otp/totp"
+	logger "github.com/soulteary/logger-kit"
+
+	"github.com/soulteary/herald-totp/internal/clock"
+	"github.com/soulteary/herald-totp/internal/config"
+	"github.com/soulteary/herald-totp/internal/handler"
+	"github.com/soulteary/herald-totp/internal/router"
+	"github.com/soulteary/herald-totp/internal/secret"
+	"github.com/soulteary/herald-totp/internal/store"
+	"github.com/soulteary/herald-totp/internal/totp"
+	"github.com/soulteary/herald-totp/pkg/heraldtotp"
+	"github.com/soulteary/herald-totp/pkg/totpservice"
+)
+
+// APIKey is the API key the server accepts; Client is already configured with it.
+const APIKey = "heraldtotptest-api-key"
+
+// Server is a herald-totp serving the real /v1 routes on an httptest.Server, with Redis replaced by
+// an in-memory miniredis. Each server has its own settings, the herald-totp defaults plus its Redis,
+// keys and audit stream, so tests can start several in parallel.
+type Server struct {
+	URL string
+
+	t      testing.TB
+	http   *httptest.Server
+	redis  *miniredis.Miniredis
+	store  *store.Store
+	config *config.Config
+	key    []byte
+
+	clock *clock.Fake
+
+	mu       sync.Mutex
+	secrets  map[string]string   // subject -> base32 secret, for CurrentCode
+	failures map[string][]string // path -> queued failure reasons
+}
+
+// NewServer starts a server that is closed when the test ends.
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	keyHex := make([]byte, 16)
+	if _, err := rand.Read(keyHex); err != nil {
+		t.Fatalf("heraldtotptest: %v", err)
+	}
+	encryptionKey := hex.EncodeToString(keyHex) // 32 bytes
+
+	cfg := config.Defaults()
+	cfg.RedisAddr = mr.Addr()
+	cfg.EncryptionKey = encryptionKey
+	cfg.APIKey = APIKey
+	cfg.AuditSinks = []string{"redis"}
+
+	s := &Server{t: t, redis: mr, config: cfg, clock: clock.NewFake(time.Now()), secrets: map[string]string{}, failures: map[string][]string{}}
+	key, err := secret.KeyBytes(encryptionKey)
+	if err != nil {
+		t.Fatalf("heraldtotptest: %v", err)
+	}
+	s.key = key
+
+	log := logger.New(logger.Config{Level: logger.Disabled})
+	if s.store, err = router.NewStore(cfg); err != nil {
+		t.Fatalf("heraldtotptest: %v", err)
+	}
+	rec, _, err := router.NewAuditRecorder(cfg, s.store, s.clock, io.Discard, log)
+	if err != nil {
+		t.Fatalf("heraldtotptest: %v", err)
+	}
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Use(s.injectFailure)
+	if _, err := router.Setup(app, router.Options{Config: func() *config.Config { return cfg }, Store: s.store, Clock: s.clock, Audit: rec, Log: log}); err != nil {
+		t.Fatalf("heraldtotptest: setup: %v", err)
+	}
+	s.http = httptest.NewServer(adaptor.FiberApp(app))
+	s.URL = s.http.URL
+	t.Cleanup(func() {
+		s.http.Close()
+		_ = app.Shutdown()
+	})
+	return s
+}
+
+// Client returns a pkg/heraldtotp client for the server, without retries.
+func (s *Server) Client() *heraldtotp.Client {
+	s.t.Helper()
+	c, err := heraldtotp.NewClient(heraldtotp.DefaultOptions().WithBaseURL(s.URL).WithAPIKey(APIKey).WithRetry(0, 0, 0))
+	if err != nil {
+		s.t.Fatalf("heraldtotptest: %v", err)
+	}
+	return c
+}
+
+// Enroll gives subject a confirmed TOTP credential with secretBase32 (generated when empty), as if it
+// had completed enroll/start and enroll/confirm, and returns the secret. Enrolling again replaces the
+// credential.
+func (s *Server) Enroll(subject, secretBase32 string) string {
+	s.t.Helper()
+	cfg := s.config
+	if secretBase32 == "" {
+		var err error
+		if secretBase32, _, err = totp.Generate(subject, totp.DefaultConfig(cfg.TOTPIssuer)); err != nil {
+			s.t.Fatalf("heraldtotptest: %v", err)
+		}
+	}
+	enc, err := secret.Encrypt(s.key, secretBase32)
+	if err != nil {
+		s.t.Fatalf("heraldtotptest: %v", err)
+	}
+	ctx := context.Background()
+	_ = s.store.DeleteCredential(ctx, subject)
+	now := s.Now().Unix()
+	cred := &store.Credential{
+		Type: totp.TypeTOTP, Subject: subject, SecretEnc: enc, Issuer: cfg.TOTPIssuer, Label: subject,
+		Period: uint(cfg.TOTPPeriod), Digits: cfg.TOTPDigits, Algo: "SHA1", Enabled: true,
+		CreatedAt: now, UpdatedAt: now,
+	}
+	if err := s.store.SaveCredential(ctx, cred); err != nil {
+		s.t.Fatalf("heraldtotptest: save credential: %v", err)
+	}
+	s.mu.Lock()
+	s.secrets[subject] = secretBase32
+	s.mu.Unlock()
+	return secretBase32
+}
+
+// SetBackupCodes replaces subject's backup codes with codes.
+func (s *Server) SetBackupCodes(subject string, codes ...string) {
+	s.t.Helper()
+	entries := make([]store.BackupCodeEntry, len(codes))
+	for i, code := range codes {
+		entries[i] = store.BackupCodeEntry{CodeHash: totpservice.BackupCodeHash(code)}
+	}
+	if err := s.store.SaveBackupCodes(context.Background(), subject, entries); err != nil {
+		s.t.Fatalf("heraldtotptest: save backup codes: %v", err)
+	}
+}
+
+// CurrentCode returns the TOTP code for a subject enrolled with Enroll at the fake clock's time.
+// The server rejects the same time step twice as a replay; Advance by the period for a fresh code.
+func (s *Server) CurrentCode(subject string) string {
+	s.t.Helper()
+	s.mu.Lock()
+	secretBase32, ok := s.secrets[subject]
+	s.mu.Unlock()
+	if !ok {
+		s.t.Fatalf("heraldtotptest: %s was not enrolled with Enroll", subject)
+	}
+	cfg := s.config
+	code, err := pqtotp.GenerateCodeCustom(secretBase32, s.Now(), pqtotp.ValidateOpts{
+		Period: uint(cfg.TOTPPeriod), Digits: totp.DigitsFromInt(cfg.TOTPDigits), Algorithm: totp.AlgorithmSHA1,
+	})
+	if err != nil {
+		s.t.Fatalf("heraldtotptest: %v", err)
+	}
+	return code
+}
+
+// Now returns the server's fake clock time. It starts at the wall clock and only moves with Advance.
+func (s *Server) Now() time.Time {
+	return s.clock.Now()
+}
+
+// Advance moves the server's fake clock forward by d. TOTP validation, timestamps and Redis expiry
+// all follow it: pending enrollments, rate-limit windows and used challenge IDs expire as they would
+// after d.
+func (s *Server) Advance(d time.Duration) {
+	s.clock.Advance(d)
+	s.redis.FastForward(d)
+}
+
+// FailNext makes the next request to path (e.g. "/v1/verify") fail with reason, with the status the
+// server uses for it, without reaching the handler. Calls queue further failures.
+func (s *Server) FailNext(path, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[path] = append(s.failures[path], reason)
+}
+
+// failureStatus is the status the server returns with each reason.
+var failureStatus = map[string]int{
+	heraldtotp.ReasonInvalidRequest: http.StatusBadRequest,
+	heraldtotp.ReasonReplay:         http.StatusBadRequest,
+	heraldtotp.ReasonInvalid:        http.StatusUnauthorized,
+	heraldtotp.ReasonUnauthorized:   http.StatusUnauthorized,
+	heraldtotp.ReasonExpired:        http.StatusNotFound,
+	heraldtotp.ReasonRateLimited:    http.StatusTooManyRequests,
+	heraldtotp.ReasonConfigError:    http.StatusInternalServerError,
+	heraldtotp.ReasonInternalError:  http.StatusInternalServerError,
+}
+
+func (s *Server) injectFailure(c *fiber.Ctx) error {
+	s.mu.Lock()
+	queue := s.failures[c.Path()]
+	var reason string
+	if len(queue) > 0 {
+		reason, s.failures[c.Path()] = queue[0], queue[1:]
+	}
+	s.mu.Unlock()
+	if reason == "" {
+		return c.Next()
+	}
+	status, ok := failureStatus[reason]
+	if !ok {
+		status = http.StatusBadRequest
+	}
+	return c.Status(status).JSON(handler.ErrorResponse{OK: false, Reason: reason})
+}
@@ -0,0 +1,105 @@
+package heraldtotptest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/soulteary/herald-totp/pkg/heraldtotp"
+)
+
+func TestServer_EnrollAndVerify(t *testing.T) {
+	srv := NewServer(t)
+	client := srv.Client()
+	ctx := context.Background()
+
+	srv.Enroll("alice", "JBSWY3DPEHPK3PXP")
+	srv.SetBackupCodes("alice", "ABCD-EFGH")
+
+	status, err := client.Status(ctx, "alice")
+	if err != nil || !status.TotpEnabled {
+		t.Fatalf("Status = %+v, %v", status, err)
+	}
+	code := srv.CurrentCode("alice")
+	if resp, err := client.Verify(ctx, &heraldtotp.VerifyRequest{Subject: "alice", Code: code}); err != nil || !resp.OK {
+		t.Fatalf("Verify = %+v, %v", resp, err)
+	}
+	if _, err := client.Verify(ctx, &heraldtotp.VerifyRequest{Subject: "alice", Code: code}); !heraldtotp.IsReplay(err) {
+		t.Errorf("Verify reused code: err = %v, want replay", err)
+	}
+	if resp, err := client.Verify(ctx, &heraldtotp.VerifyRequest{Subject: "alice", Code: "abcdefgh"}); err != nil || !resp.OK {
+		t.Errorf("Verify backup code = %+v, %v", resp, err)
+	}
+
+	generated := srv.Enroll("bob", "")
+	if generated == "" {
+		t.Fatal("Enroll returned no secret")
+	}
+	if _, err := client.Verify(ctx, &heraldtotp.VerifyRequest{Subject: "bob", Code: srv.CurrentCode("bob")}); err != nil {
+		t.Errorf("Verify with generated secret: %v", err)
+	}
+}
+
+func TestServer_FailNext(t *testing.T) {
+	srv := NewServer(t)
+	client := srv.Client()
+	ctx := context.Background()
+	srv.Enroll("alice", "")
+
+	srv.FailNext("/v1/verify", heraldtotp.ReasonRateLimited)
+	srv.FailNext("/v1/verify", heraldtotp.ReasonReplay)
+	_, err := client.Verify(ctx, &heraldtotp.VerifyRequest{Subject: "alice", Code: srv.CurrentCode("alice")})
+	if !heraldtotp.IsRateLimited(err) {
+		t.Errorf("first Verify: err = %v, want rate_limited", err)
+	}
+	_, err = client.Verify(ctx, &heraldtotp.VerifyRequest{Subject: "alice", Code: srv.CurrentCode("alice")})
+	if !heraldtotp.IsReplay(err) {
+		t.Errorf("second Verify: err = %v, want replay", err)
+	}
+	// The queue is drained; the injected failures never reached the handler, so the code is unused.
+	if _, err := client.Verify(ctx, &heraldtotp.VerifyRequest{Subject: "alice", Code: srv.CurrentCode("alice")}); err != nil {
+		t.Errorf("third Verify: %v", err)
+	}
+	if _, err := client.Status(ctx, "alice"); err != nil {
+		t.Errorf("Status is unaffected by verify failures: %v", err)
+	}
+}
+
+func TestServer_Advance(t *testing.T) {
+	srv := NewServer(t)
+	client := srv.Client()
+	ctx := context.Background()
+
+	start, err := client.EnrollStart(ctx, &heraldtotp.EnrollStartRequest{Subject: "alice"})
+	if err != nil {
+		t.Fatalf("EnrollStart: %v", err)
+	}
+	before := srv.Now()
+	srv.Advance(time.Hour)
+	if got := srv.Now().Sub(before); got < time.Hour {
+		t.Errorf("Now moved by %v, want at least 1h", got)
+	}
+	if _, err := client.EnrollStatus(ctx, start.EnrollID, false); !heraldtotp.IsExpired(err) {
+		t.Errorf("EnrollStatus after the enrollment TTL: err = %v, want expired", err)
+	}
+
+	// Verification follows the fake clock well past TOTP_SKEW periods.
+	srv.Enroll("bob", "")
+	if _, err := client.Verify(ctx, &heraldtotp.VerifyRequest{Subject: "bob", Code: srv.CurrentCode("bob")}); err != nil {
+		t.Errorf("Verify after Advance: %v", err)
+	}
+}
+
+func TestServer_Independent(t *testing.T) {
+	// Servers have their own settings and Redis, so one's credentials are unknown to the other.
+	t.Parallel()
+	a, b := NewServer(t), NewServer(t)
+	a.Enroll("alice", "JBSWY3DPEHPK3PXP")
+	ctx := context.Background()
+	if status, err := b.Client().Status(ctx, "alice"); err != nil || status.TotpEnabled {
+		t.Errorf("other server Status = %+v, %v, want not enrolled", status, err)
+	}
+	if _, err := a.Client().Verify(ctx, &heraldtotp.VerifyRequest{Subject: "alice", Code: a.CurrentCode("alice")}); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+}
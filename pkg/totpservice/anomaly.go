@@ -0,0 +1,100 @@
+package totpservice
+
+import (
+	"context"
+
+	secure "github.com/soulteary/secure-kit"
+
+	"github.com/soulteary/herald-totp/internal/audit"
+)
+
+// Anomaly signals raised on verify traffic; they are the reason of anomaly audit events and the
+// signal label of the anomalies metric.
+const (
+	SignalCredentialStuffing  = "credential_stuffing"  // one IP failing across many subjects
+	SignalDistributedGuessing = "distributed_guessing" // one subject failing from many IPs
+	SignalReplayStorm         = "replay_storm"         // repeated replays from one IP
+)
+
+// blocked reports whether verification of subject or from the caller's IP is blocked after an anomaly.
+func (s *Service) blocked(ctx context.Context, cfg *Config, subject string, caller Caller) bool {
+	if cfg.AnomalyBlockTTL <= 0 {
+		return false
+	}
+	blocked, _ := s.store.IsBlocked(ctx, subject, caller.IP)
+	return blocked
+}
+
+// trackFailure counts a failed verification in the sliding windows and raises credential_stuffing or
+// distributed_guessing when a count crosses its threshold. Callers without an IP are not tracked.
+func (s *Service) trackFailure(ctx context.Context, cfg *Config, subject string, caller Caller) {
+	if cfg.AnomalyWindow <= 0 || caller.IP == "" || (cfg.AnomalyIPSubjects <= 0 && cfg.AnomalySubjectIPs <= 0) {
+		return
+	}
+	subjectsFromIP, ipsForSubject, err := s.store.TrackVerifyFailure(ctx, subject, caller.IP, cfg.AnomalyWindow)
+	if err != nil {
+		return
+	}
+	if crossed(cfg, subjectsFromIP, cfg.AnomalyIPSubjects) {
+		s.raise(ctx, cfg, subject, caller, SignalCredentialStuffing, "ip")
+	}
+	if crossed(cfg, ipsForSubject, cfg.AnomalySubjectIPs) {
+		s.raise(ctx, cfg, subject, caller, SignalDistributedGuessing, "subject")
+	}
+}
+
+// trackReplay counts a replayed code or challenge from the caller's IP (the subject's when the IP is
+// unknown) and raises replay_storm, blocking that IP or subject, when the count crosses its threshold.
+func (s *Service) trackReplay(ctx context.Context, cfg *Config, subject string, caller Caller) {
+	if cfg.AnomalyWindow <= 0 || cfg.AnomalyReplays <= 0 {
+		return
+	}
+	dimension, value := "ip", caller.IP
+	if caller.IP == "" {
+		dimension, value = "subject", subject
+	}
+	replays, err := s.store.TrackReplay(ctx, dimension, value, cfg.AnomalyWindow)
+	if err != nil {
+		return
+	}
+	if crossed(cfg, replays, cfg.AnomalyReplays) {
+		s.raise(ctx, cfg, subject, caller, SignalReplayStorm, dimension)
+	}
+}
+
+// crossed reports whether count should raise a signal with the given threshold (0 = disabled). With
+// blocking on, every count at or past the threshold does: the caller got this far, so the block it
+// would apply is missing (expired, or the write failed). Otherwise signals repeat at each multiple of
+// the threshold, so a sustained attack is reported again without an event per attempt.
+func crossed(cfg *Config, count int64, threshold int) bool {
+	if threshold <= 0 || count < int64(threshold) {
+		return false
+	}
+	return cfg.AnomalyBlockTTL > 0 || count%int64(threshold) == 0
+}
+
+// raise records an anomaly signal and, with ANOMALY_BLOCK_TTL set, blocks the caller's IP or the
+// subject (dimension "ip" or "subject").
+func (s *Service) raise(ctx context.Context, cfg *Config, subject string, caller Caller, signal, dimension string) {
+	outcome := audit.OutcomeDetected
+	if cfg.AnomalyBlockTTL > 0 {
+		var err error
+		if dimension == "ip" {
+			err = s.store.BlockIP(ctx, caller.IP, cfg.AnomalyBlockTTL)
+		} else {
+			err = s.store.BlockSubject(ctx, subject, cfg.AnomalyBlockTTL)
+		}
+		if err == nil {
+			outcome = audit.OutcomeBlocked
+			s.metrics.RecordAnomalyBlock(dimension)
+		}
+	}
+	s.metrics.RecordAnomaly(signal)
+	s.log.Warn().
+		Str("signal", signal).
+		Str("subject", secure.MaskString(subject, 4)).
+		Str("ip", caller.IP).
+		Str("outcome", outcome).
+		Msg("verify: anomaly detected")
+	s.auditEvent(ctx, caller, audit.EventAnomaly, subject, outcome, signal)
+}
@@ -0,0 +1,29 @@
+package totpservice
+
+import (
+	"context"
+
+	"github.com/soulteary/herald-totp/internal/audit"
+)
+
+// AuditResponse is the response for GET /v1/audit.
+type AuditResponse struct {
+	Subject string       `json:"subject"`
+	Events  []AuditEvent `json:"events"`
+}
+
+// AuditEvents returns up to limit recent audit events for one subject, newest first.
+func (s *Service) AuditEvents(ctx context.Context, subject string, limit int) (*AuditResponse, *Error) {
+	if subject == "" {
+		return nil, errBadRequest("invalid_request", "subject is required")
+	}
+	events, err := audit.Recent(ctx, s.store, subject, int64(limit))
+	if err != nil {
+		return nil, errInternal()
+	}
+	out := make([]AuditEvent, len(events))
+	for i, e := range events {
+		out[i] = AuditEvent(e)
+	}
+	return &AuditResponse{Subject: subject, Events: out}, nil
+}
@@ -0,0 +1,81 @@
+package totpservice
+
+import "time"
+
+// Re-enrollment policies: what enroll/confirm does when the subject already has a credential.
+const (
+	ReenrollReject      = "reject"       // confirm fails with already_enrolled
+	ReenrollRequireCode = "require_code" // confirm must carry a current TOTP or backup code to replace the credential
+	ReenrollAdd         = "add"          // new authenticator is stored next to the existing one
+)
+
+// Config holds the settings a Service applies. The fields match the herald-totp server settings of
+// the same name (see docs/enUS/DEPLOYMENT.md); start from DefaultConfig.
+type Config struct {
+	// EncryptionKey encrypts the stored secrets; at least 32 bytes. Without it enrollment and
+	// verification fail with config_error.
+	EncryptionKey string
+
+	TOTPIssuer string
+	TOTPPeriod int
+	TOTPDigits int
+	TOTPSkew   uint // accepted time steps before and after the current one
+
+	HOTPLookAhead    int
+	HOTPResyncWindow int
+
+	EnrollTTL                time.Duration
+	MaxPendingEnrollments    int
+	ReenrollPolicy           string
+	MaxCredentialsPerSubject int // ReenrollAdd only
+	ExposeSecretInEnroll     bool
+	BackupCodeCount          int
+
+	// Calls allowed per subject per hour and per client IP per minute.
+	RateLimitPerSubject int
+	RateLimitPerIP      int
+
+	QRSize            int
+	QRMaxSize         int
+	QRErrorCorrection string
+
+	// PSKCPreSharedKey is the hex AES key that encrypts secrets in PSKC seed files.
+	PSKCPreSharedKey string
+
+	// Anomaly detection on verify, over a sliding AnomalyWindow: failures from one IP across
+	// AnomalyIPSubjects subjects, failures for one subject from AnomalySubjectIPs IPs, and
+	// AnomalyReplays replays from one IP each raise a signal (0 disables it). With AnomalyBlockTTL
+	// set, the offending IP or subject is also refused verification for that long.
+	AnomalyWindow     time.Duration
+	AnomalyIPSubjects int
+	AnomalySubjectIPs int
+	AnomalyReplays    int
+	AnomalyBlockTTL   time.Duration
+}
+
+// DefaultConfig returns the server's default settings, without an encryption key.
+func DefaultConfig() Config {
+	return Config{
+		TOTPIssuer:               "Herald",
+		TOTPPeriod:               30,
+		TOTPDigits:               6,
+		TOTPSkew:                 1,
+		HOTPLookAhead:            10,
+		HOTPResyncWindow:         100,
+		EnrollTTL:                10 * time.Minute,
+		MaxPendingEnrollments:    3,
+		ReenrollPolicy:           ReenrollRequireCode,
+		MaxCredentialsPerSubject: 5,
+		ExposeSecretInEnroll:     true,
+		BackupCodeCount:          10,
+		RateLimitPerSubject:      20,
+		RateLimitPerIP:           30,
+		QRSize:                   256,
+		QRMaxSize:                1024,
+		QRErrorCorrection:        "M",
+		AnomalyWindow:            10 * time.Minute,
+		AnomalyIPSubjects:        10,
+		AnomalySubjectIPs:        5,
+		AnomalyReplays:           5,
+	}
+}
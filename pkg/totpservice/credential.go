@@ -0,0 +1,87 @@
+package totpservice
+
+import (
+	"context"
+	"time"
+
+	"github.com/soulteary/herald-totp/internal/store"
+	"github.com/soulteary/herald-totp/internal/totp"
+)
+
+// enabledCredentials filters out disabled credentials.
+func enabledCredentials(creds []*store.Credential) []*store.Credential {
+	out := make([]*store.Credential, 0, len(creds))
+	for _, c := range creds {
+		if c.Enabled {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// matchCredential returns the first credential that accepts code at now, or nil if none does.
+// TOTP credentials are checked against the clock; HOTP credentials within HOTP_LOOK_AHEAD counters,
+// and a matched HOTP credential has its counter advanced in memory (persist it after markCredentialUsed).
+// A non-nil error means a stored secret could not be decrypted.
+func (s *Service) matchCredential(cfg *Config, creds []*store.Credential, code string, now time.Time) (*store.Credential, error) {
+	for _, cred := range creds {
+		secretPlain, err := s.decrypt(cred.SecretEnc)
+		if err != nil {
+			return nil, err
+		}
+		if isHOTP(cred) {
+			if matched, ok := totp.MatchHOTP(code, secretPlain, cred.Counter, uint64(cfg.HOTPLookAhead), totpConfigFromCred(cfg, cred)); ok {
+				cred.Counter = matched + 1
+				return cred, nil
+			}
+			continue
+		}
+		if valid, err := totp.Validate(code, secretPlain, totpConfigFromCred(cfg, cred), now); err == nil && valid {
+			return cred, nil
+		}
+	}
+	return nil, nil
+}
+
+// markCredentialUsed records a successful code on a matched credential. It returns false for a TOTP
+// code whose time step was already used (replay); HOTP replay is prevented by the advanced counter.
+func markCredentialUsed(cred *store.Credential, now time.Time) bool {
+	if !isHOTP(cred) {
+		step := totp.TimeStep(now, uint(cred.Period))
+		if step <= cred.LastUsedStep {
+			return false
+		}
+		cred.LastUsedStep = step
+	}
+	cred.UpdatedAt = now.Unix()
+	return true
+}
+
+// isHOTP reports whether the credential is counter-based.
+func isHOTP(cred *store.Credential) bool {
+	return cred.Type == totp.TypeHOTP
+}
+
+// credentialMethod returns the AMR / metrics reason for a credential ("totp" or "hotp").
+func credentialMethod(cred *store.Credential) string {
+	if isHOTP(cred) {
+		return totp.TypeHOTP
+	}
+	return totp.TypeTOTP
+}
+
+// verifyCurrentCode checks a code from one of the subject's existing authenticators (TOTP with replay
+// protection, HOTP, or an unused backup code) to authorise replacing the credential.
+func (s *Service) verifyCurrentCode(ctx context.Context, cfg *Config, subject string, creds []*store.Credential, code string, now time.Time) (bool, error) {
+	cred, err := s.matchCredential(cfg, creds, code, now)
+	if err != nil {
+		return false, err
+	}
+	if cred != nil {
+		if !markCredentialUsed(cred, now) {
+			return false, nil
+		}
+		return true, s.store.SaveCredential(ctx, cred)
+	}
+	return s.store.ConsumeBackupCode(ctx, subject, BackupCodeHash(code))
+}
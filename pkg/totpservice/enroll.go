@@ -0,0 +1,364 @@
+package totpservice
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	secure "github.com/soulteary/secure-kit"
+
+	"github.com/soulteary/herald-totp/internal/audit"
+	"github.com/soulteary/herald-totp/internal/qrcode"
+	"github.com/soulteary/herald-totp/internal/store"
+	"github.com/soulteary/herald-totp/internal/totp"
+)
+
+// EnrollStartRequest is the request body for POST /v1/enroll/start.
+// Type is "totp" (default) or "hotp" for counter-based tokens. QRFormat (png or svg) asks for a rendered QR code in the response; QRSize and QRLevel
+// default to QR_SIZE and QR_ERROR_CORRECTION.
+type EnrollStartRequest struct {
+	Subject  string `json:"subject"`
+	Label    string `json:"label"`
+	Type     string `json:"type,omitempty"`
+	QRFormat string `json:"qr_format,omitempty"`
+	QRSize   int    `json:"qr_size,omitempty"`
+	QRLevel  string `json:"qr_level,omitempty"`
+}
+
+// EnrollStartResponse is the response for POST /v1/enroll/start.
+// QRCode is a PNG data URI or SVG markup, only set when qr_format was requested.
+type EnrollStartResponse struct {
+	EnrollID     string `json:"enroll_id"`
+	SecretBase32 string `json:"secret_base32,omitempty"`
+	OtpauthURI   string `json:"otpauth_uri"`
+	QRCode       string `json:"qr_code,omitempty"`
+}
+
+// maxReauthAttempts is how many wrong current_code values an enrollment accepts before it is deleted,
+// and how many token assignments to a subject accept before they are refused for the enrollment TTL.
+const maxReauthAttempts = 3
+
+// EnrollConfirmRequest is the request body for POST /v1/enroll/confirm.
+// CurrentCode is a TOTP or backup code from the existing authenticator; it is required to replace
+// a credential when REENROLL_POLICY=require_code.
+type EnrollConfirmRequest struct {
+	EnrollID    string `json:"enroll_id"`
+	Code        string `json:"code"`
+	CurrentCode string `json:"current_code,omitempty"`
+}
+
+// EnrollConfirmResponse is the response for POST /v1/enroll/confirm.
+type EnrollConfirmResponse struct {
+	Subject     string   `json:"subject"`
+	TotpEnabled bool     `json:"totp_enabled"`
+	BackupCodes []string `json:"backup_codes,omitempty"`
+}
+
+// StartEnrollment creates a pending enrollment with a fresh secret for the subject.
+func (s *Service) StartEnrollment(ctx context.Context, caller Caller, req EnrollStartRequest) (*EnrollStartResponse, *Error) {
+	cfg := s.config()
+	if req.Subject == "" {
+		return nil, errBadRequest("invalid_request", "subject is required")
+	}
+	if req.Label == "" {
+		req.Label = req.Subject
+	}
+	switch req.Type {
+	case "":
+		req.Type = totp.TypeTOTP
+	case totp.TypeTOTP, totp.TypeHOTP:
+	default:
+		return nil, errBadRequest("invalid_request", "type must be totp or hotp")
+	}
+	var qrOpts qrcode.Options
+	if req.QRFormat != "" {
+		opts, err := qrOptions(cfg, req.QRFormat, req.QRSize, req.QRLevel)
+		if err != nil {
+			return nil, errBadRequest("invalid_request", err.Error())
+		}
+		qrOpts = opts
+	}
+
+	if s.cipher == nil {
+		s.log.Warn().Msg("HERALD_TOTP_ENCRYPTION_KEY not set or invalid (need 32 bytes)")
+		return nil, errConfig("encryption not configured")
+	}
+
+	if !s.allow(ctx, cfg, req.Subject, caller) {
+		s.auditEvent(ctx, caller, audit.EventEnrollStart, req.Subject, audit.OutcomeFailure, "rate_limited")
+		return nil, errRateLimited()
+	}
+
+	if cfg.ReenrollPolicy == ReenrollReject {
+		existing, err := s.store.GetCredentials(ctx, req.Subject)
+		if err != nil {
+			return nil, errInternal()
+		}
+		if len(enabledCredentials(existing)) > 0 {
+			s.auditEvent(ctx, caller, audit.EventEnrollStart, req.Subject, audit.OutcomeFailure, "already_enrolled")
+			return nil, errConflict("already_enrolled", "subject already has TOTP enabled")
+		}
+	}
+
+	pending, err := s.store.CountPendingEnrollments(ctx, req.Subject, s.clock.Now().Unix())
+	if err != nil {
+		return nil, errInternal()
+	}
+	if pending >= int64(cfg.MaxPendingEnrollments) {
+		s.auditEvent(ctx, caller, audit.EventEnrollStart, req.Subject, audit.OutcomeFailure, "too_many_enrollments")
+		return nil, &Error{Status: http.StatusTooManyRequests, Reason: "too_many_enrollments", Message: "too many pending enrollments; confirm or cancel one first"}
+	}
+
+	otpCfg := totpConfigFromConfig(cfg)
+	generate := totp.Generate
+	if req.Type == totp.TypeHOTP {
+		generate = totp.GenerateHOTP
+	}
+	secretBase32, otpauthURI, err := generate(req.Label, otpCfg)
+	if err != nil {
+		s.log.Warn().Err(err).Str("subject", secure.MaskString(req.Subject, 4)).Msg("enroll start: generate failed")
+		return nil, errInternal()
+	}
+
+	enrollID, err := NewEnrollID()
+	if err != nil {
+		return nil, errInternal()
+	}
+
+	secretEnc, err := s.cipher.Encrypt(secretBase32)
+	if err != nil {
+		s.log.Warn().Err(err).Msg("enroll start: encrypt failed")
+		return nil, errInternal()
+	}
+
+	now := s.clock.Now()
+	expiresAt := now.Add(cfg.EnrollTTL).Unix()
+	e := &store.Enrollment{
+		EnrollID:  enrollID,
+		Type:      req.Type,
+		Subject:   req.Subject,
+		SecretEnc: secretEnc,
+		Issuer:    cfg.TOTPIssuer,
+		Label:     req.Label,
+		Period:    uint(cfg.TOTPPeriod),
+		Digits:    cfg.TOTPDigits,
+		ExpiresAt: expiresAt,
+		CreatedAt: now.Unix(),
+	}
+	if err := s.store.SaveEnrollment(ctx, e); err != nil {
+		s.log.Warn().Err(err).Msg("enroll start: save failed")
+		return nil, errInternal()
+	}
+
+	resp := EnrollStartResponse{EnrollID: enrollID, OtpauthURI: otpauthURI}
+	if qrOpts.Format != "" {
+		resp.QRCode, err = qrcode.Inline(otpauthURI, qrOpts)
+		if err != nil {
+			s.log.Warn().Err(err).Msg("enroll start: render QR failed")
+			return nil, errInternal()
+		}
+	}
+
+	s.metrics.RecordEnrollStart()
+	s.auditEvent(ctx, caller, audit.EventEnrollStart, req.Subject, audit.OutcomeSuccess, "")
+
+	if cfg.ExposeSecretInEnroll {
+		resp.SecretBase32 = secretBase32
+	}
+	return &resp, nil
+}
+
+// ConfirmEnrollment checks the first code of a pending enrollment and turns it into a credential,
+// applying REENROLL_POLICY when the subject already has one.
+func (s *Service) ConfirmEnrollment(ctx context.Context, caller Caller, req EnrollConfirmRequest) (*EnrollConfirmResponse, *Error) {
+	cfg := s.config()
+	if req.EnrollID == "" || req.Code == "" {
+		return nil, errBadRequest("invalid_request", "enroll_id and code are required")
+	}
+
+	if s.cipher == nil {
+		return nil, errConfig("")
+	}
+
+	e, err := s.store.GetEnrollment(ctx, req.EnrollID)
+	if err != nil {
+		return nil, errInternal()
+	}
+	if e == nil {
+		subject, _ := s.store.EnrollmentSubject(ctx, req.EnrollID)
+		s.metrics.RecordEnrollConfirm("failure")
+		s.auditEvent(ctx, caller, audit.EventEnrollConfirm, subject, audit.OutcomeFailure, "expired")
+		return nil, errBadRequest("expired", "enrollment not found or expired")
+	}
+
+	secretPlain, err := s.decrypt(e.SecretEnc)
+	if err != nil {
+		s.log.Warn().Err(err).Msg("enroll confirm: decrypt failed")
+		return nil, errInternal()
+	}
+
+	otpCfg := totpConfigFromConfig(cfg)
+	otpCfg.Period = uint(e.Period)
+	otpCfg.Digits = totp.DigitsFromInt(e.Digits)
+	var counter uint64
+	valid := false
+	if e.Type == totp.TypeHOTP {
+		// The first code from a fresh token is counter 0, but allow for presses before enrolling.
+		var matched uint64
+		if matched, valid = totp.MatchHOTP(req.Code, secretPlain, 0, uint64(cfg.HOTPLookAhead), otpCfg); valid {
+			counter = matched + 1
+		}
+	} else {
+		valid, err = totp.Validate(req.Code, secretPlain, otpCfg, s.clock.Now())
+	}
+	if err != nil || !valid {
+		s.metrics.RecordEnrollConfirm("failure")
+		s.auditEvent(ctx, caller, audit.EventEnrollConfirm, e.Subject, audit.OutcomeFailure, "invalid")
+		return nil, errBadRequest("invalid", "code verification failed")
+	}
+
+	existing, err := s.store.GetCredentials(ctx, e.Subject)
+	if err != nil {
+		return nil, errInternal()
+	}
+	existing = enabledCredentials(existing)
+	addCredential := false
+	if len(existing) > 0 {
+		switch cfg.ReenrollPolicy {
+		case ReenrollReject:
+			s.metrics.RecordEnrollConfirm("failure")
+			s.auditEvent(ctx, caller, audit.EventEnrollConfirm, e.Subject, audit.OutcomeFailure, "already_enrolled")
+			return nil, errConflict("already_enrolled", "subject already has TOTP enabled")
+		case ReenrollAdd:
+			if len(existing) >= cfg.MaxCredentialsPerSubject {
+				s.metrics.RecordEnrollConfirm("failure")
+				s.auditEvent(ctx, caller, audit.EventEnrollConfirm, e.Subject, audit.OutcomeFailure, "too_many_credentials")
+				return nil, errConflict("too_many_credentials", "subject has the maximum number of authenticators")
+			}
+			addCredential = true
+		default: // require_code
+			if reason, apiErr := s.reauthorize(ctx, cfg, caller, e.Subject, existing, req.CurrentCode); apiErr != nil {
+				if reason == "" {
+					return nil, apiErr
+				}
+				s.metrics.RecordEnrollConfirm("failure")
+				s.auditEvent(ctx, caller, audit.EventEnrollConfirm, e.Subject, audit.OutcomeFailure, reason)
+				if reason == "reauth_invalid" {
+					s.trackFailure(ctx, cfg, e.Subject, caller)
+					if attempts, _ := s.store.IncrEnrollmentAttempts(ctx, req.EnrollID); attempts >= maxReauthAttempts {
+						_ = s.store.DeleteEnrollment(ctx, req.EnrollID)
+						return nil, errUnauthorized("reauth_invalid", "current_code verification failed; too many attempts, start a new enrollment")
+					}
+				}
+				return nil, apiErr
+			}
+		}
+	}
+
+	s.metrics.RecordEnrollConfirm("success")
+	now := s.clock.Now()
+	cred := &store.Credential{
+		Type:         e.Type,
+		Subject:      e.Subject,
+		SecretEnc:    e.SecretEnc,
+		Issuer:       e.Issuer,
+		Label:        e.Label,
+		Period:       e.Period,
+		Digits:       e.Digits,
+		Algo:         "SHA1",
+		Enabled:      true,
+		LastUsedStep: 0,
+		Counter:      counter,
+		CreatedAt:    now.Unix(),
+		UpdatedAt:    now.Unix(),
+	}
+	if addCredential {
+		if cred.ID, err = NewCredentialID(); err != nil {
+			return nil, errInternal()
+		}
+	} else if len(existing) > 0 {
+		// Authorised replacement: drop the old authenticators before saving the new one.
+		if err := s.store.DeleteCredential(ctx, e.Subject); err != nil {
+			s.log.Warn().Err(err).Msg("enroll confirm: delete old credential failed")
+			return nil, errInternal()
+		}
+	}
+	if err := s.store.SaveCredential(ctx, cred); err != nil {
+		s.log.Warn().Err(err).Msg("enroll confirm: save credential failed")
+		return nil, errInternal()
+	}
+	_ = s.store.DeleteEnrollment(ctx, req.EnrollID)
+
+	// An added authenticator keeps the subject's existing backup codes.
+	var backupCodes []string
+	if !addCredential {
+		backupCodes = s.issueBackupCodes(ctx, e.Subject)
+	}
+	s.auditEvent(ctx, caller, audit.EventEnrollConfirm, e.Subject, audit.OutcomeSuccess, "")
+
+	return &EnrollConfirmResponse{
+		Subject:     e.Subject,
+		TotpEnabled: true,
+		BackupCodes: backupCodes,
+	}, nil
+}
+
+// reauthorize checks current_code, a code from one of the subject's existing authenticators, before
+// REENROLL_POLICY=require_code replaces them. The code is a guess at the subject's live codes, so it is
+// limited like verify. On failure it returns the audit reason ("" for internal errors) and the error.
+func (s *Service) reauthorize(ctx context.Context, cfg *Config, caller Caller, subject string, existing []*store.Credential, currentCode string) (string, *Error) {
+	if currentCode == "" {
+		return "reauth_required", errForbidden("reauth_required", "current_code from the existing authenticator is required")
+	}
+	if s.blocked(ctx, cfg, subject, caller) {
+		return "blocked", errRateLimited()
+	}
+	if !s.allow(ctx, cfg, subject, caller) {
+		return "rate_limited", errRateLimited()
+	}
+	ok, err := s.verifyCurrentCode(ctx, cfg, subject, existing, currentCode, s.clock.Now())
+	if err != nil {
+		s.log.Warn().Err(err).Msg("reauthorize: verify current code failed")
+		return "", errInternal()
+	}
+	if !ok {
+		return "reauth_invalid", errUnauthorized("reauth_invalid", "current_code verification failed")
+	}
+	return "", nil
+}
+
+// issueBackupCodes generates BACKUP_CODE_COUNT single-use backup codes for the subject, replacing any existing ones.
+func (s *Service) issueBackupCodes(ctx context.Context, subject string) []string {
+	backupCodes := generateBackupCodes(s.config().BackupCodeCount)
+	entries := make([]store.BackupCodeEntry, len(backupCodes))
+	for i, code := range backupCodes {
+		entries[i] = store.BackupCodeEntry{CodeHash: BackupCodeHash(code), UsedAt: 0}
+	}
+	if err := s.store.SaveBackupCodes(ctx, subject, entries); err != nil {
+		s.log.Warn().Err(err).Msg("save backup codes failed")
+	}
+	return backupCodes
+}
+
+// BackupCodeHash returns the stored hash of a backup code, as written by enroll/confirm and matched by verify.
+func BackupCodeHash(code string) string {
+	return secure.GetSHA256Hash(normalizeBackupCode(code))
+}
+
+// normalizeBackupCode uppercases and removes dash (ABCD-EFGH -> ABCDEFGH).
+func normalizeBackupCode(code string) string {
+	return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+// generateBackupCodes returns n human-readable backup codes (e.g. ABCD-EFGH).
+func generateBackupCodes(n int) []string {
+	const chars = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	const partLen = 4
+	out := make([]string, n)
+	for i := 0; i < n; i++ {
+		p1, _ := secure.RandomString(partLen, chars)
+		p2, _ := secure.RandomString(partLen, chars)
+		out[i] = p1 + "-" + p2
+	}
+	return out
+}
@@ -0,0 +1,110 @@
+package totpservice
+
+import (
+	"context"
+
+	"github.com/soulteary/herald-totp/internal/audit"
+	"github.com/soulteary/herald-totp/internal/store"
+	"github.com/soulteary/herald-totp/internal/totp"
+)
+
+// EnrollStatusResponse is the response for GET /v1/enroll/:enroll_id.
+type EnrollStatusResponse struct {
+	EnrollID     string `json:"enroll_id"`
+	Subject      string `json:"subject"`
+	Status       string `json:"status"` // always "pending"; confirmed, cancelled and expired enrollments are not found
+	ExpiresAt    int64  `json:"expires_at"`
+	CreatedAt    int64  `json:"created_at"`
+	SecretBase32 string `json:"secret_base32,omitempty"`
+	OtpauthURI   string `json:"otpauth_uri,omitempty"`
+}
+
+// EnrollCancelRequest is the request body for POST /v1/enroll/cancel.
+type EnrollCancelRequest struct {
+	EnrollID string `json:"enroll_id"`
+}
+
+// EnrollCancelResponse is the response for POST /v1/enroll/cancel.
+type EnrollCancelResponse struct {
+	OK       bool   `json:"ok"`
+	EnrollID string `json:"enroll_id"`
+}
+
+// EnrollmentStatus returns a pending enrollment's status and expiry. With includeURI the otpauth URI is
+// rebuilt so a frontend that lost it can show the QR again.
+func (s *Service) EnrollmentStatus(ctx context.Context, enrollID string, includeURI bool) (*EnrollStatusResponse, *Error) {
+	cfg := s.config()
+	if enrollID == "" {
+		return nil, errBadRequest("invalid_request", "enroll_id is required")
+	}
+	e, err := s.store.GetEnrollment(ctx, enrollID)
+	if err != nil {
+		return nil, errInternal()
+	}
+	if e == nil {
+		return nil, errNotFound("expired", "enrollment not found or expired")
+	}
+	resp := EnrollStatusResponse{
+		EnrollID:  e.EnrollID,
+		Subject:   e.Subject,
+		Status:    "pending",
+		ExpiresAt: e.ExpiresAt,
+		CreatedAt: e.CreatedAt,
+	}
+	if includeURI {
+		if s.cipher == nil {
+			return nil, errConfig("encryption not configured")
+		}
+		secretPlain, uri, err := s.enrollmentURI(cfg, e)
+		if err != nil {
+			s.log.Warn().Err(err).Msg("enroll status: rebuild otpauth URI failed")
+			return nil, errInternal()
+		}
+		resp.OtpauthURI = uri
+		if cfg.ExposeSecretInEnroll {
+			resp.SecretBase32 = secretPlain
+		}
+	}
+	return &resp, nil
+}
+
+// CancelEnrollment discards a pending enrollment before it expires.
+func (s *Service) CancelEnrollment(ctx context.Context, caller Caller, req EnrollCancelRequest) (*EnrollCancelResponse, *Error) {
+	if req.EnrollID == "" {
+		return nil, errBadRequest("invalid_request", "enroll_id is required")
+	}
+	e, err := s.store.GetEnrollment(ctx, req.EnrollID)
+	if err != nil {
+		return nil, errInternal()
+	}
+	if e == nil {
+		return nil, errNotFound("expired", "enrollment not found or expired")
+	}
+	if err := s.store.DeleteEnrollment(ctx, req.EnrollID); err != nil {
+		return nil, errInternal()
+	}
+	s.auditEvent(ctx, caller, audit.EventEnrollCancel, e.Subject, audit.OutcomeSuccess, "")
+	return &EnrollCancelResponse{OK: true, EnrollID: req.EnrollID}, nil
+}
+
+// enrollmentURI decrypts a pending enrollment's secret and rebuilds its otpauth URI.
+func (s *Service) enrollmentURI(cfg *Config, e *store.Enrollment) (secretBase32, otpauthURI string, err error) {
+	secretBase32, err = s.decrypt(e.SecretEnc)
+	if err != nil {
+		return "", "", err
+	}
+	otpCfg := totpConfigFromConfig(cfg)
+	otpCfg.Issuer = e.Issuer
+	otpCfg.Period = e.Period
+	otpCfg.Digits = totp.DigitsFromInt(e.Digits)
+	if e.Type == totp.TypeHOTP {
+		// A pending HOTP enrollment has not advanced its counter yet.
+		otpauthURI, err = totp.HOTPKeyURI(e.Label, secretBase32, 0, otpCfg)
+	} else {
+		otpauthURI, err = totp.KeyURI(e.Label, secretBase32, otpCfg)
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return secretBase32, otpauthURI, nil
+}
@@ -0,0 +1,50 @@
+package totpservice
+
+import "net/http"
+
+// Error is a failed call: the HTTP status and the reason and message clients receive. The gRPC API
+// maps Status to a gRPC status code.
+type Error struct {
+	Status  int
+	Reason  string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return e.Reason
+	}
+	return e.Reason + ": " + e.Message
+}
+
+func errBadRequest(reason, message string) *Error {
+	return &Error{Status: http.StatusBadRequest, Reason: reason, Message: message}
+}
+
+func errNotFound(reason, message string) *Error {
+	return &Error{Status: http.StatusNotFound, Reason: reason, Message: message}
+}
+
+func errRateLimited() *Error {
+	return &Error{Status: http.StatusTooManyRequests, Reason: "rate_limited"}
+}
+
+func errInternal() *Error {
+	return &Error{Status: http.StatusInternalServerError, Reason: "internal_error"}
+}
+
+func errConfig(message string) *Error {
+	return &Error{Status: http.StatusInternalServerError, Reason: "config_error", Message: message}
+}
+
+func errUnauthorized(reason, message string) *Error {
+	return &Error{Status: http.StatusUnauthorized, Reason: reason, Message: message}
+}
+
+func errForbidden(reason, message string) *Error {
+	return &Error{Status: http.StatusForbidden, Reason: reason, Message: message}
+}
+
+func errConflict(reason, message string) *Error {
+	return &Error{Status: http.StatusConflict, Reason: reason, Message: message}
+}
@@ -0,0 +1,68 @@
+package totpservice
+
+import (
+	"context"
+
+	secure "github.com/soulteary/secure-kit"
+
+	"github.com/soulteary/herald-totp/internal/audit"
+	"github.com/soulteary/herald-totp/internal/totp"
+)
+
+// HOTPResyncRequest is the request body for POST /v1/hotp/resync.
+// Code1 and Code2 are two consecutive codes from the token.
+type HOTPResyncRequest struct {
+	Subject string `json:"subject"`
+	Code1   string `json:"code1"`
+	Code2   string `json:"code2"`
+}
+
+// HOTPResyncResponse is the response for POST /v1/hotp/resync.
+type HOTPResyncResponse struct {
+	OK      bool   `json:"ok"`
+	Subject string `json:"subject"`
+}
+
+// ResyncHOTP recovers a HOTP token pressed more than HOTP_LOOK_AHEAD times without verifying: it finds
+// two consecutive codes within HOTP_RESYNC_WINDOW and moves the counter past them.
+func (s *Service) ResyncHOTP(ctx context.Context, caller Caller, req HOTPResyncRequest) (*HOTPResyncResponse, *Error) {
+	cfg := s.config()
+	if req.Subject == "" || req.Code1 == "" || req.Code2 == "" {
+		return nil, errBadRequest("invalid_request", "subject, code1 and code2 are required")
+	}
+	if !s.allow(ctx, cfg, req.Subject, caller) {
+		s.auditEvent(ctx, caller, audit.EventHOTPResync, req.Subject, audit.OutcomeFailure, "rate_limited")
+		return nil, errRateLimited()
+	}
+	if s.cipher == nil {
+		return nil, errConfig("encryption not configured")
+	}
+	creds, err := s.store.GetCredentials(ctx, req.Subject)
+	if err != nil {
+		return nil, errInternal()
+	}
+	for _, cred := range enabledCredentials(creds) {
+		if !isHOTP(cred) {
+			continue
+		}
+		secretPlain, err := s.decrypt(cred.SecretEnc)
+		if err != nil {
+			s.log.Warn().Err(err).Str("subject", secure.MaskString(req.Subject, 4)).Msg("hotp resync: decrypt failed")
+			return nil, errInternal()
+		}
+		matched, ok := totp.ResyncHOTP(req.Code1, req.Code2, secretPlain, cred.Counter, uint64(cfg.HOTPResyncWindow), totpConfigFromCred(cfg, cred))
+		if !ok {
+			continue
+		}
+		cred.Counter = matched + 1
+		cred.UpdatedAt = s.clock.Now().Unix()
+		if err := s.store.SaveCredential(ctx, cred); err != nil {
+			s.log.Warn().Err(err).Msg("hotp resync: save credential failed")
+			return nil, errInternal()
+		}
+		s.auditEvent(ctx, caller, audit.EventHOTPResync, req.Subject, audit.OutcomeSuccess, "")
+		return &HOTPResyncResponse{OK: true, Subject: req.Subject}, nil
+	}
+	s.auditEvent(ctx, caller, audit.EventHOTPResync, req.Subject, audit.OutcomeFailure, "invalid")
+	return nil, errUnauthorized("invalid", "codes do not match a HOTP token within the resync window")
+}
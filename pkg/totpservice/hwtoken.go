@@ -0,0 +1,241 @@
+package totpservice
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+
+	secure "github.com/soulteary/secure-kit"
+
+	"github.com/soulteary/herald-totp/internal/audit"
+	"github.com/soulteary/herald-totp/internal/hwtoken"
+	"github.com/soulteary/herald-totp/internal/store"
+)
+
+// TokensImportResponse is the response for POST /v1/admin/tokens/import.
+type TokensImportResponse struct {
+	OK       bool     `json:"ok"`
+	Imported int      `json:"imported"`
+	Skipped  []string `json:"skipped,omitempty"` // serials already in the inventory
+}
+
+// HardwareTokenInfo is an inventory entry without its seed.
+type HardwareTokenInfo struct {
+	Serial     string `json:"serial"`
+	Type       string `json:"type"`
+	Algo       string `json:"algo"`
+	Digits     int    `json:"digits"`
+	Period     uint   `json:"period,omitempty"`
+	Issuer     string `json:"issuer,omitempty"`
+	ImportedAt int64  `json:"imported_at"`
+}
+
+// TokensListResponse is the response for GET /v1/admin/tokens.
+type TokensListResponse struct {
+	Tokens []HardwareTokenInfo `json:"tokens"`
+}
+
+// TokensAssignRequest is the request body for POST /v1/admin/tokens/assign.
+type TokensAssignRequest struct {
+	Serial      string `json:"serial"`
+	Subject     string `json:"subject"`
+	CurrentCode string `json:"current_code,omitempty"`
+}
+
+// TokensAssignResponse is the response for POST /v1/admin/tokens/assign.
+// BackupCodes are issued unless the token was added next to the subject's existing authenticators.
+type TokensAssignResponse struct {
+	Subject     string   `json:"subject"`
+	Serial      string   `json:"serial"`
+	TotpEnabled bool     `json:"totp_enabled"`
+	BackupCodes []string `json:"backup_codes,omitempty"`
+}
+
+// ImportTokens parses a hardware token seed file (format "csv" or "pskc") and adds the tokens to the
+// unassigned inventory. Serials already in the inventory are skipped unless overwrite is set.
+func (s *Service) ImportTokens(ctx context.Context, format string, seedFile io.Reader, overwrite bool) (*TokensImportResponse, *Error) {
+	cfg := s.config()
+	if s.cipher == nil {
+		return nil, errConfig("encryption not configured")
+	}
+
+	var seeds []hwtoken.Seed
+	var err error
+	switch format {
+	case "csv":
+		seeds, err = hwtoken.ParseCSV(seedFile)
+	case "pskc":
+		var psk []byte
+		if cfg.PSKCPreSharedKey != "" {
+			if psk, err = hex.DecodeString(cfg.PSKCPreSharedKey); err != nil {
+				return nil, errConfig("PSKC_PRESHARED_KEY must be hex")
+			}
+		}
+		seeds, err = hwtoken.ParsePSKC(seedFile, psk)
+	default:
+		return nil, errBadRequest("invalid_request", "format must be csv or pskc")
+	}
+	if err != nil {
+		return nil, errBadRequest("invalid_seed_file", err.Error())
+	}
+
+	now := s.clock.Now().Unix()
+	tokens := make([]*store.HardwareToken, 0, len(seeds))
+	for _, seed := range seeds {
+		secretEnc, err := s.cipher.Encrypt(seed.SecretBase32())
+		if err != nil {
+			s.log.Warn().Err(err).Msg("tokens import: encrypt failed")
+			return nil, errInternal()
+		}
+		tokens = append(tokens, &store.HardwareToken{
+			Serial:     seed.Serial,
+			Type:       seed.Type,
+			SecretEnc:  secretEnc,
+			Algo:       seed.Algorithm,
+			Digits:     seed.Digits,
+			Period:     uint(seed.Period),
+			Counter:    seed.Counter,
+			Issuer:     seed.Issuer,
+			ImportedAt: now,
+		})
+	}
+	skipped, err := s.store.AddHardwareTokens(ctx, tokens, overwrite)
+	if err != nil {
+		s.log.Warn().Err(err).Msg("tokens import: save failed")
+		return nil, errInternal()
+	}
+	s.log.Info().Int("imported", len(tokens)-len(skipped)).Int("skipped", len(skipped)).Str("format", format).Msg("hardware tokens imported")
+	return &TokensImportResponse{OK: true, Imported: len(tokens) - len(skipped), Skipped: skipped}, nil
+}
+
+// ListTokens returns the unassigned hardware token inventory.
+func (s *Service) ListTokens(ctx context.Context) (*TokensListResponse, *Error) {
+	tokens, err := s.store.ListHardwareTokens(ctx)
+	if err != nil {
+		return nil, errInternal()
+	}
+	out := make([]HardwareTokenInfo, 0, len(tokens))
+	for _, t := range tokens {
+		out = append(out, HardwareTokenInfo{
+			Serial: t.Serial, Type: t.Type, Algo: t.Algo, Digits: t.Digits,
+			Period: t.Period, Issuer: t.Issuer, ImportedAt: t.ImportedAt,
+		})
+	}
+	return &TokensListResponse{Tokens: out}, nil
+}
+
+// AssignToken takes a token out of the inventory and makes it a credential of the subject. A subject
+// that already has one is handled like enroll/confirm by REENROLL_POLICY: reject fails, add keeps the
+// existing authenticators (up to MAX_CREDENTIALS_PER_SUBJECT), and require_code replaces them once
+// current_code proves the subject still holds one. The token is taken first, so an unknown serial
+// fails before current_code is checked, and it goes back to the inventory when the assignment fails.
+func (s *Service) AssignToken(ctx context.Context, caller Caller, req TokensAssignRequest) (*TokensAssignResponse, *Error) {
+	cfg := s.config()
+	if req.Serial == "" || req.Subject == "" {
+		return nil, errBadRequest("invalid_request", "serial and subject are required")
+	}
+
+	t, err := s.store.TakeHardwareToken(ctx, req.Serial)
+	if err != nil {
+		return nil, errInternal()
+	}
+	if t == nil {
+		return nil, errNotFound("not_found", "token not in the unassigned inventory")
+	}
+	fail := func(apiErr *Error) (*TokensAssignResponse, *Error) {
+		s.restoreToken(ctx, t)
+		return nil, apiErr
+	}
+
+	existing, err := s.store.GetCredentials(ctx, req.Subject)
+	if err != nil {
+		return fail(errInternal())
+	}
+	existing = enabledCredentials(existing)
+	addCredential := false
+	if len(existing) > 0 {
+		switch cfg.ReenrollPolicy {
+		case ReenrollReject:
+			s.auditEvent(ctx, caller, audit.EventEnrollConfirm, req.Subject, audit.OutcomeFailure, "already_enrolled")
+			return fail(errConflict("already_enrolled", "subject already has TOTP enabled"))
+		case ReenrollAdd:
+			if len(existing) >= cfg.MaxCredentialsPerSubject {
+				s.auditEvent(ctx, caller, audit.EventEnrollConfirm, req.Subject, audit.OutcomeFailure, "too_many_credentials")
+				return fail(errConflict("too_many_credentials", "subject has the maximum number of authenticators"))
+			}
+			addCredential = true
+		default: // require_code
+			attempts, err := s.store.AssignAttempts(ctx, req.Subject)
+			if err != nil {
+				return fail(errInternal())
+			}
+			if attempts >= maxReauthAttempts {
+				s.auditEvent(ctx, caller, audit.EventEnrollConfirm, req.Subject, audit.OutcomeFailure, "rate_limited")
+				return fail(errRateLimited())
+			}
+			if reason, apiErr := s.reauthorize(ctx, cfg, caller, req.Subject, existing, req.CurrentCode); apiErr != nil {
+				if reason == "" {
+					return fail(apiErr)
+				}
+				s.auditEvent(ctx, caller, audit.EventEnrollConfirm, req.Subject, audit.OutcomeFailure, reason)
+				if reason == "reauth_invalid" {
+					s.trackFailure(ctx, cfg, req.Subject, caller)
+					_, _ = s.store.IncrAssignAttempts(ctx, req.Subject)
+				}
+				return fail(apiErr)
+			}
+		}
+	}
+
+	now := s.clock.Now().Unix()
+	issuer := t.Issuer
+	if issuer == "" {
+		issuer = cfg.TOTPIssuer
+	}
+	cred := &store.Credential{
+		Type:      t.Type,
+		Subject:   req.Subject,
+		SecretEnc: t.SecretEnc,
+		Issuer:    issuer,
+		Label:     t.Serial,
+		Period:    t.Period,
+		Digits:    t.Digits,
+		Algo:      t.Algo,
+		Enabled:   true,
+		Counter:   t.Counter,
+		Serial:    t.Serial,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if addCredential {
+		if cred.ID, err = NewCredentialID(); err != nil {
+			return fail(errInternal())
+		}
+	} else if len(existing) > 0 {
+		// Authorised replacement: drop the old authenticators before saving the token.
+		if err := s.store.DeleteCredential(ctx, req.Subject); err != nil {
+			s.log.Warn().Err(err).Msg("tokens assign: delete old credential failed")
+			return fail(errInternal())
+		}
+	}
+	if err := s.store.SaveCredential(ctx, cred); err != nil {
+		s.log.Warn().Err(err).Msg("tokens assign: save credential failed")
+		return fail(errInternal())
+	}
+
+	// An added authenticator keeps the subject's existing backup codes.
+	var backupCodes []string
+	if !addCredential {
+		backupCodes = s.issueBackupCodes(ctx, req.Subject)
+	}
+	s.log.Info().Str("serial", t.Serial).Str("subject", secure.MaskString(req.Subject, 4)).Msg("hardware token assigned")
+	s.auditEvent(ctx, caller, audit.EventEnrollConfirm, req.Subject, audit.OutcomeSuccess, "hardware_token")
+	return &TokensAssignResponse{Subject: req.Subject, Serial: t.Serial, TotpEnabled: true, BackupCodes: backupCodes}, nil
+}
+
+// restoreToken puts a token taken for an assignment that failed back into the inventory.
+func (s *Service) restoreToken(ctx context.Context, t *store.HardwareToken) {
+	if _, err := s.store.AddHardwareTokens(ctx, []*store.HardwareToken{t}, true); err != nil {
+		s.log.Warn().Err(err).Str("serial", t.Serial).Msg("tokens assign: restore token failed")
+	}
+}
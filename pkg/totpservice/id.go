@@ -1,4 +1,4 @@
-package handler
+package totpservice
 
 import (
 	"crypto/rand"
@@ -7,6 +7,7 @@ import (
 
 const idPrefixEnroll = "e_"
 const idPrefixChallenge = "c_"
+const idPrefixCredential = "a_"
 const randomIDLen = 12 // 12 bytes -> 16 chars base64url
 
 // NewEnrollID returns a new enrollment ID (e_xxxx).
@@ -26,3 +27,12 @@ func NewChallengeID() (string, error) {
 	}
 	return idPrefixChallenge + encoding.URLEncoding.EncodeToString(b)[:16], nil
 }
+
+// NewCredentialID returns a new ID (a_xxxx) for an additional authenticator.
+func NewCredentialID() (string, error) {
+	b := make([]byte, randomIDLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return idPrefixCredential + encoding.URLEncoding.EncodeToString(b)[:16], nil
+}
@@ -1,4 +1,4 @@
-package handler
+package totpservice
 
 import (
 	"strings"
@@ -36,3 +36,13 @@ func TestNewChallengeID(t *testing.T) {
 		t.Error("NewChallengeID should produce unique IDs")
 	}
 }
+
+func TestNewCredentialID(t *testing.T) {
+	id, err := NewCredentialID()
+	if err != nil {
+		t.Fatalf("NewCredentialID: %v", err)
+	}
+	if !strings.HasPrefix(id, idPrefixCredential) {
+		t.Errorf("NewCredentialID = %q, want prefix %q", id, idPrefixCredential)
+	}
+}
@@ -0,0 +1,38 @@
+package totpservice
+
+import (
+	"context"
+	"time"
+)
+
+// UpdateInventoryMetrics counts the enrolled subjects, credentials and pending enrollments in the store
+// and sets the matching gauges. It scans the whole keyspace, so run it periodically rather than per
+// request; RunInventoryMetrics does.
+func (s *Service) UpdateInventoryMetrics(ctx context.Context) error {
+	subjects, credentials, err := s.store.CountCredentials(ctx)
+	if err != nil {
+		return err
+	}
+	pending, err := s.store.CountEnrollments(ctx)
+	if err != nil {
+		return err
+	}
+	s.metrics.SetInventory(subjects, credentials, pending)
+	return nil
+}
+
+// RunInventoryMetrics updates the inventory gauges now and then every interval until ctx is done.
+func (s *Service) RunInventoryMetrics(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.UpdateInventoryMetrics(ctx); err != nil && ctx.Err() == nil {
+			s.log.Warn().Err(err).Msg("metrics: inventory update failed")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
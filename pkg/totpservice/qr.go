@@ -0,0 +1,57 @@
+package totpservice
+
+import (
+	"context"
+
+	"github.com/soulteary/herald-totp/internal/qrcode"
+)
+
+// qrOptions fills unset size and level from QR_SIZE / QR_ERROR_CORRECTION and validates the result.
+func qrOptions(cfg *Config, format string, size int, level string) (qrcode.Options, error) {
+	opts := qrcode.Options{Format: format, Size: size, Level: level}
+	if opts.Format == "" {
+		opts.Format = qrcode.FormatPNG
+	}
+	if opts.Size == 0 {
+		opts.Size = cfg.QRSize
+	}
+	if opts.Level == "" {
+		opts.Level = cfg.QRErrorCorrection
+	}
+	return opts, opts.Validate(cfg.QRMaxSize)
+}
+
+// EnrollmentQR renders the otpauth URI of a pending enrollment as a png or svg image (format, size and
+// level default to png, QR_SIZE and QR_ERROR_CORRECTION) and returns it with its content type. It
+// stops working once the enrollment is confirmed, cancelled or expired.
+func (s *Service) EnrollmentQR(ctx context.Context, enrollID, format string, size int, level string) ([]byte, string, *Error) {
+	cfg := s.config()
+	if enrollID == "" {
+		return nil, "", errBadRequest("invalid_request", "enroll_id is required")
+	}
+	opts, err := qrOptions(cfg, format, size, level)
+	if err != nil {
+		return nil, "", errBadRequest("invalid_request", err.Error())
+	}
+	if s.cipher == nil {
+		return nil, "", errConfig("encryption not configured")
+	}
+	e, err := s.store.GetEnrollment(ctx, enrollID)
+	if err != nil {
+		return nil, "", errInternal()
+	}
+	if e == nil {
+		return nil, "", errNotFound("expired", "enrollment not found or expired")
+	}
+	_, uri, err := s.enrollmentURI(cfg, e)
+	if err != nil {
+		s.log.Warn().Err(err).Msg("enroll qr: rebuild otpauth URI failed")
+		return nil, "", errInternal()
+	}
+	img, contentType, err := qrcode.Render(uri, opts)
+	if err != nil {
+		s.log.Warn().Err(err).Msg("enroll qr: render failed")
+		return nil, "", errInternal()
+	}
+	return img, contentType, nil
+}
@@ -0,0 +1,35 @@
+package totpservice
+
+import (
+	"context"
+
+	"github.com/soulteary/herald-totp/internal/audit"
+)
+
+// RevokeRequest is the request body for POST /v1/revoke.
+type RevokeRequest struct {
+	Subject string `json:"subject"`
+}
+
+// RevokeResponse is the response for POST /v1/revoke.
+type RevokeResponse struct {
+	OK      bool   `json:"ok"`
+	Subject string `json:"subject"`
+}
+
+// Revoke removes the subject's credentials and backup codes.
+func (s *Service) Revoke(ctx context.Context, caller Caller, req RevokeRequest) (*RevokeResponse, *Error) {
+	if req.Subject == "" {
+		return nil, errBadRequest("invalid_request", "subject is required")
+	}
+
+	if !s.allow(ctx, s.config(), req.Subject, caller) {
+		s.auditEvent(ctx, caller, audit.EventRevoke, req.Subject, audit.OutcomeFailure, "rate_limited")
+		return nil, errRateLimited()
+	}
+
+	_ = s.store.DeleteCredential(ctx, req.Subject)
+	_ = s.store.DeleteBackupCodes(ctx, req.Subject)
+	s.auditEvent(ctx, caller, audit.EventRevoke, req.Subject, audit.OutcomeSuccess, "")
+	return &RevokeResponse{OK: true, Subject: req.Subject}, nil
+}
@@ -0,0 +1,200 @@
+package totpservice
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	logger "github.com/soulteary/logger-kit"
+	metricskit "github.com/soulteary/metrics-kit"
+
+	"github.com/soulteary/herald-totp/internal/clock"
+	"github.com/soulteary/herald-totp/internal/metrics"
+	"github.com/soulteary/herald-totp/internal/secret"
+	"github.com/soulteary/herald-totp/internal/store"
+	"github.com/soulteary/herald-totp/internal/tracing"
+)
+
+// Clock tells the time; any type with a Now method will do.
+type Clock = clock.Clock
+
+// Metrics is a set of herald-totp Prometheus collectors; see NewMetrics.
+type Metrics struct {
+	set *metrics.Metrics
+}
+
+// NewMetrics registers a metrics set on reg.
+func NewMetrics(reg *metricskit.Registry) *Metrics {
+	return &Metrics{set: metrics.New(reg)}
+}
+
+// ObserveRequest records the latency of an API request served over the service (transport: e.g.
+// "http" or "grpc"; route: the route pattern or RPC method; status: the HTTP status or gRPC code).
+func (m *Metrics) ObserveRequest(transport, route, status string, d time.Duration) {
+	if m != nil {
+		m.set.ObserveRequest(transport, route, status, d)
+	}
+}
+
+// ObserveStoreOperation records a Redis operation on the service's database made outside the service,
+// such as an audit stream write, under the same latency and error metrics as the service's own.
+func (m *Metrics) ObserveStoreOperation(op string, d time.Duration, err error) {
+	if m != nil {
+		m.set.ObserveStoreOperation(op, d, err)
+	}
+}
+
+// AuditEvent is one audit record: an enrollment, verification or revocation and its outcome. Type is
+// e.g. "enroll_confirm", "verify" or "anomaly"; Outcome is e.g. "success", "failure" or "blocked".
+type AuditEvent struct {
+	Timestamp int64  `json:"timestamp"`
+	Type      string `json:"type"`
+	Subject   string `json:"subject"`
+	Service   string `json:"service,omitempty"`
+	KeyID     string `json:"key_id,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	Outcome   string `json:"outcome"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// Options configure a Service. Only Config.EncryptionKey is required.
+type Options struct {
+	// Config holds the settings. It is ignored when Reload is set.
+	Config Config
+	// Reload, when set, is called by every operation for the current settings, so they can change at
+	// runtime. EncryptionKey is still read once, by New.
+	Reload func() Config
+	// Clock is read for TOTP time steps, expiry and timestamps. Nil uses the wall clock.
+	Clock Clock
+	// Metrics receives the service and store metrics. Nil records none.
+	Metrics *Metrics
+	// Audit receives audit events. Nil drops them (the herald-totp server passes its audit sinks).
+	Audit func(ctx context.Context, e AuditEvent)
+	// Log receives warnings. Nil discards them.
+	Log *logger.Logger
+}
+
+// Service runs herald-totp enrollment, verification, revocation, HOTP resync and the hardware token
+// inventory over one Redis store, independent of the transport. The herald-totp HTTP and gRPC APIs
+// are adapters over it; Go services can embed it to do the same in-process.
+type Service struct {
+	config  func() *Config
+	store   *store.Store
+	clock   Clock
+	cipher  *secret.Cipher
+	metrics *metrics.Metrics
+	audit   func(ctx context.Context, e AuditEvent)
+	log     *logger.Logger
+}
+
+// Caller identifies who made a request independent of the transport: the client IP used for rate
+// limits and the service and key ID recorded in audit events.
+type Caller struct {
+	IP      string
+	Service string
+	KeyID   string
+}
+
+// New returns a Service keeping its state in rdb, under the same keys as the herald-totp server, so an
+// embedded Service and a server sharing the Redis database see the same credentials. It fails when
+// Config.EncryptionKey is set but not a valid key; without a key, calls that need one return
+// config_error.
+func New(rdb *redis.Client, opts Options) (*Service, error) {
+	s := &Service{
+		clock: opts.Clock,
+		audit: opts.Audit,
+		log:   opts.Log,
+	}
+	if opts.Reload != nil {
+		s.config = func() *Config {
+			cfg := opts.Reload()
+			return &cfg
+		}
+	} else {
+		cfg := opts.Config
+		s.config = func() *Config { return &cfg }
+	}
+	cfg := s.config()
+	if cfg.EncryptionKey != "" {
+		cipher, err := cipherFromKey(cfg.EncryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("totpservice: encryption key: %w", err)
+		}
+		s.cipher = cipher
+	}
+	if s.clock == nil {
+		s.clock = clock.System()
+	}
+	if opts.Metrics != nil {
+		s.metrics = opts.Metrics.set
+	}
+	if s.audit == nil {
+		s.audit = func(context.Context, AuditEvent) {}
+	}
+	if s.log == nil {
+		s.log = logger.New(logger.Config{Level: logger.Disabled})
+	}
+	s.store = store.NewStore(rdb, cfg.EnrollTTL, 0, store.ChallengeUsedTTL, store.RateSubjectWindow, store.RateIPWindow).
+		WithClock(s.clock).
+		WithHook(s.metrics.StoreHook()).
+		WithHook(tracing.StoreHook())
+	return s, nil
+}
+
+// cipherFromKey returns the cipher for an encryption key setting, which must be at least 32 bytes.
+func cipherFromKey(key string) (*secret.Cipher, error) {
+	if len(key) < 32 {
+		return nil, secret.ErrKeySize
+	}
+	keyBytes, err := secret.KeyBytes(key)
+	if err != nil {
+		return nil, err
+	}
+	return secret.NewCipher(keyBytes)
+}
+
+// Clock returns the clock the service reads the time from.
+func (s *Service) Clock() Clock { return s.clock }
+
+// Metrics returns the metrics set the service records to.
+func (s *Service) Metrics() *Metrics { return &Metrics{set: s.metrics} }
+
+// decrypt decrypts a stored secret, counting failures.
+func (s *Service) decrypt(secretEnc string) (string, error) {
+	plain, err := s.cipher.Decrypt(secretEnc)
+	if err != nil {
+		s.metrics.RecordDecryptFailure()
+	}
+	return plain, err
+}
+
+// allow counts a call against the subject's and the caller IP's rate limits and reports whether both
+// are still within RATE_LIMIT_PER_SUBJECT and RATE_LIMIT_PER_IP.
+func (s *Service) allow(ctx context.Context, cfg *Config, subject string, caller Caller) bool {
+	subjectCount, _ := s.store.IncrRateSubject(ctx, subject)
+	if subjectCount > int64(cfg.RateLimitPerSubject) {
+		s.metrics.RecordRateLimited("subject")
+		return false
+	}
+	ipCount, _ := s.store.IncrRateIP(ctx, caller.IP)
+	if ipCount > int64(cfg.RateLimitPerIP) {
+		s.metrics.RecordRateLimited("ip")
+		return false
+	}
+	return true
+}
+
+// auditEvent emits an audit event carrying the caller service, key ID and client IP.
+func (s *Service) auditEvent(ctx context.Context, caller Caller, eventType, subject, outcome, reason string) {
+	s.audit(ctx, AuditEvent{
+		Timestamp: s.clock.Now().Unix(),
+		Type:      eventType,
+		Subject:   subject,
+		Service:   caller.Service,
+		KeyID:     caller.KeyID,
+		IP:        caller.IP,
+		Outcome:   outcome,
+		Reason:    reason,
+	})
+}
@@ -0,0 +1,619 @@
+package totpservice
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	pqtotp "github.com/pquerna/otp/totp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+	metricskit "github.com/soulteary/metrics-kit"
+
+	"github.com/soulteary/herald-totp/internal/clock"
+	"github.com/soulteary/herald-totp/internal/store"
+	"github.com/soulteary/herald-totp/internal/totp"
+)
+
+const testEncryptionKey = "0123456789abcdef0123456789abcdef" // 32 bytes
+
+// testConfig returns the default settings with an encryption key and rate limits tests do not hit.
+func testConfig() Config {
+	cfg := DefaultConfig()
+	cfg.EncryptionKey = testEncryptionKey
+	cfg.RateLimitPerSubject, cfg.RateLimitPerIP = 100, 100
+	return cfg
+}
+
+// newTestService returns a service on its own in-memory Redis.
+func newTestService(t *testing.T, opts Options) *Service {
+	t.Helper()
+	svc, _ := newTestServiceRedis(t, opts)
+	return svc
+}
+
+// newTestServiceRedis is newTestService also returning the in-memory Redis, to move its clock.
+func newTestServiceRedis(t *testing.T, opts Options) (*Service, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	svc, err := New(redis.NewClient(&redis.Options{Addr: mr.Addr()}), opts)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return svc, mr
+}
+
+// clockTestStart is the first second of a 30-second time step.
+var clockTestStart = time.Unix(1_700_000_010, 0)
+
+// saveClockTestCredential stores a confirmed TOTP credential for subject using the config's period.
+func saveClockTestCredential(t *testing.T, svc *Service, subject, secretBase32 string) {
+	t.Helper()
+	enc, err := svc.cipher.Encrypt(secretBase32)
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	cfg := svc.config()
+	cred := &store.Credential{
+		Type: totp.TypeTOTP, Subject: subject, SecretEnc: enc, Period: uint(cfg.TOTPPeriod),
+		Digits: cfg.TOTPDigits, Algo: "SHA1", Enabled: true,
+	}
+	if err := svc.store.SaveCredential(context.Background(), cred); err != nil {
+		t.Fatalf("SaveCredential: %v", err)
+	}
+}
+
+func clockTestCode(t *testing.T, secretBase32 string, at time.Time) string {
+	t.Helper()
+	code, err := pqtotp.GenerateCodeCustom(secretBase32, at, pqtotp.ValidateOpts{
+		Period: 30, Digits: totp.DigitsFromInt(6), Algorithm: totp.AlgorithmSHA1,
+	})
+	if err != nil {
+		t.Fatalf("GenerateCodeCustom: %v", err)
+	}
+	return code
+}
+
+func TestVerify_SkewWindow(t *testing.T) {
+	const secretBase32 = "JBSWY3DPEHPK3PXP"
+	step := 30 * time.Second
+
+	tests := []struct {
+		name     string
+		skew     uint
+		codeAt   time.Duration // code generated at clockTestStart+codeAt
+		verifyAt time.Duration // clock set to clockTestStart+verifyAt
+		ok       bool
+	}{
+		{"same step, first second", 1, 0, 0, true},
+		{"same step, last second", 1, 0, step - time.Second, true},
+		{"previous step within skew", 1, -step, 0, true},
+		{"next step within skew", 1, step, step - time.Second, true},
+		{"two steps back beyond skew", 1, -2 * step, 0, false},
+		{"two steps ahead beyond skew", 1, 2 * step, step - time.Second, false},
+		{"code expires at the step boundary", 1, -step, step, false},
+		{"no skew rejects previous step", 0, -step, 0, false},
+		{"wider skew accepts two steps back", 2, -2 * step, 0, true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.TOTPSkew = tt.skew
+			clk := clock.NewFake(clockTestStart.Add(tt.verifyAt))
+			svc := newTestService(t, Options{Config: cfg, Clock: clk})
+			subject := "skew" + strconv.Itoa(i)
+			saveClockTestCredential(t, svc, subject, secretBase32)
+			req := VerifyRequest{Subject: subject, Code: clockTestCode(t, secretBase32, clockTestStart.Add(tt.codeAt))}
+			resp, apiErr := svc.Verify(context.Background(), Caller{}, req)
+			if tt.ok {
+				if apiErr != nil {
+					t.Fatalf("Verify: %v", apiErr)
+				}
+				if resp.IssuedAt != clk.Now().Unix() {
+					t.Errorf("IssuedAt = %d, want the clock's %d", resp.IssuedAt, clk.Now().Unix())
+				}
+				return
+			}
+			if apiErr == nil || apiErr.Reason != "invalid" {
+				t.Errorf("Verify = %+v, %v; want invalid", resp, apiErr)
+			}
+		})
+	}
+}
+
+func TestVerify_StepReplay(t *testing.T) {
+	const secretBase32 = "JBSWY3DPEHPK3PXP"
+	step := 30 * time.Second
+
+	tests := []struct {
+		name   string
+		second time.Duration // clock advance between the two verifications
+		reason string        // "" = second code accepted
+	}{
+		{"same second", 0, "replay"},
+		{"last second of the step", step - time.Second, "replay"},
+		{"next step", step, ""},
+		{"several steps later", 10 * step, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clk := clock.NewFake(clockTestStart)
+			svc := newTestService(t, Options{Config: testConfig(), Clock: clk})
+			saveClockTestCredential(t, svc, "alice", secretBase32)
+			first := VerifyRequest{Subject: "alice", Code: clockTestCode(t, secretBase32, clk.Now())}
+			if _, apiErr := svc.Verify(context.Background(), Caller{}, first); apiErr != nil {
+				t.Fatalf("first Verify: %v", apiErr)
+			}
+			clk.Advance(tt.second)
+			second := VerifyRequest{Subject: "alice", Code: clockTestCode(t, secretBase32, clk.Now())}
+			_, apiErr := svc.Verify(context.Background(), Caller{}, second)
+			switch {
+			case tt.reason == "" && apiErr != nil:
+				t.Errorf("second Verify: %v", apiErr)
+			case tt.reason != "" && (apiErr == nil || apiErr.Reason != tt.reason):
+				t.Errorf("second Verify = %v, want %s", apiErr, tt.reason)
+			}
+		})
+	}
+}
+
+func TestVerify_BackupCodeUsedAtFromClock(t *testing.T) {
+	ctx := context.Background()
+	clk := clock.NewFake(clockTestStart)
+	svc := newTestService(t, Options{Config: testConfig(), Clock: clk})
+	saveClockTestCredential(t, svc, "backup", "JBSWY3DPEHPK3PXP")
+	if err := svc.store.SaveBackupCodes(ctx, "backup", []store.BackupCodeEntry{{CodeHash: BackupCodeHash("ABCD-EFGH")}}); err != nil {
+		t.Fatalf("SaveBackupCodes: %v", err)
+	}
+
+	resp, apiErr := svc.Verify(ctx, Caller{}, VerifyRequest{Subject: "backup", Code: "ABCD-EFGH"})
+	if apiErr != nil {
+		t.Fatalf("Verify: %v", apiErr)
+	}
+	if resp.IssuedAt != clockTestStart.Unix() {
+		t.Errorf("IssuedAt = %d, want %d", resp.IssuedAt, clockTestStart.Unix())
+	}
+	entries, err := svc.store.GetBackupCodes(ctx, "backup")
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("GetBackupCodes = %v, %v", entries, err)
+	}
+	if entries[0].UsedAt != clockTestStart.Unix() {
+		t.Errorf("UsedAt = %d, want %d", entries[0].UsedAt, clockTestStart.Unix())
+	}
+}
+
+func TestService_EmbeddedLifecycle(t *testing.T) {
+	ctx := context.Background()
+	clk := clock.NewFake(clockTestStart)
+	svc := newTestService(t, Options{Config: testConfig(), Clock: clk})
+	caller := Caller{IP: "192.0.2.1", Service: "billing"}
+
+	start, apiErr := svc.StartEnrollment(ctx, caller, EnrollStartRequest{Subject: "alice"})
+	if apiErr != nil {
+		t.Fatalf("StartEnrollment: %v", apiErr)
+	}
+	confirm, apiErr := svc.ConfirmEnrollment(ctx, caller, EnrollConfirmRequest{
+		EnrollID: start.EnrollID, Code: clockTestCode(t, start.SecretBase32, clk.Now()),
+	})
+	if apiErr != nil || !confirm.TotpEnabled || len(confirm.BackupCodes) != DefaultConfig().BackupCodeCount {
+		t.Fatalf("ConfirmEnrollment = %+v, %v", confirm, apiErr)
+	}
+	if status, apiErr := svc.Status(ctx, "alice"); apiErr != nil || !status.TotpEnabled {
+		t.Fatalf("Status = %+v, %v", status, apiErr)
+	}
+
+	// The confirm code's step counts as used only once verified; the next step verifies.
+	clk.Advance(30 * time.Second)
+	code := clockTestCode(t, start.SecretBase32, clk.Now())
+	if resp, apiErr := svc.Verify(ctx, caller, VerifyRequest{Subject: "alice", Code: code}); apiErr != nil || resp.AMR[0] != "totp" {
+		t.Fatalf("Verify = %+v, %v", resp, apiErr)
+	}
+	if _, apiErr := svc.Verify(ctx, caller, VerifyRequest{Subject: "alice", Code: code}); apiErr == nil || apiErr.Reason != "replay" {
+		t.Errorf("Verify reused code = %v, want replay", apiErr)
+	}
+	if resp, apiErr := svc.Verify(ctx, caller, VerifyRequest{Subject: "alice", Code: confirm.BackupCodes[0]}); apiErr != nil || len(resp.AMR) != 2 {
+		t.Errorf("Verify backup code = %+v, %v", resp, apiErr)
+	}
+	if _, apiErr := svc.Verify(ctx, caller, VerifyRequest{Subject: "alice", Code: confirm.BackupCodes[0]}); apiErr == nil || apiErr.Reason != "invalid" {
+		t.Errorf("Verify used backup code = %v, want invalid", apiErr)
+	}
+
+	if _, apiErr := svc.Revoke(ctx, caller, RevokeRequest{Subject: "alice"}); apiErr != nil {
+		t.Fatalf("Revoke: %v", apiErr)
+	}
+	if status, _ := svc.Status(ctx, "alice"); status.TotpEnabled {
+		t.Error("Status after Revoke: still enabled")
+	}
+}
+
+func TestService_IndependentInstances(t *testing.T) {
+	// Two services with their own settings, key, metrics and audit trail in one process.
+	newInstance := func(rateLimit int, key string) (*Service, *Metrics, *[]AuditEvent) {
+		cfg := testConfig()
+		cfg.EncryptionKey = key
+		cfg.RateLimitPerSubject = rateLimit
+		m := NewMetrics(metricskit.NewRegistry("herald_totp_test"))
+		var events []AuditEvent
+		svc := newTestService(t, Options{
+			Config:  cfg,
+			Metrics: m,
+			Audit:   func(_ context.Context, e AuditEvent) { events = append(events, e) },
+		})
+		return svc, m, &events
+	}
+	strict, strictMetrics, strictEvents := newInstance(1, testEncryptionKey)
+	lenient, lenientMetrics, lenientEvents := newInstance(5, "fedcba9876543210fedcba9876543210")
+
+	ctx := context.Background()
+	caller := Caller{IP: "192.0.2.1"}
+	for i := 0; i < 2; i++ {
+		if _, err := lenient.StartEnrollment(ctx, caller, EnrollStartRequest{Subject: "alice"}); err != nil {
+			t.Fatalf("lenient StartEnrollment %d: %v", i, err)
+		}
+	}
+	if _, err := strict.StartEnrollment(ctx, caller, EnrollStartRequest{Subject: "alice"}); err != nil {
+		t.Fatalf("strict StartEnrollment: %v", err)
+	}
+	if _, err := strict.StartEnrollment(ctx, caller, EnrollStartRequest{Subject: "alice"}); err == nil || err.Reason != "rate_limited" {
+		t.Errorf("second strict StartEnrollment = %v, want rate_limited", err)
+	}
+
+	if got := testutil.ToFloat64(lenientMetrics.set.EnrollStartTotal); got != 2 {
+		t.Errorf("lenient enroll_start_total = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(strictMetrics.set.EnrollStartTotal); got != 1 {
+		t.Errorf("strict enroll_start_total = %v, want 1", got)
+	}
+	if len(*lenientEvents) != 2 || len(*strictEvents) != 2 || (*strictEvents)[1].Reason != "rate_limited" {
+		t.Errorf("audit events: lenient %+v, strict %+v", *lenientEvents, *strictEvents)
+	}
+}
+
+func TestService_Reload(t *testing.T) {
+	cfg := testConfig()
+	cfg.RateLimitPerSubject = 1
+	svc := newTestService(t, Options{Reload: func() Config { return cfg }})
+	ctx := context.Background()
+	if _, err := svc.Revoke(ctx, Caller{}, RevokeRequest{Subject: "alice"}); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	if _, err := svc.Revoke(ctx, Caller{}, RevokeRequest{Subject: "alice"}); err == nil || err.Reason != "rate_limited" {
+		t.Errorf("second Revoke = %v, want rate_limited", err)
+	}
+	cfg.RateLimitPerSubject = 10
+	if _, err := svc.Revoke(ctx, Caller{}, RevokeRequest{Subject: "alice"}); err != nil {
+		t.Errorf("Revoke after raising the limit: %v", err)
+	}
+}
+
+func TestService_NoEncryptionKey(t *testing.T) {
+	svc := newTestService(t, Options{Config: DefaultConfig()})
+	_, err := svc.StartEnrollment(context.Background(), Caller{}, EnrollStartRequest{Subject: "alice"})
+	if err == nil || err.Reason != "config_error" {
+		t.Errorf("StartEnrollment = %v, want config_error", err)
+	}
+	if _, err := svc.Status(context.Background(), "alice"); err != nil {
+		t.Errorf("Status does not need the key: %v", err)
+	}
+}
+
+func TestNew_InvalidEncryptionKey(t *testing.T) {
+	mr := miniredis.RunT(t)
+	cfg := DefaultConfig()
+	cfg.EncryptionKey = "short"
+	if _, err := New(redis.NewClient(&redis.Options{Addr: mr.Addr()}), Options{Config: cfg}); err == nil {
+		t.Error("New with a short encryption key: want error")
+	}
+}
+
+func TestService_Metrics(t *testing.T) {
+	ctx := context.Background()
+	clk := clock.NewFake(clockTestStart)
+	cfg := testConfig()
+	cfg.RateLimitPerIP = 3
+	m := NewMetrics(metricskit.NewRegistry("herald_totp_test"))
+	svc := newTestService(t, Options{Config: cfg, Clock: clk, Metrics: m})
+	saveClockTestCredential(t, svc, "alice", "JBSWY3DPEHPK3PXP")
+	if err := svc.store.SaveBackupCodes(ctx, "alice", []store.BackupCodeEntry{{CodeHash: BackupCodeHash("ABCD-EFGH")}}); err != nil {
+		t.Fatalf("SaveBackupCodes: %v", err)
+	}
+	if _, err := svc.StartEnrollment(ctx, Caller{IP: "192.0.2.9"}, EnrollStartRequest{Subject: "bob"}); err != nil {
+		t.Fatalf("StartEnrollment: %v", err)
+	}
+
+	caller := Caller{IP: "192.0.2.1"}
+	if _, err := svc.Verify(ctx, caller, VerifyRequest{Subject: "alice", Code: "ABCD-EFGH"}); err != nil {
+		t.Fatalf("Verify backup code: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		_, _ = svc.Verify(ctx, caller, VerifyRequest{Subject: "alice", Code: "000000"})
+	}
+	if got := testutil.ToFloat64(m.set.BackupCodesConsumedTotal); got != 1 {
+		t.Errorf("backup_codes_consumed_total = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.set.RateLimitedTotal.WithLabelValues("ip")); got != 1 {
+		t.Errorf(`rate_limited_total{dimension="ip"} = %v, want 1`, got)
+	}
+	if got := testutil.ToFloat64(m.set.RateLimitedTotal.WithLabelValues("subject")); got != 0 {
+		t.Errorf(`rate_limited_total{dimension="subject"} = %v, want 0`, got)
+	}
+	if testutil.CollectAndCount(m.set.RedisDuration) == 0 {
+		t.Error("redis_operation_duration_seconds has no series")
+	}
+
+	cred, _ := svc.store.GetCredential(ctx, "alice")
+	cred.SecretEnc = "not-a-ciphertext"
+	if err := svc.store.SaveCredential(ctx, cred); err != nil {
+		t.Fatalf("SaveCredential: %v", err)
+	}
+	// 192.0.2.1 is rate limited by now, so verify from another IP.
+	if _, err := svc.Verify(ctx, Caller{IP: "192.0.2.2"}, VerifyRequest{Subject: "alice", Code: "000000"}); err == nil || err.Reason != "internal_error" {
+		t.Errorf("Verify with a corrupt secret = %v, want internal_error", err)
+	}
+	if got := testutil.ToFloat64(m.set.DecryptFailuresTotal); got != 1 {
+		t.Errorf("decrypt_failures_total = %v, want 1", got)
+	}
+
+	if err := svc.UpdateInventoryMetrics(ctx); err != nil {
+		t.Fatalf("UpdateInventoryMetrics: %v", err)
+	}
+	if got := testutil.ToFloat64(m.set.EnrolledSubjects); got != 1 {
+		t.Errorf("enrolled_subjects = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.set.ActiveCredentials); got != 1 {
+		t.Errorf("active_credentials = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.set.PendingEnrollments); got != 1 {
+		t.Errorf("pending_enrollments = %v, want 1", got)
+	}
+}
+
+func TestVerify_Anomalies(t *testing.T) {
+	tests := []struct {
+		name      string
+		signal    string
+		dimension string
+		attempt   func(svc *Service, i int) (Caller, VerifyRequest) // the i-th of 3 attempts
+		next      func(svc *Service) (Caller, VerifyRequest)        // refused while the block lasts
+	}{
+		{
+			"credential stuffing", SignalCredentialStuffing, "ip",
+			func(_ *Service, i int) (Caller, VerifyRequest) {
+				return Caller{IP: "192.0.2.1"}, VerifyRequest{Subject: "user" + strconv.Itoa(i), Code: "000000"}
+			},
+			func(*Service) (Caller, VerifyRequest) {
+				return Caller{IP: "192.0.2.1"}, VerifyRequest{Subject: "user9", Code: "000000"}
+			},
+		},
+		{
+			"distributed guessing", SignalDistributedGuessing, "subject",
+			func(_ *Service, i int) (Caller, VerifyRequest) {
+				return Caller{IP: "192.0.2." + strconv.Itoa(i)}, VerifyRequest{Subject: "alice", Code: "000000"}
+			},
+			func(*Service) (Caller, VerifyRequest) {
+				return Caller{IP: "198.51.100.1"}, VerifyRequest{Subject: "alice", Code: "000000"}
+			},
+		},
+		{
+			"replay storm", SignalReplayStorm, "ip",
+			func(svc *Service, _ int) (Caller, VerifyRequest) {
+				_ = svc.store.MarkChallengeUsed(context.Background(), "c_used")
+				return Caller{IP: "192.0.2.1"}, VerifyRequest{Subject: "alice", Code: "000000", ChallengeID: "c_used"}
+			},
+			func(*Service) (Caller, VerifyRequest) {
+				return Caller{IP: "192.0.2.1"}, VerifyRequest{Subject: "bob", Code: "000000"}
+			},
+		},
+	}
+	for _, tt := range tests {
+		for _, blockTTL := range []time.Duration{0, time.Minute} {
+			t.Run(tt.name+"/block "+blockTTL.String(), func(t *testing.T) {
+				ctx := context.Background()
+				cfg := testConfig()
+				cfg.AnomalyIPSubjects, cfg.AnomalySubjectIPs, cfg.AnomalyReplays = 3, 3, 3
+				cfg.AnomalyBlockTTL = blockTTL
+				m := NewMetrics(metricskit.NewRegistry("herald_totp_test"))
+				var anomalies []AuditEvent
+				svc := newTestService(t, Options{Config: cfg, Clock: clock.NewFake(clockTestStart), Metrics: m,
+					Audit: func(_ context.Context, e AuditEvent) {
+						if e.Type == "anomaly" {
+							anomalies = append(anomalies, e)
+						}
+					},
+				})
+
+				for i := 1; i <= 3; i++ {
+					caller, req := tt.attempt(svc, i)
+					if _, err := svc.Verify(ctx, caller, req); err == nil || err.Reason == "rate_limited" {
+						t.Fatalf("attempt %d = %v, want a verify failure", i, err)
+					}
+				}
+				if got := testutil.ToFloat64(m.set.AnomaliesTotal.WithLabelValues(tt.signal)); got != 1 {
+					t.Errorf(`anomalies_total{signal=%q} = %v, want 1`, tt.signal, got)
+				}
+				wantOutcome := "detected"
+				if blockTTL > 0 {
+					wantOutcome = "blocked"
+				}
+				if len(anomalies) != 1 || anomalies[0].Reason != tt.signal || anomalies[0].Outcome != wantOutcome {
+					t.Fatalf("anomaly audit events = %+v, want one %s with outcome %s", anomalies, tt.signal, wantOutcome)
+				}
+
+				caller, req := tt.next(svc)
+				_, err := svc.Verify(ctx, caller, req)
+				blocked := err != nil && err.Reason == "rate_limited"
+				if blocked != (blockTTL > 0) {
+					t.Errorf("Verify after the anomaly = %v, blocked = %v, want blocked = %v", err, blocked, blockTTL > 0)
+				}
+				wantBlocks := 0.0
+				if blockTTL > 0 {
+					wantBlocks = 1
+				}
+				if got := testutil.ToFloat64(m.set.AnomalyBlocksTotal.WithLabelValues(tt.dimension)); got != wantBlocks {
+					t.Errorf(`anomaly_blocks_total{dimension=%q} = %v, want %v`, tt.dimension, got, wantBlocks)
+				}
+			})
+		}
+	}
+}
+
+func TestConfirmEnrollment_ExpiredAuditSubject(t *testing.T) {
+	ctx := context.Background()
+	var events []AuditEvent
+	svc := newTestService(t, Options{Config: testConfig(), Audit: func(_ context.Context, e AuditEvent) { events = append(events, e) }})
+	start, err := svc.StartEnrollment(ctx, Caller{}, EnrollStartRequest{Subject: "alice"})
+	if err != nil {
+		t.Fatalf("StartEnrollment: %v", err)
+	}
+	if _, err := svc.CancelEnrollment(ctx, Caller{}, EnrollCancelRequest{EnrollID: start.EnrollID}); err != nil {
+		t.Fatalf("CancelEnrollment: %v", err)
+	}
+	for _, id := range []string{start.EnrollID, "e_unknown"} {
+		events = nil
+		if _, err := svc.ConfirmEnrollment(ctx, Caller{}, EnrollConfirmRequest{EnrollID: id, Code: "000000"}); err == nil || err.Reason != "expired" {
+			t.Fatalf("ConfirmEnrollment(%s) = %v, want expired", id, err)
+		}
+		want := "alice"
+		if id == "e_unknown" {
+			want = ""
+		}
+		if len(events) != 1 || events[0].Reason != "expired" || events[0].Subject != want {
+			t.Errorf("ConfirmEnrollment(%s) audit events = %+v, want one expired event for %q", id, events, want)
+		}
+	}
+}
+
+func TestConfirmEnrollment_ReauthAttempts(t *testing.T) {
+	tests := []struct {
+		name       string
+		perSubject int
+		want       []string // reasons of successive confirms with a wrong current_code
+	}{
+		{"enrollment deleted after max attempts", 100, []string{"reauth_invalid", "reauth_invalid", "reauth_invalid", "expired"}},
+		{"rate limited per subject", 2, []string{"reauth_invalid", "rate_limited"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			clk := clock.NewFake(clockTestStart)
+			cfg := testConfig()
+			cfg.RateLimitPerSubject = tt.perSubject
+			svc := newTestService(t, Options{Config: cfg, Clock: clk})
+			saveClockTestCredential(t, svc, "alice", "JBSWY3DPEHPK3PXP")
+			start, err := svc.StartEnrollment(ctx, Caller{IP: "192.0.2.1"}, EnrollStartRequest{Subject: "alice"})
+			if err != nil {
+				t.Fatalf("StartEnrollment: %v", err)
+			}
+			req := EnrollConfirmRequest{EnrollID: start.EnrollID, Code: clockTestCode(t, start.SecretBase32, clk.Now()), CurrentCode: "000000"}
+			for i, want := range tt.want {
+				if _, err := svc.ConfirmEnrollment(ctx, Caller{IP: "192.0.2.1"}, req); err == nil || err.Reason != want {
+					t.Fatalf("confirm %d = %v, want %s", i+1, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAssignToken_Reauth(t *testing.T) {
+	ctx := context.Background()
+	clk := clock.NewFake(clockTestStart)
+	svc := newTestService(t, Options{Config: testConfig(), Clock: clk})
+	saveClockTestCredential(t, svc, "alice", "JBSWY3DPEHPK3PXP")
+	saveClockTestCredential(t, svc, "bob", "JBSWY3DPEHPK3PXP")
+	importToken := func(serial string) {
+		t.Helper()
+		seeds := strings.NewReader("serial,secret\n" + serial + ",GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ\n")
+		if _, err := svc.ImportTokens(ctx, "csv", seeds, false); err != nil {
+			t.Fatalf("ImportTokens: %v", err)
+		}
+	}
+	assign := func(serial, subject, currentCode string) *Error {
+		_, err := svc.AssignToken(ctx, Caller{IP: "192.0.2.1"}, TokensAssignRequest{Serial: serial, Subject: subject, CurrentCode: currentCode})
+		return err
+	}
+
+	importToken("HW1")
+	for i, want := range []string{"reauth_invalid", "reauth_invalid", "reauth_invalid", "rate_limited"} {
+		if err := assign("HW1", "alice", "000000"); err == nil || err.Reason != want {
+			t.Fatalf("assign %d with a wrong current_code = %v, want %s", i+1, err, want)
+		}
+	}
+	if tokens, _ := svc.store.ListHardwareTokens(ctx); len(tokens) != 1 {
+		t.Errorf("inventory = %d tokens, want the refused token kept", len(tokens))
+	}
+
+	// An unknown serial fails before current_code is checked, so the code still works afterwards.
+	code := clockTestCode(t, "JBSWY3DPEHPK3PXP", clk.Now())
+	if err := assign("HW2", "bob", code); err == nil || err.Reason != "not_found" {
+		t.Fatalf("assign unknown serial = %v, want not_found", err)
+	}
+	importToken("HW2")
+	if err := assign("HW2", "bob", code); err != nil {
+		t.Errorf("assign with the same current_code = %v, want success", err)
+	}
+}
+
+func TestVerify_AnomaliesRepeat(t *testing.T) {
+	ctx := context.Background()
+	fail := func(svc *Service, ip, subject string) *Error {
+		_, err := svc.Verify(ctx, Caller{IP: ip}, VerifyRequest{Subject: subject, Code: "000000"})
+		return err
+	}
+
+	t.Run("signal repeats at each multiple of the threshold", func(t *testing.T) {
+		cfg := testConfig()
+		cfg.AnomalyIPSubjects = 2
+		m := NewMetrics(metricskit.NewRegistry("herald_totp_test"))
+		svc := newTestService(t, Options{Config: cfg, Clock: clock.NewFake(clockTestStart), Metrics: m})
+		for i := 1; i <= 5; i++ {
+			_ = fail(svc, "192.0.2.1", "user"+strconv.Itoa(i))
+		}
+		if got := testutil.ToFloat64(m.set.AnomaliesTotal.WithLabelValues(SignalCredentialStuffing)); got != 2 {
+			t.Errorf("credential_stuffing after 5 subjects with threshold 2 = %v, want 2", got)
+		}
+	})
+
+	t.Run("expired block is applied again", func(t *testing.T) {
+		cfg := testConfig()
+		cfg.AnomalyIPSubjects = 2
+		cfg.AnomalyBlockTTL = time.Minute // shorter than the 10m window
+		m := NewMetrics(metricskit.NewRegistry("herald_totp_test"))
+		svc, mr := newTestServiceRedis(t, Options{Config: cfg, Clock: clock.NewFake(clockTestStart), Metrics: m})
+		_ = fail(svc, "192.0.2.1", "user1")
+		_ = fail(svc, "192.0.2.1", "user2")
+		if err := fail(svc, "192.0.2.1", "user3"); err == nil || err.Reason != "rate_limited" {
+			t.Fatalf("Verify from the blocked IP = %v, want rate_limited", err)
+		}
+		mr.FastForward(time.Minute)
+		if err := fail(svc, "192.0.2.1", "user3"); err == nil || err.Reason != "invalid" {
+			t.Fatalf("Verify after the block expired = %v, want invalid", err)
+		}
+		if err := fail(svc, "192.0.2.1", "user4"); err == nil || err.Reason != "rate_limited" {
+			t.Errorf("Verify after the next failure = %v, want rate_limited (blocked again)", err)
+		}
+		if got := testutil.ToFloat64(m.set.AnomalyBlocksTotal.WithLabelValues("ip")); got != 2 {
+			t.Errorf(`anomaly_blocks_total{dimension="ip"} = %v, want 2`, got)
+		}
+	})
+
+	t.Run("replays are counted per IP", func(t *testing.T) {
+		cfg := testConfig()
+		cfg.AnomalyReplays = 2
+		cfg.AnomalyBlockTTL = time.Minute
+		svc := newTestService(t, Options{Config: cfg, Clock: clock.NewFake(clockTestStart)})
+		_ = svc.store.MarkChallengeUsed(ctx, "c_used")
+		replay := VerifyRequest{Subject: "alice", Code: "000000", ChallengeID: "c_used"}
+		_, _ = svc.Verify(ctx, Caller{IP: "192.0.2.1"}, replay)
+		_, _ = svc.Verify(ctx, Caller{IP: "192.0.2.2"}, replay)
+		if err := fail(svc, "192.0.2.2", "bob"); err == nil || err.Reason != "invalid" {
+			t.Errorf("Verify from an IP with one replay = %v, want invalid (not blocked)", err)
+		}
+		_, _ = svc.Verify(ctx, Caller{IP: "192.0.2.1"}, replay)
+		if err := fail(svc, "192.0.2.1", "bob"); err == nil || err.Reason != "rate_limited" {
+			t.Errorf("Verify from the replaying IP = %v, want rate_limited", err)
+		}
+	})
+}
@@ -0,0 +1,27 @@
+package totpservice
+
+import (
+	"context"
+)
+
+// StatusResponse is the response for GET /v1/status.
+type StatusResponse struct {
+	Subject     string `json:"subject"`
+	TotpEnabled bool   `json:"totp_enabled"`
+}
+
+// Status reports whether the subject has an enabled credential.
+func (s *Service) Status(ctx context.Context, subject string) (*StatusResponse, *Error) {
+	if subject == "" {
+		return nil, errBadRequest("invalid_request", "subject is required")
+	}
+	cred, err := s.store.GetCredential(ctx, subject)
+	if err != nil {
+		return nil, errInternal()
+	}
+	enabled := cred != nil && cred.Enabled
+	return &StatusResponse{
+		Subject:     subject,
+		TotpEnabled: enabled,
+	}, nil
+}
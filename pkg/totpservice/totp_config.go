@@ -0,0 +1,28 @@
+package totpservice
+
+import (
+	"github.com/soulteary/herald-totp/internal/store"
+	"github.com/soulteary/herald-totp/internal/totp"
+)
+
+// totpConfigFromConfig returns TOTP config from the active settings (for enroll start/confirm).
+func totpConfigFromConfig(cfg *Config) totp.Config {
+	return totp.Config{
+		Issuer: cfg.TOTPIssuer,
+		Period: uint(cfg.TOTPPeriod),
+		Digits: totp.DigitsFromInt(cfg.TOTPDigits),
+		Algo:   totp.AlgorithmSHA1,
+		Skew:   uint(cfg.TOTPSkew),
+	}
+}
+
+// totpConfigFromCred returns TOTP config from a stored credential (for verify).
+func totpConfigFromCred(cfg *Config, cred *store.Credential) totp.Config {
+	return totp.Config{
+		Issuer: cfg.TOTPIssuer,
+		Period: uint(cred.Period),
+		Digits: totp.DigitsFromInt(cred.Digits),
+		Algo:   totp.AlgorithmFromString(cred.Algo),
+		Skew:   uint(cfg.TOTPSkew),
+	}
+}
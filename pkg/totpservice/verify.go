@@ -0,0 +1,120 @@
+package totpservice
+
+import (
+	"context"
+
+	secure "github.com/soulteary/secure-kit"
+
+	"github.com/soulteary/herald-totp/internal/audit"
+)
+
+// VerifyRequest is the request body for POST /v1/verify.
+type VerifyRequest struct {
+	Subject     string `json:"subject"`
+	Code        string `json:"code"`
+	ChallengeID string `json:"challenge_id"` // optional, for replay/audit
+}
+
+// VerifyResponse is the response for POST /v1/verify (success).
+type VerifyResponse struct {
+	OK       bool     `json:"ok"`
+	Subject  string   `json:"subject,omitempty"`
+	AMR      []string `json:"amr,omitempty"`
+	IssuedAt int64    `json:"issued_at,omitempty"`
+}
+
+// Verify checks a TOTP, HOTP or backup code for the subject. Failures carry the verify reasons:
+// invalid_request, replay, rate_limited, invalid, config_error or internal_error. Callers blocked after
+// an anomaly (ANOMALY_BLOCK_TTL) fail with rate_limited.
+func (s *Service) Verify(ctx context.Context, caller Caller, req VerifyRequest) (*VerifyResponse, *Error) {
+	cfg := s.config()
+	if req.Subject == "" || req.Code == "" {
+		return nil, errBadRequest("invalid_request", "")
+	}
+
+	if s.blocked(ctx, cfg, req.Subject, caller) {
+		s.metrics.RecordVerify("failure", "blocked")
+		s.auditEvent(ctx, caller, audit.EventVerify, req.Subject, audit.OutcomeFailure, "blocked")
+		return nil, errRateLimited()
+	}
+
+	// Optional challenge_id replay check
+	if req.ChallengeID != "" {
+		used, err := s.store.IsChallengeUsed(ctx, req.ChallengeID)
+		if err != nil {
+			return nil, errInternal()
+		}
+		if used {
+			s.metrics.RecordVerify("failure", "replay")
+			s.auditEvent(ctx, caller, audit.EventVerify, req.Subject, audit.OutcomeFailure, "replay")
+			s.trackReplay(ctx, cfg, req.Subject, caller)
+			return nil, errBadRequest("replay", "")
+		}
+	}
+
+	// Rate limit
+	if !s.allow(ctx, cfg, req.Subject, caller) {
+		s.metrics.RecordVerify("failure", "rate_limited")
+		s.auditEvent(ctx, caller, audit.EventVerify, req.Subject, audit.OutcomeFailure, "rate_limited")
+		return nil, errRateLimited()
+	}
+
+	creds, err := s.store.GetCredentials(ctx, req.Subject)
+	if err != nil {
+		return nil, errInternal()
+	}
+	creds = enabledCredentials(creds)
+	if len(creds) == 0 {
+		s.metrics.RecordVerify("failure", "invalid")
+		s.auditEvent(ctx, caller, audit.EventVerify, req.Subject, audit.OutcomeFailure, "invalid")
+		s.trackFailure(ctx, cfg, req.Subject, caller)
+		return nil, errBadRequest("invalid", "")
+	}
+
+	if s.cipher == nil {
+		return nil, errConfig("")
+	}
+	now := s.clock.Now()
+	cred, err := s.matchCredential(cfg, creds, req.Code, now)
+	if err != nil {
+		s.log.Warn().Err(err).Str("subject", secure.MaskString(req.Subject, 4)).Msg("verify: decrypt failed")
+		return nil, errInternal()
+	}
+	if cred == nil {
+		// Try backup code (user might have lost device)
+		codeHash := BackupCodeHash(req.Code)
+		consumed, _ := s.store.ConsumeBackupCode(ctx, req.Subject, codeHash)
+		if consumed {
+			s.metrics.RecordVerify("success", "backup_code")
+			s.metrics.RecordBackupCodeConsumed()
+			s.auditEvent(ctx, caller, audit.EventBackupCodeUsed, req.Subject, audit.OutcomeSuccess, "backup_code")
+			if req.ChallengeID != "" {
+				_ = s.store.MarkChallengeUsed(ctx, req.ChallengeID)
+			}
+			issuedAt := s.clock.Now().Unix()
+			return &VerifyResponse{OK: true, Subject: req.Subject, AMR: []string{"totp", "backup_code"}, IssuedAt: issuedAt}, nil
+		}
+		s.metrics.RecordVerify("failure", "invalid")
+		s.auditEvent(ctx, caller, audit.EventVerify, req.Subject, audit.OutcomeFailure, "invalid")
+		s.trackFailure(ctx, cfg, req.Subject, caller)
+		return nil, errUnauthorized("invalid", "")
+	}
+
+	if !markCredentialUsed(cred, now) {
+		s.metrics.RecordVerify("failure", "replay")
+		s.auditEvent(ctx, caller, audit.EventVerify, req.Subject, audit.OutcomeFailure, "replay")
+		s.trackReplay(ctx, cfg, req.Subject, caller)
+		return nil, errBadRequest("replay", "")
+	}
+	if err := s.store.SaveCredential(ctx, cred); err != nil {
+		s.log.Warn().Err(err).Msg("verify: save credential failed")
+		return nil, errInternal()
+	}
+	method := credentialMethod(cred)
+	s.metrics.RecordVerify("success", method)
+	s.auditEvent(ctx, caller, audit.EventVerify, req.Subject, audit.OutcomeSuccess, method)
+	if req.ChallengeID != "" {
+		_ = s.store.MarkChallengeUsed(ctx, req.ChallengeID)
+	}
+	return &VerifyResponse{OK: true, Subject: req.Subject, AMR: []string{method}, IssuedAt: now.Unix()}, nil
+}